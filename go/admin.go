@@ -1,16 +1,24 @@
 package main
 
 import (
-	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/bwmarrin/snowflake"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,10 +29,11 @@ import (
 func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		sessID := c.Request().Header.Get("x-session")
+		ctx := dbContext(c)
 
 		adminSession := new(Session)
 		query := "SELECT * FROM admin_sessions WHERE session_id=? AND deleted_at IS NULL"
-		if err := h.DB.Get(adminSession, query, sessID); err != nil {
+		if err := h.DB.GetContext(ctx, adminSession, query, sessID); err != nil {
 			if err == sql.ErrNoRows {
 				return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
 			}
@@ -38,7 +47,7 @@ func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.Handle
 
 		if adminSession.ExpiredAt < requestAt {
 			query = "UPDATE admin_sessions SET deleted_at=? WHERE session_id=?"
-			if _, err = h.DB.Exec(query, requestAt, sessID); err != nil {
+			if _, err = h.DB.ExecContext(ctx, query, requestAt, sessID); err != nil {
 				return errorResponse(c, http.StatusInternalServerError, err)
 			}
 			return errorResponse(c, http.StatusUnauthorized, ErrExpiredSession)
@@ -52,20 +61,29 @@ func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.Handle
 }
 
 // adminLogin 管理者権限ログイン
+// 接続元IP・管理者IDごとに失敗が続いた場合はロックし、ロック中は429を返す
 // POST /admin/login
 func (h *Handler) adminLogin(c echo.Context) error {
+	ctx := dbContext(c)
+
 	defer c.Request().Body.Close()
 	req := new(AdminLoginRequest)
 	if err := parseRequestBody(c, req); err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
+	limitKeys := []string{"ip:" + c.RealIP(), "user:" + strconv.FormatInt(req.UserID, 10)}
+	// 受け付けた試行は失敗として数えておき、ログインに成功した場合だけ取り消す
+	if retryAfter, ok := h.AdminLogins.Attempt(time.Now(), limitKeys...); !ok {
+		return adminLoginLockedResponse(c, retryAfter)
+	}
+
 	requestAt, err := getRequestTime(c)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -75,6 +93,7 @@ func (h *Handler) adminLogin(c echo.Context) error {
 	user := new(AdminUser)
 	if err = tx.Get(user, query, req.UserID); err != nil {
 		if err == sql.ErrNoRows {
+			// 存在する管理者IDを探られないよう、存在しないIDも失敗として数えたままにする
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
@@ -120,12 +139,20 @@ func (h *Handler) adminLogin(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	h.AdminLogins.Succeed(limitKeys...)
 
 	return successResponse(c, &AdminLoginResponse{
 		AdminSession: sess,
 	})
 }
 
+// adminLoginLockedResponse 管理者ログインがロック中の場合のレスポンス
+func adminLoginLockedResponse(c echo.Context, retryAfter time.Duration) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return errorResponse(c, http.StatusTooManyRequests, ErrAdminLoginLocked)
+}
+
 type AdminLoginRequest struct {
 	UserID   int64  `json:"userId"`
 	Password string `json:"password"`
@@ -138,6 +165,8 @@ type AdminLoginResponse struct {
 // adminLogout 管理者権限ログアウト
 // DELETE /admin/logout
 func (h *Handler) adminLogout(c echo.Context) error {
+	ctx := dbContext(c)
+
 	sessID := c.Request().Header.Get("x-session")
 
 	requestAt, err := getRequestTime(c)
@@ -146,7 +175,7 @@ func (h *Handler) adminLogout(c echo.Context) error {
 	}
 
 	query := "UPDATE admin_sessions SET deleted_at=? WHERE session_id=? AND deleted_at IS NULL"
-	if _, err = h.DB.Exec(query, requestAt, sessID); err != nil {
+	if _, err = h.DB.ExecContext(ctx, query, requestAt, sessID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -156,40 +185,42 @@ func (h *Handler) adminLogout(c echo.Context) error {
 // adminListMaster マスタデータ閲覧
 // GET /admin/master
 func (h *Handler) adminListMaster(c echo.Context) error {
+	ctx := dbContext(c)
+
 	masterVersions := make([]*VersionMaster, 0)
-	if err := h.DB.Select(&masterVersions, "SELECT * FROM version_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &masterVersions, "SELECT * FROM version_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	items := make([]*ItemMaster, 0)
-	if err := h.DB.Select(&items, "SELECT * FROM item_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &items, "SELECT * FROM item_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	gachas := make([]*GachaMaster, 0)
-	if err := h.DB.Select(&gachas, "SELECT * FROM gacha_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &gachas, "SELECT * FROM gacha_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	gachaItems := make([]*GachaItemMaster, 0)
-	if err := h.DB.Select(&gachaItems, "SELECT * FROM gacha_item_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &gachaItems, "SELECT * FROM gacha_item_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	presentAlls := make([]*PresentAllMaster, 0)
-	if err := h.DB.Select(&presentAlls, "SELECT * FROM present_all_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &presentAlls, "SELECT * FROM present_all_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 
 	}
 
 	loginBonuses := make([]*LoginBonusMaster, 0)
-	if err := h.DB.Select(&loginBonuses, "SELECT * FROM login_bonus_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &loginBonuses, "SELECT * FROM login_bonus_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 
 	}
 
 	loginBonusRewards := make([]*LoginBonusRewardMaster, 0)
-	if err := h.DB.Select(&loginBonusRewards, "SELECT * FROM login_bonus_reward_masters"); err != nil {
+	if err := h.DB.SelectContext(ctx, &loginBonusRewards, "SELECT * FROM login_bonus_reward_masters"); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -214,352 +245,570 @@ type AdminListMasterResponse struct {
 	LoginBonuses      []*LoginBonusMaster       `json:"loginBonuses"`
 }
 
+// adminExportMasterManifest マスタのエクスポートの目録
+// テーブルごとの行数と圧縮前のCSVのSHA-256を返す。再取り込み時にファイルが壊れていないかの確認に使う
+// ジョブとして実行するため、async=1 でバックグラウンドで実行でき、POST /admin/jobs/{jobID}/cancel で止められる
+// GET /admin/master/export
+func (h *Handler) adminExportMasterManifest(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	return h.runAdminJob(c, JobKindMasterExport, requestAt, func(job *Job) (interface{}, error) {
+		tables := make([]*MasterExportManifestTable, 0, len(masterCSVTables))
+		for _, t := range masterCSVTables {
+			rows, checksum, err := masterExportChecksum(job.Context(), h.DB, t)
+			if err != nil {
+				return nil, errors.Wrapf(err, "export %s", t.table)
+			}
+			tables = append(tables, &MasterExportManifestTable{
+				Table:    t.table,
+				FormName: t.formName,
+				File:     t.table + ".csv.gz",
+				Rows:     rows,
+				SHA256:   checksum,
+			})
+			job.SetProgress(&AdminExportMasterManifestResponse{
+				Tables: append([]*MasterExportManifestTable{}, tables...),
+			})
+		}
+
+		return &AdminExportMasterManifestResponse{
+			Tables: tables,
+		}, nil
+	})
+}
+
+// adminExportMasterTable マスタを1テーブルずつgzip圧縮したCSVでエクスポートする
+// そのまま PUT /admin/master に渡して取り込める。行数と圧縮前のCSVのSHA-256はトレーラで返す
+// 書き出し中はジョブとして GET /admin/jobs に表示され、キャンセルした場合はトレーラを返さずに途中で終了する
+// GET /admin/master/export/{table}
+func (h *Handler) adminExportMasterTable(c echo.Context) error {
+	ctx := dbContext(c)
+
+	t, ok := findMasterCSVTable(c.Param("table"))
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrMasterTableNotFound)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	// 書き出し中のエラーはステータスコードで返せないため、行数を先に確認してクエリの誤りなどを弾いておく
+	var count int
+	if err := h.DB.GetContext(ctx, &count, "SELECT COUNT(*) FROM "+t.table); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	job, err := h.startJob(JobKindMasterExport, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", t.table+".csv.gz"))
+	res.Header().Set("X-Job-Id", job.ID)
+	res.Header().Set("Trailer", "X-Master-Rows, X-Master-Sha256")
+	res.WriteHeader(http.StatusOK)
+
+	hash := sha256.New()
+	gz := gzip.NewWriter(res)
+	rows, err := exportMasterCSV(job.Context(), h.DB, t, io.MultiWriter(gz, hash), func(rows int) {
+		job.SetProgress(&MasterExportProgress{Table: t.table, Rows: rows, TotalRows: count})
+	})
+	job.SetProgress(&MasterExportProgress{Table: t.table, Rows: rows, TotalRows: count})
+	if err == nil {
+		err = gz.Close()
+	}
+	job.Finish(&MasterExportProgress{Table: t.table, Rows: rows, TotalRows: count}, err)
+	if err != nil {
+		return errors.Wrapf(err, "export %s", t.table)
+	}
+	res.Header().Set("X-Master-Rows", strconv.Itoa(rows))
+	res.Header().Set("X-Master-Sha256", hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+// MasterExportProgress 1テーブルのエクスポートの途中経過
+type MasterExportProgress struct {
+	Table     string `json:"table"`
+	Rows      int    `json:"rows"`
+	TotalRows int    `json:"totalRows"` // 書き出し開始前に数えた行数
+}
+
+type AdminExportMasterManifestResponse struct {
+	Tables []*MasterExportManifestTable `json:"tables"`
+}
+
+type MasterExportManifestTable struct {
+	Table    string `json:"table"`
+	FormName string `json:"formName"`
+	File     string `json:"file"`
+	Rows     int    `json:"rows"`
+	SHA256   string `json:"sha256"`
+}
+
 // adminUpdateMaster マスタデータ更新
+// CSVは1行ずつ読んで取り込み、全シャードで取り込みと検証が成功した場合のみコミットする
+// async=1 の場合はジョブIDを返してバックグラウンドで取り込む。進捗は GET /admin/master/jobs/{jobID} で確認する
 // PUT /admin/master
 func (h *Handler) adminUpdateMaster(c echo.Context) error {
-	wg := sync.WaitGroup{}
-	errCh := make(chan struct {
-		code int
-		err  error
-	}, len(h.DBs))
-	respCh := make(chan *AdminUpdateMasterResponse, len(h.DBs))
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
 
-	defer close(errCh)
-	defer close(respCh)
+	form, err := c.MultipartForm()
+	if err != nil && err != http.ErrNotMultipart {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	upload := masterUploadFromForm(form)
 
-	for _, db := range h.DBs {
-		wg.Add(1)
-		go func(db *sqlx.DB) {
-			defer wg.Done()
+	if c.QueryParam("async") == "1" {
+		saved, cleanup, err := saveMasterUpload(upload)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		job, err := h.startJob(JobKindMasterUpdate, requestAt)
+		if err != nil {
+			cleanup()
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
 
-			resp, code, err := h._adminUpdateMaster(c, db)
+		logger := c.Logger()
+		go func() {
+			defer cleanup()
+			res, _, err := h.updateMaster(saved, newMasterUpdateJob(job, len(h.DBs)))
 			if err != nil {
-				errCh <- struct {
-					code int
-					err  error
-				}{code, err}
-				return
+				logger.Errorf("failed to update master: jobID=%s, err=%+v", job.ID, err)
 			}
-			respCh <- resp
-		}(db)
+			job.Finish(res, err)
+		}()
+
+		return c.JSON(http.StatusAccepted, &AdminJobResponse{
+			JobID: job.ID,
+		})
 	}
 
-	wg.Wait()
-	if len(errCh) > 0 {
-		err := <-errCh
-		return errorResponse(c, err.code, err.err)
+	// 同期で取り込む場合も、途中で止められるようにジョブとして登録する
+	job, err := h.startJob(JobKindMasterUpdate, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	res, code, err := h.updateMaster(upload, newMasterUpdateJob(job, len(h.DBs)))
+	job.Finish(res, err)
+	if err != nil {
+		return errorResponse(c, code, err)
 	}
+	return successResponse(c, res)
+}
 
-	// Cache invalidation is handled by the application
-	return successResponse(c, <-respCh)
+// adminGetMasterUpdateJob 非同期のマスタ更新の進捗
+// GET /admin/master/jobs/{jobID}
+func (h *Handler) adminGetMasterUpdateJob(c echo.Context) error {
+	job, ok := h.Jobs.Get(c.Param("jobID"))
+	if !ok || job.Kind != JobKindMasterUpdate {
+		return errorResponse(c, http.StatusNotFound, ErrMasterUpdateJobNotFound)
+	}
+	return successResponse(c, job.Snapshot())
 }
 
-func (h *Handler) _adminUpdateMaster(c echo.Context, targetDb *sqlx.DB) (*AdminUpdateMasterResponse, int, error) {
-	tx, err := targetDb.Beginx()
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
+// updateMaster 全シャードにマスタを取り込み、全シャードで成功した場合のみコミットする
+func (h *Handler) updateMaster(upload map[string]masterCSVOpener, job *MasterUpdateJob) (*AdminUpdateMasterResponse, int, error) {
+	type shardResult struct {
+		tx           *sqlx.Tx
+		activeMaster *VersionMaster
+		code         int
+		err          error
 	}
-	defer tx.Rollback() //nolint:errcheck
+	results := make([]*shardResult, len(h.DBs))
 
-	// version master
-	versionMasterRecs, err := readFormFileToCSV(c, "versionMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
-		}
+	wg := sync.WaitGroup{}
+	for i, db := range h.DBs {
+		wg.Add(1)
+		go func(i int, db *sqlx.DB) {
+			defer wg.Done()
+
+			tx, activeMaster, code, err := importMasterToShard(job.Context(), db, upload, func(table string, rows int) {
+				job.SetRows(i, table, rows)
+			})
+			results[i] = &shardResult{tx, activeMaster, code, err}
+		}(i, db)
 	}
-	if versionMasterRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range versionMasterRecs {
-			if i == 0 {
-				continue
+	wg.Wait()
+
+	rollbackAll := func() {
+		for _, r := range results {
+			if r.tx != nil {
+				r.tx.Rollback() //nolint:errcheck
 			}
-			data = append(data, map[string]interface{}{
-				"id":             v[0],
-				"status":         v[1],
-				"master_version": v[2],
-			})
 		}
+	}
 
-		query := "INSERT INTO version_masters(id, status, master_version) VALUES (:id, :status, :master_version) ON DUPLICATE KEY UPDATE status=VALUES(status), master_version=VALUES(master_version)"
-		if _, err = tx.NamedExec(query, data); err != nil {
+	// 1つでも失敗したシャードがあれば、全シャードをロールバックしてマスタの食い違いを防ぐ
+	for _, r := range results {
+		if r.err != nil {
+			rollbackAll()
+			return nil, r.code, r.err
+		}
+	}
+	// 取り込み後、コミット前にキャンセルされた場合もコミットしない
+	if err := job.Context().Err(); err != nil {
+		rollbackAll()
+		return nil, http.StatusConflict, err
+	}
+	for _, r := range results {
+		if err := r.tx.Commit(); err != nil {
+			// コミット済みのシャードは戻せないため、エラーを返して再実行してもらう
+			rollbackAll()
 			return nil, http.StatusInternalServerError, err
 		}
-	} else {
-		c.Logger().Debug("Skip Update Master: versionMaster")
 	}
 
-	// item
-	itemMasterRecs, err := readFormFileToCSV(c, "itemMaster")
+	// マスタデータが更新されたのでキャッシュを破棄する
+	h.Cache.Clear()
+
+	// 全シャードに同じCSVを取り込むため、行数は先頭のシャードのものを返す
+	return &AdminUpdateMasterResponse{
+		VersionMaster: results[0].activeMaster,
+		RowCounts:     job.RowCounts(0),
+	}, 0, nil
+}
+
+// importMasterToShard シャードにマスタを取り込んで検証する。コミットは呼び出し側で行う
+// エラーの場合はロールバック済みで、トランザクションはnilを返す
+func importMasterToShard(ctx context.Context, db *sqlx.DB, upload map[string]masterCSVOpener, progress func(table string, rows int)) (*sqlx.Tx, *VersionMaster, int, error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
-		}
+		return nil, nil, http.StatusInternalServerError, err
 	}
-	if itemMasterRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range itemMasterRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":                 v[0],
-				"item_type":          v[1],
-				"name":               v[2],
-				"description":        v[3],
-				"amount_per_sec":     v[4],
-				"max_level":          v[5],
-				"max_amount_per_sec": v[6],
-				"base_exp_per_level": v[7],
-				"gained_exp":         v[8],
-				"shortening_min":     v[9],
-			})
-		}
 
-		query := strings.Join([]string{
-			"INSERT INTO item_masters(id, item_type, name, description, amount_per_sec, max_level, max_amount_per_sec, base_exp_per_level, gained_exp, shortening_min)",
-			"VALUES (:id, :item_type, :name, :description, :amount_per_sec, :max_level, :max_amount_per_sec, :base_exp_per_level, :gained_exp, :shortening_min)",
-			"ON DUPLICATE KEY UPDATE item_type=VALUES(item_type), name=VALUES(name), description=VALUES(description), amount_per_sec=VALUES(amount_per_sec), max_level=VALUES(max_level), max_amount_per_sec=VALUES(max_amount_per_sec), base_exp_per_level=VALUES(base_exp_per_level), gained_exp=VALUES(gained_exp), shortening_min=VALUES(shortening_min)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: itemMaster")
+	fail := func(err error) (*sqlx.Tx, *VersionMaster, int, error) {
+		tx.Rollback() //nolint:errcheck
+		return nil, nil, masterImportErrorStatus(err), err
 	}
 
-	// gacha
-	gachaRecs, err := readFormFileToCSV(c, "gachaMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
+	for _, t := range masterCSVTables {
+		open, ok := upload[t.formName]
+		if !ok {
+			continue
 		}
-	}
-	if gachaRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range gachaRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":            v[0],
-				"name":          v[1],
-				"start_at":      v[2],
-				"end_at":        v[3],
-				"display_order": v[4],
-				"created_at":    v[5],
-			})
+		r, err := open()
+		if err != nil {
+			return fail(err)
 		}
-
-		query := strings.Join([]string{
-			"INSERT INTO gacha_masters(id, name, start_at, end_at, display_order, created_at)",
-			"VALUES (:id, :name, :start_at, :end_at, :display_order, :created_at)",
-			"ON DUPLICATE KEY UPDATE name=VALUES(name), start_at=VALUES(start_at), end_at=VALUES(end_at), display_order=VALUES(display_order), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
+		_, err = importMasterCSV(ctx, tx, r, t, func(rows int) {
+			progress(t.table, rows)
+		})
+		r.Close()
+		if err != nil {
+			return fail(err)
 		}
-	} else {
-		c.Logger().Debug("Skip Update Master: gachaMaster")
 	}
 
-	// gacha item
-	gachaItemRecs, err := readFormFileToCSV(c, "gachaItemMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
-		}
+	if err := validateImportedMasters(tx); err != nil {
+		return fail(err)
 	}
-	if gachaItemRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range gachaItemRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":         v[0],
-				"gacha_id":   v[1],
-				"item_type":  v[2],
-				"item_id":    v[3],
-				"amount":     v[4],
-				"weight":     v[5],
-				"created_at": v[6],
-			})
-		}
 
-		query := strings.Join([]string{
-			"INSERT INTO gacha_item_masters(id, gacha_id, item_type, item_id, amount, weight, created_at)",
-			"VALUES (:id, :gacha_id, :item_type, :item_id, :amount, :weight, :created_at)",
-			"ON DUPLICATE KEY UPDATE gacha_id=VALUES(gacha_id), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), weight=VALUES(weight), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: gachaItemMaster")
+	activeMaster := new(VersionMaster)
+	if err := tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+		return fail(err)
+	}
+
+	return tx, activeMaster, 0, nil
+}
+
+// masterImportErrorStatus マスタの取り込みエラーのステータスコード。CSVの内容が不正な場合は400とする
+func masterImportErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case ErrInvalidMasterCSV, ErrPresentMessageTooLong, ErrInvalidGachaWeight:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type AdminUpdateMasterResponse struct {
+	VersionMaster *VersionMaster `json:"versionMaster"`
+	RowCounts     map[string]int `json:"rowCounts"` // テーブルごとに取り込んだ行数
+}
+
+// adminActivateMaster 指定したマスタバージョンを有効化する
+// init.shを再実行せずに、有効なマスタバージョンがないDBの立ち上げやバージョンの切り替えを行うためのもの
+// POST /admin/master/activate
+func (h *Handler) adminActivateMaster(c echo.Context) error {
+	ctx := dbContext(c)
+
+	defer c.Request().Body.Close()
+	req := new(AdminActivateMasterRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.MasterVersion == "" {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidMasterVersion)
 	}
 
-	// present all
-	presentAllRecs, err := readFormFileToCSV(c, "presentAllMaster")
+	res, code, err := h.activateMaster(ctx, req.MasterVersion)
 	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
+		if partial, ok := errors.Cause(err).(*PartialMasterActivationError); ok {
+			return partialMasterActivationResponse(c, partial)
 		}
+		return errorResponse(c, code, err)
 	}
-	if presentAllRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range presentAllRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":                  v[0],
-				"registered_start_at": v[1],
-				"registered_end_at":   v[2],
-				"item_type":           v[3],
-				"item_id":             v[4],
-				"amount":              v[5],
-				"present_message":     v[6],
-				"created_at":          v[7],
-			})
-		}
+	return successResponse(c, res)
+}
 
-		query := strings.Join([]string{
-			"INSERT INTO present_all_masters(id, registered_start_at, registered_end_at, item_type, item_id, amount, present_message, created_at)",
-			"VALUES (:id, :registered_start_at, :registered_end_at, :item_type, :item_id, :amount, :present_message, :created_at)",
-			"ON DUPLICATE KEY UPDATE registered_start_at=VALUES(registered_start_at), registered_end_at=VALUES(registered_end_at), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), present_message=VALUES(present_message), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
+// activateMaster 全シャードでマスタバージョンを検証して切り替え、全シャードで成功した場合のみコミットする
+// コミットの途中で失敗した場合は、コミット済みのシャードを戻せないため、どのシャードが切り替わったかをPartialMasterActivationErrorで返す
+func (h *Handler) activateMaster(ctx context.Context, masterVersion string) (*AdminActivateMasterResponse, int, error) {
+	type shardResult struct {
+		tx           *sqlx.Tx
+		activeMaster *VersionMaster
+		code         int
+		err          error
+	}
+	results := make([]*shardResult, len(h.DBs))
+
+	wg := sync.WaitGroup{}
+	for i, db := range h.DBs {
+		wg.Add(1)
+		go func(i int, db *sqlx.DB) {
+			defer wg.Done()
+
+			tx, activeMaster, code, err := prepareMasterActivation(ctx, db, masterVersion)
+			results[i] = &shardResult{tx, activeMaster, code, err}
+		}(i, db)
+	}
+	wg.Wait()
+
+	rollbackAll := func() {
+		for _, r := range results {
+			if r.tx != nil {
+				r.tx.Rollback() //nolint:errcheck
+			}
 		}
-	} else {
-		c.Logger().Debug("Skip Update Master: presentAllMaster")
 	}
 
-	// login bonuses
-	loginBonusRecs, err := readFormFileToCSV(c, "loginBonusMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
+	// 1つでもバージョンがない・切り替えに失敗したシャードがあれば、どのシャードも切り替えない
+	for i, r := range results {
+		if r.err != nil {
+			rollbackAll()
+			return nil, r.code, errors.Wrapf(r.err, "shard=%d", i)
 		}
 	}
-	if loginBonusRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range loginBonusRecs {
-			if i == 0 {
-				continue
-			}
-			looped := 0
-			if v[4] == "TRUE" {
-				looped = 1
+
+	committed := make([]int, 0, len(results))
+	for i, r := range results {
+		if err := r.tx.Commit(); err != nil {
+			rollbackAll()
+			// 一部のシャードだけが切り替わっているため、キャッシュも破棄して新旧どちらのマスタも読み直させる
+			h.Cache.Clear()
+			return nil, http.StatusInternalServerError, &PartialMasterActivationError{
+				MasterVersion:   masterVersion,
+				CommittedShards: committed,
+				FailedShard:     i,
+				Err:             err,
 			}
-			data = append(data, map[string]interface{}{
-				"id":           v[0],
-				"start_at":     v[1],
-				"end_at":       v[2],
-				"column_count": v[3],
-				"looped":       looped,
-				"created_at":   v[5],
-			})
 		}
+		committed = append(committed, i)
+	}
 
-		query := strings.Join([]string{
-			"INSERT INTO login_bonus_masters(id, start_at, end_at, column_count, looped, created_at)",
-			"VALUES (:id, :start_at, :end_at, :column_count, :looped, :created_at)",
-			"ON DUPLICATE KEY UPDATE start_at=VALUES(start_at), end_at=VALUES(end_at), column_count=VALUES(column_count), looped=VALUES(looped), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: loginBonusMaster")
+	// 有効なマスタバージョンが変わったのでキャッシュを破棄する
+	// 他のプロセスはapiMiddlewareで有効なバージョンが変わったことに気づいて破棄する
+	h.Cache.Clear()
+
+	res := &AdminActivateMasterResponse{}
+	if len(results) > 0 {
+		res.VersionMaster = results[0].activeMaster
 	}
+	return res, 0, nil
+}
 
-	// login bonus rewards
-	loginBonusRewardRecs, err := readFormFileToCSV(c, "loginBonusRewardMaster")
+// prepareMasterActivation 1シャード分のマスタバージョンを検証して切り替える。コミットは呼び出し側で行う
+// エラーの場合はロールバック済みで、トランザクションはnilを返す
+func prepareMasterActivation(ctx context.Context, db *sqlx.DB, masterVersion string) (*sqlx.Tx, *VersionMaster, int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		if err != ErrNoFormFile {
-			return nil, http.StatusBadRequest, err
-		}
+		return nil, nil, http.StatusInternalServerError, err
 	}
-	if loginBonusRewardRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range loginBonusRewardRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":              v[0],
-				"login_bonus_id":  v[1],
-				"reward_sequence": v[2],
-				"item_type":       v[3],
-				"item_id":         v[4],
-				"amount":          v[5],
-				"created_at":      v[6],
-			})
-		}
 
-		query := strings.Join([]string{
-			"INSERT INTO login_bonus_reward_masters(id, login_bonus_id, reward_sequence, item_type, item_id, amount, created_at)",
-			"VALUES (:id, :login_bonus_id, :reward_sequence, :item_type, :item_id, :amount, :created_at)",
-			"ON DUPLICATE KEY UPDATE login_bonus_id=VALUES(login_bonus_id), reward_sequence=VALUES(reward_sequence), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: loginBonusRewardMaster")
+	fail := func(code int, err error) (*sqlx.Tx, *VersionMaster, int, error) {
+		tx.Rollback() //nolint:errcheck
+		return nil, nil, code, err
 	}
 
-	activeMaster := new(VersionMaster)
-	if err = tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
-		return nil, http.StatusInternalServerError, err
+	target := new(VersionMaster)
+	if err = tx.Get(target, "SELECT * FROM version_masters WHERE master_version=? FOR UPDATE", masterVersion); err != nil {
+		if err == sql.ErrNoRows {
+			return fail(http.StatusNotFound, ErrInvalidMasterVersion)
+		}
+		return fail(http.StatusInternalServerError, err)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
+	if _, err = tx.Exec("UPDATE version_masters SET status=0 WHERE status=1 AND id<>?", target.ID); err != nil {
+		return fail(http.StatusInternalServerError, err)
 	}
+	if _, err = tx.Exec("UPDATE version_masters SET status=1 WHERE id=?", target.ID); err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	target.Status = 1
 
-	return &AdminUpdateMasterResponse{
-		VersionMaster: activeMaster,
-	}, 0, nil
+	return tx, target, 0, nil
 }
 
-type AdminUpdateMasterResponse struct {
+// PartialMasterActivationError 一部のシャードだけマスタバージョンが切り替わった状態で失敗したエラー
+// 切り替わったシャードは戻せないため、同じバージョンで再実行して残りのシャードを揃える
+type PartialMasterActivationError struct {
+	MasterVersion   string
+	CommittedShards []int
+	FailedShard     int
+	Err             error
+}
+
+func (e *PartialMasterActivationError) Error() string {
+	return fmt.Sprintf("%s: masterVersion=%s, committedShards=%v, failedShard=%d: %v", ErrPartialMasterActivation.Error(), e.MasterVersion, e.CommittedShards, e.FailedShard, e.Err)
+}
+
+// partialMasterActivationResponse 一部のシャードだけ切り替わった場合のレスポンス。再実行が必要なことが分かるよう、シャードごとの状態を返す
+func partialMasterActivationResponse(c echo.Context, e *PartialMasterActivationError) error {
+	c.Logger().Errorf("status=%d, err=%+v", http.StatusInternalServerError, errors.WithStack(e))
+
+	return c.JSON(http.StatusInternalServerError, &PartialMasterActivationResponse{
+		StatusCode:      http.StatusInternalServerError,
+		Message:         e.Error(),
+		Code:            responseErrorCode(c, http.StatusInternalServerError, ErrPartialMasterActivation),
+		MasterVersion:   e.MasterVersion,
+		CommittedShards: e.CommittedShards,
+		FailedShard:     e.FailedShard,
+	})
+}
+
+type PartialMasterActivationResponse struct {
+	StatusCode      int    `json:"status_code"`
+	Message         string `json:"message"`
+	Code            string `json:"code,omitempty"`
+	MasterVersion   string `json:"masterVersion"`
+	CommittedShards []int  `json:"committedShards"`
+	FailedShard     int    `json:"failedShard"`
+}
+
+type AdminActivateMasterRequest struct {
+	MasterVersion string `json:"masterVersion"`
+}
+
+type AdminActivateMasterResponse struct {
 	VersionMaster *VersionMaster `json:"versionMaster"`
 }
 
-// readFromFileToCSV ファイルからcsvレコードを取得する
-func readFormFileToCSV(c echo.Context, name string) ([][]string, error) {
-	file, err := c.FormFile(name)
-	if err != nil {
-		return nil, ErrNoFormFile
+// adminTokenIssueStats ワンタイムトークンの発行数の統計
+// userId を指定した場合は、そのユーザーの直近の発行数もあわせて返す。統計はこのプロセスのもののみ
+// GET /admin/tokens/stats
+func (h *Handler) adminTokenIssueStats(c echo.Context) error {
+	now := time.Now()
+	stats := h.TokenIssues.Stats(now)
+	if v := c.QueryParam("userId"); v != "" {
+		userID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		count := h.TokenIssues.Count(userID, now)
+		stats.UserIssued = &count
+	}
+	return successResponse(c, stats)
+}
+
+// adminTokenDivergence ワンタイムトークンがユーザーのシャード・キャッシュ・他のDBで食い違っていないか確認する
+// 有効なトークンを新しい順にn件(デフォルト100件、最大1000件)集めて調べ、食い違うものだけを返す
+// GET /admin/tokens/divergence?n={n}
+func (h *Handler) adminTokenDivergence(c echo.Context) error {
+	ctx := dbContext(c)
+
+	n := TokenDivergenceDefaultSample
+	if nStr := c.QueryParam("n"); nStr != "" {
+		var err error
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n < 1 || n > TokenDivergenceMaxSample {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("n should be between 1 and %d", TokenDivergenceMaxSample))
+		}
 	}
 
-	src, err := file.Open()
+	res, err := h.checkTokenDivergence(ctx, time.Now().Unix(), n)
 	if err != nil {
-		return nil, err
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	defer src.Close()
+	return successResponse(c, res)
+}
+
+// adminMetrics このプロセスで集計している統計
+// GET /admin/metrics
+func (h *Handler) adminMetrics(c echo.Context) error {
+	return successResponse(c, &AdminMetricsResponse{
+		LoginGrants: h.LoginMetrics.Snapshot(),
+		TokenIssues: h.TokenIssues.Stats(time.Now()),
+		Outbox:      h.Outbox.Stats(),
+		ShardTxs:    h.shardTxStats(),
+	})
+}
 
-	buf := new(bytes.Buffer)
-	if _, err = io.Copy(buf, src); err != nil {
-		return nil, err
+// shardTxStats シャードごとのトランザクションの回数
+// シャードの設定がなく単一のDBに接続している場合は、ドライバを包んでいないため0のままになる
+func (h *Handler) shardTxStats() []*ShardTxStats {
+	stats := make([]*ShardTxStats, 0, len(h.ShardErrors))
+	for i, errLog := range h.ShardErrors {
+		s := errLog.Txs().Stats()
+		s.Shard = i
+		s.Host = errLog.Host()
+		stats = append(stats, s)
 	}
+	return stats
+}
 
-	csvReader := csv.NewReader(bytes.NewReader(buf.Bytes()))
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		return nil, err
+type AdminMetricsResponse struct {
+	LoginGrants *LoginGrantMetricsSnapshot `json:"loginGrants"`
+	TokenIssues *TokenIssueStats           `json:"tokenIssues"`
+	Outbox      *OutboxRelayStats          `json:"outbox"`
+	ShardTxs    []*ShardTxStats            `json:"shardTxs"`
+}
+
+// adminShardErrors シャードごとの直近のエラー
+// GET /admin/shards/errors
+func (h *Handler) adminShardErrors(c echo.Context) error {
+	now := time.Now()
+	shards := make([]*AdminShardErrors, 0, len(h.ShardErrors))
+	for i, errLog := range h.ShardErrors {
+		shards = append(shards, &AdminShardErrors{
+			Shard:       i,
+			Host:        errLog.Host(),
+			TotalErrors: errLog.Total(),
+			Errors:      errLog.Recent(now),
+		})
 	}
 
-	return records, nil
+	return successResponse(c, &AdminShardErrorsResponse{
+		Shards: shards,
+	})
+}
+
+type AdminShardErrorsResponse struct {
+	Shards []*AdminShardErrors `json:"shards"`
+}
+
+type AdminShardErrors struct {
+	Shard       int           `json:"shard"`
+	Host        string        `json:"host"`
+	TotalErrors int64         `json:"totalErrors"`
+	Errors      []*ShardError `json:"errors"`
 }
 
 // adminUser ユーザの詳細画面
 // GET /admin/user/{userID}
 func (h *Handler) adminUser(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
@@ -567,7 +816,7 @@ func (h *Handler) adminUser(c echo.Context) error {
 
 	query := "SELECT * FROM users WHERE id=?"
 	user := new(User)
-	if err = h.DB.Get(user, query, userID); err != nil {
+	if err = h.DB.GetContext(ctx, user, query, userID); err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
@@ -576,43 +825,43 @@ func (h *Handler) adminUser(c echo.Context) error {
 
 	query = "SELECT * FROM user_devices WHERE user_id=?"
 	devices := make([]*UserDevice, 0)
-	if err = h.DB.Select(&devices, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &devices, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_cards WHERE user_id=?"
 	cards := make([]*UserCard, 0)
-	if err = h.DB.Select(&cards, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &cards, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_decks WHERE user_id=?"
 	decks := make([]*UserDeck, 0)
-	if err = h.DB.Select(&decks, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &decks, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_items WHERE user_id=?"
 	items := make([]*UserItem, 0)
-	if err = h.DB.Select(&items, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &items, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_login_bonuses WHERE user_id=?"
 	loginBonuses := make([]*UserLoginBonus, 0)
-	if err = h.DB.Select(&loginBonuses, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &loginBonuses, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_presents WHERE user_id=?"
 	presents := make([]*UserPresent, 0)
-	if err = h.DB.Select(&presents, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &presents, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	query = "SELECT * FROM user_present_all_received_history WHERE user_id=?"
 	presentHistory := make([]*UserPresentAllReceivedHistory, 0)
-	if err = h.DB.Select(&presentHistory, query, userID); err != nil {
+	if err = h.DB.SelectContext(ctx, &presentHistory, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -643,6 +892,8 @@ type AdminUserResponse struct {
 // adminBanUser ユーザBAN処理
 // POST /admin/user/{userId}/ban
 func (h *Handler) adminBanUser(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
@@ -655,7 +906,7 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 
 	query := "SELECT * FROM users WHERE id=?"
 	user := new(User)
-	if err = h.DB.Get(user, query, userID); err != nil {
+	if err = h.DB.GetContext(ctx, user, query, userID); err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusBadRequest, ErrUserNotFound)
 		}
@@ -667,7 +918,7 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	query = "INSERT user_bans(id, user_id, created_at, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE updated_at = ?"
-	if _, err = h.getDBForUserID(userID).Exec(query, banID, userID, requestAt, requestAt, requestAt); err != nil {
+	if _, err = h.getDBForUserID(userID).ExecContext(ctx, query, banID, userID, requestAt, requestAt, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -680,6 +931,951 @@ type AdminBanUserResponse struct {
 	User *User `json:"user"`
 }
 
+// adminGrantCoins 複数のユーザーにまとめてコインを付与する(メンテナンスの補填など)
+// allActive=true の場合は削除・BANされていない全ユーザーが対象。所持上限(ISUCON_COIN_CAP)を超える分は破棄する
+// シャードごとに1トランザクションで並列に付与し、シャードごとの更新件数を返す。失敗したシャードはロールバックされ、他のシャードには影響しない
+// ジョブとして実行するため、async=1 でバックグラウンドで実行でき、キャンセルした場合はコミット前のシャードがロールバックされる
+// POST /admin/coins/grant
+func (h *Handler) adminGrantCoins(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminGrantCoinsRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Amount <= 0 || (!req.AllActive && len(req.UserIDs) == 0) {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidCoinGrant)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	shardUserIDs := make([][]int64, len(h.DBs))
+	for _, userID := range req.UserIDs {
+		shard := h.getShardIndex(userID)
+		shardUserIDs[shard] = append(shardUserIDs[shard], userID)
+	}
+
+	logger := c.Logger()
+	return h.runAdminJob(c, JobKindCoinGrant, requestAt, func(job *Job) (interface{}, error) {
+		var mu sync.Mutex
+		results := make([]*AdminGrantCoinsShardResult, len(h.DBs))
+		wg := sync.WaitGroup{}
+		for i, db := range h.DBs {
+			wg.Add(1)
+			go func(i int, db *sqlx.DB) {
+				defer wg.Done()
+
+				result := &AdminGrantCoinsShardResult{Shard: i}
+				updated, err := grantCoinsToShard(job.Context(), db, shardUserIDs[i], req.AllActive, req.Amount, requestAt)
+				if err != nil {
+					logger.Errorf("failed to grant coins: shard=%d, err=%+v", i, err)
+					result.Error = err.Error()
+				}
+				result.Updated = updated
+
+				mu.Lock()
+				defer mu.Unlock()
+				results[i] = result
+				job.SetProgress(newAdminGrantCoinsResponse(req.Amount, results))
+			}(i, db)
+		}
+		wg.Wait()
+
+		// キャンセルされたシャードはロールバック済み。コミット済みのシャードの件数は途中経過に残る
+		if err := job.Context().Err(); err != nil {
+			return nil, err
+		}
+		return newAdminGrantCoinsResponse(req.Amount, results), nil
+	})
+}
+
+// newAdminGrantCoinsResponse 終わったシャードの結果を集計する。まだ終わっていないシャードはnil
+func newAdminGrantCoinsResponse(amount int64, results []*AdminGrantCoinsShardResult) *AdminGrantCoinsResponse {
+	res := &AdminGrantCoinsResponse{
+		Amount: amount,
+		Shards: make([]*AdminGrantCoinsShardResult, 0, len(results)),
+	}
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		res.TotalUpdated += r.Updated
+		res.Shards = append(res.Shards, r)
+	}
+	return res
+}
+
+// grantCoinsToShard 1シャード分のユーザーにコインを付与し、更新したユーザー数を返す
+// バッチの間でctxを確認し、キャンセルされた場合はロールバックしてエラーを返す
+// allActiveの場合はuserIDsを無視し、シャード内の削除・BANされていない全ユーザーをid順に区切って付与する
+func grantCoinsToShard(ctx context.Context, db *sqlx.DB, userIDs []int64, allActive bool, amount, requestAt int64) (int64, error) {
+	if !allActive && len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 上限を下げた後に既に上限を超えているユーザーのコインは減らさない
+	newCoin := "isu_coin + ?"
+	args := []interface{}{amount, requestAt}
+	if coinCap > 0 {
+		newCoin = "GREATEST(isu_coin, LEAST(isu_coin + ?, ?))"
+		args = []interface{}{amount, coinCap, requestAt}
+	}
+	query := fmt.Sprintf("UPDATE users SET isu_coin = %s, updated_at = ? WHERE id IN (?) AND deleted_at IS NULL", newCoin)
+
+	grant := func(ids []int64) (int64, error) {
+		q, params, err := sqlx.In(query, append(append([]interface{}{}, args...), ids)...)
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.ExecContext(ctx, q, params...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+
+	updated := int64(0)
+	if allActive {
+		selectQuery := `SELECT id FROM users AS u WHERE id > ? AND deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM user_bans AS b WHERE b.user_id = u.id)
+			ORDER BY id LIMIT ?`
+		lastID := int64(0)
+		for {
+			ids := make([]int64, 0, AdminCoinGrantBatchSize)
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			if err := tx.SelectContext(ctx, &ids, selectQuery, lastID, AdminCoinGrantBatchSize); err != nil {
+				return 0, err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			n, err := grant(ids)
+			if err != nil {
+				return 0, err
+			}
+			updated += n
+			lastID = ids[len(ids)-1]
+		}
+	} else {
+		for start := 0; start < len(userIDs); start += AdminCoinGrantBatchSize {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			end := start + AdminCoinGrantBatchSize
+			if end > len(userIDs) {
+				end = len(userIDs)
+			}
+			n, err := grant(userIDs[start:end])
+			if err != nil {
+				return 0, err
+			}
+			updated += n
+		}
+	}
+
+	// ランキングなど他のシャードの集計に反映できるよう、付与と同じトランザクションでイベントを残す
+	if updated > 0 {
+		event := &CoinGrantEvent{Amount: amount, AllActive: allActive, Updated: updated, GrantedAt: requestAt}
+		if err := insertOutboxEvent(tx, EventTypeCoinGrant, nil, event, requestAt); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
+
+// CoinGrantEvent 一括のコイン付与のイベントの内容
+type CoinGrantEvent struct {
+	Amount    int64 `json:"amount"`
+	AllActive bool  `json:"allActive"`
+	Updated   int64 `json:"updated"`
+	GrantedAt int64 `json:"grantedAt"`
+}
+
+type AdminGrantCoinsRequest struct {
+	UserIDs   []int64 `json:"userIds"`
+	AllActive bool    `json:"allActive"`
+	Amount    int64   `json:"amount"`
+}
+
+type AdminGrantCoinsResponse struct {
+	Amount       int64                         `json:"amount"`
+	TotalUpdated int64                         `json:"totalUpdated"`
+	Shards       []*AdminGrantCoinsShardResult `json:"shards"`
+}
+
+type AdminGrantCoinsShardResult struct {
+	Shard   int    `json:"shard"`
+	Updated int64  `json:"updated"` // 上限に達していて変わらなかったユーザーは含まない
+	Error   string `json:"error,omitempty"`
+}
+
+// adminResetUserLogin ユーザーの当日ログイン状態をリセットする(検証用)
+// last_activated_atをloginLocationでの前日の最後の時刻にずらし、次回のloginでログインボーナスの処理が再度行われるようにする
+// resetLoginBonus=1 の場合はログインボーナスの進捗も削除する
+// POST /admin/user/{userID}/reset-login
+func (h *Handler) adminResetUserLogin(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	resetLoginBonus := c.QueryParam("resetLoginBonus") == "1"
+
+	// 同時に走るloginと競合しないよう、loginと同じロックを取る
+	unlock := h.UserLocks.Lock(userID)
+	defer unlock()
+
+	tx, err := h.getDBForUserID(userID).BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	user := new(User)
+	if err = tx.Get(user, "SELECT * FROM users WHERE id=? FOR UPDATE", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	lastActivatedAt := endOfPreviousDay(requestAt, loginLocation)
+	if _, err = tx.Exec("UPDATE users SET last_activated_at=?, updated_at=? WHERE id=?", lastActivatedAt, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	user.LastActivatedAt = lastActivatedAt
+	user.UpdatedAt = requestAt
+
+	if resetLoginBonus {
+		if _, err = tx.Exec("DELETE FROM user_login_bonuses WHERE user_id=?", userID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminResetUserLoginResponse{
+		User:            user,
+		LastActivatedAt: lastActivatedAt,
+		ResetLoginBonus: resetLoginBonus,
+	})
+}
+
+// endOfPreviousDay requestAtのloc上での当日の0時の1秒前。1日が24時間でない日でも必ず前日になる
+func endOfPreviousDay(requestAt int64, loc *time.Location) int64 {
+	t := time.Unix(requestAt, 0).In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Unix() - 1
+}
+
+type AdminResetUserLoginResponse struct {
+	User            *User `json:"user"`
+	LastActivatedAt int64 `json:"lastActivatedAt"`
+	ResetLoginBonus bool  `json:"resetLoginBonus"`
+}
+
+// adminLoginPreview ユーザーが今ログインした場合に付与されるログインボーナスと全員プレゼントを返す(検証・分析用)
+// セッションの発行やログインボーナスの進捗の更新などの書き込みは一切しない。at={unixtime}で判定する時刻を指定できる
+// 同日にすでにログインしている場合は、loginと同じく何も付与されない
+// GET /admin/user/{userID}/login-preview
+func (h *Handler) adminLoginPreview(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+	if atStr := c.QueryParam("at"); atStr != "" {
+		requestAt, err = strconv.ParseInt(atStr, 10, 64)
+		if err != nil || requestAt <= 0 {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid at"))
+		}
+	}
+
+	db := h.getDBForUserID(userID)
+	user := new(User)
+	if err = db.GetContext(ctx, user, "SELECT * FROM users WHERE id=?", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	res := &AdminLoginPreviewResponse{
+		RequestAt:    requestAt,
+		LoginBonuses: make([]*UserLoginBonus, 0),
+		Rewards:      make([]*UserPresent, 0),
+		Presents:     make([]*UserPresent, 0),
+	}
+	if isCompleteTodayLogin(time.Unix(user.LastActivatedAt, 0), time.Unix(requestAt, 0), loginLocation) {
+		res.AlreadyLoggedInToday = true
+		return successResponse(c, res)
+	}
+
+	grants, err := h.planLoginBonus(ctx, db, userID, requestAt)
+	if err != nil {
+		if err == ErrLoginBonusRewardNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	for _, grant := range grants {
+		res.LoginBonuses = append(res.LoginBonuses, grant.userBonus)
+		res.Rewards = append(res.Rewards, loginBonusRewardPresent(grant))
+	}
+
+	presentAlls, err := planPresentAll(ctx, db, userID, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	for _, np := range presentAlls {
+		presentMessage, err := sanitizePresentMessage(np.PresentMessage)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, errors.Wrapf(err, "presentAllID=%d", np.ID))
+		}
+		res.Presents = append(res.Presents, &UserPresent{
+			UserID:         userID,
+			SentAt:         requestAt,
+			ItemType:       np.ItemType,
+			ItemID:         np.ItemID,
+			Amount:         int(np.Amount),
+			PresentMessage: presentMessage,
+			Source:         PresentSourcePresentAll,
+			SourceID:       &np.ID,
+			CreatedAt:      requestAt,
+			UpdatedAt:      requestAt,
+		})
+	}
+
+	return successResponse(c, res)
+}
+
+// AdminLoginPreviewResponse ログインした場合の付与内容
+// LoginBonusesは進めた後の進捗で、新しく始まるボーナスのIDは0になる。Rewardsはその報酬で、LoginBonusesと同じ順に並ぶ
+type AdminLoginPreviewResponse struct {
+	RequestAt            int64             `json:"requestAt"`
+	AlreadyLoggedInToday bool              `json:"alreadyLoggedInToday"`
+	LoginBonuses         []*UserLoginBonus `json:"loginBonuses"`
+	Rewards              []*UserPresent    `json:"rewards"`
+	Presents             []*UserPresent    `json:"presents"`
+}
+
+// adminResyncUserCardStats ユーザーの初期レベルのカードの生産性を現在のマスタの値に合わせる
+// マスタの生産性が途中で変更された場合に、変更前に付与されたカードとの差異を解消するためのもの
+// POST /admin/user/{userID}/cards/resync-stats
+func (h *Handler) adminResyncUserCardStats(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var exists int
+	if err = tx.Get(&exists, "SELECT 1 FROM users WHERE id=?", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	cards := make([]*UserCard, 0)
+	query := "SELECT * FROM user_cards WHERE user_id=? AND level=1 FOR UPDATE"
+	if err = tx.Select(&cards, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	updated := make([]*UserCard, 0)
+	for _, card := range cards {
+		master, err := h.getItemMaster(ctx, card.CardID)
+		if err != nil {
+			if err == ErrItemNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if master.AmountPerSec == nil {
+			return errorResponse(c, http.StatusInternalServerError, ErrInvalidItemMaster)
+		}
+		if card.AmountPerSec == *master.AmountPerSec {
+			continue
+		}
+
+		card.AmountPerSec = *master.AmountPerSec
+		card.UpdatedAt = requestAt
+		if _, err = tx.Exec("UPDATE user_cards SET amount_per_sec=?, updated_at=? WHERE id=?", card.AmountPerSec, card.UpdatedAt, card.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		updated = append(updated, card)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminResyncUserCardStatsResponse{
+		UpdatedCards: updated,
+	})
+}
+
+type AdminResyncUserCardStatsResponse struct {
+	UpdatedCards []*UserCard `json:"updatedCards"`
+}
+
+// ユーザーデータの整合性チェックで検出する不整合の種類
+const (
+	IntegrityViolationDuplicateActiveDeck = "duplicate_active_deck"
+	IntegrityViolationDanglingDeckCard    = "dangling_deck_card"
+	IntegrityViolationNegativeItemAmount  = "negative_item_amount"
+	IntegrityViolationNegativeCoin        = "negative_coin"
+	IntegrityViolationCoinOverCap         = "coin_over_cap"
+)
+
+// adminCheckUserIntegrity ユーザーのデータの整合性をチェックし、不整合の一覧を返す
+// repair=1 の場合は安全に直せるものだけ修正する。コインは失われると戻せないため修正しない
+// GET /admin/user/{userID}/integrity
+func (h *Handler) adminCheckUserIntegrity(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	repair := c.QueryParam("repair") == "1"
+
+	db := h.getDBForUserID(userID)
+
+	if repair {
+		release, err := h.acquireWriteSlot(userID)
+		if err != nil {
+			return shardBusyResponse(c, err)
+		}
+		defer release()
+	}
+
+	// 修正しない場合もチェック中に状態が変わらないよう、1つのトランザクションで読む
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	lock := ""
+	if repair {
+		lock = " FOR UPDATE"
+	}
+
+	user := new(User)
+	if err = tx.Get(user, "SELECT * FROM users WHERE id=?"+lock, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	violations := make([]*IntegrityViolation, 0)
+
+	// 装備中のデッキは1つだけ。複数ある場合は最新のもの以外を外す
+	decks := make([]*UserDeck, 0)
+	if err = tx.Select(&decks, "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL ORDER BY id DESC"+lock, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	for i, deck := range decks {
+		if i == 0 {
+			continue
+		}
+		violations = append(violations, &IntegrityViolation{
+			Type:     IntegrityViolationDuplicateActiveDeck,
+			TargetID: deck.ID,
+			Detail:   fmt.Sprintf("deck %d is active along with deck %d", deck.ID, decks[0].ID),
+			Repaired: repair,
+		})
+		if repair {
+			if _, err = tx.Exec("UPDATE user_decks SET updated_at=?, deleted_at=? WHERE id=?", requestAt, requestAt, deck.ID); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+		}
+	}
+
+	// 装備中のデッキのカードが全て所持しているカードか。手放したカードを含むデッキは外す
+	if len(decks) > 0 {
+		deck := decks[0]
+		cardIDs := []int64{deck.CardID1, deck.CardID2, deck.CardID3}
+		query, params, err := sqlx.In("SELECT id FROM user_cards WHERE id IN (?) AND user_id=? AND deleted_at IS NULL", cardIDs, userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		owned := make([]int64, 0, len(cardIDs))
+		if err = tx.Select(&owned, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		ownedMap := make(map[int64]bool, len(owned))
+		for _, id := range owned {
+			ownedMap[id] = true
+		}
+
+		dangling := false
+		for _, cardID := range cardIDs {
+			if ownedMap[cardID] {
+				continue
+			}
+			dangling = true
+			violations = append(violations, &IntegrityViolation{
+				Type:     IntegrityViolationDanglingDeckCard,
+				TargetID: deck.ID,
+				Detail:   fmt.Sprintf("deck %d references card %d which is not owned", deck.ID, cardID),
+				Repaired: repair,
+			})
+		}
+		if dangling && repair {
+			if _, err = tx.Exec("UPDATE user_decks SET updated_at=?, deleted_at=? WHERE id=?", requestAt, requestAt, deck.ID); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+		}
+	}
+
+	// アイテムの所持数は0以上。負になっているものは0に戻す
+	items := make([]*UserItem, 0)
+	if err = tx.Select(&items, "SELECT * FROM user_items WHERE user_id=? AND amount < 0"+lock, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	for _, item := range items {
+		violations = append(violations, &IntegrityViolation{
+			Type:     IntegrityViolationNegativeItemAmount,
+			TargetID: item.ID,
+			Detail:   fmt.Sprintf("item %d has amount %d", item.ItemID, item.Amount),
+			Repaired: repair,
+		})
+		if repair {
+			if _, err = tx.Exec("UPDATE user_items SET amount=0, updated_at=? WHERE id=?", requestAt, item.ID); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+		}
+	}
+
+	// コインは0以上、かつ所持上限以下
+	if user.IsuCoin < 0 {
+		violations = append(violations, &IntegrityViolation{
+			Type:     IntegrityViolationNegativeCoin,
+			TargetID: user.ID,
+			Detail:   fmt.Sprintf("isu_coin is %d", user.IsuCoin),
+		})
+	}
+	if coinCap > 0 && user.IsuCoin > coinCap {
+		violations = append(violations, &IntegrityViolation{
+			Type:     IntegrityViolationCoinOverCap,
+			TargetID: user.ID,
+			Detail:   fmt.Sprintf("isu_coin %d exceeds cap %d", user.IsuCoin, coinCap),
+		})
+	}
+
+	if repair {
+		if err = tx.Commit(); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	return successResponse(c, &AdminUserIntegrityResponse{
+		UserID:     userID,
+		Repair:     repair,
+		Violations: violations,
+	})
+}
+
+type AdminUserIntegrityResponse struct {
+	UserID     int64                 `json:"userId"`
+	Repair     bool                  `json:"repair"`
+	Violations []*IntegrityViolation `json:"violations"`
+}
+
+type IntegrityViolation struct {
+	Type     string `json:"type"`
+	TargetID int64  `json:"targetId"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// adminSimulateGacha ガチャの抽選シミュレーション
+// DBへの書き込みは行わず、drawGachaと同じ抽選ロジックでn回抽選した結果の分布を返す
+// GET /admin/gacha/{gachaID}/simulate?n={n}
+func (h *Handler) adminSimulateGacha(c echo.Context) error {
+	ctx := dbContext(c)
+
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+	}
+
+	n := GachaSimulateDefaultCount
+	if nStr := c.QueryParam("n"); nStr != "" {
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n < 1 || n > GachaSimulateMaxCount {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("n should be between 1 and %d", GachaSimulateMaxCount))
+		}
+	}
+
+	gachaItemList, cumulative, err := h.getGachaItems(ctx, gachaID)
+	if err != nil {
+		if err == ErrGachaItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		if err == ErrInvalidGachaWeight {
+			return errorResponse(c, http.StatusUnprocessableEntity, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	sum := totalWeight(cumulative)
+
+	// 最大GachaSimulateMaxCount回抽選するため、結果は保持せずに件数だけを数える
+	counts := make(map[int64]int, len(gachaItemList))
+	rng := acquireRand()
+	eachGachaItem(gachaItemList, cumulative, n, rng, func(item *GachaItemMaster) {
+		counts[item.ID]++
+	})
+	releaseRand(rng)
+
+	results := make([]*GachaSimulateResult, 0, len(gachaItemList))
+	for _, v := range gachaItemList {
+		results = append(results, &GachaSimulateResult{
+			GachaItem:       v,
+			Count:           counts[v.ID],
+			ObservedRate:    float64(counts[v.ID]) / float64(n),
+			TheoreticalRate: float64(gachaItemWeight(v)) / float64(sum),
+		})
+	}
+
+	return successResponse(c, &AdminSimulateGachaResponse{
+		GachaID: gachaID,
+		N:       n,
+		Results: results,
+	})
+}
+
+type AdminSimulateGachaResponse struct {
+	GachaID int64                  `json:"gachaId"`
+	N       int                    `json:"n"`
+	Results []*GachaSimulateResult `json:"results"`
+}
+
+type GachaSimulateResult struct {
+	GachaItem       *GachaItemMaster `json:"gachaItem"`
+	Count           int              `json:"count"`
+	ObservedRate    float64          `json:"observedRate"`
+	TheoreticalRate float64          `json:"theoreticalRate"`
+}
+
+// adminGachaStats ガチャの実際の排出統計
+// 全シャードの抽選履歴を並列に集計し、設定されたweightから求めた理論値と比較する
+// GET /admin/gacha/{gachaID}/stats?from=&to=
+func (h *Handler) adminGachaStats(c echo.Context) error {
+	ctx := dbContext(c)
+
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+	}
+
+	from := int64(0)
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid from"))
+		}
+	}
+	to := int64(math.MaxInt64)
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid to"))
+		}
+	}
+	if from > to {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("from should be less than or equal to to"))
+	}
+
+	// weightが不正なガチャも統計は確認できるよう、キャッシュを通さずマスタを直接引く
+	gachaItemList := make([]*GachaItemMaster, 0)
+	if err := h.DB.SelectContext(ctx, &gachaItemList, "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC", gachaID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if len(gachaItemList) == 0 {
+		return errorResponse(c, http.StatusNotFound, ErrGachaItemNotFound)
+	}
+
+	wg := sync.WaitGroup{}
+	errCh := make(chan error, len(h.DBs))
+	countCh := make(chan []*gachaDrawCount, len(h.DBs))
+
+	defer close(errCh)
+	defer close(countCh)
+
+	for _, db := range h.DBs {
+		wg.Add(1)
+		go func(db *sqlx.DB) {
+			defer wg.Done()
+
+			counts := make([]*gachaDrawCount, 0)
+			query := "SELECT gacha_item_id, COUNT(*) AS cnt FROM user_gacha_draw_histories WHERE gacha_id=? AND drawn_at BETWEEN ? AND ? GROUP BY gacha_item_id"
+			if err := db.SelectContext(ctx, &counts, query, gachaID, from, to); err != nil {
+				errCh <- err
+				return
+			}
+			countCh <- counts
+		}(db)
+	}
+
+	wg.Wait()
+	if len(errCh) > 0 {
+		return errorResponse(c, http.StatusInternalServerError, <-errCh)
+	}
+
+	// シャードごとの集計結果をマージする
+	counts := make(map[int64]int64, len(gachaItemList))
+	var total int64
+	for i := 0; i < len(h.DBs); i++ {
+		for _, v := range <-countCh {
+			counts[v.GachaItemID] += v.Count
+			total += v.Count
+		}
+	}
+
+	var sum int64
+	for _, v := range gachaItemList {
+		sum += gachaItemWeight(v)
+	}
+
+	results := make([]*GachaStatsResult, 0, len(gachaItemList))
+	for _, v := range gachaItemList {
+		result := &GachaStatsResult{
+			GachaItem: v,
+			Count:     counts[v.ID],
+		}
+		if total > 0 {
+			result.ObservedRate = float64(counts[v.ID]) / float64(total)
+		}
+		if sum > 0 {
+			result.TheoreticalRate = float64(gachaItemWeight(v)) / float64(sum)
+		}
+		results = append(results, result)
+	}
+
+	return successResponse(c, &AdminGachaStatsResponse{
+		GachaID: gachaID,
+		From:    from,
+		To:      to,
+		Total:   total,
+		Results: results,
+	})
+}
+
+type gachaDrawCount struct {
+	GachaItemID int64 `db:"gacha_item_id"`
+	Count       int64 `db:"cnt"`
+}
+
+type AdminGachaStatsResponse struct {
+	GachaID int64               `json:"gachaId"`
+	From    int64               `json:"from"`
+	To      int64               `json:"to"`
+	Total   int64               `json:"total"`
+	Results []*GachaStatsResult `json:"results"`
+}
+
+type GachaStatsResult struct {
+	GachaItem       *GachaItemMaster `json:"gachaItem"`
+	Count           int64            `json:"count"`
+	ObservedRate    float64          `json:"observedRate"`
+	TheoreticalRate float64          `json:"theoreticalRate"`
+}
+
+// adminClearCache このプロセスのマスタデータとワンタイムトークンのキャッシュをクリアする
+// DBを手で修正した後などに、DBを作り直さずにキャッシュだけを捨てるためのもの
+// トークンはメインのDBに書いてユーザーのシャードで検証するため、シャードがメインのDBと異なる構成では
+// キャッシュしていた発行済みのトークンが使えなくなる。その場合はレスポンスのwarningで知らせる
+// fanout=1 の場合は各シャードのホストにも同じリクエストを送る
+// POST /admin/cache/clear
+func (h *Handler) adminClearCache(c echo.Context) error {
+	masterStats := h.Cache.Stats()
+	h.Cache.Clear()
+	tokens := h.TokenCache.Clear()
+
+	res := &AdminClearCacheResponse{
+		MasterData: masterStats,
+		Tokens:     tokens,
+	}
+	if tokens > 0 && h.hasShardOutsideMainDB() {
+		res.Warning = ClearCacheTokensWarning
+	}
+
+	if c.QueryParam("fanout") == "1" {
+		res.Hosts = clearCacheOnHosts(c.Request().Header.Get("x-session"))
+	}
+
+	return successResponse(c, res)
+}
+
+// ClearCacheTokensWarning キャッシュしていたトークンがDBで検証できず、使えなくなる場合の警告
+const ClearCacheTokensWarning = "cleared tokens of users whose shard is not the main db can no longer be used until reissued"
+
+// hasShardOutsideMainDB メインのDBとは別のDBをシャードに使っているか
+func (h *Handler) hasShardOutsideMainDB() bool {
+	for _, db := range h.DBs {
+		if db != h.DB {
+			return true
+		}
+	}
+	return false
+}
+
+// adminFanoutClient 各ホストへの転送に使うクライアント。応答しないホストで管理者のリクエストが止まらないようタイムアウトを設定する
+var adminFanoutClient = &http.Client{Timeout: time.Duration(getEnvInt("ISUCON_ADMIN_FANOUT_TIMEOUT_MS", 5000)) * time.Millisecond}
+
+// clearCacheOnHosts 各シャードのホストにキャッシュのクリアを依頼する
+// 転送先でさらに転送しないよう、fanoutは付けずに送る
+func clearCacheOnHosts(sessID string) []*HostClearCacheResult {
+	results := make([]*HostClearCacheResult, len(dbHosts))
+	wg := sync.WaitGroup{}
+
+	for i, host := range dbHosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+
+			result := &HostClearCacheResult{Host: host}
+			results[i] = result
+
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:8080/admin/cache/clear", host), nil)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			req.Header.Set("x-session", sessID)
+
+			resp, err := adminFanoutClient.Do(req)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				result.Error = fmt.Sprintf("CODE: %d", resp.StatusCode)
+				return
+			}
+			cleared := new(AdminClearCacheResponse)
+			if err := json.NewDecoder(resp.Body).Decode(cleared); err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.MasterData = cleared.MasterData
+			result.Tokens = cleared.Tokens
+			result.Warning = cleared.Warning
+		}(i, host)
+	}
+
+	wg.Wait()
+	return results
+}
+
+type AdminClearCacheResponse struct {
+	MasterData *MasterDataCacheStats   `json:"masterData"`
+	Tokens     int                     `json:"tokens"`
+	Warning    string                  `json:"warning,omitempty"`
+	Hosts      []*HostClearCacheResult `json:"hosts,omitempty"`
+}
+
+type HostClearCacheResult struct {
+	Host       string                `json:"host"`
+	MasterData *MasterDataCacheStats `json:"masterData,omitempty"`
+	Tokens     int                   `json:"tokens"`
+	Warning    string                `json:"warning,omitempty"`
+	Error      string                `json:"error,omitempty"`
+}
+
+// adminDecodeID snowflake IDを分解し、埋め込まれた時刻・ノード・シーケンスと振り分け先のシャードを返す
+// シャードの振り分けを間違えたデータの調査用
+// GET /admin/id/{id}/decode
+func (h *Handler) adminDecodeID(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid id"))
+	}
+
+	sid := snowflake.ParseInt64(id)
+	res := &AdminDecodeIDResponse{
+		ID:          id,
+		Epoch:       snowflake.Epoch,
+		TimestampMs: sid.Time(),
+		Node:        sid.Node(),
+		Step:        sid.Step(),
+		ShardIndex:  -1,
+	}
+	if len(h.DBs) > 0 {
+		res.ShardIndex = h.getShardIndex(id)
+	}
+
+	return successResponse(c, res)
+}
+
+type AdminDecodeIDResponse struct {
+	ID          int64 `json:"id"`
+	Epoch       int64 `json:"epoch"`
+	TimestampMs int64 `json:"timestampMs"`
+	Node        int64 `json:"node"`
+	Step        int64 `json:"step"`
+	ShardIndex  int   `json:"shardIndex"`
+}
+
 // hashPassword パスワードをハッシュ化する
 //
 //nolint:deadcode,unused
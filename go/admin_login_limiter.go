@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// //////////////////////////////////////
+// admin login limiter
+
+// AdminLoginLimiter 管理者ログインの失敗回数をキー(接続元IP・管理者ID)ごとに数え、失敗が続いたキーをロックする
+// maxFailures回失敗すると baseLockout、以降は失敗するたびに倍の期間(maxLockoutまで)ロックする
+// 最後の失敗からmaxLockoutが経過したキーは失敗回数を忘れる
+type AdminLoginLimiter struct {
+	mu          sync.Mutex
+	maxFailures int
+	baseLockout time.Duration
+	maxLockout  time.Duration
+	maxKeys     int
+	failures    map[string]*adminLoginFailure
+}
+
+type adminLoginFailure struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewAdminLoginLimiter 設定に応じてリミッタを作成する
+// ISUCON_ADMIN_LOGIN_MAX_FAILURES が0以下の場合はロックしない
+func NewAdminLoginLimiter() *AdminLoginLimiter {
+	baseLockout := time.Duration(getEnvInt("ISUCON_ADMIN_LOGIN_LOCKOUT_SEC", 30)) * time.Second
+	maxLockout := time.Duration(getEnvInt("ISUCON_ADMIN_LOGIN_MAX_LOCKOUT_SEC", 3600)) * time.Second
+	if maxLockout < baseLockout {
+		maxLockout = baseLockout
+	}
+	return &AdminLoginLimiter{
+		maxFailures: getEnvInt("ISUCON_ADMIN_LOGIN_MAX_FAILURES", 5),
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+		maxKeys:     getEnvInt("ISUCON_ADMIN_LOGIN_MAX_KEYS", 10000),
+		failures:    make(map[string]*adminLoginFailure),
+	}
+}
+
+// Attempt ログインの試行を受け付ける。いずれかのキーがロック中の場合は受け付けず、ロックが解けるまでの時間を返す
+// 並行したリクエストがロックの確認と失敗の記録の間をすり抜けて何度でも試せないよう、
+// 受け付けた試行は確認と同じロックの中で先に失敗として数え、認証に成功した場合にSucceedで消す
+func (l *AdminLoginLimiter) Attempt(now time.Time, keys ...string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok {
+			continue
+		}
+		if wait := f.lockedUntil.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+
+	l.fail(now, keys...)
+	return 0, true
+}
+
+// fail ログインの失敗を記録する。l.muを取ってから呼ぶこと
+func (l *AdminLoginLimiter) fail(now time.Time, keys ...string) {
+	if l.maxFailures <= 0 {
+		return
+	}
+
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok || now.Sub(f.lastFailure) > l.maxLockout {
+			if !ok && l.maxKeys > 0 && len(l.failures) >= l.maxKeys {
+				l.evict(now)
+			}
+			f = &adminLoginFailure{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.lastFailure = now
+		if f.count >= l.maxFailures {
+			f.lockedUntil = now.Add(l.lockoutDuration(f.count))
+		}
+	}
+}
+
+// Succeed ログインに成功したキーの失敗回数を消す
+func (l *AdminLoginLimiter) Succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// lockoutDuration 失敗回数に応じたロックの期間
+func (l *AdminLoginLimiter) lockoutDuration(count int) time.Duration {
+	d := l.baseLockout
+	for i := l.maxFailures; i < count && d < l.maxLockout; i++ {
+		d *= 2
+	}
+	if d > l.maxLockout {
+		d = l.maxLockout
+	}
+	return d
+}
+
+// evict 失敗回数を忘れてよいキーを取り除く。それでも上限に達している場合は、最も古く失敗したキーを取り除く
+func (l *AdminLoginLimiter) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, f := range l.failures {
+		if now.Sub(f.lastFailure) > l.maxLockout {
+			delete(l.failures, key)
+			continue
+		}
+		if oldestKey == "" || f.lastFailure.Before(oldest) {
+			oldestKey, oldest = key, f.lastFailure
+		}
+	}
+	if len(l.failures) >= l.maxKeys && oldestKey != "" {
+		delete(l.failures, oldestKey)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestAdminLoginLimiter(maxFailures int) *AdminLoginLimiter {
+	return &AdminLoginLimiter{
+		maxFailures: maxFailures,
+		baseLockout: 30 * time.Second,
+		maxLockout:  time.Hour,
+		maxKeys:     100,
+		failures:    make(map[string]*adminLoginFailure),
+	}
+}
+
+func TestAdminLoginLimiterLocksAfterMaxFailures(t *testing.T) {
+	l := newTestAdminLoginLimiter(3)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.Attempt(now, "user:1"); !ok {
+			t.Fatalf("attempt %d was rejected before reaching the limit", i+1)
+		}
+	}
+	retryAfter, ok := l.Attempt(now, "user:1")
+	if ok {
+		t.Fatal("attempt after 3 failures was accepted")
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("retryAfter = %s, want 30s", retryAfter)
+	}
+
+	// 別のキーはロックされない
+	if _, ok := l.Attempt(now, "user:2"); !ok {
+		t.Error("another key was locked")
+	}
+}
+
+func TestAdminLoginLimiterLockoutExpires(t *testing.T) {
+	l := newTestAdminLoginLimiter(3)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		l.Attempt(now, "user:1")
+	}
+
+	if _, ok := l.Attempt(now.Add(29*time.Second), "user:1"); ok {
+		t.Fatal("accepted before the lockout expired")
+	}
+	if _, ok := l.Attempt(now.Add(30*time.Second), "user:1"); !ok {
+		t.Fatal("rejected after the lockout expired")
+	}
+	// 続けて失敗したため、次のロックは倍の期間になる
+	retryAfter, ok := l.Attempt(now.Add(30*time.Second), "user:1")
+	if ok || retryAfter != time.Minute {
+		t.Errorf("Attempt = (%s, %t), want (1m, false)", retryAfter, ok)
+	}
+}
+
+func TestAdminLoginLimiterSucceedResets(t *testing.T) {
+	l := newTestAdminLoginLimiter(3)
+	now := time.Unix(1000, 0)
+	l.Attempt(now, "user:1")
+	l.Attempt(now, "user:1")
+	l.Succeed("user:1")
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.Attempt(now, "user:1"); !ok {
+			t.Fatalf("attempt %d after success was rejected", i+1)
+		}
+	}
+}
+
+func TestAdminLoginLimiterConcurrentAttempts(t *testing.T) {
+	l := newTestAdminLoginLimiter(5)
+	now := time.Unix(1000, 0)
+
+	var mu sync.Mutex
+	accepted := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := l.Attempt(now, "ip:192.0.2.1", "user:1"); ok {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 5 {
+		t.Errorf("accepted %d parallel attempts, want 5", accepted)
+	}
+}
+
+func TestAdminLoginLimiterDisabled(t *testing.T) {
+	l := newTestAdminLoginLimiter(0)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		if _, ok := l.Attempt(now, "user:1"); !ok {
+			t.Fatal("attempt was rejected while the limiter is disabled")
+		}
+	}
+}
+
+func TestIPExtractorIgnoresClientHeaders(t *testing.T) {
+	t.Setenv("ISUCON_TRUST_PROXY_XFF", "")
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/login", nil)
+	req.RemoteAddr = "192.0.2.1:12345"
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1")
+	req.Header.Set(echo.HeaderXRealIP, "198.51.100.2")
+
+	if ip := ipExtractor()(req); ip != "192.0.2.1" {
+		t.Errorf("ip = %s, want 192.0.2.1", ip)
+	}
+}
+
+func TestIPExtractorTrustsOnlyProxyAppendedAddress(t *testing.T) {
+	t.Setenv("ISUCON_TRUST_PROXY_XFF", "1")
+
+	// nginxが手前に付け足したアドレスだけを使い、クライアントが送った左側のアドレスは使わない
+	req := httptest.NewRequest(http.MethodPost, "/admin/login", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1, 192.0.2.1")
+
+	if ip := ipExtractor()(req); ip != "192.0.2.1" {
+		t.Errorf("ip = %s, want 192.0.2.1", ip)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestEndOfPreviousDay(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+
+	tests := []struct {
+		name      string
+		requestAt time.Time
+		want      time.Time
+	}{
+		{
+			name:      "jst",
+			requestAt: time.Date(2022, 8, 27, 0, 0, 0, 0, jst),
+			want:      time.Date(2022, 8, 26, 23, 59, 59, 0, jst),
+		},
+		// 夏時間が終わる日は25時間あり、24時間前はまだ当日になる
+		{
+			name:      "25-hour day",
+			requestAt: time.Date(2024, 11, 3, 23, 30, 0, 0, newYork),
+			want:      time.Date(2024, 11, 2, 23, 59, 59, 0, newYork),
+		},
+	}
+	for _, tt := range tests {
+		loc := tt.requestAt.Location()
+		got := endOfPreviousDay(tt.requestAt.Unix(), loc)
+		if got != tt.want.Unix() {
+			t.Errorf("%s: endOfPreviousDay = %s, want %s", tt.name, time.Unix(got, 0).In(loc), tt.want)
+		}
+		if isCompleteTodayLogin(time.Unix(got, 0), tt.requestAt, loc) {
+			t.Errorf("%s: %s is still the same day as %s", tt.name, time.Unix(got, 0).In(loc), tt.requestAt)
+		}
+	}
+}
+
+// newTestIntegrityDB 装備中のデッキが2つあり、新しい方が手放したカード13を含み、
+// アイテムの所持数が負で、コインが所持上限を超えたユーザー100に応答する
+func newTestIntegrityDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM users", []string{"id", "isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(150)}}
+	})
+	fake.onQuery("FROM user_decks", []string{"id", "user_id", "user_card_id_1", "user_card_id_2", "user_card_id_3"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(2), args[0], int64(11), int64(12), int64(13)},
+			{int64(1), args[0], int64(11), int64(12), int64(14)},
+		}
+	})
+	fake.onQuery("FROM user_cards", []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11)}, {int64(12)}}
+	})
+	fake.onQuery("FROM user_items", []string{"id", "user_id", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(5), args[0], int64(10), int64(-3)}}
+	})
+	fake.onExec("UPDATE user_decks", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestAdminCheckUserIntegrity(t *testing.T) {
+	prev := coinCap
+	coinCap = 100
+	t.Cleanup(func() { coinCap = prev })
+
+	for _, repair := range []bool{false, true} {
+		fake := newTestIntegrityDB()
+		h := &Handler{DBs: []*sqlx.DB{fake.open()}}
+		path := "/admin/user/100/integrity"
+		if repair {
+			path += "?repair=1"
+		}
+
+		rec := getJSON("/admin/user/:userID/integrity", h.adminCheckUserIntegrity, path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("repair=%v: status = %d, body = %s", repair, rec.Code, rec.Body.String())
+		}
+		res := new(AdminUserIntegrityResponse)
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []struct {
+			typ      string
+			targetID int64
+			repaired bool
+		}{
+			{typ: IntegrityViolationDuplicateActiveDeck, targetID: 1, repaired: repair},
+			{typ: IntegrityViolationDanglingDeckCard, targetID: 2, repaired: repair},
+			{typ: IntegrityViolationNegativeItemAmount, targetID: 5, repaired: repair},
+			// コインは修正しない
+			{typ: IntegrityViolationCoinOverCap, targetID: 100, repaired: false},
+		}
+		if len(res.Violations) != len(want) {
+			t.Fatalf("repair=%v: body = %s, want %d violations", repair, rec.Body.String(), len(want))
+		}
+		for i, w := range want {
+			v := res.Violations[i]
+			if v.Type != w.typ || v.TargetID != w.targetID || v.Repaired != w.repaired {
+				t.Errorf("repair=%v: violation %d = %+v, want %+v", repair, i, v, w)
+			}
+		}
+
+		if !repair {
+			// レポートのみの場合は何も書き込まない
+			if fake.executed("UPDATE") != 0 || fake.discarded("UPDATE") != 0 {
+				t.Errorf("report: committed = %v, want no writes", fake.committed)
+			}
+			continue
+		}
+		// 重複したデッキと手放したカードを含むデッキを外し、負の所持数を0に戻す
+		if fake.executed("UPDATE user_decks") != 2 || fake.executed("UPDATE user_items SET amount=0") != 1 || fake.executed("UPDATE users") != 0 {
+			t.Errorf("repair: committed = %v, want both decks cleared and the item reset", fake.committed)
+		}
+	}
+}
+
+// newTestCoinGrantDB コインの一括付与のUPDATEを、usersの所持コインに対して再現する
+func newTestCoinGrantDB(mu *sync.Mutex, coins map[int64]int64) *fakeSQL {
+	// 引数は付与数(, 上限), updated_at, ユーザーIDの順
+	grant := func(newCoin func(coin, amount int64, args []driver.Value) int64, idsFrom int) func(args []driver.Value) (int64, error) {
+		return func(args []driver.Value) (int64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			changed := int64(0)
+			for _, id := range args[idsFrom:] {
+				coin, ok := coins[id.(int64)]
+				if !ok {
+					continue
+				}
+				if next := newCoin(coin, args[0].(int64), args); next != coin {
+					coins[id.(int64)] = next
+					changed++
+				}
+			}
+			return changed, nil
+		}
+	}
+	fake := &fakeSQL{}
+	fake.onExec("GREATEST(isu_coin, LEAST(isu_coin + ?, ?))", grant(func(coin, amount int64, args []driver.Value) int64 {
+		capped := coin + amount
+		if limit := args[1].(int64); capped > limit {
+			capped = limit
+		}
+		if capped < coin {
+			return coin
+		}
+		return capped
+	}, 3))
+	fake.onExec("isu_coin = isu_coin + ?", grant(func(coin, amount int64, args []driver.Value) int64 {
+		return coin + amount
+	}, 2))
+	fake.onExec("INSERT INTO events_outbox", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestAdminGrantCoinsRespectsCap(t *testing.T) {
+	prev := coinCap
+	t.Cleanup(func() { coinCap = prev })
+
+	for _, limit := range []int64{1000, 0} {
+		coinCap = limit
+		var mu sync.Mutex
+		// 1と2はシャード0、1<<23はシャード1
+		coins := map[int64]int64{1: 100, 2: 1200, 1 << 23: 900}
+		shards := []*fakeSQL{newTestCoinGrantDB(&mu, coins), newTestCoinGrantDB(&mu, coins)}
+		h := &Handler{DBs: []*sqlx.DB{shards[0].open(), shards[1].open()}, Jobs: NewJobs()}
+
+		rec := postJSON("/admin/coins/grant", h.adminGrantCoins, "/admin/coins/grant", `{"userIds":[1,2,8388608],"amount":500}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("cap=%d: status = %d, body = %s", limit, rec.Code, rec.Body.String())
+		}
+		res := new(AdminGrantCoinsResponse)
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[int64]int64{1: 600, 2: 1700, 1 << 23: 1400}
+		wantUpdated := int64(3)
+		if limit > 0 {
+			// 上限で止め、既に上限を超えているユーザーのコインは減らさない
+			want = map[int64]int64{1: 600, 2: 1200, 1 << 23: 1000}
+			wantUpdated = 2
+		}
+		for id, coin := range want {
+			if coins[id] != coin {
+				t.Errorf("cap=%d: user %d has %d coins, want %d", limit, id, coins[id], coin)
+			}
+		}
+		if res.TotalUpdated != wantUpdated || len(res.Shards) != 2 {
+			t.Errorf("cap=%d: response = %s, want %d users updated over 2 shards", limit, rec.Body.String(), wantUpdated)
+		}
+		for i, shard := range shards {
+			if shard.executed("UPDATE users") != 1 {
+				t.Errorf("cap=%d: shard %d committed = %v, want one batch committed", limit, i, shard.committed)
+			}
+		}
+	}
+}
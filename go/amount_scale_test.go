@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFormatScaledAmount(t *testing.T) {
+	tests := []struct {
+		amount int64
+		scale  int64
+		want   string
+	}{
+		{amount: 7, scale: 1, want: "7"},
+		{amount: 1250, scale: 1000, want: "1.25"},
+		{amount: 1001, scale: 1000, want: "1.001"},
+		{amount: 5, scale: 1000, want: "0.005"},
+		{amount: 3000, scale: 1000, want: "3"},
+		{amount: 999999999999999, scale: 1000, want: "999999999999.999"},
+		{amount: 123456789, scale: 1000000, want: "123.456789"},
+		{amount: -1500, scale: 1000, want: "-1.5"},
+		// 10のべき乗でない単位は10進数で割り切れないため分数で返す
+		{amount: 7, scale: 3, want: "2+1/3"},
+		{amount: 9, scale: 3, want: "3"},
+	}
+	for _, tt := range tests {
+		if got := formatScaledAmount(tt.amount, tt.scale); got != tt.want {
+			t.Errorf("formatScaledAmount(%d, %d) = %s, want %s", tt.amount, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestSplitScaledAmountKeepsPrecision(t *testing.T) {
+	// 1/1000ずつ1000回付与すると、ちょうど1になり端数は残らない
+	var whole, fraction int64
+	for i := 0; i < 1000; i++ {
+		var w int64
+		w, fraction = splitScaledAmount(fraction, 1, 1000)
+		whole += w
+	}
+	if whole != 1 || fraction != 0 {
+		t.Errorf("1000 grants of 0.001 = (%d, %d), want (1, 0)", whole, fraction)
+	}
+
+	// 整数部と端数から元の値を復元でき、表示でも桁が失われない
+	whole, fraction = splitScaledAmount(999, 123456789, 1000)
+	if whole != 123457 || fraction != 788 {
+		t.Errorf("splitScaledAmount = (%d, %d), want (123457, 788)", whole, fraction)
+	}
+	if got := formatScaledAmount(whole*1000+fraction, 1000); got != "123457.788" {
+		t.Errorf("display = %s, want 123457.788", got)
+	}
+}
+
+// newTestScaledHandler 端数単位のアイテムマスタをキャッシュに入れたハンドラ。DBには問い合わせない
+func newTestScaledHandler() *Handler {
+	h := &Handler{Cache: newTestMasterDataCache()}
+	scale1000, scale100 := 1000, 100
+	h.Cache.SetItemMaster(&ItemMaster{ID: 1, ItemType: ItemTypeCoin, AmountScale: &scale1000})
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA, AmountScale: &scale100})
+	h.Cache.SetItemMaster(&ItemMaster{ID: 11, ItemType: ItemTypeEnhanceA})
+	return h
+}
+
+func TestFillPresentDisplayAmounts(t *testing.T) {
+	h := newTestScaledHandler()
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeCoin, ItemID: 1, Amount: 1250},
+		{ID: 2, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 5},
+		{ID: 3, ItemType: ItemTypeEnhanceA, ItemID: 11, Amount: 5},
+		{ID: 4, ItemType: ItemTypeCard, ItemID: 2, Amount: 1},
+	}
+
+	if err := h.fillPresentDisplayAmounts(context.Background(), presents); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.25", "0.05", "", ""}
+	for i, p := range presents {
+		if p.DisplayAmount != want[i] {
+			t.Errorf("present %d displayAmount = %q, want %q", p.ID, p.DisplayAmount, want[i])
+		}
+	}
+
+	// 端数なしのアイテムはこれまでと同じレスポンスになる
+	b, err := json.Marshal(presents[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "displayAmount") {
+		t.Errorf("unscaled present = %s, want no displayAmount", b)
+	}
+}
+
+func TestFillGachaItemDisplayAmounts(t *testing.T) {
+	h := newTestScaledHandler()
+	items := []*GachaItemMaster{
+		{ID: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 250},
+		{ID: 2, ItemType: ItemTypeEnhanceA, ItemID: 11, Amount: 3},
+	}
+
+	if err := h.fillGachaItemIcons(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	if items[0].DisplayAmount != "2.5" || items[1].DisplayAmount != "" {
+		t.Errorf("displayAmounts = [%q %q], want [\"2.5\" \"\"]", items[0].DisplayAmount, items[1].DisplayAmount)
+	}
+}
+
+func TestListItemDisplayAmountIncludesFraction(t *testing.T) {
+	h := newTestScaledHandler()
+	columns := []string{"id", "user_id", "item_type", "item_id", "amount", "created_at", "updated_at", "deleted_at"}
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_items", columns, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), int64(100), int64(ItemTypeEnhanceA), int64(10), int64(3), int64(0), int64(0), nil},
+			{int64(2), int64(100), int64(ItemTypeEnhanceA), int64(11), int64(4), int64(0), int64(0), nil},
+		}
+	})
+	rows, err := fake.open().Queryx("SELECT * FROM user_items WHERE user_id = ?", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	fill := h.itemDisplayAmountFiller(context.Background(), []*UserItemFraction{{ItemID: 10, Fraction: 5}})
+	var buf bytes.Buffer
+	if err := writeListItemResponse(&buf, "token", &User{ID: 100}, rows, nil, map[string]bool{"items": true}, fill); err != nil {
+		t.Fatal(err)
+	}
+
+	res := new(ListItemResponse)
+	if err := json.Unmarshal(buf.Bytes(), res); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if len(res.Items) != 2 {
+		t.Fatalf("items = %d, want 2", len(res.Items))
+	}
+	if res.Items[0].Amount != 3 || res.Items[0].DisplayAmount != "3.05" {
+		t.Errorf("scaled item = amount %d, displayAmount %q, want 3 and 3.05", res.Items[0].Amount, res.Items[0].DisplayAmount)
+	}
+	if res.Items[1].DisplayAmount != "" {
+		t.Errorf("unscaled item displayAmount = %q, want none", res.Items[1].DisplayAmount)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// //////////////////////////////////////
+// gacha animation seed
+
+var (
+	// gachaAnimationSeedEnabled 抽選結果の演出用のシードを返すかどうか
+	gachaAnimationSeedEnabled = getEnv("ISUCON_GACHA_ANIMATION_SEED", "1") == "1"
+	// animationSeedKey シードを抽選IDから求めるための鍵
+	// 未設定の場合は固定の鍵を使い、全台・再起動をまたいでも同じ抽選には同じシードを返す
+	// シードは抽選に使った乱数と無関係なため、鍵が知られても抽選結果は推測できない。シードを第三者に推測させたくない場合のみISUCON_GACHA_ANIMATION_SEED_KEYを設定する
+	animationSeedKey = loadAnimationSeedKey()
+)
+
+// defaultAnimationSeedKey ISUCON_GACHA_ANIMATION_SEED_KEYが未設定の場合の鍵
+const defaultAnimationSeedKey = "isucon12-gacha-animation-seed"
+
+// loadAnimationSeedKey シードを求めるための鍵を取得する
+func loadAnimationSeedKey() []byte {
+	return []byte(getEnv("ISUCON_GACHA_ANIMATION_SEED_KEY", defaultAnimationSeedKey))
+}
+
+// gachaAnimationSeed 抽選ごとの演出用のシードを求める
+// クライアントはこのシードで演出の乱数を初期化することで、サーバーの抽選結果の順に沿った演出を再現できる
+// シードは抽選IDの鍵付きハッシュで、抽選に使った乱数とは無関係なため、シードから以降の抽選結果を推測することはできない
+// 同じ抽選には常に同じシードを返すが、演出1回分のためのもので、別の抽選に使い回すものではない
+func gachaAnimationSeed(drawID int64) string {
+	if !gachaAnimationSeedEnabled {
+		return ""
+	}
+	mac := hmac.New(sha256.New, animationSeedKey)
+	mac.Write([]byte(strconv.FormatInt(drawID, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
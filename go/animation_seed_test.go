@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestGachaAnimationSeedStableOnReplay(t *testing.T) {
+	prevKey := animationSeedKey
+	t.Cleanup(func() { animationSeedKey = prevKey })
+
+	t.Setenv("ISUCON_GACHA_ANIMATION_SEED_KEY", "")
+	animationSeedKey = loadAnimationSeedKey()
+	seed := gachaAnimationSeed(123)
+	if seed == "" {
+		t.Fatal("seed is empty")
+	}
+
+	// 再起動や別の台で鍵を読み直しても、同じ抽選には同じシードを返す
+	animationSeedKey = loadAnimationSeedKey()
+	if replayed := gachaAnimationSeed(123); replayed != seed {
+		t.Errorf("replayed seed = %s, want %s", replayed, seed)
+	}
+	if other := gachaAnimationSeed(124); other == seed {
+		t.Errorf("draws 123 and 124 share the seed %s", seed)
+	}
+
+	// 鍵を設定した場合はその鍵で求め、読み直しても変わらない
+	t.Setenv("ISUCON_GACHA_ANIMATION_SEED_KEY", "secret")
+	animationSeedKey = loadAnimationSeedKey()
+	keyed := gachaAnimationSeed(123)
+	if keyed == seed {
+		t.Errorf("seed with a key = %s, want it to differ from the default key", keyed)
+	}
+	animationSeedKey = loadAnimationSeedKey()
+	if replayed := gachaAnimationSeed(123); replayed != keyed {
+		t.Errorf("replayed seed with a key = %s, want %s", replayed, keyed)
+	}
+}
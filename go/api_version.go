@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// api version
+
+const (
+	// APIVersion1 エラーはstatus_codeとmessageのみ
+	APIVersion1 int = 1
+	// APIVersion2 エラーにcodeを追加し、クライアントがmessageの文言に依存せずに分岐できるようにしたもの
+	APIVersion2 int = 2
+
+	// DefaultAPIVersion Accept-Versionが指定されていない場合のバージョン。既存のクライアントのため当面は1のまま
+	DefaultAPIVersion int = APIVersion1
+	// LatestAPIVersion 対応している最新のバージョン
+	LatestAPIVersion int = APIVersion2
+)
+
+// apiVersionMiddleware Accept-Versionヘッダでレスポンスの形式のバージョンを決め、X-Api-Versionで返す
+// 未指定・解釈できない場合はDefaultAPIVersion、対応していない新しいバージョンの場合はLatestAPIVersionとする
+func apiVersionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		version := DefaultAPIVersion
+		if v, err := strconv.Atoi(c.Request().Header.Get("Accept-Version")); err == nil && v >= APIVersion1 {
+			version = v
+			if version > LatestAPIVersion {
+				version = LatestAPIVersion
+			}
+		}
+		c.Set("apiVersion", version)
+		c.Response().Header().Set("X-Api-Version", strconv.Itoa(version))
+		return next(c)
+	}
+}
+
+// getAPIVersion リクエストで決まったレスポンスの形式のバージョンを取得する
+func getAPIVersion(c echo.Context) int {
+	if v, ok := c.Get("apiVersion").(int); ok {
+		return v
+	}
+	return DefaultAPIVersion
+}
+
+// errorCodes エラーごとのコード。バージョン2以降のエラーレスポンスのcodeとして返す
+var errorCodes = map[error]string{
+	ErrInvalidRequestBody:       "invalid_request_body",
+	ErrInvalidMasterVersion:     "invalid_master_version",
+	ErrPartialMasterActivation:  "partial_master_activation",
+	ErrInvalidItemType:          "invalid_item_type",
+	ErrInvalidPlatformType:      "invalid_platform_type",
+	ErrInvalidToken:             "invalid_token",
+	ErrTokenNotFound:            "token_not_found",
+	ErrTokenExpired:             "token_expired",
+	ErrTokenTypeMismatch:        "token_type_mismatch",
+	ErrExpiredSession:           "session_expired",
+	ErrUserNotFound:             "user_not_found",
+	ErrUserDeviceNotFound:       "user_device_not_found",
+	ErrItemNotFound:             "item_not_found",
+	ErrGachaNotFound:            "gacha_not_found",
+	ErrGachaItemNotFound:        "gacha_item_not_found",
+	ErrGachaDrawNotFound:        "gacha_draw_not_found",
+	ErrGachaAlreadyRerolled:     "gacha_already_rerolled",
+	ErrGachaPresentReceived:     "gacha_present_received",
+	ErrNotEnoughCoin:            "not_enough_coin",
+	ErrLoginBonusRewardNotFound: "login_bonus_reward_not_found",
+	ErrUnauthorized:             "unauthorized",
+	ErrForbidden:                "forbidden",
+	ErrShardBusy:                "shard_busy",
+	ErrInvalidDeckCards:         "invalid_deck_cards",
+	ErrDeckCardMissing:          "deck_card_missing",
+	ErrInvalidDeckPresetName:    "invalid_deck_preset_name",
+	ErrDeckPresetNotFound:       "deck_preset_not_found",
+	ErrDeckPresetLimitExceeded:  "deck_preset_limit_exceeded",
+	ErrInvalidUserName:          "invalid_user_name",
+	ErrUserNameTaken:            "user_name_taken",
+	ErrCardEquipped:             "card_equipped",
+	ErrInvalidPresentAmount:     "invalid_present_amount",
+	ErrTooManyTokenIssues:       "too_many_token_issues",
+	ErrAdminLoginLocked:         "admin_login_locked",
+	ErrInvalidMergeSource:       "invalid_merge_source",
+	ErrInvalidFields:            "invalid_fields",
+}
+
+// errorCode エラーのコードを求める。個別のコードがないエラーはステータスコードから決める
+func errorCode(statusCode int, err error) string {
+	if code, ok := errorCodes[errors.Cause(err)]; ok {
+		return code
+	}
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		return "internal_error"
+	}
+}
+
+// responseErrorCode バージョン2以降の場合のみエラーのコードを返す。バージョン1では空文字で、レスポンスに含めない
+func responseErrorCode(c echo.Context, statusCode int, err error) string {
+	if getAPIVersion(c) < APIVersion2 {
+		return ""
+	}
+	return errorCode(statusCode, err)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+func TestErrorResponseByAPIVersion(t *testing.T) {
+	e := echo.New()
+	e.Use(apiVersionMiddleware)
+	e.GET("/known", func(c echo.Context) error {
+		return errorResponse(c, http.StatusNotFound, errors.Wrap(ErrUserNotFound, "userID=100"))
+	})
+	e.GET("/unknown", func(c echo.Context) error {
+		return errorResponse(c, http.StatusConflict, fmt.Errorf("something conflicted"))
+	})
+
+	tests := []struct {
+		name          string
+		path          string
+		acceptVersion string
+		wantVersion   string
+		wantCode      string
+	}{
+		{name: "default", path: "/known", wantVersion: "1"},
+		{name: "version 1", path: "/known", acceptVersion: "1", wantVersion: "1"},
+		{name: "unparsable", path: "/known", acceptVersion: "v2", wantVersion: "1"},
+		{name: "version 2", path: "/known", acceptVersion: "2", wantVersion: "2", wantCode: "user_not_found"},
+		{name: "newer than supported", path: "/known", acceptVersion: "9", wantVersion: "2", wantCode: "user_not_found"},
+		{name: "version 2 without a specific code", path: "/unknown", acceptVersion: "2", wantVersion: "2", wantCode: "conflict"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.acceptVersion != "" {
+			req.Header.Set("Accept-Version", tt.acceptVersion)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if v := rec.Header().Get("X-Api-Version"); v != tt.wantVersion {
+			t.Errorf("%s: X-Api-Version = %q, want %q", tt.name, v, tt.wantVersion)
+		}
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["status_code"] != float64(rec.Code) || body["message"] == "" {
+			t.Errorf("%s: body = %s, want status_code and message", tt.name, rec.Body.String())
+		}
+		// バージョン1ではcodeを含めない
+		code, ok := body["code"]
+		if tt.wantCode == "" && ok {
+			t.Errorf("%s: body = %s, want no code", tt.name, rec.Body.String())
+		}
+		if tt.wantCode != "" && code != tt.wantCode {
+			t.Errorf("%s: code = %v, want %q", tt.name, code, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCacheMissesIssueOneQuery(t *testing.T) {
+	var queries int32
+	fake := &fakeSQL{}
+	fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		atomic.AddInt32(&queries, 1)
+		// 他のリクエストが読み込みの完了を待つ間に到着するよう、読み込みを遅らせる
+		time.Sleep(50 * time.Millisecond)
+		return [][]driver.Value{{args[0], int64(ItemTypeEnhanceA)}}
+	})
+	h := &Handler{DB: fake.open(), Cache: newTestMasterDataCache()}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, err := h.getItemMaster(context.Background(), 10)
+			if err == nil && item.ID != 10 {
+				t.Errorf("item = %d, want 10", item.ID)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("20 concurrent misses issued %d queries, want 1", n)
+	}
+}
+
+func TestCancelledLeaderDoesNotFailWaitingLoads(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fake := &fakeSQL{}
+	fake.onQuery("FROM login_bonus_masters", []string{"id", "start_at", "end_at", "column_count", "looped"}, func(args []driver.Value) [][]driver.Value {
+		close(started)
+		<-release
+		return [][]driver.Value{{int64(1), int64(0), int64(2000), int64(7), false}}
+	})
+	h := &Handler{DB: fake.open(), Cache: newTestMasterDataCache()}
+
+	// 最初のリクエストが読み込みを始めた後に、後続のリクエストが同じ読み込みを待つ
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := h.getLoginBonuses(leaderCtx)
+		leaderErr <- err
+	}()
+	<-started
+	followerErr := make(chan error, 1)
+	var follower []*LoginBonusMaster
+	go func() {
+		var err error
+		follower, err = h.getLoginBonuses(context.Background())
+		followerErr <- err
+	}()
+
+	// 最初のリクエストがクライアントに切断されても、読み込みは最後まで続ける
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-leaderErr; err != nil {
+		t.Errorf("leader err = %v, want the shared load unaffected by its own context", err)
+	}
+	if err := <-followerErr; err != nil || len(follower) != 1 {
+		t.Errorf("follower = %v, err = %v, want the loaded login bonus", follower, err)
+	}
+}
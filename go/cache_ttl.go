@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// //////////////////////////////////////
+// cache ttl jitter
+
+// cacheTTLJitterPercent TTLで作り直すキャッシュの有効期間を、この割合(%)の範囲でランダムに短くする
+// 全シャード・全プロセスのキャッシュが同時に切れて、DBへの読み込みが集中しないようにする
+var cacheTTLJitterPercent = getEnvInt("ISUCON_CACHE_TTL_JITTER_PERCENT", 10)
+
+// jitteredTTL ttlをcacheTTLJitterPercentの範囲でランダムに短くする
+func jitteredTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || cacheTTLJitterPercent <= 0 {
+		return ttl
+	}
+	percent := cacheTTLJitterPercent
+	if percent > 100 {
+		percent = 100
+	}
+	maxJitter := int64(ttl) * int64(percent) / 100
+	if maxJitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Int63n(maxJitter+1))
+}
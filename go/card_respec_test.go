@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// testRespecMaterial 1つあたりgainedExpの経験値を持つ強化素材のマスタ
+func testRespecMaterial(id int64, gainedExp int) *ItemMaster {
+	return &ItemMaster{ID: id, ItemType: ItemTypeEnhanceA, GainedExp: &gainedExp}
+}
+
+func TestCalcRespecRefund(t *testing.T) {
+	materials := []*ItemMaster{
+		testRespecMaterial(31, 1000),
+		testRespecMaterial(32, 300),
+		{ID: 33, ItemType: ItemTypeEnhanceA},
+		testRespecMaterial(34, 100),
+	}
+	tests := []struct {
+		name      string
+		totalExp  int
+		percent   int
+		wantExp   int
+		wantItems map[int64]int
+	}{
+		// 1450のうち100に満たない50は返却しない
+		{name: "half", totalExp: 2900, percent: 50, wantExp: 1400, wantItems: map[int64]int{31: 1, 32: 1, 34: 1}},
+		{name: "full", totalExp: 2900, percent: 100, wantExp: 2900, wantItems: map[int64]int{31: 2, 32: 3}},
+		{name: "over 100 percent", totalExp: 2900, percent: 150, wantExp: 2900, wantItems: map[int64]int{31: 2, 32: 3}},
+		{name: "below smallest material", totalExp: 150, percent: 50, wantExp: 0, wantItems: map[int64]int{}},
+		{name: "no refund", totalExp: 2900, percent: 0, wantExp: 0, wantItems: map[int64]int{}},
+		{name: "no exp", totalExp: 0, percent: 50, wantExp: 0, wantItems: map[int64]int{}},
+	}
+	for _, tt := range tests {
+		exp, refunds := calcRespecRefund(tt.totalExp, tt.percent, materials)
+		got := make(map[int64]int)
+		for _, r := range refunds {
+			got[r.Item.ID] = r.Amount
+		}
+		if exp != tt.wantExp || len(got) != len(tt.wantItems) {
+			t.Errorf("%s: refunded %d exp as %v, want %d exp as %v", tt.name, exp, got, tt.wantExp, tt.wantItems)
+			continue
+		}
+		for id, amount := range tt.wantItems {
+			if got[id] != amount {
+				t.Errorf("%s: item %d amount = %d, want %d", tt.name, id, got[id], amount)
+			}
+		}
+	}
+}
+
+// respecRecord リセットでDBに書き込んだ内容
+type respecRecord struct {
+	card  []driver.Value
+	items map[int64]int64
+}
+
+// newTestRespecDB レベル5で累計経験値2000のカード11のリセットに応答する
+// 強化素材は経験値1000のアイテム31と300のアイテム32。カードがデッキに装備されている場合はequippedを1にする
+func newTestRespecDB(equipped int64, record *respecRecord) *fakeSQL {
+	fake := newTestTokenDB(100, "token", 2, 2000)
+	fake.withDevice()
+	fake.onQuery("FROM user_cards as uc", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp", "base_amount_per_sec", "max_level", "max_amount_per_sec", "base_exp_per_level"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], args[1], int64(2), int64(50), int64(5), int64(2000), int64(10), int64(10), int64(100), int64(100)}}
+	})
+	fake.onQuery("FROM user_decks", []string{"COUNT(*)"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{equipped}}
+	})
+	fake.onQuery("WHERE item_type=? AND gained_exp > 0", []string{"id", "item_type", "gained_exp"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(31), args[0], int64(1000)}, {int64(32), args[0], int64(300)}}
+	})
+	fake.onExec("UPDATE user_cards", func(args []driver.Value) (int64, error) {
+		record.card = args
+		return 1, nil
+	})
+	fake.onQuery("FROM item_masters WHERE id=?", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], args[1]}}
+	})
+	fake.onQuery("FROM user_items", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_items", func(args []driver.Value) (int64, error) {
+		record.items[args[2].(int64)] += args[4].(int64)
+		return 1, nil
+	})
+	fake.onQuery("SELECT * FROM user_cards", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(100), int64(2), int64(10), int64(1), int64(0)}}
+	})
+	return fake
+}
+
+func TestRespecCardRefundsMaterials(t *testing.T) {
+	prev := cardRespecRefundPercent
+	cardRespecRefundPercent = 80
+	t.Cleanup(func() { cardRespecRefundPercent = prev })
+
+	record := &respecRecord{items: make(map[int64]int64)}
+	fake := newTestRespecDB(0, record)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/card/respec/:cardID", h.respecCard, "/user/100/card/respec/11", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(RespecCardResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2000の80%の1600を、1000を1つと300を2つで返却し、端数の100は返却しない
+	if res.RefundedExp != 1600 {
+		t.Errorf("refundedExp = %d, want 1600", res.RefundedExp)
+	}
+	if len(record.items) != 2 || record.items[31] != 1 || record.items[32] != 2 {
+		t.Errorf("granted items = %v, want 1 of item 31 and 2 of item 32", record.items)
+	}
+	// レベル1に戻し、生産性をマスタの初期値に戻す
+	if len(record.card) < 3 || record.card[0] != int64(10) || record.card[1] != int64(1) || record.card[2] != int64(0) {
+		t.Errorf("card update = %v, want amount_per_sec 10, level 1 and no exp", record.card)
+	}
+	if fake.executed("UPDATE user_cards") != 1 || fake.executed("INSERT INTO user_items") != 2 {
+		t.Errorf("committed = %v, want the reset and refunds in one transaction", fake.committed)
+	}
+}
+
+func TestRespecCardEquipped(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		prev := cardRespecAllowEquipped
+		cardRespecAllowEquipped = allow
+		t.Cleanup(func() { cardRespecAllowEquipped = prev })
+
+		record := &respecRecord{items: make(map[int64]int64)}
+		fake := newTestRespecDB(1, record)
+		h := newTestHandler(t, fake)
+
+		rec := postJSON("/user/:userID/card/respec/:cardID", h.respecCard, "/user/100/card/respec/11", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+		if allow {
+			if rec.Code != http.StatusOK || fake.executed("UPDATE user_cards") != 1 {
+				t.Errorf("allowed: status = %d, body = %s, want the equipped card reset", rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		// 装備中のカードはリセットせず、素材も返却しない
+		if rec.Code != http.StatusConflict || fake.executed("UPDATE user_cards") != 0 || len(record.items) != 0 {
+			t.Errorf("rejected: status = %d, body = %s, items = %v, want 409 without changes", rec.Code, rec.Body.String(), record.items)
+		}
+	}
+}
+
+func TestRespecCardSoftDeleted(t *testing.T) {
+	// カード11は統合などで論理削除されていて、削除済みを除く問い合わせには返らない
+	record := &respecRecord{items: make(map[int64]int64)}
+	fake := &fakeSQL{}
+	fake.onQuery("uc.deleted_at IS NULL", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.rules = append(fake.rules, newTestRespecDB(0, record).rules...)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/card/respec/:cardID", h.respecCard, "/user/100/card/respec/11", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, body = %s, want 404", rec.Code, rec.Body.String())
+	}
+	if len(record.items) != 0 || fake.executed("UPDATE user_cards") != 0 {
+		t.Errorf("committed = %v, want nothing refunded for a deleted card", fake.committed)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLevelUpCardReachesMaxAmountPerSec(t *testing.T) {
+	linear, exponential := AmountGrowthTypeLinear, AmountGrowthTypeExponential
+	growthRate := 1.5
+	tests := []struct {
+		name   string
+		base   int
+		max    int
+		maxLv  int
+		growth *int
+		rate   *float64
+	}{
+		// 1レベルあたりの増分が割り切れず、切り捨てると最大値に届かない組み合わせ
+		{name: "linear", base: 1, max: 10, maxLv: 7, growth: &linear},
+		{name: "default growth", base: 3, max: 100, maxLv: 13},
+		{name: "exponential", base: 2, max: 1000, maxLv: 9, growth: &exponential, rate: &growthRate},
+	}
+	for _, tt := range tests {
+		card := &TargetUserCardData{
+			Level:            1,
+			TotalExp:         math.MaxInt32,
+			AmountPerSec:     tt.base,
+			BaseAmountPerSec: tt.base,
+			MaxLevel:         tt.maxLv,
+			MaxAmountPerSec:  tt.max,
+			BaseExpPerLevel:  10,
+			AmountGrowthType: tt.growth,
+			ExpGrowthRate:    tt.rate,
+		}
+
+		// 生産性はレベルとともに減らずに増え、max levelでmax_amount_per_secになる
+		prev := tt.base
+		for lv := 2; lv <= tt.maxLv; lv++ {
+			amount := calcAmountPerSec(card, lv)
+			if amount < prev {
+				t.Errorf("%s: amount at level %d = %d, below level %d = %d", tt.name, lv, amount, lv-1, prev)
+			}
+			prev = amount
+		}
+
+		levelUpCard(card)
+		if card.Level != tt.maxLv || card.AmountPerSec != tt.max {
+			t.Errorf("%s: level %d, amount %d, want level %d and amount %d", tt.name, card.Level, card.AmountPerSec, tt.maxLv, tt.max)
+		}
+	}
+}
+
+func TestCardCurveMatchesLevelUp(t *testing.T) {
+	// レベル2で累計経験値12のカード。最大レベル6で、経験値は1レベルごとに1.5倍になる
+	newCard := func(totalExp int) *TargetUserCardData {
+		growthRate := 1.5
+		return &TargetUserCardData{
+			ID: 11, UserID: 100, CardID: 2, AmountPerSec: 13, Level: 2, TotalExp: totalExp,
+			BaseAmountPerSec: 3, MaxLevel: 6, MaxAmountPerSec: 50, BaseExpPerLevel: 10, ExpGrowthRate: &growthRate,
+		}
+	}
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_cards as uc", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp", "base_amount_per_sec", "max_level", "max_amount_per_sec", "base_exp_per_level", "exp_growth_rate"}, func(args []driver.Value) [][]driver.Value {
+		c := newCard(12)
+		return [][]driver.Value{{c.ID, c.UserID, c.CardID, int64(c.AmountPerSec), int64(c.Level), int64(c.TotalExp), int64(c.BaseAmountPerSec), int64(c.MaxLevel), int64(c.MaxAmountPerSec), int64(c.BaseExpPerLevel), *c.ExpGrowthRate}}
+	})
+	h := newTestHandler(t, fake)
+
+	rec := getJSON("/user/:userID/card/:cardID/curve", h.getCardCurve, "/user/100/card/11/curve")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(CardCurveResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Levels) != 5 || res.Levels[0].Level != 2 || res.Levels[0].AmountPerSec != 13 {
+		t.Fatalf("levels = %s, want levels 2 to 6 starting from the current amount", rec.Body.String())
+	}
+
+	// 強化で累計経験値がrequiredExpに達するとそのレベルになり、1足りないと前のレベルのまま
+	for _, lv := range res.Levels[1:] {
+		card := newCard(lv.RequiredExp)
+		levelUpCard(card)
+		if card.Level != lv.Level || card.AmountPerSec != lv.AmountPerSec {
+			t.Errorf("exp %d: level %d, amount %d, want level %d and amount %d as in the curve", lv.RequiredExp, card.Level, card.AmountPerSec, lv.Level, lv.AmountPerSec)
+		}
+		if lv.RemainingExp != lv.RequiredExp-12 {
+			t.Errorf("level %d remainingExp = %d, want %d", lv.Level, lv.RemainingExp, lv.RequiredExp-12)
+		}
+
+		card = newCard(lv.RequiredExp - 1)
+		levelUpCard(card)
+		if card.Level != lv.Level-1 {
+			t.Errorf("exp %d: level %d, want %d", lv.RequiredExp-1, card.Level, lv.Level-1)
+		}
+	}
+}
+
+// newTestAddExpDB レベル1のカード11に、所持数2で経験値1の強化素材を使う強化に応答する
+// 強化素材のuser_itemsのidはitem_idと同じにする
+func newTestAddExpDB(itemQueries *int) *fakeSQL {
+	fake := newTestTokenDB(100, "token", 2, 2000)
+	fake.withDevice()
+	fake.onQuery("FROM user_cards as uc", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp", "base_amount_per_sec", "max_level", "max_amount_per_sec", "base_exp_per_level"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], args[1], int64(2), int64(1), int64(1), int64(0), int64(1), int64(10), int64(100), int64(1000)}}
+	})
+	// 引数はitem_type 2つ、user_items.idの一覧、user_idの順
+	fake.onQuery("FROM user_items as ui", []string{"id", "user_id", "item_id", "item_type", "amount", "gained_exp"}, func(args []driver.Value) [][]driver.Value {
+		*itemQueries++
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[2 : len(args)-1] {
+			rows = append(rows, []driver.Value{id, args[len(args)-1], id, int64(ItemTypeEnhanceA), int64(2), int64(1)})
+		}
+		return rows
+	})
+	fake.onExec("UPDATE user_cards", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onQuery("SELECT * FROM user_cards", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(100), int64(2), int64(1), int64(1), int64(50)}}
+	})
+	return fake
+}
+
+func TestAddExpToCardLoadsItemsInOneQuery(t *testing.T) {
+	prev := addExpMaxDistinctItems
+	addExpMaxDistinctItems = 50
+	t.Cleanup(func() { addExpMaxDistinctItems = prev })
+
+	addExp := func(items []string) (int, int, *fakeSQL) {
+		var itemQueries int
+		fake := newTestAddExpDB(&itemQueries)
+		h := newTestHandler(t, fake)
+		body := `{"viewerId":"viewer","oneTimeToken":"token","items":[` + strings.Join(items, ",") + `]}`
+		rec := postJSON("/user/:userID/card/addexp/:cardID", h.addExpToCard, "/user/100/card/addexp/11", body)
+		return rec.Code, itemQueries, fake
+	}
+	items := func(n int) []string {
+		items := make([]string, 0, n)
+		for id := 1; id <= n; id++ {
+			items = append(items, fmt.Sprintf(`{"id":%d,"amount":1}`, id))
+		}
+		return items
+	}
+
+	// 上限までの強化素材は1回の問い合わせでまとめて読む
+	code, itemQueries, fake := addExp(items(50))
+	if code != http.StatusOK || itemQueries != 1 || fake.executed("UPDATE user_items") != 50 {
+		t.Errorf("50 items: status = %d, item queries = %d, updated %d items, want 200 with one query and 50 updates", code, itemQueries, fake.executed("UPDATE user_items"))
+	}
+
+	// 同じアイテムの重複は1種類として数える
+	code, _, _ = addExp(append(items(50), `{"id":1,"amount":1}`))
+	if code != http.StatusOK {
+		t.Errorf("50 distinct items with a duplicate: status = %d, want 200", code)
+	}
+
+	// 種類数が上限を超える場合は読み込まずに弾く
+	code, itemQueries, _ = addExp(items(51))
+	if code != http.StatusBadRequest || itemQueries != 0 {
+		t.Errorf("51 items: status = %d, item queries = %d, want 400 without loading items", code, itemQueries)
+	}
+
+	// 重複して指定した消費量の合計が所持数を超える場合は弾く
+	code, _, fake = addExp([]string{`{"id":1,"amount":2}`, `{"id":2,"amount":1}`, `{"id":1,"amount":1}`})
+	if code != http.StatusBadRequest || fake.executed("UPDATE user_items") != 0 {
+		t.Errorf("insufficient item: status = %d, want 400 without consuming items", code)
+	}
+}
+
+func TestAddExpToCardMixesMaterialTypes(t *testing.T) {
+	// 1は強化素材A(gained_exp 300)、2は強化素材B(gained_exp 250)で、どちらも5つ持つ。3は他のユーザーのもの
+	var askedTypes []driver.Value
+	var updated []driver.Value
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_items as ui", []string{"id", "user_id", "item_id", "item_type", "amount", "gained_exp"}, func(args []driver.Value) [][]driver.Value {
+		askedTypes = args[:2]
+		owned := map[int64][]driver.Value{
+			1: {int64(1), int64(100), int64(10), int64(ItemTypeEnhanceA), int64(5), int64(300)},
+			2: {int64(2), int64(100), int64(20), int64(ItemTypeEnhanceB), int64(5), int64(250)},
+		}
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[2 : len(args)-1] {
+			if row, ok := owned[id.(int64)]; ok {
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	})
+	fake.onExec("UPDATE user_cards", func(args []driver.Value) (int64, error) {
+		updated = args
+		return 1, nil
+	})
+	var itemQueries int
+	fake.rules = append(fake.rules, newTestAddExpDB(&itemQueries).rules...)
+	addExp := func(items string) int {
+		h := newTestHandler(t, fake)
+		h.TokenCache.SetToken("token", 100, 2, 2000, 0)
+		body := `{"viewerId":"viewer","oneTimeToken":"token","items":[` + items + `]}`
+		return postJSON("/user/:userID/card/addexp/:cardID", h.addExpToCard, "/user/100/card/addexp/11", body).Code
+	}
+
+	if code := addExp(`{"id":1,"amount":2},{"id":2,"amount":2}`); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if len(askedTypes) != 2 || askedTypes[0] != int64(ItemTypeEnhanceA) || askedTypes[1] != int64(ItemTypeEnhanceB) {
+		t.Errorf("item types asked = %v, want both enhancement material types", askedTypes)
+	}
+
+	// 種別ごとの獲得経験値×消費量を合算し、合計でレベルを上げる
+	want := &TargetUserCardData{Level: 1, TotalExp: 300*2 + 250*2, BaseAmountPerSec: 1, MaxLevel: 10, MaxAmountPerSec: 100, BaseExpPerLevel: 1000}
+	levelUpCard(want)
+	if want.Level < 2 {
+		t.Fatalf("expected level = %d, want the combined exp to level up", want.Level)
+	}
+	if len(updated) < 3 || updated[0] != int64(want.AmountPerSec) || updated[1] != int64(want.Level) || updated[2] != int64(want.TotalExp) {
+		t.Errorf("updated card = %v, want amount_per_sec %d, level %d, total_exp %d", updated, want.AmountPerSec, want.Level, want.TotalExp)
+	}
+
+	// どちらの種別でも、所持していないアイテムを混ぜると何も消費しない
+	before := fake.executed("UPDATE user_items")
+	if code := addExp(`{"id":1,"amount":1},{"id":3,"amount":1}`); code != http.StatusNotFound {
+		t.Errorf("with an unowned item: status = %d, want 404", code)
+	}
+	if fake.executed("UPDATE user_items") != before {
+		t.Errorf("committed = %v, want nothing consumed with an unowned item", fake.committed)
+	}
+}
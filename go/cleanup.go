@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// cleanup job
+
+// startCleanupJob 期限切れセッション・ワンタイムトークンを定期的に掃除するジョブをシャードごとに起動する
+// ワンタイムトークンはメインのDBにもあるため、tokenLocationsの各DBを対象にする
+// ISUCON_CLEANUP_INTERVAL_SEC が0以下(デフォルト)の場合は起動しない
+// ベンチマーカーはx-isu-dateで実時刻と異なる時刻を送ってくることがあるため、実時刻で判定するこのジョブは明示的に有効にした場合のみ動かす
+// ctxがキャンセルされると、実行中のバッチを中断して止まる
+func (h *Handler) startCleanupJob(ctx context.Context, logger echo.Logger) {
+	interval := time.Duration(getEnvInt("ISUCON_CLEANUP_INTERVAL_SEC", 0)) * time.Second
+	if interval <= 0 {
+		return
+	}
+	batchSize := cleanupBatchSize()
+
+	for _, loc := range h.tokenLocations() {
+		go func(loc *tokenLocation) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				now := time.Now().Unix()
+				sessions, tokens, err := cleanupShard(ctx, loc.db, loc.shard, now, batchSize)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Errorf("cleanup failed: db=%s, err=%v", loc.name, err)
+					continue
+				}
+				logger.Infof("cleanup done: db=%s, sessions=%d, tokens=%d", loc.name, sessions, tokens)
+			}
+		}(loc)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.TokenCache.CleanupExpiredTokens(time.Now().Unix())
+			}
+		}
+	}()
+}
+
+// cleanupBatchSize 1回の文で掃除する件数。0以下を指定された場合はデフォルトの1000件とする
+// LIMIT 0では1件も処理できず、全件を処理し終えたと判定できなくなるため
+func cleanupBatchSize() int {
+	batchSize := getEnvInt("ISUCON_CLEANUP_BATCH_SIZE", 1000)
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return batchSize
+}
+
+// cleanupShard 1シャード分の掃除を行い、処理した件数を返す。メインのDB(shard=-1)はワンタイムトークンのみ掃除する
+// ロックを長時間保持しないよう、batchSize件ずつ処理する
+func cleanupShard(ctx context.Context, db sqlx.ExecerContext, shard int, now int64, batchSize int) (int64, int64, error) {
+	// 使用済み・期限切れのワンタイムトークンは再利用されないため物理削除する
+	query := "DELETE FROM user_one_time_tokens WHERE (deleted_at IS NOT NULL OR expired_at < ?) LIMIT ?"
+	tokens, err := execInBatches(ctx, db, batchSize, query, now, batchSize)
+	if err != nil {
+		return 0, tokens, err
+	}
+	// メインのDBにはユーザーごとのデータはトークンしかない
+	if shard < 0 {
+		return 0, tokens, nil
+	}
+
+	// 期限切れのセッションは論理削除する
+	query = "UPDATE user_sessions SET deleted_at=? WHERE expired_at < ? AND deleted_at IS NULL LIMIT ?"
+	sessions, err := execInBatches(ctx, db, batchSize, query, now, now, batchSize)
+	if err != nil {
+		return sessions, tokens, err
+	}
+
+	return sessions, tokens, nil
+}
+
+// execInBatches 影響行数がbatchSize未満になるまでqueryを繰り返し実行し、合計の影響行数を返す
+// バッチの間でctxを確認し、キャンセルされた場合はそれまでの件数とエラーを返す
+func execInBatches(ctx context.Context, db sqlx.ExecerContext, batchSize int, query string, args ...interface{}) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		res, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return total, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += affected
+		// 何も処理しなかった場合も、繰り返しても進まないため終える
+		if affected == 0 || affected < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
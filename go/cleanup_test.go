@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestCleanupDB 1回目の実行でbatchSize件、2回目でremain件を処理したと応答する
+func newTestCleanupDB(match string, batchSize, remain int64) *fakeSQL {
+	fake := &fakeSQL{}
+	calls := 0
+	fake.onExec(match, func(args []driver.Value) (int64, error) {
+		calls++
+		if calls == 1 {
+			return batchSize, nil
+		}
+		return remain, nil
+	})
+	return fake
+}
+
+func TestCleanupShardInBatches(t *testing.T) {
+	fake := newTestCleanupDB("DELETE FROM user_one_time_tokens", 10, 3)
+	sessions := newTestCleanupDB("UPDATE user_sessions", 10, 0)
+	fake.rules = append(fake.rules, sessions.rules...)
+
+	nSessions, nTokens, err := cleanupShard(context.Background(), fake.open(), 0, 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nSessions != 10 || nTokens != 13 {
+		t.Errorf("cleaned sessions %d, tokens %d, want 10 and 13", nSessions, nTokens)
+	}
+	if fake.executed("DELETE FROM user_one_time_tokens") != 2 || fake.executed("UPDATE user_sessions") != 2 {
+		t.Errorf("committed = %v, want 2 batches for each table", fake.committed)
+	}
+}
+
+func TestCleanupShardMainDBCleansOnlyTokens(t *testing.T) {
+	// メインのDBにuser_sessionsへの文が来た場合はfakeSQLがエラーにする
+	fake := newTestCleanupDB("DELETE FROM user_one_time_tokens", 10, 4)
+
+	nSessions, nTokens, err := cleanupShard(context.Background(), fake.open(), -1, 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nSessions != 0 || nTokens != 14 {
+		t.Errorf("cleaned sessions %d, tokens %d, want 0 and 14", nSessions, nTokens)
+	}
+}
+
+func TestCleanupTargetsIncludeMainDB(t *testing.T) {
+	shard, mainDB := (&fakeSQL{}).open(), (&fakeSQL{}).open()
+	h := &Handler{DBs: []*sqlx.DB{shard}, DB: mainDB}
+
+	locations := h.tokenLocations()
+	if len(locations) != 2 || locations[0].db != shard || locations[1].db != mainDB || locations[1].shard != -1 {
+		t.Errorf("locations = %+v, want the shard and the main DB", locations)
+	}
+}
+
+func TestCleanupBatchSizeDefaultsForNonPositive(t *testing.T) {
+	for env, want := range map[string]int{"": 1000, "0": 1000, "-5": 1000, "200": 200} {
+		t.Setenv("ISUCON_CLEANUP_BATCH_SIZE", env)
+		if got := cleanupBatchSize(); got != want {
+			t.Errorf("ISUCON_CLEANUP_BATCH_SIZE=%q: batch size = %d, want %d", env, got, want)
+		}
+	}
+}
+
+func TestCleanupShardStopsWithoutProgress(t *testing.T) {
+	// LIMIT 0などで1件も処理できない場合に、同じ文を繰り返さない
+	fake := newTestCleanupDB("DELETE FROM user_one_time_tokens", 0, 0)
+	if _, _, err := cleanupShard(context.Background(), fake.open(), -1, 1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.executed("DELETE FROM user_one_time_tokens"); n != 1 {
+		t.Errorf("executed %d times, want 1", n)
+	}
+}
+
+func TestCleanupShardCancelled(t *testing.T) {
+	fake := newTestCleanupDB("DELETE FROM user_one_time_tokens", 10, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := cleanupShard(ctx, fake.open(), -1, 1000, 10); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if n := fake.executed("DELETE FROM user_one_time_tokens"); n != 0 {
+		t.Errorf("executed %d times after cancel, want none", n)
+	}
+}
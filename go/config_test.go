@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadLocation(t *testing.T) {
+	jst := 9 * 60 * 60
+	at := time.Unix(0, 0)
+
+	if loc, err := loadLocation(""); err != nil || offset(at, loc) != jst {
+		t.Errorf("unset = (%v, %v), want JST", loc, err)
+	}
+	if loc, err := loadLocation("UTC"); err != nil || offset(at, loc) != 0 {
+		t.Errorf("UTC = (%v, %v), want UTC", loc, err)
+	}
+	// 不正な場合はJSTで動かし続け、ログに出すためのエラーを返す
+	if loc, err := loadLocation("Invalid/Zone"); err == nil || offset(at, loc) != jst {
+		t.Errorf("invalid = (%v, %v), want JST with an error", loc, err)
+	}
+}
+
+func offset(at time.Time, loc *time.Location) int {
+	_, off := at.In(loc).Zone()
+	return off
+}
+
+func TestParseItemValues(t *testing.T) {
+	values, ignored := parseItemValues(" 1:100, 2:abc,3,, 4:-5 ")
+	if len(values) != 2 || values[1] != 100 || values[4] != -5 {
+		t.Errorf("values = %v, want 1:100 and 4:-5", values)
+	}
+	// 解釈できない要素はログに出せるよう返し、空の要素は含めない
+	if len(ignored) != 2 || ignored[0] != "2:abc" || ignored[1] != "3" {
+		t.Errorf("ignored = %q, want [2:abc 3]", ignored)
+	}
+
+	if values, ignored := parseItemValues(""); len(values) != 0 || len(ignored) != 0 {
+		t.Errorf("unset = (%v, %q), want nothing", values, ignored)
+	}
+}
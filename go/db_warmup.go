@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// db warmup
+
+// warmupTarget 起動時に接続を確認するDB
+type warmupTarget struct {
+	name string
+	host string
+	db   *sqlx.DB
+}
+
+// warmupResult 起動時の接続確認の結果
+type warmupResult struct {
+	target  *warmupTarget
+	elapsed time.Duration
+	err     error
+}
+
+// warmupDBs 起動時に各DBへPingして接続を確立しておく
+// sqlx.Openは接続しないため、そのままでは最初のリクエストが接続の確立を待ち、落ちているシャードにもリクエストが来るまで気づかない
+// ISUCON_DB_WARMUP_TIMEOUT_MS(デフォルト3秒)以内に接続できなかったDBはログに出し、
+// ISUCON_DB_WARMUP_REQUIRED=1 の場合は1つでも接続できなければエラーを返して起動を止める
+func warmupDBs(targets []*warmupTarget, logger echo.Logger) error {
+	timeout := time.Duration(getEnvInt("ISUCON_DB_WARMUP_TIMEOUT_MS", 3000)) * time.Millisecond
+	if timeout <= 0 {
+		return nil
+	}
+	required := getEnv("ISUCON_DB_WARMUP_REQUIRED", "") == "1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// 全DBを並行して確認し、落ちているDBがあっても起動がtimeout以上待たないようにする
+	results := make([]*warmupResult, len(targets))
+	wg := sync.WaitGroup{}
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target *warmupTarget) {
+			defer wg.Done()
+			start := time.Now()
+			err := target.db.PingContext(ctx)
+			results[i] = &warmupResult{target: target, elapsed: time.Since(start), err: err}
+		}(i, target)
+	}
+	wg.Wait()
+
+	unreachable := make([]string, 0)
+	for _, r := range results {
+		if r.err != nil {
+			logger.Errorf("db warmup failed: %s(%s), elapsed=%s, err=%v", r.target.name, r.target.host, r.elapsed, r.err)
+			unreachable = append(unreachable, fmt.Sprintf("%s(%s)", r.target.name, r.target.host))
+			continue
+		}
+		logger.Infof("db warmup done: %s(%s), elapsed=%s", r.target.name, r.target.host, r.elapsed)
+	}
+
+	if required && len(unreachable) > 0 {
+		return fmt.Errorf("unreachable dbs: %s", strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
+// dbWarmupTargets メインのDBと各シャードを接続確認の対象にする
+func dbWarmupTargets(db *sqlx.DB, dbs []*sqlx.DB, shardErrors []*ShardErrorLog) []*warmupTarget {
+	targets := []*warmupTarget{{name: "main", host: getEnv("ISUCON_DB_HOST", "127.0.0.1"), db: db}}
+	for i, shard := range dbs {
+		host := ""
+		if i < len(shardErrors) {
+			host = shardErrors[i].Host()
+		}
+		targets = append(targets, &warmupTarget{name: fmt.Sprintf("shard%d", i), host: host, db: shard})
+	}
+	return targets
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// newTestWarmupTargets 接続できるメインのDBと、接続できないホストを指すシャードを返す
+func newTestWarmupTargets(t *testing.T) []*warmupTarget {
+	// 使われていないポートへの接続はすぐに拒否される
+	bad, err := sqlx.Open("mysql", "isucon:isucon@tcp(127.0.0.1:1)/isucon?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bad.Close() })
+	return []*warmupTarget{
+		{name: "main", host: "127.0.0.1", db: (&fakeSQL{}).open()},
+		{name: "shard0", host: "127.0.0.1:1", db: bad},
+	}
+}
+
+func TestWarmupDBsReportsBadHost(t *testing.T) {
+	t.Setenv("ISUCON_DB_WARMUP_TIMEOUT_MS", "2000")
+	t.Setenv("ISUCON_DB_WARMUP_REQUIRED", "")
+	logs := new(bytes.Buffer)
+	logger := echo.New().Logger
+	logger.SetOutput(logs)
+	logger.SetLevel(log.INFO)
+
+	// 必須にしない場合は、接続できなかったシャードをログに出して起動を続ける
+	if err := warmupDBs(newTestWarmupTargets(t), logger); err != nil {
+		t.Fatalf("err = %v, want startup to continue", err)
+	}
+	if !strings.Contains(logs.String(), "db warmup failed: shard0(127.0.0.1:1)") {
+		t.Errorf("logs = %s, want the bad shard reported", logs.String())
+	}
+	if !strings.Contains(logs.String(), "db warmup done: main(127.0.0.1)") {
+		t.Errorf("logs = %s, want the main db reported as connected", logs.String())
+	}
+
+	// 必須にした場合は起動を止める
+	t.Setenv("ISUCON_DB_WARMUP_REQUIRED", "1")
+	err := warmupDBs(newTestWarmupTargets(t), logger)
+	if err == nil || !strings.Contains(err.Error(), "shard0(127.0.0.1:1)") || strings.Contains(err.Error(), "main") {
+		t.Errorf("err = %v, want only the bad shard reported", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// fakeDeckUser デッキプリセットを保存・装備するユーザーの状態
+type fakeDeckUser struct {
+	owned   map[int64]bool
+	presets []*UserDeckPreset
+	deck    []int64
+}
+
+func (u *fakeDeckUser) preset(name string) *UserDeckPreset {
+	for _, p := range u.presets {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func presetRow(p *UserDeckPreset) []driver.Value {
+	return []driver.Value{p.ID, p.UserID, p.Name, p.CardID1, p.CardID2, p.CardID3, p.CreatedAt, p.UpdatedAt}
+}
+
+var deckPresetColumns = []string{"id", "user_id", "name", "user_card_id_1", "user_card_id_2", "user_card_id_3", "created_at", "updated_at"}
+
+// newTestDeckPresetDB プリセットと装備中のデッキをuに読み書きする
+func newTestDeckPresetDB(u *fakeDeckUser) *fakeSQL {
+	fake := (&fakeSQL{}).withDevice()
+	fake.onQuery("FROM user_cards", []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[:len(args)-1] {
+			if u.owned[id.(int64)] {
+				rows = append(rows, []driver.Value{id})
+			}
+		}
+		return rows
+	})
+	fake.onQuery("SELECT name FROM user_deck_presets", []string{"name"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, p := range u.presets {
+			rows = append(rows, []driver.Value{p.Name})
+		}
+		return rows
+	})
+	fake.onExec("INSERT INTO user_deck_presets", func(args []driver.Value) (int64, error) {
+		saved := &UserDeckPreset{
+			ID: args[0].(int64), UserID: args[1].(int64), Name: args[2].(string),
+			CardID1: args[3].(int64), CardID2: args[4].(int64), CardID3: args[5].(int64),
+			CreatedAt: args[6].(int64), UpdatedAt: args[7].(int64),
+		}
+		// 同じ名前のプリセットは上書きする
+		if p := u.preset(saved.Name); p != nil {
+			p.CardID1, p.CardID2, p.CardID3, p.UpdatedAt = saved.CardID1, saved.CardID2, saved.CardID3, saved.UpdatedAt
+			return 2, nil
+		}
+		u.presets = append(u.presets, saved)
+		return 1, nil
+	})
+	fake.onQuery("user_id=? AND name=?", deckPresetColumns, func(args []driver.Value) [][]driver.Value {
+		if p := u.preset(args[1].(string)); p != nil {
+			return [][]driver.Value{presetRow(p)}
+		}
+		return nil
+	})
+	fake.onQuery("FROM user_deck_presets WHERE user_id=? ORDER BY", deckPresetColumns, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, p := range u.presets {
+			rows = append(rows, presetRow(p))
+		}
+		return rows
+	})
+	fake.onExec("UPDATE user_decks", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_decks", func(args []driver.Value) (int64, error) {
+		u.deck = []int64{args[2].(int64), args[3].(int64), args[4].(int64)}
+		return 1, nil
+	})
+	return fake
+}
+
+func newTestDeckPresetHandler(t *testing.T, u *fakeDeckUser) *Handler {
+	return newTestHandler(t, newTestDeckPresetDB(u))
+}
+
+func saveDeckPreset(h *Handler, name string, cardIDs string) int {
+	body := fmt.Sprintf(`{"viewerId":"viewer","name":%q,"cardIds":%s}`, name, cardIDs)
+	return postJSON("/user/:userID/deck/preset", h.saveDeckPreset, "/user/100/deck/preset", body).Code
+}
+
+func activateDeckPreset(h *Handler, name string) int {
+	return postJSON("/user/:userID/deck/preset/:name/activate", h.activateDeckPreset, "/user/100/deck/preset/"+name+"/activate", `{"viewerId":"viewer"}`).Code
+}
+
+func TestDeckPresetRoundTrip(t *testing.T) {
+	u := &fakeDeckUser{owned: map[int64]bool{11: true, 12: true, 13: true, 14: true, 15: true, 16: true}}
+	h := newTestDeckPresetHandler(t, u)
+
+	if code := saveDeckPreset(h, "pve", "[11,12,13]"); code != http.StatusOK {
+		t.Fatalf("save pve status = %d", code)
+	}
+	if code := saveDeckPreset(h, "pvp", "[14,15,16]"); code != http.StatusOK {
+		t.Fatalf("save pvp status = %d", code)
+	}
+
+	// 一覧には保存した順に並ぶ
+	rec := getJSON("/user/:userID/deck/presets", h.listDeckPresets, "/user/100/deck/presets")
+	res := new(ListDeckPresetsResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Presets) != 2 || res.Presets[0].Name != "pve" || res.Presets[1].Name != "pvp" {
+		t.Fatalf("presets = %s, want pve and pvp", rec.Body.String())
+	}
+
+	// 装備すると、保存したカードで新しいデッキを作る
+	for _, tt := range []struct {
+		name string
+		want []int64
+	}{
+		{name: "pvp", want: []int64{14, 15, 16}},
+		{name: "pve", want: []int64{11, 12, 13}},
+	} {
+		if code := activateDeckPreset(h, tt.name); code != http.StatusOK {
+			t.Fatalf("activate %s status = %d", tt.name, code)
+		}
+		if fmt.Sprint(u.deck) != fmt.Sprint(tt.want) {
+			t.Errorf("deck after activating %s = %v, want %v", tt.name, u.deck, tt.want)
+		}
+	}
+
+	// 同じ名前で保存し直すと上書きし、装備にも反映される
+	if code := saveDeckPreset(h, "pvp", "[16,15,14]"); code != http.StatusOK {
+		t.Fatalf("overwrite pvp status = %d", code)
+	}
+	if code := activateDeckPreset(h, "pvp"); code != http.StatusOK || fmt.Sprint(u.deck) != "[16 15 14]" {
+		t.Errorf("activate overwritten pvp = (%d, %v), want [16 15 14]", code, u.deck)
+	}
+	if len(u.presets) != 2 {
+		t.Errorf("%d presets saved, want the overwrite to keep 2", len(u.presets))
+	}
+}
+
+func TestActivateDeckPresetWithSoldCard(t *testing.T) {
+	u := &fakeDeckUser{owned: map[int64]bool{11: true, 12: true, 13: true}}
+	h := newTestDeckPresetHandler(t, u)
+	if code := saveDeckPreset(h, "pve", "[11,12,13]"); code != http.StatusOK {
+		t.Fatalf("save status = %d", code)
+	}
+
+	// 保存した後にカードを売却した場合は装備せず、デッキはそのまま
+	delete(u.owned, 12)
+	if code := activateDeckPreset(h, "pve"); code != http.StatusConflict {
+		t.Errorf("activate status = %d, want 409", code)
+	}
+	if u.deck != nil {
+		t.Errorf("deck = %v, want unchanged", u.deck)
+	}
+	if code := activateDeckPreset(h, "unknown"); code != http.StatusNotFound {
+		t.Errorf("activate unknown status = %d, want 404", code)
+	}
+}
+
+func TestSaveDeckPresetLimit(t *testing.T) {
+	u := &fakeDeckUser{owned: map[int64]bool{11: true, 12: true, 13: true}}
+	h := newTestDeckPresetHandler(t, u)
+	for i := 0; i < DeckPresetMaxCount; i++ {
+		if code := saveDeckPreset(h, fmt.Sprintf("deck%d", i), "[11,12,13]"); code != http.StatusOK {
+			t.Fatalf("save %d status = %d", i, code)
+		}
+	}
+
+	if code := saveDeckPreset(h, "extra", "[11,12,13]"); code != http.StatusConflict {
+		t.Errorf("save over the limit status = %d, want 409", code)
+	}
+	// 既存のプリセットの上書きは上限に達していてもできる
+	if code := saveDeckPreset(h, "deck0", "[13,12,11]"); code != http.StatusOK {
+		t.Errorf("overwrite at the limit status = %d, want 200", code)
+	}
+}
+
+func TestUpdateDeckWithCardSoldDuringUpdateKeepsOldDeck(t *testing.T) {
+	u := &fakeDeckUser{owned: map[int64]bool{11: true, 12: true, 13: true, 14: true, 15: true, 16: true}, deck: []int64{11, 12, 13}}
+	fake := &fakeSQL{}
+	// トランザクションの前の検証を通った後に、カード16が売却される
+	checks := 0
+	fake.onQuery("FROM user_cards", []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		checks++
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[:len(args)-1] {
+			if u.owned[id.(int64)] {
+				rows = append(rows, []driver.Value{id})
+			}
+		}
+		delete(u.owned, 16)
+		return rows
+	})
+	fake.rules = append(fake.rules, newTestDeckPresetDB(u).rules...)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/card", h.updateDeck, "/user/100/card", `{"viewerId":"viewer","cardIds":[14,15,16]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, body = %s, want 400", rec.Code, rec.Body.String())
+	}
+	// 装備中のデッキを外す前に弾くので、デッキがない状態にならない
+	if checks != 2 || fmt.Sprint(u.deck) != "[11 12 13]" {
+		t.Errorf("checked %d times, deck = %v, want the old deck kept after checking in the transaction", checks, u.deck)
+	}
+	if fake.executed("UPDATE user_decks") != 0 || fake.discarded("UPDATE user_decks") != 0 {
+		t.Errorf("committed = %v, rolled back = %v, want the old deck never removed", fake.committed, fake.rolledBack)
+	}
+}
+
+func TestCheckDeckCardsOwned(t *testing.T) {
+	if err := checkDeckCardsOwned([]int64{11, 12, 13}, []int64{13, 11, 12}); err != nil {
+		t.Errorf("all owned: err = %v, want nil", err)
+	}
+	// 所持していないカードが複数ある場合は最初のスロットを返す
+	err := checkDeckCardsOwned([]int64{11, 12, 13}, []int64{11})
+	var missing *DeckCardMissingError
+	if !errors.As(err, &missing) || missing.Slot != 2 || missing.UserCardID != 12 || errors.Cause(err) != ErrDeckCardMissing {
+		t.Errorf("err = %v, want slot 2 with card 12 as ErrDeckCardMissing", err)
+	}
+}
+
+// decodeDeckCardMissing 所持していないカードのスロットを返したレスポンスを読む
+func decodeDeckCardMissing(t *testing.T, rec *httptest.ResponseRecorder) *DeckCardMissingResponse {
+	t.Helper()
+	res := new(DeckCardMissingResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDeckWithSoldCardReportsSlot(t *testing.T) {
+	// デッキの更新: 3枚目のカード16は売却済み
+	u := &fakeDeckUser{owned: map[int64]bool{11: true, 12: true, 13: true, 14: true, 15: true}, deck: []int64{11, 12, 13}}
+	h := newTestDeckPresetHandler(t, u)
+	rec := postJSON("/user/:userID/card", h.updateDeck, "/user/100/card", `{"viewerId":"viewer","cardIds":[14,15,16]}`)
+	if res := decodeDeckCardMissing(t, rec); rec.Code != http.StatusBadRequest || res.Slot != 3 || res.UserCardID != 16 {
+		t.Errorf("update deck: status = %d, body = %s, want 400 naming slot 3", rec.Code, rec.Body.String())
+	}
+	if fmt.Sprint(u.deck) != "[11 12 13]" {
+		t.Errorf("deck = %v, want unchanged", u.deck)
+	}
+
+	// プリセットの装備: 保存した後に2枚目のカード12を売却した
+	if code := saveDeckPreset(h, "pve", "[11,12,13]"); code != http.StatusOK {
+		t.Fatalf("save status = %d", code)
+	}
+	delete(u.owned, 12)
+	rec = postJSON("/user/:userID/deck/preset/:name/activate", h.activateDeckPreset, "/user/100/deck/preset/pve/activate", `{"viewerId":"viewer"}`)
+	if res := decodeDeckCardMissing(t, rec); rec.Code != http.StatusConflict || res.Slot != 2 || res.UserCardID != 12 {
+		t.Errorf("activate preset: status = %d, body = %s, want 409 naming slot 2", rec.Code, rec.Body.String())
+	}
+
+	// 報酬の受け取り: 装備中のデッキの2枚目のカード12を売却した
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_cards", []string{"id", "amount_per_sec"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11), int64(1)}, {int64(13), int64(3)}}
+	})
+	fake.rules = append(fake.rules, newTestRewardDB().rules...)
+	h = newTestHandler(t, fake)
+	rec = postJSON("/user/:userID/reward", h.reward, "/user/100/reward", `{"viewerId":"viewer"}`)
+	if res := decodeDeckCardMissing(t, rec); rec.Code != http.StatusConflict || res.Slot != 2 || res.UserCardID != 12 {
+		t.Errorf("reward: status = %d, body = %s, want 409 naming slot 2", rec.Code, rec.Body.String())
+	}
+	if fake.executed("UPDATE users") != 0 || fake.executed("INSERT INTO reward_histories") != 0 {
+		t.Errorf("committed = %v, want no reward granted", fake.committed)
+	}
+}
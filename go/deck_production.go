@@ -0,0 +1,83 @@
+package main
+
+// //////////////////////////////////////
+// deck production
+
+// deckSynergyRule デッキ内のカードの組み合わせで生産性にボーナスを付けるルール
+// groupKeyが同じカードがminMatches枚以上デッキにある場合、その各カードの生産性にbonusPercent(%)を上乗せする
+type deckSynergyRule struct {
+	name         string
+	minMatches   int
+	bonusPercent int
+	groupKey     func(card *UserCard) string
+}
+
+// deckSynergyRules デッキの生産性に適用するルール
+// 今はボーナスがないため空で、生産性は装備カードのamount_per_secの合計のまま
+// ルールをマスタで管理するようになったら、マスタの読み込み時にここを差し替える
+// カードのマスタにレアリティなどの属性がないため、今はgroupKeyにはcard_idのようなユーザーカードの値しか使えない
+var deckSynergyRules = []*deckSynergyRule{}
+
+// computeDeckProduction デッキに装備したカードの生産性を、シナジーのボーナスを含めて計算する
+// home, rewardで同じ計算を使い、表示される生産性と実際に受け取るコインがずれないようにする
+func computeDeckProduction(cards []*UserCard) *DeckProduction {
+	return computeDeckProductionWithRules(cards, deckSynergyRules)
+}
+
+// computeDeckProductionWithRules 指定したルールでデッキの生産性を計算する
+// 複数のルールに当てはまるカードには、各ルールのボーナスを加算で付ける
+func computeDeckProductionWithRules(cards []*UserCard, rules []*deckSynergyRule) *DeckProduction {
+	production := &DeckProduction{
+		Cards: make([]*CardProduction, 0, len(cards)),
+	}
+	for _, card := range cards {
+		production.Cards = append(production.Cards, &CardProduction{
+			UserCardID: card.ID,
+			CardID:     card.CardID,
+			Base:       int64(card.AmountPerSec),
+		})
+	}
+
+	for _, rule := range rules {
+		groups := make(map[string][]int, len(cards))
+		for i, card := range cards {
+			key := rule.groupKey(card)
+			groups[key] = append(groups[key], i)
+		}
+		for _, indexes := range groups {
+			if len(indexes) < rule.minMatches {
+				continue
+			}
+			for _, i := range indexes {
+				p := production.Cards[i]
+				p.Bonus += p.Base * int64(rule.bonusPercent) / 100
+			}
+		}
+	}
+
+	for _, p := range production.Cards {
+		p.Total = p.Base + p.Bonus
+		production.Base += p.Base
+		production.Bonus += p.Bonus
+	}
+	production.Total = production.Base + production.Bonus
+
+	return production
+}
+
+// DeckProduction デッキの生産性の内訳
+type DeckProduction struct {
+	Base  int64             `json:"base"`
+	Bonus int64             `json:"bonus"`
+	Total int64             `json:"total"`
+	Cards []*CardProduction `json:"cards"`
+}
+
+// CardProduction 装備カードごとの生産性の内訳
+type CardProduction struct {
+	UserCardID int64 `json:"userCardId"`
+	CardID     int64 `json:"cardId"`
+	Base       int64 `json:"base"`
+	Bonus      int64 `json:"bonus"`
+	Total      int64 `json:"total"`
+}
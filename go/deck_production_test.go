@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// sameCardSynergy 同じカードが2枚以上あるデッキの各カードに50%を上乗せする
+// カードのマスタにレアリティがないため、card_idをレアリティの代わりに使う
+var sameCardSynergy = &deckSynergyRule{
+	name:         "same card",
+	minMatches:   2,
+	bonusPercent: 50,
+	groupKey:     func(card *UserCard) string { return strconv.FormatInt(card.CardID, 10) },
+}
+
+func TestComputeDeckProductionWithRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		cards     []*UserCard
+		rules     []*deckSynergyRule
+		wantBonus []int64
+		wantTotal int64
+	}{
+		{
+			name:      "no rules",
+			cards:     []*UserCard{{ID: 1, CardID: 2, AmountPerSec: 10}, {ID: 2, CardID: 2, AmountPerSec: 20}, {ID: 3, CardID: 3, AmountPerSec: 5}},
+			wantBonus: []int64{0, 0, 0},
+			wantTotal: 35,
+		},
+		{
+			name:      "matching cards",
+			cards:     []*UserCard{{ID: 1, CardID: 2, AmountPerSec: 10}, {ID: 2, CardID: 2, AmountPerSec: 20}, {ID: 3, CardID: 3, AmountPerSec: 5}},
+			rules:     []*deckSynergyRule{sameCardSynergy},
+			wantBonus: []int64{5, 10, 0},
+			wantTotal: 50,
+		},
+		{
+			name:      "no matching cards",
+			cards:     []*UserCard{{ID: 1, CardID: 2, AmountPerSec: 10}, {ID: 2, CardID: 3, AmountPerSec: 20}, {ID: 3, CardID: 4, AmountPerSec: 5}},
+			rules:     []*deckSynergyRule{sameCardSynergy},
+			wantBonus: []int64{0, 0, 0},
+			wantTotal: 35,
+		},
+		{
+			// 複数のルールのボーナスは加算する
+			name:      "stacked rules",
+			cards:     []*UserCard{{ID: 1, CardID: 2, AmountPerSec: 10}, {ID: 2, CardID: 2, AmountPerSec: 20}, {ID: 3, CardID: 3, AmountPerSec: 5}},
+			rules:     []*deckSynergyRule{sameCardSynergy, sameCardSynergy},
+			wantBonus: []int64{10, 20, 0},
+			wantTotal: 65,
+		},
+	}
+	for _, tt := range tests {
+		p := computeDeckProductionWithRules(tt.cards, tt.rules)
+		if p.Base != 35 || p.Total != tt.wantTotal || p.Base+p.Bonus != p.Total {
+			t.Errorf("%s: production = base %d, bonus %d, total %d, want base 35 and total %d", tt.name, p.Base, p.Bonus, p.Total, tt.wantTotal)
+		}
+		for i, card := range p.Cards {
+			if card.UserCardID != tt.cards[i].ID || card.Bonus != tt.wantBonus[i] || card.Total != card.Base+card.Bonus {
+				t.Errorf("%s: card %d = %+v, want bonus %d", tt.name, i+1, card, tt.wantBonus[i])
+			}
+		}
+	}
+}
+
+func TestRewardAppliesDeckSynergy(t *testing.T) {
+	prev := deckSynergyRules
+	// 装備したカード11〜13はどれもcard_idが同じで、生産性1, 2, 3にそれぞれ50%が上乗せされる
+	deckSynergyRules = []*deckSynergyRule{sameCardSynergy}
+	t.Cleanup(func() { deckSynergyRules = prev })
+
+	var coin driver.Value
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) {
+		coin = args[0]
+		return 1, nil
+	})
+	fake.rules = append(fake.rules, newTestRewardDB().rules...)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/reward", h.reward, "/user/100/reward", `{"viewerId":"viewer"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	// 900から1000までの100秒分を、ボーナスを含めた毎秒8で付与する
+	if coin != int64(800) {
+		t.Errorf("isu_coin = %v, want 800 including the synergy bonus", coin)
+	}
+}
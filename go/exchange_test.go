@@ -0,0 +1,31 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestExchangeItemRejectsNonMaterialSource(t *testing.T) {
+	fake := (&fakeSQL{}).withDevice()
+	// 誤ってカードを交換元にしたレート
+	fake.onQuery("FROM exchange_masters", []string{"id", "from_item_id", "from_amount", "to_item_type", "to_item_id", "to_amount"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], int64(1), int64(ItemTypeEnhanceA), int64(10), int64(1)}}
+	})
+	fake.onQuery("FROM user_items", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], int64(ItemTypeCard), args[1], int64(5)}}
+	})
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	h := &Handler{DBs: []*sqlx.DB{fake.open()}, Cache: newTestMasterDataCache()}
+	h.Cache.SetItemMaster(&ItemMaster{ID: 2, ItemType: ItemTypeCard})
+
+	rec := postJSON("/user/:userID/item/exchange", h.exchangeItem, "/user/100/item/exchange", `{"viewerId":"viewer","fromItemId":2,"amount":1}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s, want 400", rec.Code, rec.Body.String())
+	}
+	if fake.executed("UPDATE user_items") != 0 || fake.discarded("UPDATE user_items") != 0 {
+		t.Errorf("committed = %v, rolledBack = %v, want the card left untouched", fake.committed, fake.rolledBack)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeSQL 文の部分一致で応答を決める、テスト用のdatabase/sqlのドライバ
+// トランザクション内で実行した文はコミットしたときにcommittedへ、ロールバックしたときにrolledBackへ入れる
+// トランザクション外で実行した文はそのままcommittedに入れる
+type fakeSQL struct {
+	mu         sync.Mutex
+	rules      []*fakeSQLRule
+	committed  []string
+	rolledBack []string
+}
+
+type fakeSQLRule struct {
+	match   string
+	columns []string
+	rows    func(args []driver.Value) [][]driver.Value
+	exec    func(args []driver.Value) (int64, error)
+}
+
+// onQuery matchを含むクエリにrowsの結果を返す
+func (f *fakeSQL) onQuery(match string, columns []string, rows func(args []driver.Value) [][]driver.Value) {
+	f.rules = append(f.rules, &fakeSQLRule{match: match, columns: columns, rows: rows})
+}
+
+// onExec matchを含む更新でexecを呼び、その戻り値を影響行数として返す
+func (f *fakeSQL) onExec(match string, exec func(args []driver.Value) (int64, error)) {
+	f.rules = append(f.rules, &fakeSQLRule{match: match, exec: exec})
+}
+
+// open このドライバに接続するDB
+func (f *fakeSQL) open() *sqlx.DB {
+	return sqlx.NewDb(sql.OpenDB(f), "mysql")
+}
+
+// withDevice どのユーザーもリクエストのviewer_idの端末を登録済みとして、user_devicesに応答する
+func (f *fakeSQL) withDevice() *fakeSQL {
+	f.onQuery("FROM user_devices", []string{"id", "user_id", "platform_id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], args[1]}}
+	})
+	return f
+}
+
+// newTestHandler shardsを順にシャードとし、最初のシャードをメインのDBも兼ねるハンドラ
+// マスタ・トークンのキャッシュとユーザーごとのロックはテストごとに新しく作る
+func newTestHandler(t testing.TB, shards ...*fakeSQL) *Handler {
+	t.Helper()
+	h := newTestIDHandler(t)
+	for _, fake := range shards {
+		h.DBs = append(h.DBs, fake.open())
+	}
+	if len(h.DBs) > 0 {
+		h.DB = h.DBs[0]
+	}
+	h.Cache = newTestMasterDataCache()
+	h.TokenCache = NewTokenCache()
+	h.UserLocks = NewUserLocks()
+	h.GachaLocks = NewUserLocks()
+	return h
+}
+
+// executed committedのうち、matchを含む文の数
+func (f *fakeSQL) executed(match string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return countMatches(f.committed, match)
+}
+
+// discarded rolledBackのうち、matchを含む文の数
+func (f *fakeSQL) discarded(match string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return countMatches(f.rolledBack, match)
+}
+
+func countMatches(queries []string, match string) int {
+	n := 0
+	for _, q := range queries {
+		if strings.Contains(q, match) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeSQL) rule(query string) (*fakeSQLRule, error) {
+	for _, r := range f.rules {
+		if strings.Contains(query, r.match) {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("fakeSQL: unexpected query: %s", query)
+}
+
+func (f *fakeSQL) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeSQLConn{f: f}, nil
+}
+
+func (f *fakeSQL) Driver() driver.Driver {
+	return fakeSQLDriver{}
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fakeSQL: use sql.OpenDB")
+}
+
+type fakeSQLConn struct {
+	f       *fakeSQL
+	inTx    bool
+	pending []string
+}
+
+func (c *fakeSQLConn) record(query string) {
+	if c.inTx {
+		c.pending = append(c.pending, query)
+		return
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.committed = append(c.f.committed, query)
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakeSQL: prepared statements are not supported")
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeSQLConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.inTx = true
+	c.pending = nil
+	return &fakeSQLTx{c: c}, nil
+}
+
+func (c *fakeSQLConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r, err := c.f.rule(query)
+	if err != nil {
+		return nil, err
+	}
+	if r.exec == nil {
+		return nil, fmt.Errorf("fakeSQL: %s is not an exec", query)
+	}
+	affected, err := r.exec(namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	c.record(query)
+	return driver.RowsAffected(affected), nil
+}
+
+func (c *fakeSQLConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.f.rule(query)
+	if err != nil {
+		return nil, err
+	}
+	if r.rows == nil {
+		return nil, fmt.Errorf("fakeSQL: %s is not a query", query)
+	}
+	c.record(query)
+	rows := r.rows(namedValues(args))
+	// 実際のドライバと同じく、応答を待つ間にcontextが終わった場合はエラーを返す
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &fakeSQLRows{columns: r.columns, rows: rows}, nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, 0, len(args))
+	for _, a := range args {
+		values = append(values, a.Value)
+	}
+	return values
+}
+
+type fakeSQLTx struct {
+	c *fakeSQLConn
+}
+
+func (tx *fakeSQLTx) Commit() error {
+	tx.c.f.mu.Lock()
+	defer tx.c.f.mu.Unlock()
+	tx.c.f.committed = append(tx.c.f.committed, tx.c.pending...)
+	tx.c.inTx, tx.c.pending = false, nil
+	return nil
+}
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.c.f.mu.Lock()
+	defer tx.c.f.mu.Unlock()
+	tx.c.f.rolledBack = append(tx.c.f.rolledBack, tx.c.pending...)
+	tx.c.inTx, tx.c.pending = false, nil
+	return nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// benchGachaItems 抽選のベンチマーク用のガチャアイテム。実際のガチャと同程度の件数にする
+func benchGachaItems(count int) []*GachaItemMaster {
+	items := make([]*GachaItemMaster, 0, count)
+	for i := 0; i < count; i++ {
+		items = append(items, &GachaItemMaster{
+			ID:       int64(i + 1),
+			GachaID:  1,
+			ItemType: ItemTypeCard,
+			ItemID:   int64(i + 1),
+			Amount:   1,
+			Weight:   (i%10 + 1) * 10,
+		})
+	}
+	return items
+}
+
+func BenchmarkSelectGachaItems100(b *testing.B) {
+	items := benchGachaItems(100)
+	cumulative := cumulativeWeights(items)
+	rng := rand.New(rand.NewSource(1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if result := selectGachaItems(items, cumulative, 100, rng); len(result) != 100 {
+			b.Fatalf("drawn %d items, want 100", len(result))
+		}
+	}
+}
+
+func BenchmarkEachGachaItem(b *testing.B) {
+	items := benchGachaItems(100)
+	cumulative := cumulativeWeights(items)
+	rng := rand.New(rand.NewSource(1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var drawn int
+	eachGachaItem(items, cumulative, b.N, rng, func(*GachaItemMaster) { drawn++ })
+	if drawn != b.N {
+		b.Fatalf("drawn %d items, want %d", drawn, b.N)
+	}
+}
+
+// gachaDrawRecord 抽選でDBに書き込んだ内容
+type gachaDrawRecord struct {
+	spent, consumedCoin, gachaCount int64
+	presents, histories             int
+}
+
+// newTestGachaDrawDB 1つのガチャを引くのに必要な文に応答し、コインの消費と挿入した行数をrecordに記録する
+func newTestGachaDrawDB(record *gachaDrawRecord) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onQuery("LEFT JOIN user_devices", []string{"id", "isu_coin", "device_id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[1], int64(1000000), int64(1)}}
+	})
+	fake.onQuery("FROM gacha_masters", []string{"id", "name", "start_at", "end_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), "gacha1", int64(0), int64(2000)}}
+	})
+	fake.onQuery("FROM gacha_item_masters", []string{"id", "gacha_id", "item_type", "item_id", "amount", "weight"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), int64(1), int64(ItemTypeCard), int64(2), int64(1), int64(1)},
+			{int64(2), int64(1), int64(ItemTypeEnhanceA), int64(10), int64(3), int64(9)},
+		}
+	})
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) {
+		record.spent += args[0].(int64)
+		return 1, nil
+	})
+	fake.onExec("INSERT INTO user_gacha_draws", func(args []driver.Value) (int64, error) {
+		record.gachaCount, record.consumedCoin = args[3].(int64), args[4].(int64)
+		return 1, nil
+	})
+	// プレゼントと抽選履歴はどちらも11列ずつ一括挿入する
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) {
+		record.presents += len(args) / 11
+		return int64(len(args) / 11), nil
+	})
+	fake.onExec("INSERT INTO user_gacha_draw_histories", func(args []driver.Value) (int64, error) {
+		record.histories += len(args) / 11
+		return int64(len(args) / 11), nil
+	})
+	return fake
+}
+
+// postJSON リクエスト時刻を1000としてhandlerにbodyをPOSTする
+func postJSON(route string, handler echo.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return serveAt1000(http.MethodPost, route, handler, req)
+}
+
+// getJSON リクエスト時刻を1000としてhandlerにGETする
+func getJSON(route string, handler echo.HandlerFunc, path string) *httptest.ResponseRecorder {
+	return serveAt1000(http.MethodGet, route, handler, httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// serveAt1000 handlerだけを登録したサーバーでreqを処理する
+func serveAt1000(method, route string, handler echo.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Add(method, route, handler, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("requestTime", int64(1000))
+			return next(c)
+		}
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDrawGachaReportsShortfall(t *testing.T) {
+	prev := gachaPricePerDraw
+	gachaPricePerDraw = 300
+	t.Cleanup(func() { gachaPricePerDraw = prev })
+
+	// 10連に必要な3000コインのうち1000コインだけ所持している
+	fake := &fakeSQL{}
+	fake.onQuery("LEFT JOIN user_devices", []string{"id", "isu_coin", "device_id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[1], int64(1000), int64(1)}}
+	})
+	fake.rules = append(fake.rules, newTestGachaDrawDB(&gachaDrawRecord{}).rules...)
+	h := newTestHandler(t, fake)
+	h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+
+	rec := postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/1/10", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, body = %s, want 409", rec.Code, rec.Body.String())
+	}
+	res := new(NotEnoughCoinResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Message != ErrNotEnoughCoin.Error() || res.Required != 3000 || res.Have != 1000 || res.Shortfall != 2000 {
+		t.Errorf("body = %+v, want required 3000, have 1000 and shortfall 2000", res)
+	}
+	if fake.executed("UPDATE users SET isu_coin") != 0 {
+		t.Errorf("committed = %v, want no coins spent", fake.committed)
+	}
+}
+
+func TestDrawGachaDirectGrant(t *testing.T) {
+	amountPerSec := 1
+	for _, direct := range []bool{false, true} {
+		record := &gachaDrawRecord{}
+		fake := &fakeSQL{}
+		// 直接付与の場合に、付与後のユーザーを取り直す文と付与する文
+		fake.onQuery("SELECT * FROM users WHERE id=?", []string{"id", "isu_coin"}, func(args []driver.Value) [][]driver.Value {
+			return [][]driver.Value{{args[0], int64(1000000) - record.spent}}
+		})
+		fake.onQuery("FROM user_items", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+		fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+			return [][]driver.Value{{int64(10), int64(ItemTypeEnhanceA)}}
+		})
+		fake.onExec("INSERT INTO user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+		fake.onExec("INSERT INTO user_cards", func(args []driver.Value) (int64, error) { return int64(len(args) / 8), nil })
+		fake.rules = append(fake.rules, newTestGachaDrawDB(record).rules...)
+		h := newTestHandler(t, fake)
+		h.Cache.SetItemMaster(&ItemMaster{ID: 2, ItemType: ItemTypeCard, AmountPerSec: &amountPerSec})
+		h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+
+		body := fmt.Sprintf(`{"viewerId":"viewer","oneTimeToken":"token","directGrant":%v}`, direct)
+		rec := postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/1/10", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("direct=%v: status = %d, body = %s", direct, rec.Code, rec.Body.String())
+		}
+		res := new(DrawGachaResponse)
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		// どちらの場合もコインを消費して抽選履歴を残す
+		if record.spent != 10*gachaPricePerDraw || record.histories != 10 {
+			t.Errorf("direct=%v: spent %d, %d histories, want %d and 10", direct, record.spent, record.histories, 10*gachaPricePerDraw)
+		}
+
+		if !direct {
+			// デフォルトはプレゼントとして付与し、カードや強化素材はまだ付与しない
+			if record.presents != 10 || len(res.Presents) != 10 || res.UpdatedResources != nil {
+				t.Errorf("presents: inserted %d, body = %s, want 10 presents without updated resources", record.presents, rec.Body.String())
+			}
+			if fake.executed("INSERT INTO user_cards") != 0 || fake.executed("INSERT INTO user_items") != 0 {
+				t.Errorf("presents: committed = %v, want nothing granted directly", fake.committed)
+			}
+			continue
+		}
+		if record.presents != 0 || len(res.Presents) != 0 || res.UpdatedResources == nil || res.UpdatedResources.User == nil {
+			t.Fatalf("direct: inserted %d presents, body = %s, want no presents and the updated user", record.presents, rec.Body.String())
+		}
+		if res.UpdatedResources.User.IsuCoin != 1000000-10*gachaPricePerDraw {
+			t.Errorf("direct: coin = %d, want the balance after the draw", res.UpdatedResources.User.IsuCoin)
+		}
+		// 10回分の結果が、カード1枚または強化素材3個ずつとして付与されている
+		granted := len(res.UpdatedResources.UserCards)
+		for _, item := range res.UpdatedResources.UserItems {
+			granted += item.Amount / 3
+		}
+		if granted != 10 {
+			t.Errorf("direct: granted %d results, want 10: %s", granted, rec.Body.String())
+		}
+	}
+}
+
+func TestDrawGachaSpendsPricePerDraw(t *testing.T) {
+	prevMax, prevChunk := gachaMaxDrawCount, gachaInsertChunkSize
+	gachaMaxDrawCount, gachaInsertChunkSize = 100, 30
+	t.Cleanup(func() { gachaMaxDrawCount, gachaInsertChunkSize = prevMax, prevChunk })
+
+	for _, n := range []int64{1, 10, 100} {
+		record := &gachaDrawRecord{}
+		fake := newTestGachaDrawDB(record)
+		h := newTestHandler(t, fake)
+		h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+
+		rec := postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, fmt.Sprintf("/user/100/gacha/draw/1/%d", n), `{"viewerId":"viewer","oneTimeToken":"token"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("n=%d: status = %d, body = %s", n, rec.Code, rec.Body.String())
+		}
+
+		// 分割して挿入しても、消費したコインは引いた回数分の価格と一致する
+		want := n * gachaPricePerDraw
+		if record.spent != want || record.consumedCoin != want {
+			t.Errorf("n=%d: spent %d, recorded %d, want %d", n, record.spent, record.consumedCoin, want)
+		}
+		if record.gachaCount != n || record.presents != int(n) || record.histories != int(n) {
+			t.Errorf("n=%d: drawn %d, presents %d, histories %d, want %d each", n, record.gachaCount, record.presents, record.histories, n)
+		}
+		if chunks := (int(n) + 29) / 30; fake.executed("INSERT INTO user_presents") != chunks {
+			t.Errorf("n=%d: presents inserted in %d statements, want %d chunks", n, fake.executed("INSERT INTO user_presents"), chunks)
+		}
+	}
+}
+
+// newTestRerollDB 10連の抽選(id=500)を引き直すのに必要な文に応答する
+// receivedは直前の抽選で付与したプレゼントのうち、既に受け取ったものの数
+func newTestRerollDB(record *gachaDrawRecord, received int64) *fakeSQL {
+	fake := newTestGachaDrawDB(record)
+	fake.withDevice()
+	fake.onQuery("FROM user_gacha_draws", []string{"id", "user_id", "gacha_id", "gacha_count", "consumed_coin", "rerolled", "reroll_of", "pity_count"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(500), args[0], int64(1), int64(10), int64(10) * gachaPricePerDraw, false, nil, int64(0)}}
+	})
+	fake.onQuery("FROM user_gacha_draw_histories", []string{"present_id"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0, 10)
+		for id := int64(1); id <= 10; id++ {
+			rows = append(rows, []driver.Value{id})
+		}
+		return rows
+	})
+	// 受け取り済みのプレゼントは論理削除されているため、取り消した数に含まれない
+	fake.onExec("UPDATE user_presents SET deleted_at", func(args []driver.Value) (int64, error) {
+		return int64(len(args)-3) - received, nil
+	})
+	fake.onExec("UPDATE user_gacha_draws SET rerolled", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestRerollGacha(t *testing.T) {
+	record := &gachaDrawRecord{}
+	fake := newTestRerollDB(record, 0)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/gacha/reroll", h.rerollGacha, "/user/100/gacha/reroll", `{"viewerId":"viewer"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	// 直前の抽選のプレゼントを取り消し、同じ回数をコインを消費せずに引き直す
+	if fake.executed("UPDATE user_presents SET deleted_at") != 1 || fake.executed("SET rerolled=1") != 1 {
+		t.Errorf("committed = %v, want the previous presents canceled and the draw marked rerolled", fake.committed)
+	}
+	if record.spent != 0 || record.gachaCount != 10 || record.presents != 10 || record.consumedCoin != 10*gachaPricePerDraw {
+		t.Errorf("record = %+v, want 10 presents for the refunded coins without spending more", record)
+	}
+}
+
+func TestRerollGachaRejectsReceivedPresents(t *testing.T) {
+	record := &gachaDrawRecord{}
+	fake := newTestRerollDB(record, 1)
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/gacha/reroll", h.rerollGacha, "/user/100/gacha/reroll", `{"viewerId":"viewer"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, body = %s, want 409", rec.Code, rec.Body.String())
+	}
+	// 取り消しはロールバックし、引き直しもしない
+	if fake.executed("UPDATE user_presents") != 0 || fake.discarded("UPDATE user_presents") != 1 {
+		t.Errorf("committed = %v, rolledBack = %v, want the cancellation rolled back", fake.committed, fake.rolledBack)
+	}
+	if record.presents != 0 {
+		t.Errorf("inserted %d presents, want none", record.presents)
+	}
+}
+
+// pityGachaItems 天井のテスト用のガチャアイテム。レアのアイテムは1割で、もう1つはピックアップで2倍にする
+func pityGachaItems() []*GachaItemMaster {
+	rare, rateUp := true, 200
+	return []*GachaItemMaster{
+		{ID: 1, GachaID: 1, ItemType: ItemTypeCard, ItemID: 1, Amount: 1, Weight: 80},
+		{ID: 2, GachaID: 1, ItemType: ItemTypeCard, ItemID: 2, Amount: 1, Weight: 5, IsRare: &rare},
+		{ID: 3, GachaID: 1, ItemType: ItemTypeCard, ItemID: 3, Amount: 1, Weight: 5, IsRare: &rare, RateUpPercent: &rateUp},
+	}
+}
+
+func TestEffectiveOddsAtPity(t *testing.T) {
+	items := pityGachaItems()
+	cumulative := cumulativeWeights(items)
+	const ceiling = 10
+
+	tests := []struct {
+		pity           int
+		wantGuaranteed bool
+		wantWeights    []int64
+	}{
+		// 天井から遠い場合はピックアップを反映した通常のweight
+		{pity: 0, wantGuaranteed: false, wantWeights: []int64{8000, 500, 1000}},
+		// 天井の直前はレアのアイテムだけから、ピックアップを反映したweightで抽選する
+		{pity: ceiling - 1, wantGuaranteed: true, wantWeights: []int64{0, 500, 1000}},
+	}
+	for _, tt := range tests {
+		effective, guaranteed := effectiveCumulativeWeights(items, cumulative, tt.pity, ceiling)
+		if guaranteed != tt.wantGuaranteed {
+			t.Errorf("pity=%d: guaranteed = %v, want %v", tt.pity, guaranteed, tt.wantGuaranteed)
+		}
+		odds := gachaOdds(items, effective)
+		var sum float64
+		for i, o := range odds {
+			if o.Weight != tt.wantWeights[i] {
+				t.Errorf("pity=%d: item %d weight = %d, want %d", tt.pity, o.GachaItemID, o.Weight, tt.wantWeights[i])
+			}
+			sum += o.Probability
+		}
+		if sum < 0.999999 || sum > 1.000001 {
+			t.Errorf("pity=%d: probabilities sum to %f, want 1", tt.pity, sum)
+		}
+	}
+}
+
+func TestSelectGachaItemsWithPity(t *testing.T) {
+	items := pityGachaItems()
+	cumulative := cumulativeWeights(items)
+	const ceiling = 10
+
+	for seed := int64(0); seed < 100; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+
+		// 天井の直前の1回は必ずレアが出て、カウントは0に戻る
+		result, pity := selectGachaItemsWithPity(items, cumulative, 1, ceiling-1, ceiling, rng)
+		if len(result) != 1 || !isRareGachaItem(result[0]) || pity != 0 {
+			t.Fatalf("seed=%d: drawn %v at pity=%d, pity after = %d, want a rare item and 0", seed, result, ceiling-1, pity)
+		}
+
+		// カウントが0から天井の回数だけ引くと、少なくとも1回はレアが出る
+		result, pity = selectGachaItemsWithPity(items, cumulative, ceiling, 0, ceiling, rng)
+		rares := 0
+		for _, item := range result {
+			if isRareGachaItem(item) {
+				rares++
+			}
+		}
+		if len(result) != ceiling || rares == 0 || pity >= ceiling {
+			t.Fatalf("seed=%d: drawn %d items with %d rares, pity after = %d, want a rare within the ceiling", seed, len(result), rares, pity)
+		}
+	}
+}
+
+func TestSelectGachaItemsSingleItem(t *testing.T) {
+	items := []*GachaItemMaster{{ID: 1, GachaID: 1, ItemType: ItemTypeCard, ItemID: 1, Amount: 1, Weight: 3}}
+	rng := rand.New(rand.NewSource(1))
+
+	result := selectGachaItems(items, cumulativeWeights(items), 10, rng)
+	if len(result) != 10 {
+		t.Fatalf("drawn %d items, want 10", len(result))
+	}
+	for i, item := range result {
+		if item.ID != 1 {
+			t.Errorf("draw %d = item %d, want the only item", i+1, item.ID)
+		}
+	}
+}
+
+func TestSelectGachaItemsSkipsZeroWeightEdges(t *testing.T) {
+	// 先頭と末尾のweightが0のアイテムは、累積和の境界でも抽選されない
+	items := []*GachaItemMaster{
+		{ID: 1, GachaID: 1, ItemType: ItemTypeCard, ItemID: 1, Amount: 1, Weight: 0},
+		{ID: 2, GachaID: 1, ItemType: ItemTypeCard, ItemID: 2, Amount: 1, Weight: 1},
+		{ID: 3, GachaID: 1, ItemType: ItemTypeCard, ItemID: 3, Amount: 1, Weight: 1},
+		{ID: 4, GachaID: 1, ItemType: ItemTypeCard, ItemID: 4, Amount: 1, Weight: 0},
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	drawn := make(map[int64]int)
+	for _, item := range selectGachaItems(items, cumulativeWeights(items), 1000, rng) {
+		drawn[item.ID]++
+	}
+	if drawn[1] != 0 || drawn[4] != 0 {
+		t.Errorf("drawn = %v, want no zero-weight items", drawn)
+	}
+	if drawn[2] == 0 || drawn[3] == 0 || drawn[2]+drawn[3] != 1000 {
+		t.Errorf("drawn = %v, want 1000 draws split between items 2 and 3", drawn)
+	}
+
+	// 全アイテムのweightが0の場合は抽選しない
+	zero := []*GachaItemMaster{items[0], items[3]}
+	if result := selectGachaItems(zero, cumulativeWeights(zero), 10, rng); len(result) != 0 {
+		t.Errorf("drawn %d items from an all-zero gacha, want none", len(result))
+	}
+}
+
+func TestSetGachaItemsWithMixedZeroWeights(t *testing.T) {
+	cache := newTestMasterDataCache()
+	mixed := []*GachaItemMaster{
+		{ID: 1, GachaID: 1, ItemType: ItemTypeCard, ItemID: 1, Amount: 1, Weight: 3},
+		{ID: 2, GachaID: 1, ItemType: ItemTypeCard, ItemID: 2, Amount: 1, Weight: 0},
+		{ID: 3, GachaID: 1, ItemType: ItemTypeCard, ItemID: 3, Amount: 1, Weight: 1},
+	}
+	if err := cache.SetGachaItems(1, mixed); err != nil {
+		t.Fatalf("mixed weights rejected: %v", err)
+	}
+
+	// weightが0のアイテムも一覧には残るが、抽選はされない
+	items, cumulative, ok := cache.GetGachaItems(1)
+	if !ok || len(items) != 3 {
+		t.Fatalf("cached %d items, want all 3 listed", len(items))
+	}
+	drawn := make(map[int64]int)
+	for _, item := range selectGachaItems(items, cumulative, 4000, rand.New(rand.NewSource(1))) {
+		drawn[item.ID]++
+	}
+	if drawn[2] != 0 {
+		t.Errorf("zero-weight item drawn %d times, want never", drawn[2])
+	}
+	// weightが3:1のアイテムはおよそ3000回と1000回
+	if drawn[1] < 2800 || drawn[1] > 3200 || drawn[1]+drawn[3] != 4000 {
+		t.Errorf("drawn = %v, want about 3000 and 1000 for items 1 and 3", drawn)
+	}
+
+	// 全アイテムのweightが0のガチャはキャッシュせずにエラーとする
+	allZero := []*GachaItemMaster{
+		{ID: 4, GachaID: 2, ItemType: ItemTypeCard, ItemID: 1, Amount: 1, Weight: 0},
+		{ID: 5, GachaID: 2, ItemType: ItemTypeCard, ItemID: 2, Amount: 1, Weight: 0},
+	}
+	if err := cache.SetGachaItems(2, allZero); err != ErrInvalidGachaWeight {
+		t.Errorf("all-zero gacha err = %v, want ErrInvalidGachaWeight", err)
+	}
+	if _, _, ok := cache.GetGachaItems(2); ok {
+		t.Error("all-zero gacha was cached")
+	}
+}
+
+func TestConcurrentDrawsDoNotOverspend(t *testing.T) {
+	var mu sync.Mutex
+	coin := 3 * gachaPricePerDraw
+	fake := &fakeSQL{}
+	// 読んだ残高を返すまでの間に、同時のガチャも同じ残高を読めるよう遅らせる
+	fake.onQuery("LEFT JOIN user_devices", []string{"id", "isu_coin", "device_id"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		have := coin
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		return [][]driver.Value{{args[1], have, int64(1)}}
+	})
+	fake.onQuery("SELECT isu_coin FROM users", []string{"isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		return [][]driver.Value{{coin}}
+	})
+	// 残高が足りる場合のみ減らす
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if coin < args[2].(int64) {
+			return 0, nil
+		}
+		coin -= args[0].(int64)
+		return 1, nil
+	})
+	fake.rules = append(fake.rules, newTestGachaDrawDB(&gachaDrawRecord{}).rules...)
+	h := newTestHandler(t, fake)
+
+	const draws = 5
+	codes := make([]int, draws)
+	var wg sync.WaitGroup
+	for i := 0; i < draws; i++ {
+		token := fmt.Sprintf("token%d", i)
+		h.TokenCache.SetToken(token, 100, 1, 2000, 0)
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			rec := postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/1/1", fmt.Sprintf(`{"viewerId":"viewer","oneTimeToken":%q}`, token))
+			codes[i] = rec.Code
+		}(i, token)
+	}
+	wg.Wait()
+
+	succeeded, rejected := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusConflict:
+			rejected++
+		}
+	}
+	if succeeded != 3 || rejected != 2 || coin != 0 {
+		t.Errorf("codes = %v, coin left = %d, want 3 draws, 2 rejected and no coin left", codes, coin)
+	}
+	// 直列化されていれば、残高が足りないガチャは消費を試みる前に弾かれる
+	if n := fake.executed("UPDATE users SET isu_coin") + fake.discarded("UPDATE users SET isu_coin"); n != 3 {
+		t.Errorf("tried to spend coins %d times, want 3", n)
+	}
+}
+
+func TestDrawGachaEndedAfterListing(t *testing.T) {
+	record := &gachaDrawRecord{}
+	fake := &fakeSQL{}
+	var loads int
+	// ガチャ1は一覧を取得した900には開催中で、引く1000までに終了している
+	fake.onQuery("FROM gacha_masters", []string{"id", "name", "start_at", "end_at"}, func(args []driver.Value) [][]driver.Value {
+		loads++
+		return [][]driver.Value{
+			{int64(1), "gacha1", int64(0), int64(950)},
+			{int64(2), "gacha2", int64(0), int64(2000)},
+		}
+	})
+	fake.rules = append(fake.rules, newTestGachaDrawDB(record).rules...)
+	h := newTestHandler(t, fake)
+
+	active, _, _, err := h.getActiveGachas(context.Background(), "", 900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 {
+		t.Fatalf("listed %d gachas, want 2", len(active))
+	}
+
+	h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+	rec := postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/1/1", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+	if rec.Code != http.StatusNotFound || record.spent != 0 {
+		t.Errorf("ended gacha: status = %d, spent = %d, want 404 without spending", rec.Code, record.spent)
+	}
+	h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+	rec = postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/2/1", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("open gacha: status = %d, body = %s, want 200", rec.Code, rec.Body.String())
+	}
+	// 開催期間は一覧で読み込んだ索引で確認し、引くたびにDBを読まない
+	if loads != 1 {
+		t.Errorf("gacha_masters read %d times, want once for the listing", loads)
+	}
+}
+
+func TestLoadGachaListCapsActiveGachas(t *testing.T) {
+	prev := maxActiveGachas
+	maxActiveGachas = 5
+	t.Cleanup(func() { maxActiveGachas = prev })
+
+	// 開催中のガチャ1〜200。idが大きいほどdisplay_orderが小さい
+	const gachas = 200
+	fake := &fakeSQL{}
+	fake.onQuery("FROM gacha_masters", []string{"id", "name", "start_at", "end_at", "display_order"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0, gachas)
+		for id := int64(1); id <= gachas; id++ {
+			rows = append(rows, []driver.Value{id, fmt.Sprintf("gacha%d", id), int64(0), int64(2000), gachas - id})
+		}
+		return rows
+	})
+	var itemQueries int
+	var queriedIDs []driver.Value
+	fake.onQuery("FROM gacha_item_masters", []string{"id", "gacha_id", "item_type", "item_id", "amount", "weight"}, func(args []driver.Value) [][]driver.Value {
+		itemQueries++
+		queriedIDs = args
+		rows := make([][]driver.Value, 0, len(args))
+		for _, id := range args {
+			rows = append(rows, []driver.Value{id, id, int64(ItemTypeEnhanceA), int64(10), int64(1), int64(1)})
+		}
+		return rows
+	})
+	fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(ItemTypeEnhanceA)}}
+	})
+	h := newTestHandler(t, fake)
+
+	list, _, _, err := h.loadGachaList(context.Background(), "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// display_order順に先頭の5件だけを返し、アイテムは1回の問い合わせでまとめて読む
+	if len(list) != 5 {
+		t.Fatalf("listed %d gachas, want 5", len(list))
+	}
+	for i, g := range list {
+		if want := int64(gachas - i); g.Gacha.ID != want || len(g.GachaItem) != 1 || g.GachaItem[0].GachaID != want {
+			t.Errorf("gacha %d = %+v with items %+v, want gacha %d with its item", i, g.Gacha, g.GachaItem, want)
+		}
+	}
+	if itemQueries != 1 || len(queriedIDs) != 5 {
+		t.Errorf("gacha_item_masters queried %d times for %v, want once for the 5 listed gachas", itemQueries, queriedIDs)
+	}
+}
+
+func TestMarkNewGachaItems(t *testing.T) {
+	prev := gachaNewItemWindow
+	gachaNewItemWindow = 100
+	t.Cleanup(func() { gachaNewItemWindow = prev })
+
+	// 1000時点で、900以降に作成したアイテムが新着
+	cached := []*GachaData{
+		{Gacha: &GachaMaster{ID: 1}, GachaItem: []*GachaItemMaster{
+			{ID: 11, CreatedAt: 800},
+			{ID: 12, CreatedAt: 900},
+			{ID: 13, CreatedAt: 1000},
+			{ID: 14, CreatedAt: 1001},
+		}},
+		{Gacha: &GachaMaster{ID: 2}, GachaItem: []*GachaItemMaster{{ID: 21, CreatedAt: 0}}},
+	}
+
+	marked := markNewGachaItems(cached, 1000)
+	want := map[int64]bool{11: false, 12: true, 13: true, 14: false, 21: false}
+	for _, g := range marked {
+		for _, item := range g.GachaItem {
+			if item.IsNew != want[item.ID] {
+				t.Errorf("item %d isNew = %v, want %v", item.ID, item.IsNew, want[item.ID])
+			}
+		}
+	}
+	// キャッシュしている一覧は書き換えない
+	for _, g := range cached {
+		for _, item := range g.GachaItem {
+			if item.IsNew {
+				t.Errorf("cached item %d marked as new", item.ID)
+			}
+		}
+	}
+	if marked[1] != cached[1] {
+		t.Errorf("gacha 2 copied, want the cached gacha without new items shared")
+	}
+
+	gachaNewItemWindow = 0
+	for _, item := range markNewGachaItems(cached, 1000)[0].GachaItem {
+		if item.IsNew {
+			t.Errorf("window 0: item %d marked as new, want none", item.ID)
+		}
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/labstack/echo/v4 v4.7.2
 	github.com/pkg/errors v0.9.1
+	golang.org/x/sync v0.3.0
 )
 
 require (
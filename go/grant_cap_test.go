@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// setCoinCap テストの間だけコインの所持上限を変える
+func setCoinCap(t *testing.T, limit int64) {
+	t.Helper()
+	prev := coinCap
+	coinCap = limit
+	t.Cleanup(func() { coinCap = prev })
+}
+
+func TestCapCoinAtBoundary(t *testing.T) {
+	setCoinCap(t, 1000)
+
+	tests := []struct {
+		name         string
+		current      int64
+		amount       int64
+		wantTotal    int64
+		wantOverflow int64
+	}{
+		{name: "below cap", current: 900, amount: 99, wantTotal: 999, wantOverflow: 0},
+		{name: "exactly reaches cap", current: 900, amount: 100, wantTotal: 1000, wantOverflow: 0},
+		{name: "one over cap", current: 900, amount: 101, wantTotal: 1000, wantOverflow: 1},
+		{name: "already at cap", current: 1000, amount: 1, wantTotal: 1000, wantOverflow: 1},
+		{name: "above cap before grant", current: 1200, amount: 10, wantTotal: 1200, wantOverflow: 10},
+		{name: "consumption is not clamped", current: 1000, amount: -300, wantTotal: 700, wantOverflow: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, overflow := capCoin(tt.current, tt.amount)
+			if total != tt.wantTotal || overflow != tt.wantOverflow {
+				t.Errorf("capCoin(%d, %d) = (%d, %d), want (%d, %d)", tt.current, tt.amount, total, overflow, tt.wantTotal, tt.wantOverflow)
+			}
+		})
+	}
+}
+
+func TestCapCoinWithoutCapDoesNotOverflow(t *testing.T) {
+	setCoinCap(t, 0)
+
+	total, overflow := capCoin(math.MaxInt64-10, 100)
+	if total != math.MaxInt64 || overflow != 90 {
+		t.Errorf("capCoin = (%d, %d), want (%d, 90)", total, overflow, int64(math.MaxInt64))
+	}
+}
+
+func TestSplitOverflowPresentsHoldsCoinOverflowAtCap(t *testing.T) {
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeCoin, ItemID: 1, Amount: 100, Source: PresentSourceLoginBonus},
+		{ID: 2, ItemType: ItemTypeCoin, ItemID: 1, Amount: 500, Source: PresentSourceCoinOverflow},
+		{ID: 3, ItemType: ItemTypeCard, ItemID: 2, Amount: 1, Source: PresentSourceGacha},
+	}
+
+	receivable, held := splitOverflowPresents(presents, true, nil)
+	if len(held) != 1 || held[0].ID != 2 {
+		t.Fatalf("held = %v, want only the coin overflow present", presentIDs(held))
+	}
+	if len(receivable) != 2 || receivable[0].ID != 1 || receivable[1].ID != 3 {
+		t.Errorf("receivable = %v, want [1 3]", presentIDs(receivable))
+	}
+
+	receivable, held = splitOverflowPresents(presents, false, nil)
+	if len(held) != 0 || len(receivable) != 3 {
+		t.Errorf("with room: receivable = %v, held = %v, want all receivable", presentIDs(receivable), presentIDs(held))
+	}
+}
+
+func TestGrantClampsInResponses(t *testing.T) {
+	var clamps GrantClamps
+	clamps.merge(GrantClamps{})
+	clamps.merge(GrantClamps{CoinClamped: true})
+	clamps.merge(GrantClamps{})
+	if !clamps.CoinClamped {
+		t.Fatal("merged clamps lost coinClamped")
+	}
+
+	responses := []interface{}{
+		&ReceivePresentResponse{GrantClamps: clamps},
+		&ExchangeItemResponse{GrantClamps: clamps},
+		&DrawGachaResponse{GrantClamps: clamps},
+	}
+	for _, res := range responses {
+		b, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"coinClamped":true`) {
+			t.Errorf("%T = %s, want coinClamped", res, b)
+		}
+	}
+}
+
+func TestCapItemAmountAtStackBoundary(t *testing.T) {
+	maxStack := 100
+	item := &ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA, MaxStack: &maxStack}
+
+	tests := []struct {
+		name         string
+		current      int64
+		amount       int64
+		wantTotal    int64
+		wantOverflow int64
+	}{
+		{name: "below stack limit", current: 90, amount: 9, wantTotal: 99, wantOverflow: 0},
+		{name: "exactly reaches stack limit", current: 90, amount: 10, wantTotal: 100, wantOverflow: 0},
+		{name: "grant that would overflow", current: 90, amount: 25, wantTotal: 100, wantOverflow: 15},
+		{name: "already at stack limit", current: 100, amount: 1, wantTotal: 100, wantOverflow: 1},
+		{name: "consumption is not clamped", current: 100, amount: -40, wantTotal: 60, wantOverflow: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, overflow := capItemAmount(item, tt.current, tt.amount)
+			if total != tt.wantTotal || overflow != tt.wantOverflow {
+				t.Errorf("capItemAmount(%d, %d) = (%d, %d), want (%d, %d)", tt.current, tt.amount, total, overflow, tt.wantTotal, tt.wantOverflow)
+			}
+		})
+	}
+}
+
+func TestCapItemAmountWithoutStackLimitFitsInt(t *testing.T) {
+	item := &ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA}
+
+	total, overflow := capItemAmount(item, math.MaxInt32-5, 8)
+	if total != math.MaxInt32 || overflow != 3 {
+		t.Errorf("capItemAmount = (%d, %d), want (%d, 3)", total, overflow, math.MaxInt32)
+	}
+}
+
+func TestSplitOverflowPresentsHoldsItemOverflowAtStackLimit(t *testing.T) {
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 5, Source: PresentSourceItemOverflow},
+		{ID: 2, ItemType: ItemTypeEnhanceA, ItemID: 11, Amount: 5, Source: PresentSourceItemOverflow},
+		{ID: 3, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 5, Source: PresentSourcePresentAll},
+	}
+
+	receivable, held := splitOverflowPresents(presents, false, map[int64]bool{10: true, 11: false})
+	if len(held) != 1 || held[0].ID != 1 {
+		t.Fatalf("held = %v, want only the overflow present of the full item", presentIDs(held))
+	}
+	if len(receivable) != 2 || receivable[0].ID != 2 || receivable[1].ID != 3 {
+		t.Errorf("receivable = %v, want [2 3]", presentIDs(receivable))
+	}
+}
+
+func TestGrantClampsReportsItemOverflow(t *testing.T) {
+	var clamps GrantClamps
+	clamps.addItem(10, 0)
+	clamps.addItem(10, 15)
+	other := GrantClamps{}
+	other.addItem(10, 5)
+	other.addItem(11, 3)
+	clamps.merge(other)
+
+	if len(clamps.ClampedItems) != 2 {
+		t.Fatalf("clampedItems = %d entries, want 2", len(clamps.ClampedItems))
+	}
+	if got := clamps.ClampedItems[0]; got.ItemID != 10 || got.Overflow != 20 {
+		t.Errorf("clampedItems[0] = %+v, want itemId 10 overflow 20", got)
+	}
+	if got := clamps.ClampedItems[1]; got.ItemID != 11 || got.Overflow != 3 {
+		t.Errorf("clampedItems[1] = %+v, want itemId 11 overflow 3", got)
+	}
+
+	b, err := json.Marshal(&RespecCardResponse{GrantClamps: clamps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"clampedItems":[{"itemId":10,"overflow":20},{"itemId":11,"overflow":3}]`) {
+		t.Errorf("response = %s, want clampedItems", b)
+	}
+}
+
+func presentIDs(presents []*UserPresent) []int64 {
+	ids := make([]int64, 0, len(presents))
+	for _, p := range presents {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/gommon/log"
+	"github.com/pkg/errors"
+)
+
+func duplicatePrimaryKeyError() error {
+	return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'user_presents.PRIMARY'"}
+}
+
+// collidingExecer 最初のcollisions回のExecContextを主キーの重複で失敗させ、渡されたidを記録する
+type collidingExecer struct {
+	collisions int
+	ids        []int64
+}
+
+func (e *collidingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.ids = append(e.ids, args[0].(int64))
+	if len(e.ids) <= e.collisions {
+		return nil, duplicatePrimaryKeyError()
+	}
+	return nil, nil
+}
+
+func newTestIDHandler(t testing.TB) *Handler {
+	t.Helper()
+	idGen, err := NewIDGenerator(1, 10*time.Millisecond, log.New("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{IDGen: idGen}
+}
+
+func TestRetryOnIDCollisionRegeneratesID(t *testing.T) {
+	h := newTestIDHandler(t)
+	id := int64(1)
+	used := make([]int64, 0)
+
+	err := h.retryOnIDCollision(func() error {
+		used = append(used, id)
+		if len(used) == 1 {
+			return duplicatePrimaryKeyError()
+		}
+		return nil
+	}, &id)
+	if err != nil {
+		t.Fatalf("retryOnIDCollision returned %v, want success after retry", err)
+	}
+	if len(used) != 2 || used[1] == used[0] {
+		t.Errorf("ids used = %v, want a new id on the retry", used)
+	}
+}
+
+func TestRetryOnIDCollisionIsBounded(t *testing.T) {
+	h := newTestIDHandler(t)
+	id := int64(1)
+	calls := 0
+
+	err := h.retryOnIDCollision(func() error {
+		calls++
+		return duplicatePrimaryKeyError()
+	}, &id)
+	if !isDuplicatePrimaryKey(err) {
+		t.Fatalf("err = %v, want the duplicate key error", err)
+	}
+	if calls != IDCollisionMaxRetries+1 {
+		t.Errorf("insert called %d times, want %d", calls, IDCollisionMaxRetries+1)
+	}
+}
+
+func TestRetryOnIDCollisionSkipsUniqueKeys(t *testing.T) {
+	h := newTestIDHandler(t)
+	id := int64(1)
+	calls := 0
+
+	err := h.retryOnIDCollision(func() error {
+		calls++
+		return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'abc' for key 'user_names.name'"}
+	}, &id)
+	if err == nil || calls != 1 || id != 1 {
+		t.Errorf("err = %v, calls = %d, id = %d, want the error without retrying", err, calls, id)
+	}
+}
+
+func TestIsDuplicatePrimaryKey(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'user_cards.PRIMARY'"}, want: true},
+		{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"}, want: true},
+		{err: errors.Wrap(duplicatePrimaryKeyError(), "insert"), want: true},
+		{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'uniq_token'"}, want: false},
+		{err: &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, want: false},
+		{err: sql.ErrNoRows, want: false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicatePrimaryKey(tt.err); got != tt.want {
+			t.Errorf("isDuplicatePrimaryKey(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHandleOverflowRetriesOnIDCollision(t *testing.T) {
+	prevCoin, prevItem := coinOverflowMode, itemOverflowMode
+	coinOverflowMode, itemOverflowMode = CoinOverflowModePresent, CoinOverflowModePresent
+	t.Cleanup(func() { coinOverflowMode, itemOverflowMode = prevCoin, prevItem })
+
+	h := newTestIDHandler(t)
+	ctx := context.Background()
+
+	coinDB := &collidingExecer{collisions: 1}
+	if err := h.handleCoinOverflow(ctx, coinDB, 1, 100, 1000); err != nil {
+		t.Fatalf("handleCoinOverflow: %v", err)
+	}
+	if len(coinDB.ids) != 2 || coinDB.ids[0] == coinDB.ids[1] {
+		t.Errorf("coin overflow present ids = %v, want a new id on the retry", coinDB.ids)
+	}
+
+	itemDB := &collidingExecer{collisions: 2}
+	item := &ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA}
+	if err := h.handleItemOverflow(ctx, itemDB, 1, item, 5, 1000); err != nil {
+		t.Fatalf("handleItemOverflow: %v", err)
+	}
+	if len(itemDB.ids) != 3 {
+		t.Errorf("item overflow present inserted %d times, want 3", len(itemDB.ids))
+	}
+}
+
+// rollbackNode idsを順に返し、使い切った後は最後のidを返し続ける。時計が巻き戻って止まったノードを再現する
+type rollbackNode struct {
+	ids   []int64
+	calls int
+}
+
+func (n *rollbackNode) Generate() snowflake.ID {
+	n.calls++
+	if len(n.ids) > 1 {
+		id := n.ids[0]
+		n.ids = n.ids[1:]
+		return snowflake.ID(id)
+	}
+	return snowflake.ID(n.ids[0])
+}
+
+func TestIDGeneratorWaitsOutClockRollback(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.New("test")
+	logger.SetOutput(&logs)
+	// 時計が巻き戻って直前以下のidが2回続いた後、追いついて大きいidに戻る
+	node := &rollbackNode{ids: []int64{100, 90, 100, 101}}
+	g := newIDGenerator(node, time.Second, logger)
+
+	if id, err := g.Generate(); err != nil || id != 100 {
+		t.Fatalf("first id = (%d, %v), want 100", id, err)
+	}
+	id, err := g.Generate()
+	if err != nil || id != 101 {
+		t.Fatalf("id after rollback = (%d, %v), want 101", id, err)
+	}
+	if node.calls != 4 {
+		t.Errorf("node called %d times, want 4", node.calls)
+	}
+	if got := strings.Count(logs.String(), "clock rollback detected"); got != 1 {
+		t.Errorf("logged rollback %d times, want once per call: %s", got, logs.String())
+	}
+}
+
+func TestIDGeneratorFailsWhenClockStaysBehind(t *testing.T) {
+	logger := log.New("test")
+	logger.SetOutput(io.Discard)
+	node := &rollbackNode{ids: []int64{100, 50}}
+	g := newIDGenerator(node, 5*time.Millisecond, logger)
+
+	if _, err := g.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := g.Generate(); errors.Cause(err) != ErrIDNotMonotonic {
+		t.Fatalf("Generate = (%d, %v), want ErrIDNotMonotonic", id, err)
+	}
+	// 失敗しても直前のidは巻き戻さず、時計が追いつけば再び採番できる
+	node.ids = []int64{101}
+	if id, err := g.Generate(); err != nil || id != 101 {
+		t.Errorf("id after recovery = (%d, %v), want 101", id, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// //////////////////////////////////////
+// initialize marker
+
+// initializeFingerprintQueries 初期化後にユーザーデータが変わったかを判定するためのクエリ
+// ベンチマーカーなどが触れるとほぼ必ずいずれかの値が変わる、安価に求められる値を選んでいる
+// 既存の行のうちupdated_atを更新しないUPDATEは検知できないため、疑わしい場合は force=1 で再投入すること
+var initializeFingerprintQueries = []string{
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), COALESCE(SUM(isu_coin), 0) FROM users",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_presents",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_sessions",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_one_time_tokens",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), COALESCE(SUM(amount), 0) FROM user_items",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), COALESCE(SUM(total_exp), 0) FROM user_cards",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_decks",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_login_bonuses",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(updated_at), 0), 0 FROM user_bans",
+	"SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(SUM(status), 0), 0 FROM version_masters",
+}
+
+// initializeBaseline 初期データのファイル(init.shとSQL)の名前・サイズ・更新日時から求めたチェックサム
+// 初期データが差し替えられた場合は再投入が必要になる
+func initializeBaseline(dir string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return "", err
+	}
+	paths = append(paths, filepath.Join(dir, "init.sh"))
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\t%d\t%d\n", filepath.Base(path), info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// initializeFingerprint 現在のユーザーデータのチェックサム
+func initializeFingerprint(db *sqlx.DB) (string, error) {
+	values := make([]string, 0, len(initializeFingerprintQueries))
+	for _, query := range initializeFingerprintQueries {
+		var count, maxID, maxUpdatedAt, sum int64
+		if err := db.QueryRow(query).Scan(&count, &maxID, &maxUpdatedAt, &sum); err != nil {
+			return "", err
+		}
+		values = append(values, fmt.Sprintf("%d,%d,%d,%d", count, maxID, maxUpdatedAt, sum))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(values, "\n")))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// isInitializeFresh 最後に初期化した時点から初期データもユーザーデータも変わっていないかどうか
+// マーカーがない・読めない場合は変わったものとして扱う
+func isInitializeFresh(db *sqlx.DB, baseline string) bool {
+	var marker struct {
+		Baseline    string `db:"baseline"`
+		Fingerprint string `db:"fingerprint"`
+	}
+	if err := db.Get(&marker, "SELECT baseline, fingerprint FROM initialize_markers WHERE id=1"); err != nil {
+		return false
+	}
+	if marker.Baseline != baseline {
+		return false
+	}
+	fingerprint, err := initializeFingerprint(db)
+	if err != nil {
+		return false
+	}
+	return marker.Fingerprint == fingerprint
+}
+
+// saveInitializeMarker 初期化直後の状態をマーカーとして記録する
+func saveInitializeMarker(db *sqlx.DB, baseline string, initializedAt int64) error {
+	fingerprint, err := initializeFingerprint(db)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO initialize_markers(id, baseline, fingerprint, initialized_at) VALUES (1, ?, ?, ?) ON DUPLICATE KEY UPDATE baseline=VALUES(baseline), fingerprint=VALUES(fingerprint), initialized_at=VALUES(initialized_at)"
+	_, err = db.Exec(query, baseline, fingerprint, initializedAt)
+	return err
+}
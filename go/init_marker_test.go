@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInitializeBaseline(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"init.sh", "1_schema.sql", "2_init.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := initializeBaseline(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := initializeBaseline(dir); err != nil || again != before {
+		t.Errorf("baseline changed without touching the files: %s, %v", again, err)
+	}
+
+	// 初期データを差し替えると変わる
+	path := filepath.Join(dir, "2_init.sql")
+	if err := os.WriteFile(path, []byte("INSERT INTO users VALUES (1);"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := initializeBaseline(dir); err != nil || after == before {
+		t.Errorf("baseline = %s, %v, want it changed after replacing 2_init.sql", after, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "init.sh")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initializeBaseline(dir); err == nil {
+		t.Error("baseline computed without init.sh, want an error")
+	}
+}
+
+func TestIsInitializeFresh(t *testing.T) {
+	users := int64(10)
+	var marker []driver.Value
+	fake := &fakeSQL{}
+	fake.onExec("INSERT INTO initialize_markers", func(args []driver.Value) (int64, error) {
+		marker = []driver.Value{args[0], args[1]}
+		return 1, nil
+	})
+	fake.onQuery("FROM initialize_markers", []string{"baseline", "fingerprint"}, func(args []driver.Value) [][]driver.Value {
+		if marker == nil {
+			return nil
+		}
+		return [][]driver.Value{marker}
+	})
+	fake.onQuery("FROM users", []string{"count", "max_id", "max_updated_at", "sum"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{users, users, int64(0), int64(0)}}
+	})
+	fake.onQuery("SELECT COUNT(*)", []string{"count", "max_id", "max_updated_at", "sum"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0), int64(0), int64(0), int64(0)}}
+	})
+	db := fake.open()
+
+	if isInitializeFresh(db, "baseline") {
+		t.Error("fresh without a marker, want a reseed")
+	}
+	if err := saveInitializeMarker(db, "baseline", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !isInitializeFresh(db, "baseline") {
+		t.Error("not fresh right after initializing, want the reseed skipped")
+	}
+	if isInitializeFresh(db, "other") {
+		t.Error("fresh with another baseline, want a reseed")
+	}
+	// ユーザーデータが変わった場合は再投入する
+	users++
+	if isInitializeFresh(db, "baseline") {
+		t.Error("fresh after a user was created, want a reseed")
+	}
+}
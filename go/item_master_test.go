@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newTestNullCardMasterDB amount_per_secがNULLのカードマスタを返す
+func newTestNullCardMasterDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM item_masters", []string{"id", "item_type", "amount_per_sec", "max_level"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(ItemTypeCard), nil, nil}}
+	})
+	return fake
+}
+
+func TestObtainItemRejectsNullCardMaster(t *testing.T) {
+	h := newTestHandler(t)
+	h.DB = newTestNullCardMasterDB().open()
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := h.obtainItem(context.Background(), tx, 100, 2, ItemTypeCard, 1, 1000); err != ErrInvalidItemMaster {
+		t.Errorf("err = %v, want ErrInvalidItemMaster", err)
+	}
+}
+
+func TestObtainItemsBatchRejectsNullCardMaster(t *testing.T) {
+	h := newTestHandler(t)
+	h.DB = newTestNullCardMasterDB().open()
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	presents := []*UserPresent{{ID: 1, ItemType: ItemTypeCard, ItemID: 2, Amount: 1}}
+	if _, err := h.obtainItemsBatch(context.Background(), tx, presents, 100, 1000); err != ErrInvalidItemMaster {
+		t.Errorf("err = %v, want ErrInvalidItemMaster", err)
+	}
+}
+
+func TestCreateUserRejectsNullInitialCardMaster(t *testing.T) {
+	fake := newTestNullCardMasterDB()
+	fake.onExec("INSERT INTO users", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_devices", func(args []driver.Value) (int64, error) { return 1, nil })
+	h := newTestHandler(t, fake)
+	h.DB = newTestNullCardMasterDB().open()
+
+	rec := postJSON("/user", h.createUser, "/user", `{"viewerId":"viewer","platformType":1}`)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), ErrInvalidItemMaster.Error()) {
+		t.Fatalf("status = %d, body = %s, want 500 with %v", rec.Code, rec.Body.String(), ErrInvalidItemMaster)
+	}
+	if fake.executed("INSERT INTO users") != 0 || fake.discarded("INSERT INTO users") != 1 {
+		t.Errorf("committed = %v, want the user creation rolled back", fake.committed)
+	}
+}
+
+func TestIsEnhanceMaterial(t *testing.T) {
+	// obtainItemでuser_itemsに積み上げる種別だけが強化素材
+	tests := []struct {
+		itemType int
+		want     bool
+	}{
+		{itemType: 0, want: false},
+		{itemType: ItemTypeCoin, want: false},
+		{itemType: ItemTypeCard, want: false},
+		{itemType: ItemTypeEnhanceA, want: true},
+		{itemType: ItemTypeEnhanceB, want: true},
+		{itemType: 5, want: false},
+	}
+	for _, tt := range tests {
+		if got := isEnhanceMaterial(tt.itemType); got != tt.want {
+			t.Errorf("isEnhanceMaterial(%d) = %v, want %v", tt.itemType, got, tt.want)
+		}
+	}
+}
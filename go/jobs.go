@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// admin jobs
+
+const (
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCanceled  = "canceled"
+)
+
+const (
+	JobKindMasterUpdate = "master_update"
+	JobKindMasterExport = "master_export"
+	JobKindPurge        = "purge"
+	JobKindCoinGrant    = "coin_grant"
+)
+
+// jobRetention 終了したジョブの状態を保持する期間
+const jobRetention = time.Hour
+
+// Job 管理APIの長い処理の進捗
+// 処理はバッチの区切りごとにContext()を確認し、キャンセルされたらそれまでの進捗を残して止まる
+type Job struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	// Progress 途中経過。形は処理ごとに異なり、キャンセルや失敗で止まった場合もそこまでの値が残る
+	Progress interface{} `json:"progress,omitempty"`
+	// Result 成功した場合の結果
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	// CancelRequested キャンセルを受け付けたかどうか。処理中のバッチが終わるまではrunningのまま
+	CancelRequested bool  `json:"cancelRequested"`
+	StartedAt       int64 `json:"startedAt"`
+	FinishedAt      int64 `json:"finishedAt,omitempty"`
+}
+
+// newJob ジョブを作成する
+func newJob(id, kind string, startedAt int64) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Job{
+		ctx:       ctx,
+		cancel:    cancel,
+		ID:        id,
+		Kind:      kind,
+		Status:    JobStatusRunning,
+		StartedAt: startedAt,
+	}
+}
+
+// Context キャンセルされると終了するcontext
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Cancel ジョブにキャンセルを要求する。既に終了している場合はfalseを返す
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.Status != JobStatusRunning {
+		return false
+	}
+	j.CancelRequested = true
+	j.cancel()
+	return true
+}
+
+// SetProgress 途中経過を更新する。渡した値はスナップショットから参照されるため、以降は変更しないこと
+func (j *Job) SetProgress(progress interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Progress = progress
+}
+
+// Finish ジョブの結果を記録する
+func (j *Job) Finish(result interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.FinishedAt = time.Now().Unix()
+	j.cancel()
+	switch {
+	case err != nil && errors.Cause(err) == context.Canceled:
+		j.Status = JobStatusCanceled
+		j.Error = err.Error()
+	case err != nil:
+		j.Status = JobStatusFailed
+		j.Error = err.Error()
+	default:
+		j.Status = JobStatusSucceeded
+		j.Result = result
+	}
+}
+
+// Snapshot レスポンス用にジョブの状態をコピーする
+func (j *Job) Snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return &Job{
+		ID:              j.ID,
+		Kind:            j.Kind,
+		Status:          j.Status,
+		Progress:        j.Progress,
+		Result:          j.Result,
+		Error:           j.Error,
+		CancelRequested: j.CancelRequested,
+		StartedAt:       j.StartedAt,
+		FinishedAt:      j.FinishedAt,
+	}
+}
+
+// Jobs 管理APIのジョブの一覧。プロセス内でのみ保持する
+type Jobs struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobs 新しいジョブ一覧を作成
+func NewJobs() *Jobs {
+	return &Jobs{
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Add ジョブを追加する。あわせて、終了してから一定時間経ったジョブを削除する
+func (js *Jobs) Add(job *Job) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	expiredAt := time.Now().Add(-jobRetention).Unix()
+	for id, j := range js.jobs {
+		j.mu.Lock()
+		expired := j.FinishedAt != 0 && j.FinishedAt < expiredAt
+		j.mu.Unlock()
+		if expired {
+			delete(js.jobs, id)
+		}
+	}
+	js.jobs[job.ID] = job
+}
+
+// Get ジョブを取得する
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	return job, ok
+}
+
+// Running 実行中のジョブを開始日時順で返す
+func (js *Jobs) Running() []*Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	running := make([]*Job, 0)
+	for _, j := range js.jobs {
+		snapshot := j.Snapshot()
+		if snapshot.Status == JobStatusRunning {
+			running = append(running, snapshot)
+		}
+	}
+	sort.Slice(running, func(i, k int) bool { return running[i].StartedAt < running[k].StartedAt })
+	return running
+}
+
+// startJob ジョブを作成して一覧に登録する。終了したらFinishを呼ぶこと
+func (h *Handler) startJob(kind string, startedAt int64) (*Job, error) {
+	id, err := generateUUID()
+	if err != nil {
+		return nil, err
+	}
+	job := newJob(id, kind, startedAt)
+	h.Jobs.Add(job)
+	return job, nil
+}
+
+// runAdminJob runをジョブとして実行する
+// async=1 の場合はジョブIDを返してバックグラウンドで実行し、それ以外は終了を待って結果を返す
+// どちらの場合も実行中は GET /admin/jobs に表示され、POST /admin/jobs/{jobID}/cancel で止められる
+// 同期実行でキャンセルされた場合は、途中経過を含むジョブの状態を409で返す
+func (h *Handler) runAdminJob(c echo.Context, kind string, startedAt int64, run func(job *Job) (interface{}, error)) error {
+	job, err := h.startJob(kind, startedAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if c.QueryParam("async") == "1" {
+		logger := c.Logger()
+		go func() {
+			res, err := run(job)
+			if err != nil {
+				logger.Errorf("job failed: kind=%s, jobID=%s, err=%+v", kind, job.ID, err)
+			}
+			job.Finish(res, err)
+		}()
+		return c.JSON(http.StatusAccepted, &AdminJobResponse{
+			JobID: job.ID,
+		})
+	}
+
+	res, err := run(job)
+	job.Finish(res, err)
+	if err != nil {
+		if errors.Cause(err) == context.Canceled {
+			return c.JSON(http.StatusConflict, job.Snapshot())
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	return successResponse(c, res)
+}
+
+// adminListJobs 実行中のジョブの一覧
+// GET /admin/jobs
+func (h *Handler) adminListJobs(c echo.Context) error {
+	return successResponse(c, &AdminListJobsResponse{
+		Jobs: h.Jobs.Running(),
+	})
+}
+
+// adminGetJob ジョブの進捗と結果
+// GET /admin/jobs/{jobID}
+func (h *Handler) adminGetJob(c echo.Context) error {
+	job, ok := h.Jobs.Get(c.Param("jobID"))
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrJobNotFound)
+	}
+	return successResponse(c, job.Snapshot())
+}
+
+// adminCancelJob 実行中のジョブをキャンセルする
+// キャンセルはバッチの区切りで反映されるため、止まったかどうかは GET /admin/jobs/{jobID} で確認する
+// POST /admin/jobs/{jobID}/cancel
+func (h *Handler) adminCancelJob(c echo.Context) error {
+	job, ok := h.Jobs.Get(c.Param("jobID"))
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrJobNotFound)
+	}
+	if !job.Cancel() {
+		return errorResponse(c, http.StatusConflict, ErrJobNotRunning)
+	}
+	return c.JSON(http.StatusAccepted, job.Snapshot())
+}
+
+type AdminJobResponse struct {
+	JobID string `json:"jobId"`
+}
+
+type AdminListJobsResponse struct {
+	Jobs []*Job `json:"jobs"`
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// batchingJob バッチの区切りごとにキャンセルを確認しながら、止められるまで処理を続けるジョブ
+func batchingJob(batches *int64) func(job *Job) (interface{}, error) {
+	return func(job *Job) (interface{}, error) {
+		for {
+			if err := job.Context().Err(); err != nil {
+				return nil, err
+			}
+			n := atomic.AddInt64(batches, 1)
+			job.SetProgress(map[string]int64{"batches": n})
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func newTestJobServer(h *Handler, run func(job *Job) (interface{}, error)) *echo.Echo {
+	e := echo.New()
+	e.POST("/run", func(c echo.Context) error {
+		return h.runAdminJob(c, "test", 1000, run)
+	})
+	e.GET("/admin/jobs", h.adminListJobs)
+	e.POST("/admin/jobs/:jobID/cancel", h.adminCancelJob)
+	return e
+}
+
+func TestJobStopsPromptlyOnCancel(t *testing.T) {
+	h := &Handler{Jobs: NewJobs()}
+	var batches int64
+	e := newTestJobServer(h, batchingJob(&batches))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run?async=1", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	res := new(AdminJobResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&batches) >= 3 })
+
+	if running := h.Jobs.Running(); len(running) != 1 || running[0].ID != res.JobID {
+		t.Fatalf("running jobs = %+v, want the started job", running)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/jobs/"+res.JobID+"/cancel", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("cancel status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+
+	job, _ := h.Jobs.Get(res.JobID)
+	waitFor(t, func() bool { return job.Snapshot().Status == JobStatusCanceled })
+	stoppedAt := atomic.LoadInt64(&batches)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt64(&batches); n != stoppedAt {
+		t.Errorf("job ran %d more batches after it was canceled", n-stoppedAt)
+	}
+
+	snapshot := job.Snapshot()
+	if progress, ok := snapshot.Progress.(map[string]int64); !ok || progress["batches"] != stoppedAt {
+		t.Errorf("progress = %v, want the batches done before the cancel", snapshot.Progress)
+	}
+	if len(h.Jobs.Running()) != 0 {
+		t.Error("canceled job is still listed as running")
+	}
+
+	// 終了したジョブはキャンセルできない
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/jobs/"+res.JobID+"/cancel", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("cancel after finish status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestRunAdminJobSyncReportsPartialProgressOnCancel(t *testing.T) {
+	h := &Handler{Jobs: NewJobs()}
+	var batches int64
+	e := newTestJobServer(h, batchingJob(&batches))
+
+	go func() {
+		for {
+			if running := h.Jobs.Running(); len(running) == 1 && atomic.LoadInt64(&batches) >= 3 {
+				job, _ := h.Jobs.Get(running[0].ID)
+				job.Cancel()
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run", nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	res := new(Job)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != JobStatusCanceled || !res.CancelRequested || res.Progress == nil {
+		t.Errorf("response = %s, want the canceled job with its progress", rec.Body.String())
+	}
+}
+
+func TestRunAdminJobSyncReturnsResult(t *testing.T) {
+	h := &Handler{Jobs: NewJobs()}
+	e := newTestJobServer(h, func(job *Job) (interface{}, error) {
+		return map[string]int{"purged": 3}, nil
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"purged\":3}\n" {
+		t.Errorf("response = %d %s, want the result", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJobFinishStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "succeeded", err: nil, want: JobStatusSucceeded},
+		{name: "failed", err: errors.New("connection refused"), want: JobStatusFailed},
+		{name: "canceled", err: context.Canceled, want: JobStatusCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := newJob("1", "test", 1000)
+			job.Finish("done", tt.err)
+			if got := job.Snapshot().Status; got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+			if job.Context().Err() == nil {
+				t.Error("context is not released after Finish")
+			}
+		})
+	}
+}
+
+// countingExecer ExecContextを呼ばれるたびにbatchSize件を処理したとして返し、stopAfter回目でcancelを呼ぶ
+type countingExecer struct {
+	batchSize int64
+	stopAfter int
+	cancel    context.CancelFunc
+	calls     int
+}
+
+func (e *countingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.calls++
+	if e.calls == e.stopAfter {
+		e.cancel()
+	}
+	return driver.RowsAffected(e.batchSize), nil
+}
+
+func TestExecInBatchesStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := &countingExecer{batchSize: 100, stopAfter: 3, cancel: cancel}
+
+	total, err := execInBatches(ctx, db, 100, "DELETE FROM user_sessions LIMIT ?", 100)
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if db.calls != 3 || total != 300 {
+		t.Errorf("calls = %d, total = %d, want to stop after 3 batches with 300 rows", db.calls, total)
+	}
+}
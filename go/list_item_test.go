@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	testUserItemColumns = []string{"id", "user_id", "item_type", "item_id", "amount", "created_at", "updated_at", "deleted_at"}
+	testUserCardColumns = []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp", "created_at", "updated_at", "deleted_at"}
+)
+
+// newTestListItemDB ユーザー100のアイテムリストに応答する。itemsとcardsはuser_items・user_cardsの行
+func newTestListItemDB(items, cards [][]driver.Value) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM users", []string{"id", "isu_coin", "last_getreward_at", "last_activated_at", "registered_at", "name", "created_at", "updated_at", "deleted_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(500), int64(900), int64(900), int64(100), "isucon", int64(100), int64(900), nil}}
+	})
+	fake.onQuery("FROM user_item_fractions", []string{"item_id", "fraction"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(10), int64(25)}}
+	})
+	fake.onQuery("FROM user_items", testUserItemColumns, func(args []driver.Value) [][]driver.Value {
+		return items
+	})
+	fake.onQuery("FROM user_cards", testUserCardColumns, func(args []driver.Value) [][]driver.Value {
+		return cards
+	})
+	fake.onExec("user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func newTestListItemHandler(t testing.TB, fake *fakeSQL) *Handler {
+	h := newTestHandler(t, fake)
+	h.Cache = newTestScaledHandler().Cache
+	h.TokenIssues = NewTokenIssueCounter()
+	return h
+}
+
+// bufferedListItemResponse ストリーミング化する前の実装と同じく、全件をスライスに読み込んでからレスポンスを返す
+func bufferedListItemResponse(t *testing.T, h *Handler, db *sqlx.DB, fields map[string]bool, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx := context.Background()
+	user := new(User)
+	if err := db.Get(user, "SELECT * FROM users WHERE id=?", 100); err != nil {
+		t.Fatal(err)
+	}
+	fractions := make([]*UserItemFraction, 0)
+	if err := db.Select(&fractions, "SELECT item_id, fraction FROM user_item_fractions WHERE user_id=?", 100); err != nil {
+		t.Fatal(err)
+	}
+	itemList := []*UserItem{}
+	if err := db.Select(&itemList, "SELECT * FROM user_items WHERE user_id = ?", 100); err != nil {
+		t.Fatal(err)
+	}
+	fill := h.itemDisplayAmountFiller(ctx, fractions)
+	for _, item := range itemList {
+		if err := fill(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cardList := make([]*UserCard, 0)
+	if err := db.Select(&cardList, "SELECT * FROM user_cards WHERE user_id=?", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err := sparseResponse(c, fields, &ListItemResponse{
+		OneTimeToken: token,
+		Items:        itemList,
+		User:         user,
+		Cards:        cardList,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestListItemStreamKeepsResponseShape(t *testing.T) {
+	items := [][]driver.Value{
+		{int64(1), int64(100), int64(ItemTypeEnhanceA), int64(10), int64(3), int64(100), int64(900), nil},
+		{int64(2), int64(100), int64(ItemTypeEnhanceA), int64(11), int64(4), int64(100), int64(900), nil},
+	}
+	cards := [][]driver.Value{
+		{int64(21), int64(100), int64(2), int64(5), int64(3), int64(120), int64(100), int64(900), nil},
+	}
+	tests := []struct {
+		query  string
+		fields map[string]bool
+	}{
+		{query: "", fields: nil},
+		{query: "?fields=items", fields: map[string]bool{"items": true}},
+		{query: "?fields=cards,user", fields: map[string]bool{"cards": true, "user": true}},
+		{query: "?fields=oneTimeToken", fields: map[string]bool{"oneTimeToken": true}},
+	}
+	for _, tt := range tests {
+		for _, rows := range []struct {
+			name         string
+			items, cards [][]driver.Value
+		}{
+			{name: "rows", items: items, cards: cards},
+			{name: "empty", items: nil, cards: nil},
+		} {
+			fake := newTestListItemDB(rows.items, rows.cards)
+			h := newTestListItemHandler(t, fake)
+
+			rec := getJSON("/user/:userID/item", h.listItem, "/user/100/item"+tt.query)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s %q: status = %d, body = %s", rows.name, tt.query, rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get(echo.HeaderContentType); ct != echo.MIMEApplicationJSONCharsetUTF8 {
+				t.Errorf("%s %q: content type = %q, want %q", rows.name, tt.query, ct, echo.MIMEApplicationJSONCharsetUTF8)
+			}
+			streamed := make(map[string]interface{})
+			if err := json.Unmarshal(rec.Body.Bytes(), &streamed); err != nil {
+				t.Fatalf("%s %q: %v: %s", rows.name, tt.query, err, rec.Body.String())
+			}
+
+			// トークンは発行ごとに変わるので、ストリーミングで返ったものを使う
+			token := ""
+			for tk := range h.TokenCache.tokens {
+				token = tk
+			}
+			want := bufferedListItemResponse(t, h, fake.open(), tt.fields, token)
+			buffered := make(map[string]interface{})
+			if err := json.Unmarshal(want.Body.Bytes(), &buffered); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(streamed, buffered) {
+				t.Errorf("%s %q:\nstreamed = %s\nbuffered = %s", rows.name, tt.query, rec.Body.String(), want.Body.String())
+			}
+		}
+	}
+}
+
+// newTestLargeListItemDB アイテムを大量に持つユーザーのuser_itemsに応答する
+func newTestLargeListItemDB(n int) *fakeSQL {
+	items := make([][]driver.Value, n)
+	for i := range items {
+		items[i] = []driver.Value{int64(i + 1), int64(100), int64(ItemTypeEnhanceA), int64(10 + i%2), int64(i), int64(100), int64(900), nil}
+	}
+	return newTestListItemDB(items, nil)
+}
+
+// peakHeapWriter 書き込みの合間にヒープ使用量を測り、baseからの増分の最大値を記録する
+// ReadMemStatsは世界を止めるので、sampleEvery回の書き込みごとにだけ測る
+type peakHeapWriter struct {
+	w           io.Writer
+	base        uint64
+	peak        uint64
+	writes      int
+	sampleEvery int
+}
+
+func newPeakHeapWriter(w io.Writer) *peakHeapWriter {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &peakHeapWriter{w: w, base: m.HeapAlloc, sampleEvery: 1000}
+}
+
+func (p *peakHeapWriter) Write(b []byte) (int, error) {
+	if p.writes%p.sampleEvery == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > p.base && m.HeapAlloc-p.base > p.peak {
+			p.peak = m.HeapAlloc - p.base
+		}
+	}
+	p.writes++
+	return p.w.Write(b)
+}
+
+// BenchmarkListItemStreamed50k 5万件のアイテムをカーソルから逐次書き出す
+// go test -bench ListItem -benchmem で、全件をスライスに載せる場合と確保量・ヒープ使用量の最大値(peak-heap-B)を比較できる
+func BenchmarkListItemStreamed50k(b *testing.B) {
+	h := newTestScaledHandler()
+	db := newTestLargeListItemDB(50000).open()
+	fields := map[string]bool{"items": true}
+	fill := h.itemDisplayAmountFiller(context.Background(), []*UserItemFraction{{ItemID: 10, Fraction: 25}})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		w := newPeakHeapWriter(io.Discard)
+		b.StartTimer()
+
+		rows, err := db.Queryx("SELECT * FROM user_items WHERE user_id = ?", 100)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := writeListItemResponse(w, "token", &User{ID: 100}, rows, nil, fields, fill); err != nil {
+			b.Fatal(err)
+		}
+		rows.Close()
+		if w.peak > peak {
+			peak = w.peak
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
+
+// BenchmarkListItemBuffered50k ストリーミング化する前と同じく、5万件をスライスに読み込んでからまとめて書き出す
+func BenchmarkListItemBuffered50k(b *testing.B) {
+	h := newTestScaledHandler()
+	db := newTestLargeListItemDB(50000).open()
+	fill := h.itemDisplayAmountFiller(context.Background(), []*UserItemFraction{{ItemID: 10, Fraction: 25}})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		w := newPeakHeapWriter(io.Discard)
+		b.StartTimer()
+
+		itemList := []*UserItem{}
+		if err := db.Select(&itemList, "SELECT * FROM user_items WHERE user_id = ?", 100); err != nil {
+			b.Fatal(err)
+		}
+		for _, item := range itemList {
+			if err := fill(item); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := json.NewEncoder(w).Encode(&ListItemResponse{OneTimeToken: "token", User: &User{ID: 100}, Items: itemList}); err != nil {
+			b.Fatal(err)
+		}
+		if w.peak > peak {
+			peak = w.peak
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
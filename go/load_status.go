@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// load status
+
+const (
+	LoadLevelHealthy    string = "healthy"
+	LoadLevelDegraded   string = "degraded"
+	LoadLevelOverloaded string = "overloaded"
+)
+
+var (
+	// 負荷を集計する区間。直前の区間の値で負荷を判定する
+	loadStatusWindow time.Duration = time.Duration(getEnvInt("ISUCON_LOAD_STATUS_WINDOW_SEC", 10)) * time.Second
+	// 平均レイテンシ(ms)がこれ以上ならdegraded/overloaded
+	loadDegradedLatencyMs   int = getEnvInt("ISUCON_LOAD_DEGRADED_LATENCY_MS", 200)
+	loadOverloadedLatencyMs int = getEnvInt("ISUCON_LOAD_OVERLOADED_LATENCY_MS", 1000)
+	// 429・503で断ったリクエストの割合(%)がこれ以上ならdegraded/overloaded
+	loadDegradedRejectPercent   int = getEnvInt("ISUCON_LOAD_DEGRADED_REJECT_PERCENT", 1)
+	loadOverloadedRejectPercent int = getEnvInt("ISUCON_LOAD_OVERLOADED_REJECT_PERCENT", 10)
+	// 100リクエストあたりのDBの接続待ちの回数がこれ以上ならdegraded/overloaded
+	loadDegradedDBWaitsPer100   int = getEnvInt("ISUCON_LOAD_DEGRADED_DB_WAITS_PER_100", 10)
+	loadOverloadedDBWaitsPer100 int = getEnvInt("ISUCON_LOAD_OVERLOADED_DB_WAITS_PER_100", 100)
+)
+
+// loadWindow 1区間分の集計
+type loadWindow struct {
+	start        time.Time
+	requests     int64
+	rejected     int64
+	latencySum   time.Duration
+	dbWaitsStart int64 // 区間の開始時点での全DBの接続待ちの累計
+	dbWaits      int64 // 区間内の接続待ちの回数。区間が終わった時点で確定する
+}
+
+// LoadMonitor リクエストのレイテンシと断ったリクエスト数、DBの接続待ちの回数を区間ごとに集計する
+// クライアントがポーリングの間隔を調整するための目安で、プロセス内でのみ集計する
+type LoadMonitor struct {
+	mu      sync.Mutex
+	window  time.Duration
+	dbWaits func() int64
+	cur     *loadWindow
+	prev    *loadWindow // nilの場合は区間が1つも終わっていない
+}
+
+// NewLoadMonitor 新しい集計を作成。dbWaitsには全DBの接続待ちの累計を返す関数を渡す
+func NewLoadMonitor(window time.Duration, dbWaits func() int64, now time.Time) *LoadMonitor {
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if dbWaits == nil {
+		dbWaits = func() int64 { return 0 }
+	}
+	return &LoadMonitor{
+		window:  window,
+		dbWaits: dbWaits,
+		cur:     &loadWindow{start: now, dbWaitsStart: dbWaits()},
+	}
+}
+
+// Observe 1リクエストのレイテンシと、断ったリクエストかどうかを記録する
+func (m *LoadMonitor) Observe(now time.Time, latency time.Duration, rejected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate(now)
+	m.cur.requests++
+	m.cur.latencySum += latency
+	if rejected {
+		m.cur.rejected++
+	}
+}
+
+// rotate 区間が終わっていれば次の区間に移る。区間をまたいでリクエストがなかった場合、直前の区間は空になる
+func (m *LoadMonitor) rotate(now time.Time) {
+	elapsed := now.Sub(m.cur.start)
+	if elapsed < m.window {
+		return
+	}
+
+	waits := m.dbWaits()
+	m.cur.dbWaits = waits - m.cur.dbWaitsStart
+	if elapsed < 2*m.window {
+		m.prev = m.cur
+	} else {
+		m.prev = &loadWindow{start: now.Add(-m.window), dbWaitsStart: waits}
+	}
+	m.cur = &loadWindow{start: now, dbWaitsStart: waits}
+}
+
+// Status 直前の区間の値から負荷の目安を返す
+// 区間が1つも終わっていない場合は、現在の区間の途中までの値を使う
+func (m *LoadMonitor) Status(now time.Time) *LoadStatusResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate(now)
+	w := m.prev
+	if w == nil {
+		w = &loadWindow{
+			start:      m.cur.start,
+			requests:   m.cur.requests,
+			rejected:   m.cur.rejected,
+			latencySum: m.cur.latencySum,
+			dbWaits:    m.dbWaits() - m.cur.dbWaitsStart,
+		}
+	}
+
+	res := &LoadStatusResponse{
+		WindowSec: int64(m.window / time.Second),
+		Requests:  w.requests,
+		DBWaits:   w.dbWaits,
+	}
+	if w.requests > 0 {
+		res.AvgLatencyMs = float64(w.latencySum) / float64(w.requests) / float64(time.Millisecond)
+		res.RejectRate = float64(w.rejected) / float64(w.requests)
+	}
+	res.Level = loadLevel(res)
+	return res
+}
+
+// loadLevel レイテンシ・断った割合・接続待ちのうち、最も悪いものを負荷の目安とする
+func loadLevel(s *LoadStatusResponse) string {
+	var dbWaitsPer100 float64
+	if s.Requests > 0 {
+		dbWaitsPer100 = float64(s.DBWaits) * 100 / float64(s.Requests)
+	}
+	switch {
+	case s.AvgLatencyMs >= float64(loadOverloadedLatencyMs),
+		s.RejectRate*100 >= float64(loadOverloadedRejectPercent),
+		dbWaitsPer100 >= float64(loadOverloadedDBWaitsPer100):
+		return LoadLevelOverloaded
+	case s.AvgLatencyMs >= float64(loadDegradedLatencyMs),
+		s.RejectRate*100 >= float64(loadDegradedRejectPercent),
+		dbWaitsPer100 >= float64(loadDegradedDBWaitsPer100):
+		return LoadLevelDegraded
+	}
+	return LoadLevelHealthy
+}
+
+// dbPoolWaits 全DBの接続プールで接続を待った回数の累計を返す関数
+func dbPoolWaits(dbs ...*sqlx.DB) func() int64 {
+	return func() int64 {
+		var waits int64
+		for _, db := range dbs {
+			waits += db.Stats().WaitCount
+		}
+		return waits
+	}
+}
+
+// loadMonitorMiddleware リクエストのレイテンシと、429・503で断ったかどうかを記録する
+// /status 自体はクライアントがポーリングするため数えない
+func (h *Handler) loadMonitorMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Path() == "/status" {
+			return next(c)
+		}
+
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		status := c.Response().Status
+		rejected := status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+		end := time.Now()
+		h.Load.Observe(end, end.Sub(start), rejected)
+		return nil
+	}
+}
+
+// status サーバーの負荷の目安を返す。認証は不要で、DBには問い合わせない
+// クライアントはdegradedやoverloadedの場合にポーリングの間隔を空ける
+// GET /status
+func (h *Handler) status(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.Load.Status(time.Now()))
+}
+
+type LoadStatusResponse struct {
+	Level        string  `json:"level"`
+	WindowSec    int64   `json:"windowSec"`
+	Requests     int64   `json:"requests"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+	RejectRate   float64 `json:"rejectRate"`
+	DBWaits      int64   `json:"dbWaits"`
+}
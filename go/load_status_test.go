@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoadMonitorLevelFollowsLatency(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewLoadMonitor(10*time.Second, nil, start)
+
+	// 最初の区間は10msで応答する
+	for i := 0; i < 10; i++ {
+		m.Observe(start.Add(time.Duration(i)*time.Second), 10*time.Millisecond, false)
+	}
+	if s := m.Status(start.Add(9 * time.Second)); s.Level != LoadLevelHealthy || s.Requests != 10 {
+		t.Errorf("status during the first window = %+v, want healthy with 10 requests", s)
+	}
+
+	// 次の区間は平均が閾値を超える
+	for i := 0; i < 10; i++ {
+		latency := time.Duration(loadOverloadedLatencyMs)*time.Millisecond + time.Duration(i)*time.Millisecond
+		m.Observe(start.Add(time.Duration(10+i)*time.Second), latency, false)
+	}
+	if s := m.Status(start.Add(19 * time.Second)); s.Level != LoadLevelHealthy {
+		t.Errorf("status before the slow window ends = %+v, want the previous healthy window", s)
+	}
+	if s := m.Status(start.Add(20 * time.Second)); s.Level != LoadLevelOverloaded || s.AvgLatencyMs < float64(loadOverloadedLatencyMs) {
+		t.Errorf("status after the slow window = %+v, want overloaded", s)
+	}
+
+	// 区間をまたいでリクエストがなければ、空の区間として健全に戻る
+	if s := m.Status(start.Add(40 * time.Second)); s.Level != LoadLevelHealthy || s.Requests != 0 {
+		t.Errorf("status after an idle window = %+v, want healthy with no requests", s)
+	}
+}
+
+func TestLoadLevelThresholds(t *testing.T) {
+	tests := []struct {
+		name   string
+		status LoadStatusResponse
+		want   string
+	}{
+		{name: "idle", status: LoadStatusResponse{}, want: LoadLevelHealthy},
+		{name: "slow", status: LoadStatusResponse{Requests: 10, AvgLatencyMs: float64(loadDegradedLatencyMs)}, want: LoadLevelDegraded},
+		{name: "rejecting", status: LoadStatusResponse{Requests: 10, RejectRate: float64(loadOverloadedRejectPercent) / 100}, want: LoadLevelOverloaded},
+		{name: "db waits", status: LoadStatusResponse{Requests: 100, DBWaits: int64(loadDegradedDBWaitsPer100)}, want: LoadLevelDegraded},
+	}
+	for _, tt := range tests {
+		if got := loadLevel(&tt.status); got != tt.want {
+			t.Errorf("%s: level = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStatusReportsSlowHandlers(t *testing.T) {
+	prev := loadDegradedLatencyMs
+	loadDegradedLatencyMs = 20
+	t.Cleanup(func() { loadDegradedLatencyMs = prev })
+
+	h := &Handler{Load: NewLoadMonitor(time.Minute, nil, time.Now())}
+	e := echo.New()
+	e.Use(h.loadMonitorMiddleware)
+	e.GET("/status", h.status)
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(30 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+	status := func() *LoadStatusResponse {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		res := new(LoadStatusResponse)
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if s := status(); s.Level != LoadLevelHealthy {
+		t.Fatalf("status before any request = %+v, want healthy", s)
+	}
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	// /status自体のリクエストは数えない
+	if s := status(); s.Level != LoadLevelDegraded || s.Requests != 1 {
+		t.Errorf("status after a slow request = %+v, want degraded with 1 request", s)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// //////////////////////////////////////
+// login grant metrics
+
+// loginGrantBuckets ログイン1回あたりの付与数のヒストグラムの区切り(以下)。最後の区切りを超えたものは+Infに数える
+var loginGrantBuckets = []int64{0, 1, 2, 5, 10, 20, 50}
+
+// LoginGrantMetrics ログイン時のログインボーナス・全員プレゼントの付与数の統計
+// ログインの遅さが復帰ユーザーへの付与処理によるものかを調べるためのもの。プロセス内でのみ集計する
+type LoginGrantMetrics struct {
+	logins        int64
+	sameDayLogins int64
+	loginBonuses  int64
+	presentAlls   int64
+	// buckets loginGrantBucketsの区切りごとの件数。末尾は+Inf
+	buckets []int64
+}
+
+// NewLoginGrantMetrics 新しい統計を作成
+func NewLoginGrantMetrics() *LoginGrantMetrics {
+	return &LoginGrantMetrics{
+		buckets: make([]int64, len(loginGrantBuckets)+1),
+	}
+}
+
+// Observe 1回のログイン処理で付与したログインボーナスと全員プレゼントの数を記録する
+// トランザクションを長引かせないよう、コミットした後に呼ぶこと
+func (m *LoginGrantMetrics) Observe(loginBonuses, presentAlls int) {
+	atomic.AddInt64(&m.logins, 1)
+	atomic.AddInt64(&m.loginBonuses, int64(loginBonuses))
+	atomic.AddInt64(&m.presentAlls, int64(presentAlls))
+
+	grants := int64(loginBonuses + presentAlls)
+	i := 0
+	for i < len(loginGrantBuckets) && grants > loginGrantBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&m.buckets[i], 1)
+}
+
+// ObserveSameDay 同日の2回目以降で、付与処理をしなかったログインを記録する
+func (m *LoginGrantMetrics) ObserveSameDay() {
+	atomic.AddInt64(&m.sameDayLogins, 1)
+}
+
+// Snapshot レスポンス用に現在の値を取得する
+func (m *LoginGrantMetrics) Snapshot() *LoginGrantMetricsSnapshot {
+	buckets := make([]*LoginGrantBucket, len(m.buckets))
+	for i := range m.buckets {
+		le := "+Inf"
+		if i < len(loginGrantBuckets) {
+			le = strconv.FormatInt(loginGrantBuckets[i], 10)
+		}
+		buckets[i] = &LoginGrantBucket{
+			LE:    le,
+			Count: atomic.LoadInt64(&m.buckets[i]),
+		}
+	}
+	return &LoginGrantMetricsSnapshot{
+		Logins:         atomic.LoadInt64(&m.logins),
+		SameDayLogins:  atomic.LoadInt64(&m.sameDayLogins),
+		LoginBonuses:   atomic.LoadInt64(&m.loginBonuses),
+		PresentAlls:    atomic.LoadInt64(&m.presentAlls),
+		GrantsPerLogin: buckets,
+	}
+}
+
+type LoginGrantMetricsSnapshot struct {
+	Logins         int64               `json:"logins"`
+	SameDayLogins  int64               `json:"sameDayLogins"`
+	LoginBonuses   int64               `json:"loginBonuses"`
+	PresentAlls    int64               `json:"presentAlls"`
+	GrantsPerLogin []*LoginGrantBucket `json:"grantsPerLogin"`
+}
+
+// LoginGrantBucket 付与数(ログインボーナス+全員プレゼント)がLE以下だったログインの数。区切りごとの件数で、累積ではない
+type LoginGrantBucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
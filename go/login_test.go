@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// fakeLoginUser ログインで読み書きするユーザーの状態
+type fakeLoginUser struct {
+	mu              sync.Mutex
+	lastActivatedAt int64
+}
+
+// newTestLoginDB ユーザー100のログインに応答する。ログインボーナス1は初日に強化素材10を1つ付与する
+func newTestLoginDB(u *fakeLoginUser) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT last_activated_at FROM users", []string{"last_activated_at"}, func(args []driver.Value) [][]driver.Value {
+		u.mu.Lock()
+		lastActivatedAt := u.lastActivatedAt
+		u.mu.Unlock()
+		// 読んだ値を返すまでの間に、同時のログインも同じ値を読めるよう遅らせる
+		time.Sleep(5 * time.Millisecond)
+		return [][]driver.Value{{lastActivatedAt}}
+	})
+	fake.onQuery("SELECT isu_coin FROM users", []string{"isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0)}}
+	})
+	fake.onQuery("FROM users", []string{"id", "isu_coin", "last_activated_at"}, func(args []driver.Value) [][]driver.Value {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return [][]driver.Value{{args[0], int64(0), u.lastActivatedAt}}
+	})
+	fake.onExec("UPDATE users SET updated_at", func(args []driver.Value) (int64, error) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.lastActivatedAt = args[1].(int64)
+		return 1, nil
+	})
+	fake.onQuery("FROM user_bans", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.withDevice()
+	fake.onExec("UPDATE user_sessions", func(args []driver.Value) (int64, error) { return 0, nil })
+	fake.onExec("INSERT INTO user_sessions", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onQuery("FROM login_bonus_masters", []string{"id", "start_at", "end_at", "column_count", "looped"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), int64(0), int64(2000), int64(7), false}}
+	})
+	fake.onQuery("FROM user_login_bonuses", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_login_bonuses", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(10), int64(ItemTypeEnhanceA)}}
+	})
+	fake.onQuery("FROM user_items", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onQuery("FROM present_all_masters", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	return fake
+}
+
+func TestConcurrentLoginsGrantOneBonus(t *testing.T) {
+	// 前日にログイン済みで、今日のログインボーナスはまだ受け取っていない
+	u := &fakeLoginUser{lastActivatedAt: 1000 - 86400}
+	fake := newTestLoginDB(u)
+	h := newTestHandler(t, fake)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA})
+	h.Cache.SetLoginBonusReward(&LoginBonusRewardMaster{ID: 1, LoginBonusID: 1, RewardSequence: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 1})
+	h.LoginMetrics = NewLoginGrantMetrics()
+
+	const logins = 5
+	codes := make([]int, logins)
+	var wg sync.WaitGroup
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := postJSON("/login", h.login, "/login", `{"viewerId":"viewer","userId":100}`)
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("login %d status = %d, want 200", i+1, code)
+		}
+	}
+	if fake.executed("INSERT INTO user_login_bonuses") != 1 || fake.executed("INSERT INTO user_items") != 1 {
+		t.Errorf("committed = %v, want the bonus progress and its reward committed once", fake.committed)
+	}
+	if m := h.LoginMetrics.Snapshot(); m.LoginBonuses != 1 {
+		t.Errorf("metrics = %+v, want a single login bonus", m)
+	}
+}
+
+func TestSessionReadableRightAfterLogin(t *testing.T) {
+	// シャードのプライマリは作成したセッションをすぐに返す
+	var mu sync.Mutex
+	sessions := make(map[string][]driver.Value)
+	primary := &fakeSQL{}
+	primary.onExec("INSERT INTO user_sessions", func(args []driver.Value) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sessions[args[2].(string)] = []driver.Value{args[0], args[1], args[2], args[5]}
+		return 1, nil
+	})
+	primary.onQuery("FROM user_sessions", []string{"id", "user_id", "session_id", "expired_at"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		if row, ok := sessions[args[0].(string)]; ok {
+			return [][]driver.Value{row}
+		}
+		return nil
+	})
+	primary.rules = append(primary.rules, newTestLoginDB(&fakeLoginUser{lastActivatedAt: 1000}).rules...)
+	// メインのDBを、まだセッションが反映されていない遅延したレプリカとみなす
+	lagging := &fakeSQL{}
+	lagging.onQuery("FROM user_sessions", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+
+	h := newTestHandler(t, primary)
+	h.DB = lagging.open()
+	h.LoginMetrics = NewLoginGrantMetrics()
+
+	rec := postJSON("/login", h.login, "/login", `{"viewerId":"viewer","userId":100}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(LoginResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	// ログイン直後のリクエストもセッションを確認できる
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	req := httptest.NewRequest(http.MethodGet, "/user/100/home", nil)
+	req.Header.Set("x-session", res.SessionID)
+	rec = serveAt1000(http.MethodGet, "/user/:userID/home", h.checkSessionMiddleware(ok), req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, body = %s, want the new session accepted", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoginGrantMetricsForMultiBonusLogin(t *testing.T) {
+	// ログインボーナス1と2、全員プレゼント5と6を初めて受け取る
+	fake := &fakeSQL{}
+	fake.onQuery("FROM login_bonus_masters", []string{"id", "start_at", "end_at", "column_count", "looped"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), int64(0), int64(2000), int64(7), false},
+			{int64(2), int64(0), int64(2000), int64(7), false},
+		}
+	})
+	fake.onQuery("FROM present_all_masters", []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(5), int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), "gift5"},
+			{int64(6), int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), "gift6"},
+		}
+	})
+	fake.onQuery("FROM user_present_all_received_history", []string{"present_all_id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_present_all_received_history", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.rules = append(fake.rules, newTestLoginDB(&fakeLoginUser{lastActivatedAt: 1000 - 86400}).rules...)
+
+	h := newTestHandler(t, fake)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA})
+	for _, bonusID := range []int64{1, 2} {
+		h.Cache.SetLoginBonusReward(&LoginBonusRewardMaster{ID: bonusID, LoginBonusID: bonusID, RewardSequence: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 1})
+	}
+	h.LoginMetrics = NewLoginGrantMetrics()
+
+	for i := 0; i < 2; i++ {
+		if rec := postJSON("/login", h.login, "/login", `{"viewerId":"viewer","userId":100}`); rec.Code != http.StatusOK {
+			t.Fatalf("login %d status = %d, body = %s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+
+	// 2回目は同日のログインなので付与数に含めない
+	m := h.LoginMetrics.Snapshot()
+	if m.Logins != 1 || m.SameDayLogins != 1 || m.LoginBonuses != 2 || m.PresentAlls != 2 {
+		t.Errorf("metrics = %+v, want one login granting 2 bonuses and 2 presents plus one same-day login", m)
+	}
+	for _, b := range m.GrantsPerLogin {
+		want := int64(0)
+		if b.LE == "5" {
+			want = 1
+		}
+		if b.Count != want {
+			t.Errorf("bucket le=%s count = %d, want %d", b.LE, b.Count, want)
+		}
+	}
+}
+
+func TestLoginGrantMetricsBuckets(t *testing.T) {
+	m := NewLoginGrantMetrics()
+	m.Observe(0, 0)
+	m.Observe(1, 1)
+	m.Observe(30, 30)
+
+	want := map[string]int64{"0": 1, "2": 1, "+Inf": 1}
+	for _, b := range m.Snapshot().GrantsPerLogin {
+		if b.Count != want[b.LE] {
+			t.Errorf("bucket le=%s count = %d, want %d", b.LE, b.Count, want[b.LE])
+		}
+	}
+}
+
+func TestLoggedOutSessionRejected(t *testing.T) {
+	// ユーザー100はセッションsessとotherを持ち、どちらも期限は2000
+	var mu sync.Mutex
+	deleted := make(map[string]bool)
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_sessions", []string{"id", "user_id", "session_id", "expired_at"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		sessID := args[0].(string)
+		if (sessID != "sess" && sessID != "other") || deleted[sessID] {
+			return nil
+		}
+		return [][]driver.Value{{int64(1), int64(100), sessID, int64(2000)}}
+	})
+	fake.onExec("UPDATE user_sessions", func(args []driver.Value) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		deleted[args[1].(string)] = true
+		return 1, nil
+	})
+	fake.onExec("UPDATE user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	db := fake.open()
+	h := &Handler{DBs: []*sqlx.DB{db}, DB: db, TokenCache: NewTokenCache()}
+	h.TokenCache.SetToken("token100", 100, 1, 2000, 0)
+	h.TokenCache.SetToken("token101", 101, 1, 2000, 0)
+
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	home := func(sessID string) int {
+		req := httptest.NewRequest(http.MethodGet, "/user/100/home", nil)
+		req.Header.Set("x-session", sessID)
+		return serveAt1000(http.MethodGet, "/user/:userID/home", h.checkSessionMiddleware(ok), req).Code
+	}
+	if code := home("sess"); code != http.StatusOK {
+		t.Fatalf("status before logout = %d, want 200", code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/user/100/logout", nil)
+	req.Header.Set("x-session", "sess")
+	rec := serveAt1000(http.MethodPost, "/user/:userID/logout", h.checkSessionMiddleware(h.logout), req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, body = %s, want 204", rec.Code, rec.Body.String())
+	}
+
+	// ログアウトしたセッションは次のリクエストで弾き、同じユーザーの他のセッションはそのまま使える
+	if code := home("sess"); code != http.StatusUnauthorized {
+		t.Errorf("status after logout = %d, want 401", code)
+	}
+	if code := home("other"); code != http.StatusOK {
+		t.Errorf("status with another session = %d, want 200", code)
+	}
+	if _, exists := h.TokenCache.GetToken("token100"); exists {
+		t.Error("token of the logged out user still cached")
+	}
+	if _, exists := h.TokenCache.GetToken("token101"); !exists {
+		t.Error("token of another user evicted")
+	}
+	if fake.executed("UPDATE user_one_time_tokens") != 1 {
+		t.Errorf("committed = %v, want the user's tokens revoked once", fake.committed)
+	}
+}
+
+func TestLoginPreviewMatchesLogin(t *testing.T) {
+	// ログインボーナス1と2、全員プレゼント5と6を初めて受け取る
+	fake := &fakeSQL{}
+	fake.onQuery("FROM login_bonus_masters", []string{"id", "start_at", "end_at", "column_count", "looped"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), int64(0), int64(2000), int64(7), false},
+			{int64(2), int64(0), int64(2000), int64(7), false},
+		}
+	})
+	fake.onQuery("FROM present_all_masters", []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(5), int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), "gift5"},
+			{int64(6), int64(0), int64(2000), int64(ItemTypeEnhanceA), int64(10), int64(3), "gift6"},
+		}
+	})
+	fake.onQuery("FROM user_present_all_received_history", []string{"present_all_id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_present_all_received_history", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.rules = append(fake.rules, newTestLoginDB(&fakeLoginUser{lastActivatedAt: 1000 - 86400}).rules...)
+
+	h := newTestHandler(t, fake)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA})
+	for _, bonusID := range []int64{1, 2} {
+		h.Cache.SetLoginBonusReward(&LoginBonusRewardMaster{ID: bonusID, LoginBonusID: bonusID, RewardSequence: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 1})
+	}
+	h.LoginMetrics = NewLoginGrantMetrics()
+
+	rec := getJSON("/admin/user/:userID/login-preview", h.adminLoginPreview, "/admin/user/100/login-preview")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	preview := new(AdminLoginPreviewResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.LoginBonuses) != 2 || len(preview.Presents) != 2 {
+		t.Fatalf("preview = %s, want 2 login bonuses and 2 presents", rec.Body.String())
+	}
+	for _, q := range append(fake.committed, fake.rolledBack...) {
+		if !strings.HasPrefix(q, "SELECT") {
+			t.Errorf("preview executed %q, want no writes", q)
+		}
+	}
+
+	// 同じユーザー・時刻での実際のログインと同じものを付与する
+	rec = postJSON("/login", h.login, "/login", `{"viewerId":"viewer","userId":100}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(LoginResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	got := res.UpdatedResources
+	if len(preview.LoginBonuses) != len(got.UserLoginBonuses) || len(preview.Rewards) != len(got.UserLoginBonuses) {
+		t.Fatalf("preview bonuses = %d with %d rewards, login bonuses = %d", len(preview.LoginBonuses), len(preview.Rewards), len(got.UserLoginBonuses))
+	}
+	for i, want := range preview.LoginBonuses {
+		b := got.UserLoginBonuses[i]
+		if b.LoginBonusID != want.LoginBonusID || b.LastRewardSequence != want.LastRewardSequence || b.LoopCount != want.LoopCount {
+			t.Errorf("login bonus %d = %+v, preview = %+v", i, b, want)
+		}
+	}
+	if len(preview.Presents) != len(got.UserPresents) {
+		t.Fatalf("preview presents = %d, login presents = %d", len(preview.Presents), len(got.UserPresents))
+	}
+	for i, want := range preview.Presents {
+		p := got.UserPresents[i]
+		if p.ItemType != want.ItemType || p.ItemID != want.ItemID || p.Amount != want.Amount || p.SourceID == nil || *p.SourceID != *want.SourceID {
+			t.Errorf("present %d = %+v, preview = %+v", i, p, want)
+		}
+	}
+
+	// ログインした後は同日のログインとして何も付与しない
+	rec = getJSON("/admin/user/:userID/login-preview", h.adminLoginPreview, "/admin/user/100/login-preview")
+	preview = new(AdminLoginPreviewResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), preview); err != nil {
+		t.Fatal(err)
+	}
+	if !preview.AlreadyLoggedInToday || len(preview.LoginBonuses) != 0 || len(preview.Presents) != 0 {
+		t.Errorf("preview after login = %s, want nothing granted", rec.Body.String())
+	}
+}
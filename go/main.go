@@ -1,51 +1,229 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/snowflake"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	ErrInvalidRequestBody       error = fmt.Errorf("invalid request body")
 	ErrInvalidMasterVersion     error = fmt.Errorf("invalid master version")
+	ErrPartialMasterActivation  error = fmt.Errorf("master version is activated on some shards only")
 	ErrInvalidItemType          error = fmt.Errorf("invalid item type")
+	ErrInvalidPresentAmount     error = fmt.Errorf("invalid present amount")
+	ErrOverflowPresentHeld      error = fmt.Errorf("holding limit is still reached")
+	ErrInvalidPlatformType      error = fmt.Errorf("invalid platform type")
 	ErrInvalidToken             error = fmt.Errorf("invalid token")
+	ErrTokenNotFound            error = fmt.Errorf("not found token")
+	ErrTokenExpired             error = fmt.Errorf("token expired")
+	ErrTokenTypeMismatch        error = fmt.Errorf("token type mismatch")
 	ErrGetRequestTime           error = fmt.Errorf("failed to get request time")
 	ErrExpiredSession           error = fmt.Errorf("session expired")
 	ErrUserNotFound             error = fmt.Errorf("not found user")
 	ErrUserDeviceNotFound       error = fmt.Errorf("not found user device")
 	ErrItemNotFound             error = fmt.Errorf("not found item")
+	ErrGachaItemNotFound        error = fmt.Errorf("not found gacha item")
+	ErrGachaDrawNotFound        error = fmt.Errorf("not found gacha draw")
+	ErrGachaAlreadyRerolled     error = fmt.Errorf("gacha draw already rerolled")
+	ErrGachaPresentReceived     error = fmt.Errorf("gacha presents already received")
+	ErrInvalidGachaWeight       error = fmt.Errorf("invalid gacha weight sum")
+	ErrNotEnoughCoin            error = fmt.Errorf("not enough isucon")
+	ErrInvalidItemMaster        error = fmt.Errorf("invalid item master: required field is null")
 	ErrLoginBonusRewardNotFound error = fmt.Errorf("not found login bonus reward")
-	ErrNoFormFile               error = fmt.Errorf("no such file")
 	ErrUnauthorized             error = fmt.Errorf("unauthorized user")
 	ErrForbidden                error = fmt.Errorf("forbidden")
 	ErrGeneratePassword         error = fmt.Errorf("failed to password hash") //nolint:deadcode
+	ErrShardBusy                error = fmt.Errorf("shard is busy")
+	ErrIDNotMonotonic           error = fmt.Errorf("generated id is not monotonic (clock rollback?)")
+	ErrPresentMessageTooLong    error = fmt.Errorf("present message too long")
+	ErrInvalidMasterCSV         error = fmt.Errorf("invalid master csv")
+	ErrMasterUpdateJobNotFound  error = fmt.Errorf("not found master update job")
+	ErrJobNotFound              error = fmt.Errorf("not found job")
+	ErrJobNotRunning            error = fmt.Errorf("job is not running")
+	ErrTooManyTokenIssues       error = fmt.Errorf("too many one-time token issues")
+	ErrInvalidCoinGrant         error = fmt.Errorf("invalid coin grant: amount must be positive and userIds or allActive is required")
+	ErrMasterTableNotFound      error = fmt.Errorf("not found master table")
+	ErrInvalidDeckCards         error = fmt.Errorf("invalid card ids")
+	ErrDeckCardMissing          error = fmt.Errorf("deck card is not owned")
+	ErrInvalidDeckPresetName    error = fmt.Errorf("invalid deck preset name")
+	ErrDeckPresetNotFound       error = fmt.Errorf("not found deck preset")
+	ErrDeckPresetLimitExceeded  error = fmt.Errorf("too many deck presets")
+	ErrInvalidUserName          error = fmt.Errorf("invalid user name")
+	ErrUserNameTaken            error = fmt.Errorf("user name already taken")
+	ErrCardEquipped             error = fmt.Errorf("card is equipped in deck")
+	ErrGachaNotFound            error = fmt.Errorf("not found gacha")
+	ErrAdminLoginLocked         error = fmt.Errorf("too many failed admin login attempts")
+	ErrInvalidMergeSource       error = fmt.Errorf("invalid merge source user")
+	ErrInvalidFields            error = fmt.Errorf("invalid fields")
 
 	dbHosts []string = strings.Split(getEnv("ISUCON_DB_HOSTS", "127.0.0.1"), ",")
+
+	// ログイン処理の日付の境界に使うタイムゾーン。読み込めなかった場合はJSTとし、起動時にloginLocationErrをログに出す
+	loginLocation, loginLocationErr = loadLocation(getEnv("ISUCON_LOGIN_TZ", ""))
+
+	// 受け取るプレゼントがこの件数を超える場合は、presentReceiveChunkSize件ごとに分けてコミットする
+	presentReceiveChunkThreshold int = getEnvInt("ISUCON_PRESENT_RECEIVE_CHUNK_THRESHOLD", 500)
+	presentReceiveChunkSize      int = getEnvInt("ISUCON_PRESENT_RECEIVE_CHUNK_SIZE", 100)
+
+	// 全員プレゼントの付与で、プレゼントと受け取り履歴を1回のINSERTで挿入する最大件数
+	// 長期間ログインしていないユーザーに大量の全員プレゼントを付与する際に、1つのSQLが大きくなりすぎないようにする
+	presentInsertBatchSize int = getEnvInt("ISUCON_PRESENT_INSERT_BATCH_SIZE", 100)
+
+	// プレゼントメッセージの最大文字数。user_presents.present_messageの長さに合わせる
+	presentMessageMaxLength int = getEnvInt("ISUCON_PRESENT_MESSAGE_MAX_LENGTH", 255)
+
+	// 開催中のガチャの索引を作り直す間隔。マスタ更新時はキャッシュのクリアで作り直される
+	gachaIndexTTL time.Duration = time.Duration(getEnvInt("ISUCON_GACHA_INDEX_TTL_MS", 60000)) * time.Millisecond
+
+	// ガチャ一覧で返す開催中のガチャの上限数(display_order順)。0以下の場合は上限なし
+	// マスタの設定ミスで大量のガチャが開催中になった場合に、レスポンスが肥大化しないようにする
+	maxActiveGachas int = getEnvInt("ISUCON_MAX_ACTIVE_GACHAS", 100)
+
+	// ガチャ一覧で、作成からこの秒数以内のガチャアイテムを新着(isNew)とする。0以下の場合は新着を付けない
+	gachaNewItemWindow int64 = int64(getEnvInt("ISUCON_GACHA_NEW_ITEM_WINDOW_SEC", 7*24*60*60))
+
+	// ガチャ1回あたりの消費コイン
+	gachaPricePerDraw int64 = int64(getEnvInt("ISUCON_GACHA_PRICE_PER_DRAW", 1000))
+
+	// 1回のガチャで引ける最大回数。引ける回数は1回か10の倍数で、この回数を超えるものは引けない
+	// デフォルトでは従来どおり1回と10回のみ
+	gachaMaxDrawCount int64 = int64(getEnvInt("ISUCON_GACHA_MAX_DRAW_COUNT", 10))
+	// ガチャの結果のプレゼントと抽選履歴を1回のINSERTで挿入する最大件数
+	// 回数の多いガチャで1つのSQLが大きくなりすぎないようにする。0以下の場合は分けない
+	gachaInsertChunkSize int = getEnvInt("ISUCON_GACHA_INSERT_CHUNK_SIZE", 100)
+
+	// ユーザーごとのコインの所持上限。0以下の場合は上限なし
+	coinCap int64 = int64(getEnvInt("ISUCON_COIN_CAP", 0))
+	// 所持上限を超えたコインの扱い(discard or present)
+	coinOverflowMode string = getEnv("ISUCON_COIN_CAP_OVERFLOW", CoinOverflowModeDiscard)
+	// 所持数の上限(item_masters.max_stack)を超えた強化素材の扱い(discard or present)
+	itemOverflowMode string = getEnv("ISUCON_ITEM_STACK_OVERFLOW", CoinOverflowModeDiscard)
+
+	// ワンタイムトークンが無効な理由(存在しない・期限切れ・種別違い)をレスポンスで返すかどうか
+	// 1以外(デフォルト)の場合はトークンが存在するかを漏らさないよう、すべてErrInvalidTokenとして返す
+	detailedTokenErrors bool = getEnv("ISUCON_DETAILED_TOKEN_ERRORS", "") == "1"
+
+	// 表示名を全ユーザーで重複させないかどうか
+	uniqueUserNames bool = getEnv("ISUCON_UNIQUE_USER_NAME", "") == "1"
+
+	// userNameFilter 不適切な表示名を弾くためのフック。trueを返した表示名は設定できない。nilの場合は何も弾かない
+	userNameFilter func(name string) bool
+
+	// カードのリセット時に、累計経験値のうち強化素材として返却する割合(%)
+	cardRespecRefundPercent int = getEnvInt("ISUCON_CARD_RESPEC_REFUND_PERCENT", 50)
+	// デッキに装備中のカードもリセットできるかどうか
+	cardRespecAllowEquipped bool = getEnv("ISUCON_CARD_RESPEC_ALLOW_EQUIPPED", "") == "1"
+
+	// 有効(status=1)なマスタバージョンがない場合に、最も新しく作成されたバージョンを有効なものとして扱うかどうか
+	// 1以外(デフォルト)の場合は、有効なバージョンがなければ全てのAPIが404を返す
+	masterVersionFallback bool = getEnv("ISUCON_MASTER_VERSION_FALLBACK", "") == "1"
+
+	// 資産額の見積もりで、カードの生産性(amount_per_sec)1あたりの価値
+	networthCardFactor int64 = int64(getEnvInt("ISUCON_NETWORTH_CARD_FACTOR", 3600))
+	// 資産額の見積もりで、強化素材1個あたりの価値。networthItemValuesで指定したアイテムはそちらを使う
+	networthMaterialValue int64 = int64(getEnvInt("ISUCON_NETWORTH_MATERIAL_VALUE", 1))
+	// 資産額の見積もりで、アイテムごとの1個あたりの価値。"item_id:value"をカンマ区切りで指定する
+	// 解釈できなかった要素は無視し、起動時にnetworthItemValuesIgnoredをログに出す
+	networthItemValues, networthItemValuesIgnored = parseItemValues(getEnv("ISUCON_NETWORTH_ITEM_VALUES", ""))
+
+	// 強化で一度に消費できるアイテムの種類数。デフォルトはリクエストのitemsの上限と同じ
+	addExpMaxDistinctItems int = getEnvInt("ISUCON_ADD_EXP_MAX_DISTINCT_ITEMS", AddExpItemsMaxCount)
+
+	// 書き込みトランザクション枠の確保を待つ最大時間
+	writeSlotAcquireTimeout time.Duration = time.Duration(getEnvInt("ISUCON_DB_WRITE_ACQUIRE_TIMEOUT_MS", 100)) * time.Millisecond
 )
 
 const (
 	DeckCardNumber      int = 3
 	PresentCountPerPage int = 100
+	// 受け取れるかを一度に確認できるプレゼントの数
+	PresentCheckMaxCount int = 1000
+	// 放置報酬の受け取り履歴の1ページあたりの件数
+	RewardHistoryCountPerPage int = 100
+
+	// 一括でコインを付与する際に、1回のUPDATEで更新するユーザー数
+	AdminCoinGrantBatchSize int = 1000
+
+	// デッキプリセットの1ユーザーあたりの上限数と名前の最大文字数
+	DeckPresetMaxCount      int = 10
+	DeckPresetNameMaxLength int = 64
+
+	// 表示名の最大文字数。users.nameの長さに合わせる
+	UserNameMaxLength int = 32
+
+	// 一度に取得できる公開プロフィールの最大件数
+	UserProfilesMaxCount int = 100
+
+	// トークンの不整合の確認で一度に調べるトークン数
+	TokenDivergenceDefaultSample int = 100
+	TokenDivergenceMaxSample     int = 1000
+
+	// 採番したidが重複した場合に、採番し直して再実行する最大回数
+	IDCollisionMaxRetries int = 3
+
+	GachaSimulateDefaultCount int = 10000
+	GachaSimulateMaxCount     int = 1000000
+
+	// アイテム種別
+	ItemTypeCoin     int = 1 // ISUCOIN
+	ItemTypeCard     int = 2 // カード(ハンマー)
+	ItemTypeEnhanceA int = 3 // 強化素材(カードの経験値)
+	ItemTypeEnhanceB int = 4 // 強化素材(時短アイテム)
+
+	// 端末のプラットフォーム種別(user_devices.platform_type)
+	PlatformWeb     int = 1 // PC
+	PlatformIOS     int = 2
+	PlatformAndroid int = 3
+
+	// プレゼントの付与元
+	PresentSourceUnknown      int = 0 // 付与元を記録する前に作られたプレゼント
+	PresentSourceGacha        int = 1 // ガチャ(source_idはガチャID)
+	PresentSourcePresentAll   int = 2 // 全員プレゼント(source_idは全員プレゼントマスタのID)
+	PresentSourceLoginBonus   int = 3 // ログインボーナス(source_idはログインボーナスID)
+	PresentSourceCoinOverflow int = 4 // 所持上限を超えたコイン
+	PresentSourceItemOverflow int = 5 // 所持上限を超えた強化素材(source_idはアイテムID)
+
+	// スケジュールの種別
+	ScheduleTypeGacha      string = "gacha"
+	ScheduleTypeLoginBonus string = "loginBonus"
+
+	// 所持上限を超えたコイン・強化素材の扱い
+	CoinOverflowModeDiscard string = "discard"
+	CoinOverflowModePresent string = "present"
+
+	AmountGrowthTypeLinear      int     = 1
+	AmountGrowthTypeExponential int     = 2
+	DefaultExpGrowthRate        float64 = 1.2
 
 	SQLDirectory string = "../sql/"
 )
@@ -55,17 +233,57 @@ type Handler struct {
 	DB         *sqlx.DB
 	Cache      *MasterDataCache
 	TokenCache *TokenCache
+	WriteSems  []*WriteSemaphore
+	UserLocks  *UserLocks
+	GachaLocks *UserLocks
+	IDGen      *IDGenerator
+
+	PresentQueue *PresentGrantQueue
+	Jobs         *Jobs
+	TokenIssues  *TokenIssueCounter
+	LoginMetrics *LoginGrantMetrics
+	// ShardErrors DBsと同じ順で、シャードごとの直近のエラー
+	ShardErrors []*ShardErrorLog
+	Outbox      *OutboxRelay
+	AdminLogins *AdminLoginLimiter
+	Load        *LoadMonitor
 }
 
 // MasterDataCache マスターデータのキャッシュ
 type MasterDataCache struct {
 	mu                sync.RWMutex
 	gachaItems        map[int64][]*GachaItemMaster
-	gachaWeightSums   map[int64]int64
+	gachaCumWeights   map[int64][]int64
 	loginBonusRewards map[string]*LoginBonusRewardMaster
 	itemMasters       map[int64]*ItemMaster
+	gachaList         *gachaListCache
+	gachaIndex        *gachaIndex
+	presentAlls       []*PresentAllMaster // nilの場合は未取得
+	loginBonuses      []*LoginBonusMaster // nilの場合は未取得
 	lastUpdated       time.Time
 	masterVersion     string
+
+	// loads キャッシュにないマスタの読み込みを、同じキーごとに1つにまとめる
+	loads singleflight.Group
+}
+
+// gachaListCache ガチャ一覧のキャッシュ。ユーザーごとのワンタイムトークンは含めない
+type gachaListCache struct {
+	masterVersion string
+	validFrom     int64
+	validUntil    int64
+	gachas        []*GachaData
+}
+
+// gachaIndex 開催中のガチャを二分探索で求めるための、全ガチャマスタを開始・終了日時順に並べたもの
+type gachaIndex struct {
+	masterVersion string
+	loadedAt      time.Time
+	// expiresAt 作り直す日時。全シャードで同時に作り直さないよう、ISUCON_GACHA_INDEX_TTL_MSをずらしたもの
+	expiresAt time.Time
+	byStart   []*GachaMaster // start_at昇順
+	byEnd     []*GachaMaster // end_at昇順
+	byID      map[int64]*GachaMaster
 }
 
 // TokenCache ワンタイムトークンのキャッシュ
@@ -82,14 +300,23 @@ type TokenInfo struct {
 	CreatedAt int64
 }
 
-// NewMasterDataCache 新しいキャッシュインスタンスを作成
+var (
+	masterDataCache     *MasterDataCache
+	masterDataCacheOnce sync.Once
+)
+
+// NewMasterDataCache プロセス内で共有するキャッシュインスタンスを取得
+// 何度呼んでも同じインスタンスを返すため、同一プロセス内の全てのHandlerがキャッシュを共有し、一度のClearで全てに反映される
 func NewMasterDataCache() *MasterDataCache {
-	return &MasterDataCache{
-		gachaItems:        make(map[int64][]*GachaItemMaster),
-		gachaWeightSums:   make(map[int64]int64),
-		loginBonusRewards: make(map[string]*LoginBonusRewardMaster),
-		itemMasters:       make(map[int64]*ItemMaster),
-	}
+	masterDataCacheOnce.Do(func() {
+		masterDataCache = &MasterDataCache{
+			gachaItems:        make(map[int64][]*GachaItemMaster),
+			gachaCumWeights:   make(map[int64][]int64),
+			loginBonusRewards: make(map[string]*LoginBonusRewardMaster),
+			itemMasters:       make(map[int64]*ItemMaster),
+		}
+	})
+	return masterDataCache
 }
 
 // NewTokenCache 新しいトークンキャッシュインスタンスを作成
@@ -121,6 +348,29 @@ func (tc *TokenCache) GetToken(token string) (*TokenInfo, bool) {
 	return tokenInfo, exists
 }
 
+// TakeToken トークンが指定したユーザー・種別のものであれば、キャッシュから取り除いて返す
+// 一致しない場合は正しいエンドポイントで使えるよう取り除かずにエラーを返す
+// 確認と削除を同じロックの中で行うため、同じトークンを使ったリクエストが並行しても取り出せるのは1つだけになる
+// キャッシュにない場合はfalseを返す
+func (tc *TokenCache) TakeToken(token string, userID int64, tokenType int) (*TokenInfo, bool, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tokenInfo, exists := tc.tokens[token]
+	if !exists {
+		return nil, false, nil
+	}
+	// 他のユーザーのトークンは、存在するかを漏らさないよう存在しないものとして扱う
+	if tokenInfo.UserID != userID {
+		return nil, true, ErrTokenNotFound
+	}
+	if tokenInfo.TokenType != tokenType {
+		return nil, true, ErrTokenTypeMismatch
+	}
+	delete(tc.tokens, token)
+	return tokenInfo, true, nil
+}
+
 // DeleteToken トークンをキャッシュから削除
 func (tc *TokenCache) DeleteToken(token string) {
 	tc.mu.Lock()
@@ -129,6 +379,33 @@ func (tc *TokenCache) DeleteToken(token string) {
 	delete(tc.tokens, token)
 }
 
+// DeleteUserTokens ユーザーのトークンをキャッシュから削除し、削除したトークン数を返す
+func (tc *TokenCache) DeleteUserTokens(userID int64) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	n := 0
+	for token, info := range tc.tokens {
+		if info.UserID == userID {
+			delete(tc.tokens, token)
+			n++
+		}
+	}
+	return n
+}
+
+// Clear キャッシュをクリアし、クリアしたトークン数を返す
+// キャッシュにないトークンはユーザーのシャードで検証するが、listGacha・listItemはトークンをメインのDBに書くため、
+// シャードがメインのDBと異なるユーザーの発行済みのトークンは、クリアすると使えなくなる(再取得が必要になる)
+func (tc *TokenCache) Clear() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	n := len(tc.tokens)
+	tc.tokens = make(map[string]*TokenInfo)
+	return n
+}
+
 // CleanupExpiredTokens 期限切れトークンをクリーンアップ
 func (tc *TokenCache) CleanupExpiredTokens(currentTime int64) {
 	tc.mu.Lock()
@@ -141,36 +418,156 @@ func (tc *TokenCache) CleanupExpiredTokens(currentTime int64) {
 	}
 }
 
-// GetGachaItems ガチャアイテムをキャッシュから取得
-func (c *MasterDataCache) GetGachaItems(gachaID int64) ([]*GachaItemMaster, int64, bool) {
+// Recent 有効期限内のトークンを新しい順にlimit件まで返す
+func (tc *TokenCache) Recent(currentTime int64, limit int) []*CachedToken {
+	tc.mu.RLock()
+	tokens := make([]*CachedToken, 0, len(tc.tokens))
+	for token, info := range tc.tokens {
+		if info.ExpiredAt < currentTime {
+			continue
+		}
+		tokens = append(tokens, &CachedToken{Token: token, TokenInfo: *info})
+	}
+	tc.mu.RUnlock()
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt > tokens[j].CreatedAt
+	})
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens
+}
+
+// CachedToken キャッシュにあるトークンとその情報
+type CachedToken struct {
+	Token string
+	TokenInfo
+}
+
+// WriteSemaphore シャードごとに書き込みトランザクションの同時実行数を制限するセマフォ
+// コネクションプールと異なり、枠が空かなければ短時間で諦めて失敗させ、負荷を逃がす
+type WriteSemaphore struct {
+	slots chan struct{}
+}
+
+// NewWriteSemaphore 新しいセマフォを作成。limitが0以下の場合は制限しない
+func NewWriteSemaphore(limit int) *WriteSemaphore {
+	if limit <= 0 {
+		return &WriteSemaphore{}
+	}
+	return &WriteSemaphore{
+		slots: make(chan struct{}, limit),
+	}
+}
+
+// newWriteSemaphores シャード数分のセマフォを作成
+// ISUCON_DB_WRITE_LIMITS にカンマ区切りでシャードごとの上限を指定する。1つだけ指定した場合は全シャード共通
+func newWriteSemaphores(shardCount int) []*WriteSemaphore {
+	limits := strings.Split(getEnv("ISUCON_DB_WRITE_LIMITS", "64"), ",")
+
+	sems := make([]*WriteSemaphore, 0, shardCount)
+	for i := 0; i < shardCount; i++ {
+		limitStr := limits[len(limits)-1]
+		if i < len(limits) {
+			limitStr = limits[i]
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(limitStr))
+		if err != nil {
+			limit = 0
+		}
+		sems = append(sems, NewWriteSemaphore(limit))
+	}
+	return sems
+}
+
+// Acquire 枠を確保する。timeout以内に確保できなければfalseを返す
+func (s *WriteSemaphore) Acquire(timeout time.Duration) bool {
+	if s.slots == nil {
+		return true
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Release 枠を解放する
+func (s *WriteSemaphore) Release() {
+	if s.slots == nil {
+		return
+	}
+	<-s.slots
+}
+
+// userLockShardCount ユーザーロックのシャード数
+const userLockShardCount = 256
+
+// UserLocks ユーザーIDごとの排他制御を行うロック
+// ユーザーごとにmutexを作るとmapが肥大化するため、ユーザーIDで振り分けた固定数のmutexを使う
+type UserLocks struct {
+	shards [userLockShardCount]sync.Mutex
+}
+
+// NewUserLocks 新しいユーザーロックを作成
+func NewUserLocks() *UserLocks {
+	return &UserLocks{}
+}
+
+// Lock ユーザーのロックを取得し、解放用の関数を返す。解放用の関数は複数回呼んでもよい
+func (l *UserLocks) Lock(userID int64) func() {
+	mu := &l.shards[uint64(userID)%userLockShardCount]
+	mu.Lock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(mu.Unlock)
+	}
+}
+
+// GetGachaItems ガチャアイテムとweightの累積和をキャッシュから取得
+func (c *MasterDataCache) GetGachaItems(gachaID int64) ([]*GachaItemMaster, []int64, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	items, exists := c.gachaItems[gachaID]
 	if !exists {
-		return nil, 0, false
+		return nil, nil, false
 	}
 
-	weightSum, exists := c.gachaWeightSums[gachaID]
+	cumulative, exists := c.gachaCumWeights[gachaID]
 	if !exists {
-		return nil, 0, false
+		return nil, nil, false
 	}
 
-	return items, weightSum, true
+	return items, cumulative, true
 }
 
-// SetGachaItems ガチャアイテムをキャッシュに設定
-func (c *MasterDataCache) SetGachaItems(gachaID int64, items []*GachaItemMaster) {
+// SetGachaItems ガチャアイテムを検証してキャッシュに設定
+// 抽選できないガチャはキャッシュせずにエラーを返す（マスタ修正後に即反映させるため）
+func (c *MasterDataCache) SetGachaItems(gachaID int64, items []*GachaItemMaster) error {
+	if err := validateGachaItems(items); err != nil {
+		return err
+	}
+	cumulative := cumulativeWeights(items)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	var weightSum int64
-	for _, item := range items {
-		weightSum += int64(item.Weight)
-	}
-
 	c.gachaItems[gachaID] = items
-	c.gachaWeightSums[gachaID] = weightSum
+	c.gachaCumWeights[gachaID] = cumulative
+	return nil
 }
 
 // GetLoginBonusReward ログインボーナス報酬をキャッシュから取得
@@ -209,42 +606,381 @@ func (c *MasterDataCache) SetItemMaster(item *ItemMaster) {
 	c.itemMasters[item.ID] = item
 }
 
+// GetGachaList ガチャ一覧をキャッシュから取得
+// マスタバージョンが異なる、またはrequestAtが有効期間外の場合はキャッシュなしとする
+func (c *MasterDataCache) GetGachaList(masterVersion string, requestAt int64) ([]*GachaData, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	gl := c.gachaList
+	if gl == nil || gl.masterVersion != masterVersion || requestAt < gl.validFrom || gl.validUntil < requestAt {
+		return nil, false
+	}
+	return gl.gachas, true
+}
+
+// SetGachaList ガチャ一覧をキャッシュに設定
+func (c *MasterDataCache) SetGachaList(masterVersion string, validFrom, validUntil int64, gachas []*GachaData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gachaList = &gachaListCache{
+		masterVersion: masterVersion,
+		validFrom:     validFrom,
+		validUntil:    validUntil,
+		gachas:        gachas,
+	}
+}
+
+// newGachaIndex 全ガチャマスタから開催中のガチャの索引を作る
+func newGachaIndex(masterVersion string, gachas []*GachaMaster) *gachaIndex {
+	byStart := make([]*GachaMaster, len(gachas))
+	copy(byStart, gachas)
+	sort.SliceStable(byStart, func(i, j int) bool { return byStart[i].StartAt < byStart[j].StartAt })
+	byEnd := make([]*GachaMaster, len(gachas))
+	copy(byEnd, gachas)
+	sort.SliceStable(byEnd, func(i, j int) bool { return byEnd[i].EndAt < byEnd[j].EndAt })
+	byID := make(map[int64]*GachaMaster, len(gachas))
+	for _, g := range gachas {
+		byID[g.ID] = g
+	}
+
+	loadedAt := time.Now()
+	return &gachaIndex{
+		masterVersion: masterVersion,
+		loadedAt:      loadedAt,
+		expiresAt:     loadedAt.Add(jitteredTTL(gachaIndexTTL)),
+		byStart:       byStart,
+		byEnd:         byEnd,
+		byID:          byID,
+	}
+}
+
+// SetGachaIndex 開催中のガチャの索引をキャッシュに設定
+func (c *MasterDataCache) SetGachaIndex(idx *gachaIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gachaIndex = idx
+}
+
+// GetActiveGachas now時点で開催中(start_at <= now <= end_at)のガチャをdisplay_order順で返す
+// あわせて、開催中のガチャの組み合わせが変わらない期間[validFrom, validUntil]を返す
+// 索引がない、マスタバージョンが異なる、または作ってからISUCON_GACHA_INDEX_TTL_MSを過ぎた場合はキャッシュなしとする
+func (c *MasterDataCache) GetActiveGachas(masterVersion string, now int64) ([]*GachaMaster, int64, int64, bool) {
+	idx, ok := c.GetGachaIndex(masterVersion)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	active, validFrom, validUntil := idx.active(now)
+	return active, validFrom, validUntil, true
+}
+
+// GetGachaIndex 開催中のガチャの索引をキャッシュから取得
+// 索引がない、マスタバージョンが異なる、または作ってからISUCON_GACHA_INDEX_TTL_MS(をずらしたもの)を過ぎた場合はキャッシュなしとする
+func (c *MasterDataCache) GetGachaIndex(masterVersion string) (*gachaIndex, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	idx := c.gachaIndex
+	if idx == nil || idx.masterVersion != masterVersion || time.Now().After(idx.expiresAt) {
+		return nil, false
+	}
+	return idx, true
+}
+
+// ActiveGachaIDs now時点で開催中のガチャのIDをdisplay_order順で返す
+func (c *MasterDataCache) ActiveGachaIDs(masterVersion string, now int64) ([]int64, bool) {
+	active, _, _, ok := c.GetActiveGachas(masterVersion, now)
+	if !ok {
+		return nil, false
+	}
+	ids := make([]int64, len(active))
+	for i, g := range active {
+		ids[i] = g.ID
+	}
+	return ids, true
+}
+
+// get ガチャマスタをIDで取得する。開催期間は問わない
+func (idx *gachaIndex) get(gachaID int64) (*GachaMaster, bool) {
+	g, ok := idx.byID[gachaID]
+	return g, ok
+}
+
+// upcoming now時点でまだ始まっていないガチャを開始日時順で返す
+func (idx *gachaIndex) upcoming(now int64) []*GachaMaster {
+	started := sort.Search(len(idx.byStart), func(i int) bool { return idx.byStart[i].StartAt > now })
+	return idx.byStart[started:]
+}
+
+// active 開始済みのガチャ(byStartの先頭から)と終了していないガチャ(byEndの末尾まで)を二分探索で求め、
+// 少ない方を走査して両方の条件を満たすものを返す
+func (idx *gachaIndex) active(now int64) ([]*GachaMaster, int64, int64) {
+	started := sort.Search(len(idx.byStart), func(i int) bool { return idx.byStart[i].StartAt > now })
+	ended := sort.Search(len(idx.byEnd), func(i int) bool { return idx.byEnd[i].EndAt >= now })
+
+	candidates := idx.byStart[:started]
+	if len(idx.byEnd)-ended < len(candidates) {
+		candidates = idx.byEnd[ended:]
+	}
+	active := make([]*GachaMaster, 0, len(candidates))
+	for _, g := range candidates {
+		if g.StartAt <= now && now <= g.EndAt {
+			active = append(active, g)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool { return active[i].DisplayOrder < active[j].DisplayOrder })
+
+	// 一覧が変わるのは、いずれかのガチャが始まる・終わるタイミングのみ
+	validFrom := int64(math.MinInt64)
+	validUntil := int64(math.MaxInt64)
+	if ended > 0 {
+		validFrom = idx.byEnd[ended-1].EndAt + 1
+	}
+	if started < len(idx.byStart) {
+		validUntil = idx.byStart[started].StartAt - 1
+	}
+	for _, g := range active {
+		if g.StartAt > validFrom {
+			validFrom = g.StartAt
+		}
+		if g.EndAt < validUntil {
+			validUntil = g.EndAt
+		}
+	}
+	return active, validFrom, validUntil
+}
+
+// GetActivePresentAlls requestAt時点で配布期間中の全員プレゼントマスタをキャッシュから取得
+func (c *MasterDataCache) GetActivePresentAlls(requestAt int64) ([]*PresentAllMaster, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.presentAlls == nil {
+		return nil, false
+	}
+	return filterActivePresentAlls(c.presentAlls, requestAt), true
+}
+
+// filterActivePresentAlls requestAt時点で配布期間中のものだけを返す
+func filterActivePresentAlls(presentAlls []*PresentAllMaster, requestAt int64) []*PresentAllMaster {
+	active := make([]*PresentAllMaster, 0)
+	for _, v := range presentAlls {
+		if v.RegisteredStartAt <= requestAt && requestAt <= v.RegisteredEndAt {
+			active = append(active, v)
+		}
+	}
+	return active
+}
+
+// SetPresentAlls 全員プレゼントマスタをすべてキャッシュに設定
+func (c *MasterDataCache) SetPresentAlls(presentAlls []*PresentAllMaster) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.presentAlls = presentAlls
+}
+
+// GetLoginBonuses ログインボーナスマスタをすべてキャッシュから取得
+func (c *MasterDataCache) GetLoginBonuses() ([]*LoginBonusMaster, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.loginBonuses == nil {
+		return nil, false
+	}
+	return c.loginBonuses, true
+}
+
+// SetLoginBonuses ログインボーナスマスタをすべてキャッシュに設定
+func (c *MasterDataCache) SetLoginBonuses(loginBonuses []*LoginBonusMaster) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.loginBonuses = loginBonuses
+}
+
+// MasterDataCacheStats マスターデータのキャッシュの種類ごとのエントリ数
+type MasterDataCacheStats struct {
+	GachaItems        int  `json:"gachaItems"`
+	LoginBonusRewards int  `json:"loginBonusRewards"`
+	ItemMasters       int  `json:"itemMasters"`
+	GachaList         bool `json:"gachaList"`
+	GachaIndex        bool `json:"gachaIndex"`
+	PresentAlls       bool `json:"presentAlls"`
+	LoginBonuses      bool `json:"loginBonuses"`
+}
+
+// Stats キャッシュのエントリ数を取得
+func (c *MasterDataCache) Stats() *MasterDataCacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return &MasterDataCacheStats{
+		GachaItems:        len(c.gachaItems),
+		LoginBonusRewards: len(c.loginBonusRewards),
+		ItemMasters:       len(c.itemMasters),
+		GachaList:         c.gachaList != nil,
+		GachaIndex:        c.gachaIndex != nil,
+		PresentAlls:       c.presentAlls != nil,
+		LoginBonuses:      c.loginBonuses != nil,
+	}
+}
+
+// SyncMasterVersion 有効なマスタバージョンがキャッシュを作ったときと変わっていれば、キャッシュをクリアする
+func (c *MasterDataCache) SyncMasterVersion(masterVersion string) {
+	c.mu.RLock()
+	same := c.masterVersion == masterVersion
+	c.mu.RUnlock()
+	if same {
+		return
+	}
+
+	c.Clear()
+	c.mu.Lock()
+	c.masterVersion = masterVersion
+	c.mu.Unlock()
+}
+
 // Clear キャッシュをクリア
 func (c *MasterDataCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.gachaItems = make(map[int64][]*GachaItemMaster)
-	c.gachaWeightSums = make(map[int64]int64)
+	c.gachaCumWeights = make(map[int64][]int64)
 	c.loginBonusRewards = make(map[string]*LoginBonusRewardMaster)
 	c.itemMasters = make(map[int64]*ItemMaster)
+	c.gachaList = nil
+	c.gachaIndex = nil
+	c.presentAlls = nil
+	c.loginBonuses = nil
 	c.lastUpdated = time.Time{}
 	c.masterVersion = ""
 }
 
 var (
-	snowflakeNode *snowflake.Node
+	snowflakeNodeID int64 = 1
 )
 
+// idNode IDの生成元。*snowflake.Nodeを満たし、テストでは時計の巻き戻りを再現するものに差し替える
+type idNode interface {
+	Generate() snowflake.ID
+}
+
+// IDGenerator snowflakeによるIDの生成器
+// 時計の巻き戻りなどで直前以下のIDが生成された場合は、警告を出して一定時間待って再生成し、それでも駄目ならエラーを返す
+type IDGenerator struct {
+	mu      sync.Mutex
+	node    idNode
+	lastID  int64
+	maxWait time.Duration
+	logger  echo.Logger
+}
+
+// NewIDGenerator 新しいID生成器を作成
+func NewIDGenerator(nodeID int64, maxWait time.Duration, logger echo.Logger) (*IDGenerator, error) {
+	node, err := snowflake.NewNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return newIDGenerator(node, maxWait, logger), nil
+}
+
+func newIDGenerator(node idNode, maxWait time.Duration, logger echo.Logger) *IDGenerator {
+	return &IDGenerator{node: node, maxWait: maxWait, logger: logger}
+}
+
+// Generate 直前に生成したIDより大きいIDを生成する
+func (g *IDGenerator) Generate() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	deadline := time.Now().Add(g.maxWait)
+	for waited := false; ; waited = true {
+		id := g.node.Generate().Int64()
+		if id > g.lastID {
+			g.lastID = id
+			return id, nil
+		}
+		if !waited {
+			g.logger.Warnf("clock rollback detected, waiting up to %s: generated=%d, last=%d", g.maxWait, id, g.lastID)
+		}
+		if !time.Now().Before(deadline) {
+			return 0, errors.Wrapf(ErrIDNotMonotonic, "generated=%d, last=%d", id, g.lastID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// parseLogLevel ログレベルの文字列をechoのロガーのレベルに変換する
+// 未指定や不正な値の場合は false を返し、従来どおりの設定のままにする
+func parseLogLevel(s string) (log.Lvl, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return log.DEBUG, true
+	case "info":
+		return log.INFO, true
+	case "warn":
+		return log.WARN, true
+	case "error":
+		return log.ERROR, true
+	case "off":
+		return log.OFF, true
+	default:
+		return 0, false
+	}
+}
+
+// minLogLevel 2つのログレベルのうち詳細な方を返す
+func minLogLevel(a, b log.Lvl) log.Lvl {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	time.Local = time.FixedZone("Local", 9*60*60)
 
-	node, err := snowflake.NewNode(1)
-	if err != nil {
-		fmt.Println(err)
-		return
+	// 以前のデプロイのID空間と衝突しないよう、エポックを環境変数で変更できるようにする
+	if epoch := getEnvInt("ISUCON_SNOWFLAKE_EPOCH_MS", 0); epoch > 0 {
+		snowflake.Epoch = int64(epoch)
 	}
-	snowflakeNode = node
-
 	e := echo.New()
-	e.Use(middleware.Logger())
+	e.IPExtractor = ipExtractor()
+	// ISUCON_LOG_LEVEL が指定された場合はロガーのレベルを変更し、INFOより上ならリクエストログも出さない
+	// errorResponseのエラーログが消えないよう、ロガーのレベルはERRORより上げない
+	logLevel, logLevelSet := parseLogLevel(getEnv("ISUCON_LOG_LEVEL", ""))
+	if logLevelSet {
+		e.Logger.SetLevel(minLogLevel(logLevel, log.ERROR))
+	}
+	if !logLevelSet || logLevel <= log.INFO {
+		e.Use(middleware.Logger())
+	}
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodPost},
-		AllowHeaders: []string{"Content-Type", "x-master-version", "x-session"},
+		AllowOrigins:  []string{"*"},
+		AllowMethods:  []string{http.MethodGet, http.MethodPost},
+		AllowHeaders:  []string{"Content-Type", "x-master-version", "x-session", "Accept-Version", DebugDBQueriesHeader},
+		ExposeHeaders: []string{"X-Api-Version", DBQueriesHeader},
 	}))
+	e.Use(apiVersionMiddleware)
+	e.Use(dbQueryCounterMiddleware)
+
+	if loginLocationErr != nil {
+		e.Logger.Warnf("failed to load ISUCON_LOGIN_TZ, fallback to JST: %v", loginLocationErr)
+	}
+	if len(networthItemValuesIgnored) > 0 {
+		e.Logger.Warnf("invalid ISUCON_NETWORTH_ITEM_VALUES entries ignored: %s", strings.Join(networthItemValuesIgnored, ","))
+	}
+
+	idGen, err := NewIDGenerator(snowflakeNodeID, time.Duration(getEnvInt("ISUCON_ID_ROLLBACK_WAIT_MS", 10))*time.Millisecond, e.Logger)
+	if err != nil {
+		e.Logger.Fatalf("failed to create id generator: %v", err)
+	}
 
 	dbx, err := connectDB(false)
 	if err != nil {
@@ -253,7 +989,7 @@ func main() {
 	defer dbx.Close()
 
 	// Connect to multiple databases for sharding
-	dbs, err := connectDBs(false)
+	dbs, shardErrors, err := connectDBs(false)
 	if err != nil {
 		e.Logger.Fatalf("failed to connect to dbs: %v", err)
 	}
@@ -264,13 +1000,34 @@ func main() {
 		}
 	}()
 
+	// ベンチマーク開始前に設定ミスや落ちているシャードに気づけるよう、起動時に接続を確認しておく
+	if err := warmupDBs(dbWarmupTargets(dbx, dbs, shardErrors), e.Logger); err != nil {
+		e.Logger.Fatalf("failed to warm up dbs: %v", err)
+	}
+
 	e.Server.Addr = fmt.Sprintf(":%v", "8080")
 	h := &Handler{
-		DBs:        dbs,
-		DB:         dbx,
-		Cache:      NewMasterDataCache(),
-		TokenCache: NewTokenCache(),
-	}
+		DBs:          dbs,
+		DB:           dbx,
+		Cache:        NewMasterDataCache(),
+		TokenCache:   NewTokenCache(),
+		WriteSems:    newWriteSemaphores(len(dbs)),
+		UserLocks:    NewUserLocks(),
+		GachaLocks:   NewUserLocks(),
+		Jobs:         NewJobs(),
+		IDGen:        idGen,
+		TokenIssues:  NewTokenIssueCounter(),
+		LoginMetrics: NewLoginGrantMetrics(),
+		ShardErrors:  shardErrors,
+		AdminLogins:  NewAdminLoginLimiter(),
+		Load:         NewLoadMonitor(loadStatusWindow, dbPoolWaits(append([]*sqlx.DB{dbx}, dbs...)...), time.Now()),
+	}
+	e.Use(h.loadMonitorMiddleware)
+	h.PresentQueue = newPresentGrantQueue(dbs, e.Logger)
+	h.Outbox = NewOutboxRelay(dbs, e.Logger)
+	h.Outbox.Subscribe(EventTypeCoinGrant, logOutboxEvent(e.Logger))
+	h.Outbox.Subscribe(EventTypeCardMaxLevel, logOutboxEvent(e.Logger))
+	h.Outbox.Subscribe(EventTypeMergeCompensation, h.compensateMerge)
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{}))
 
@@ -278,21 +1035,43 @@ func main() {
 	e.POST("/initialize", initialize)
 	e.POST("/initializeOne", initializeOne)
 	e.GET("/health", h.health)
+	e.GET("/version", h.version)
+	e.GET("/status", h.status)
 
 	// feature
-	API := e.Group("", h.apiMiddleware)
+	API := e.Group("", requestTimeoutMiddleware(), h.apiMiddleware)
 	API.POST("/user", h.createUser)
 	API.POST("/login", h.login)
+	API.POST("/users/profiles", h.getUserProfiles)
 	sessCheckAPI := API.Group("", h.checkSessionMiddleware)
 	sessCheckAPI.GET("/user/:userID/gacha/index", h.listGacha)
 	sessCheckAPI.POST("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha)
+	sessCheckAPI.POST("/user/:userID/gacha/reroll", h.rerollGacha)
+	sessCheckAPI.GET("/user/:userID/gacha/:gachaID/odds", h.getGachaOdds)
 	sessCheckAPI.GET("/user/:userID/present/index/:n", h.listPresent)
 	sessCheckAPI.POST("/user/:userID/present/receive", h.receivePresent)
+	sessCheckAPI.POST("/user/:userID/present/check", h.checkPresents)
+	sessCheckAPI.GET("/user/:userID/present-all", h.listPresentAll)
 	sessCheckAPI.GET("/user/:userID/item", h.listItem)
+	sessCheckAPI.GET("/user/:userID/networth", h.getNetworth)
+	sessCheckAPI.POST("/user/:userID/item/exchange", h.exchangeItem)
+	sessCheckAPI.POST("/user/:userID/item/use/:itemID", h.useItem)
 	sessCheckAPI.POST("/user/:userID/card/addexp/:cardID", h.addExpToCard)
+	sessCheckAPI.POST("/user/:userID/card/respec/:cardID", h.respecCard)
+	sessCheckAPI.GET("/user/:userID/card/:cardID/curve", h.getCardCurve)
 	sessCheckAPI.POST("/user/:userID/card", h.updateDeck)
+	sessCheckAPI.POST("/user/:userID/deck/preset", h.saveDeckPreset)
+	sessCheckAPI.GET("/user/:userID/deck/presets", h.listDeckPresets)
+	sessCheckAPI.POST("/user/:userID/deck/preset/:name/activate", h.activateDeckPreset)
 	sessCheckAPI.POST("/user/:userID/reward", h.reward)
 	sessCheckAPI.GET("/user/:userID/home", h.home)
+	sessCheckAPI.GET("/user/:userID/reward/history", h.listRewardHistory)
+	sessCheckAPI.POST("/user/:userID/name", h.updateUserName)
+	sessCheckAPI.POST("/user/:userID/merge", h.mergeUser)
+	sessCheckAPI.POST("/user/:userID/logout", h.logout)
+	sessCheckAPI.GET("/user/:userID/loginbonus/history", h.listLoginBonusHistory)
+	sessCheckAPI.GET("/user/:userID/schedule", h.getSchedule)
+	sessCheckAPI.GET("/user/:userID/token/:tokenType/valid", h.validateOneTimeToken)
 
 	// admin
 	adminAPI := e.Group("", h.adminMiddleware)
@@ -301,15 +1080,73 @@ func main() {
 	adminAuthAPI.DELETE("/admin/logout", h.adminLogout)
 	adminAuthAPI.GET("/admin/master", h.adminListMaster)
 	adminAuthAPI.PUT("/admin/master", h.adminUpdateMaster)
+	adminAuthAPI.GET("/admin/master/export", h.adminExportMasterManifest)
+	adminAuthAPI.GET("/admin/master/export/:table", h.adminExportMasterTable)
+	adminAuthAPI.GET("/admin/master/jobs/:jobID", h.adminGetMasterUpdateJob)
+	adminAuthAPI.GET("/admin/jobs", h.adminListJobs)
+	adminAuthAPI.GET("/admin/jobs/:jobID", h.adminGetJob)
+	adminAuthAPI.POST("/admin/jobs/:jobID/cancel", h.adminCancelJob)
+	adminAuthAPI.POST("/admin/master/activate", h.adminActivateMaster)
+	adminAuthAPI.POST("/admin/cache/clear", h.adminClearCache)
+	adminAuthAPI.POST("/admin/purge", h.adminPurge)
+	adminAuthAPI.GET("/admin/tokens/stats", h.adminTokenIssueStats)
+	adminAuthAPI.GET("/admin/tokens/divergence", h.adminTokenDivergence)
+	adminAuthAPI.GET("/admin/metrics", h.adminMetrics)
+	adminAuthAPI.GET("/admin/shards/errors", h.adminShardErrors)
 	adminAuthAPI.GET("/admin/user/:userID", h.adminUser)
 	adminAuthAPI.POST("/admin/user/:userID/ban", h.adminBanUser)
+	adminAuthAPI.POST("/admin/coins/grant", h.adminGrantCoins)
+	adminAuthAPI.POST("/admin/user/:userID/reset-login", h.adminResetUserLogin)
+	adminAuthAPI.GET("/admin/user/:userID/login-preview", h.adminLoginPreview)
+	adminAuthAPI.POST("/admin/user/:userID/cards/resync-stats", h.adminResyncUserCardStats)
+	adminAuthAPI.GET("/admin/user/:userID/integrity", h.adminCheckUserIntegrity)
+	adminAuthAPI.GET("/admin/gacha/:gachaID/simulate", h.adminSimulateGacha)
+	adminAuthAPI.GET("/admin/gacha/:gachaID/stats", h.adminGachaStats)
+	adminAuthAPI.GET("/admin/id/:id/decode", h.adminDecodeID)
+
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	h.startCleanupJob(cleanupCtx, e.Logger)
+	h.Outbox.Start()
 
 	e.Logger.Infof("Start server: address=%s", e.Server.Addr)
-	e.Logger.Error(e.StartServer(e.Server))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.StartServer(e.Server)
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		e.Logger.Error(err)
+	case <-quit:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			e.Logger.Error(err)
+		}
+	}
+
+	// 掃除のジョブは途中で止めても次回に続きから処理する
+	stopCleanup()
+	// キューに残っているプレゼントの付与と、処理中のイベントの中継を終えてからDB接続を閉じる
+	h.PresentQueue.Close()
+	h.Outbox.Close()
 }
 
-// connectDB DBに接続する
-func connectDB(batch bool) (*sqlx.DB, error) {
+// ipExtractor c.RealIP()で接続元IPを求める方法
+// 既定ではクライアントが自由に書き換えられるヘッダを信用せず、接続元のアドレスを使う
+// nginxなどのプロキシを経由する場合は ISUCON_TRUST_PROXY_XFF=1 とし、
+// X-Forwarded-Forを右から見てプライベートアドレスなどの信用できるプロキシ以外で最初のアドレスを使う
+func ipExtractor() echo.IPExtractor {
+	if getEnv("ISUCON_TRUST_PROXY_XFF", "") == "1" {
+		return echo.ExtractIPFromXFFHeader()
+	}
+	return echo.ExtractIPDirect()
+}
+
+// connectDB DBに接続する
+func connectDB(batch bool) (*sqlx.DB, error) {
 	dsn := fmt.Sprintf(
 		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=%s&multiStatements=%t&interpolateParams=true",
 		getEnv("ISUCON_DB_USER", "isucon"),
@@ -320,9 +1157,24 @@ func connectDB(batch bool) (*sqlx.DB, error) {
 		"Asia%2FTokyo",
 		batch,
 	)
-	dbx, err := sqlx.Open("mysql", dsn)
-	if err != nil {
-		return nil, err
+	var dbx *sqlx.DB
+	if debugDBQueries {
+		// クエリ数を数えるため、シャードと同じドライバで包む。エラーは記録しない
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dbx = sqlx.NewDb(sql.OpenDB(&errorRecordingConnector{connector: connector}), "mysql")
+	} else {
+		var err error
+		dbx, err = sqlx.Open("mysql", dsn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	dbx.SetMaxOpenConns(100)                  // 最大接続数を100に設定
@@ -333,11 +1185,13 @@ func connectDB(batch bool) (*sqlx.DB, error) {
 }
 
 // connectDBs 複数のDBに接続する
-func connectDBs(batch bool) ([]*sqlx.DB, error) {
+// シャードごとに、返したエラーを記録するShardErrorLogも返す
+func connectDBs(batch bool) ([]*sqlx.DB, []*ShardErrorLog, error) {
 	hosts := getEnv("ISUCON_DB_HOSTS", "127.0.0.1")
 	hostList := strings.Split(hosts, ",")
 
 	dbs := make([]*sqlx.DB, 0, len(hostList))
+	errLogs := make([]*ShardErrorLog, 0, len(hostList))
 	for _, host := range hostList {
 		dsn := fmt.Sprintf(
 			"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=%s&multiStatements=%t",
@@ -349,27 +1203,36 @@ func connectDBs(batch bool) ([]*sqlx.DB, error) {
 			"Asia%2FTokyo",
 			batch,
 		)
-		dbx, err := sqlx.Open("mysql", dsn)
+		cfg, err := mysql.ParseDSN(dsn)
+		if err == nil {
+			var connector driver.Connector
+			connector, err = mysql.NewConnector(cfg)
+			if err == nil {
+				errLog := NewShardErrorLog(host, shardErrorLogSize, shardErrorMaxAge)
+				dbs = append(dbs, sqlx.NewDb(sql.OpenDB(&errorRecordingConnector{connector: connector, log: errLog}), "mysql"))
+				errLogs = append(errLogs, errLog)
+			}
+		}
 		if err != nil {
 			// Close all opened connections
 			for _, db := range dbs {
 				db.Close()
 			}
-			return nil, err
+			return nil, nil, err
 		}
-		dbs = append(dbs, dbx)
 	}
 
 	if len(dbs) == 0 {
 		// Fallback to single DB connection
 		db, err := connectDB(batch)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		dbs = append(dbs, db)
+		errLogs = append(errLogs, NewShardErrorLog(getEnv("ISUCON_DB_HOST", "127.0.0.1"), shardErrorLogSize, shardErrorMaxAge))
 	}
 
-	return dbs, nil
+	return dbs, errLogs, nil
 }
 
 // adminMiddleware 管理者ツール向けのmiddleware
@@ -386,9 +1249,53 @@ func (h *Handler) adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// requestTimeoutMiddleware ユーザ向けAPIの処理時間に上限を設けるmiddleware
+// 参照系(GET)は ISUCON_READ_TIMEOUT_MS、更新系は ISUCON_WRITE_TIMEOUT_MS で指定し、0の場合は上限なし
+// 期限はdbContextでDBに渡すcontextに設定するため、期限を過ぎるとクエリやコミットが失敗してトランザクションはロールバックされる
+// 503はハンドラが戻ってから返すため、クライアントに失敗を返した更新が後からコミットされることはない
+// 後続のmiddlewareも期限内に実行されるよう、グループの先頭に置くこと
+func requestTimeoutMiddleware() echo.MiddlewareFunc {
+	readTimeout := time.Duration(getEnvInt("ISUCON_READ_TIMEOUT_MS", 0)) * time.Millisecond
+	writeTimeout := time.Duration(getEnvInt("ISUCON_WRITE_TIMEOUT_MS", 0)) * time.Millisecond
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			timeout := writeTimeout
+			if c.Request().Method == http.MethodGet {
+				timeout = readTimeout
+			}
+			if timeout <= 0 {
+				return next(c)
+			}
+
+			ctx, cancel := withDBTimeout(c, timeout)
+			defer cancel()
+
+			err := next(c)
+			if ctx.Err() != context.DeadlineExceeded {
+				return err
+			}
+			c.Logger().Errorf("request timeout: path=%s, err=%+v", c.Path(), err)
+			// 期限までにレスポンスを書き出していた場合はそのまま返す
+			if c.Response().Committed {
+				return nil
+			}
+			return c.JSON(http.StatusServiceUnavailable, struct {
+				StatusCode int    `json:"status_code"`
+				Message    string `json:"message"`
+			}{
+				StatusCode: http.StatusServiceUnavailable,
+				Message:    "request timeout",
+			})
+		}
+	}
+}
+
 // apiMiddleware　ユーザ向けAPI向けのmiddleware
 func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		ctx := dbContext(c)
+
 		requestAt, err := time.Parse(time.RFC1123, c.Request().Header.Get("x-isu-date"))
 		if err != nil {
 			requestAt = time.Now()
@@ -396,15 +1303,17 @@ func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		c.Set("requestTime", requestAt.Unix())
 
 		// 有効なマスタデータか確認
-		query := "SELECT * FROM version_masters WHERE status=1"
-		masterVersion := new(VersionMaster)
-		if err := h.DB.Get(masterVersion, query); err != nil {
+		masterVersion, err := h.getActiveMasterVersion(ctx, c.Logger())
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return errorResponse(c, http.StatusNotFound, fmt.Errorf("active master version is not found"))
 			}
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 
+		// 他のプロセスでマスタバージョンが切り替えられた場合も、古いマスタのキャッシュを使わないよう破棄する
+		h.Cache.SyncMasterVersion(masterVersion.MasterVersion)
+
 		if masterVersion.MasterVersion != c.Request().Header.Get("x-master-version") {
 			return errorResponse(c, http.StatusUnprocessableEntity, ErrInvalidMasterVersion)
 		}
@@ -412,7 +1321,7 @@ func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		// BANユーザ確認
 		userID, err := getUserID(c)
 		if err == nil && userID != 0 {
-			isBan, err := h.checkBan(userID)
+			isBan, err := h.checkBan(ctx, userID)
 			if err != nil {
 				return errorResponse(c, http.StatusInternalServerError, err)
 			}
@@ -428,6 +1337,23 @@ func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// getActiveMasterVersion 有効なマスタバージョンを取得する
+// 有効なバージョンがない場合はsql.ErrNoRowsを返すが、ISUCON_MASTER_VERSION_FALLBACK=1 の場合は
+// 有効化の失敗でAPI全体が止まらないよう、最も新しく作成されたバージョンを警告を出したうえで返す
+func (h *Handler) getActiveMasterVersion(ctx context.Context, logger echo.Logger) (*VersionMaster, error) {
+	masterVersion := new(VersionMaster)
+	err := h.DB.GetContext(ctx, masterVersion, "SELECT * FROM version_masters WHERE status=1")
+	if err != sql.ErrNoRows || !masterVersionFallback {
+		return masterVersion, err
+	}
+
+	if err := h.DB.GetContext(ctx, masterVersion, "SELECT * FROM version_masters ORDER BY id DESC LIMIT 1"); err != nil {
+		return nil, err
+	}
+	logger.Warnf("active master version is not found, fallback to latest version: %s", masterVersion.MasterVersion)
+	return masterVersion, nil
+}
+
 // checkSessionMiddleware セッションが有効か確認するmiddleware
 func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -447,11 +1373,14 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 		}
 
 		// ユーザーIDに基づいて適切なDBを選択
+		// login・createUserで作成した直後のセッションを確実に読めるよう、セッションは常にシャードのプライマリから読む
+		// 読み取りレプリカを導入する場合もここはレプリカに向けないこと(レプリカ遅延で401を返してしまう)
 		db := h.getDBForUserID(userID)
 
+		ctx := dbContext(c)
 		userSession := new(Session)
 		query := "SELECT * FROM user_sessions WHERE session_id=? AND deleted_at IS NULL"
-		if err := db.Get(userSession, query, sessID); err != nil {
+		if err := db.GetContext(ctx, userSession, query, sessID); err != nil {
 			if err == sql.ErrNoRows {
 				return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
 			}
@@ -465,7 +1394,7 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 		// 期限切れチェック
 		if userSession.ExpiredAt < requestAt {
 			query = "UPDATE user_sessions SET deleted_at=? WHERE session_id=?"
-			if _, err = db.Exec(query, requestAt, sessID); err != nil {
+			if _, err = db.ExecContext(ctx, query, requestAt, sessID); err != nil {
 				return errorResponse(c, http.StatusInternalServerError, err)
 			}
 			return errorResponse(c, http.StatusUnauthorized, ErrExpiredSession)
@@ -479,28 +1408,25 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 }
 
 // checkOneTimeToken ワンタイムトークンの確認用middleware
-func (h *Handler) checkOneTimeToken(userID int64, token string, tokenType int, requestAt int64) error {
+func (h *Handler) checkOneTimeToken(ctx context.Context, userID int64, token string, tokenType int, requestAt int64) error {
 	// まずキャッシュから確認
-	if tokenInfo, exists := h.TokenCache.GetToken(token); exists {
-		// トークンタイプが一致しない場合
-		if tokenInfo.TokenType != tokenType {
-			return ErrInvalidToken
-		}
-
+	// 種別やユーザーが一致しないトークンは、本来のエンドポイントで使えるよう失効させずに弾く
+	tokenInfo, exists, err := h.TokenCache.TakeToken(token, userID, tokenType)
+	if err != nil {
+		return tokenError(err)
+	}
+	if exists {
 		// 期限切れの場合
 		if tokenInfo.ExpiredAt < requestAt {
-			h.TokenCache.DeleteToken(token)
 			// DBからも削除
-			query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-			h.getDBForUserID(userID).Exec(query, requestAt, token)
-			return ErrInvalidToken
+			query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=? AND token_type=?"
+			h.getDBForUserID(userID).ExecContext(ctx, query, requestAt, token, tokenType) //nolint:errcheck
+			return tokenError(ErrTokenExpired)
 		}
 
-		// 使用済みとしてキャッシュから削除
-		h.TokenCache.DeleteToken(token)
-		// DBからも削除
-		query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-		if _, err := h.getDBForUserID(userID).Exec(query, requestAt, token); err != nil {
+		// キャッシュからは取り除いたので、DBでも使用済みにする
+		query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=? AND token_type=?"
+		if _, err := h.getDBForUserID(userID).ExecContext(ctx, query, requestAt, token, tokenType); err != nil {
 			return err
 		}
 
@@ -511,39 +1437,128 @@ func (h *Handler) checkOneTimeToken(userID int64, token string, tokenType int, r
 	tk := new(UserOneTimeToken)
 	// ユーザーIDに基づいて適切なDBを選択
 	db := h.getDBForUserID(userID)
-	query := "SELECT * FROM user_one_time_tokens WHERE token=? AND token_type=? AND deleted_at IS NULL"
-	if err := db.Get(tk, query, token, tokenType); err != nil {
+	query := "SELECT * FROM user_one_time_tokens WHERE token=? AND deleted_at IS NULL"
+	if err := db.GetContext(ctx, tk, query, token); err != nil {
 		if err == sql.ErrNoRows {
-			return ErrInvalidToken
+			return tokenError(ErrTokenNotFound)
 		}
 		return err
 	}
+	if tk.UserID != userID {
+		return tokenError(ErrTokenNotFound)
+	}
+	if tk.TokenType != tokenType {
+		return tokenError(ErrTokenTypeMismatch)
+	}
 
 	if tk.ExpiredAt < requestAt {
 		query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-		if _, err := db.Exec(query, requestAt, token); err != nil {
+		if _, err := db.ExecContext(ctx, query, requestAt, token); err != nil {
 			return err
 		}
-		return ErrInvalidToken
+		return tokenError(ErrTokenExpired)
 	}
 
 	// 使ったトークンは失効する
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-	if _, err := db.Exec(query, requestAt, token); err != nil {
+	// 確認してから失効させるまでの間に同じトークンが使われた場合に備え、未使用のものを失効できた場合のみ有効とする
+	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=? AND token_type=? AND deleted_at IS NULL"
+	res, err := db.ExecContext(ctx, query, requestAt, token, tokenType)
+	if err != nil {
 		return err
 	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return tokenError(ErrTokenNotFound)
+	}
 
 	return nil
 }
 
+// tokenError ワンタイムトークンが無効な理由を、ISUCON_DETAILED_TOKEN_ERRORSの設定に応じて返す
+func tokenError(err error) error {
+	if !detailedTokenErrors {
+		return ErrInvalidToken
+	}
+	return err
+}
+
+// isTokenError ワンタイムトークンが無効であることを表すエラーかどうか
+func isTokenError(err error) bool {
+	switch err {
+	case ErrInvalidToken, ErrTokenNotFound, ErrTokenExpired, ErrTokenTypeMismatch:
+		return true
+	}
+	return false
+}
+
+// tokenErrorStatus ワンタイムトークンのエラーに対応するステータスコード
+// 期限切れは一覧を取り直せば回復できるため、それ以外と区別できるよう410を返す
+func tokenErrorStatus(err error) int {
+	switch err {
+	case ErrTokenExpired:
+		return http.StatusGone
+	case ErrTokenNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// peekOneTimeToken ワンタイムトークンを消費せずに有効か確認する
+// 有効な場合は有効期限を返す
+func (h *Handler) peekOneTimeToken(ctx context.Context, userID int64, token string, tokenType int, requestAt int64) (int64, error) {
+	// まずキャッシュから確認
+	if tokenInfo, exists := h.TokenCache.GetToken(token); exists {
+		switch {
+		case tokenInfo.UserID != userID:
+			return 0, tokenError(ErrTokenNotFound)
+		case tokenInfo.TokenType != tokenType:
+			return 0, tokenError(ErrTokenTypeMismatch)
+		case tokenInfo.ExpiredAt < requestAt:
+			return 0, tokenError(ErrTokenExpired)
+		}
+		return tokenInfo.ExpiredAt, nil
+	}
+
+	// キャッシュにない場合はDBから確認（フォールバック）
+	tk := new(UserOneTimeToken)
+	query := "SELECT * FROM user_one_time_tokens WHERE user_id=? AND token=? AND deleted_at IS NULL"
+	if err := h.getDBForUserID(userID).GetContext(ctx, tk, query, userID, token); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, tokenError(ErrTokenNotFound)
+		}
+		return 0, err
+	}
+	if tk.TokenType != tokenType {
+		return 0, tokenError(ErrTokenTypeMismatch)
+	}
+	if tk.ExpiredAt < requestAt {
+		return 0, tokenError(ErrTokenExpired)
+	}
+
+	return tk.ExpiredAt, nil
+}
+
+// validatePlatformType プラットフォーム種別が既知の値かを確認する
+func validatePlatformType(platformType int) error {
+	switch platformType {
+	case PlatformWeb, PlatformIOS, PlatformAndroid:
+		return nil
+	}
+	return ErrInvalidPlatformType
+}
+
 // checkViewerID viewerIDとplatformの確認を行う
-func (h *Handler) checkViewerID(userID int64, viewerID string) error {
+func (h *Handler) checkViewerID(ctx context.Context, userID int64, viewerID string) error {
 	// ユーザーIDに基づいて適切なDBを選択
 	db := h.getDBForUserID(userID)
 
 	query := "SELECT * FROM user_devices WHERE user_id=? AND platform_id=?"
 	device := new(UserDevice)
-	if err := db.Get(device, query, userID, viewerID); err != nil {
+	if err := db.GetContext(ctx, device, query, userID, viewerID); err != nil {
 		if err == sql.ErrNoRows {
 			return ErrUserDeviceNotFound
 		}
@@ -553,14 +1568,35 @@ func (h *Handler) checkViewerID(userID int64, viewerID string) error {
 	return nil
 }
 
+// getUserWithViewerID ユーザーを取得しつつ、viewerIDがそのユーザーの端末かを1回のクエリで確認する
+// ユーザーが存在しない場合はErrUserNotFound、端末が一致しない場合はErrUserDeviceNotFoundを返す
+func (h *Handler) getUserWithViewerID(ctx context.Context, userID int64, viewerID string) (*User, error) {
+	row := struct {
+		User
+		DeviceID sql.NullInt64 `db:"device_id"`
+	}{}
+	query := "SELECT u.*, d.id AS device_id FROM users u LEFT JOIN user_devices d ON d.user_id=u.id AND d.platform_id=? WHERE u.id=? LIMIT 1"
+	if err := h.getDBForUserID(userID).GetContext(ctx, &row, query, viewerID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if !row.DeviceID.Valid {
+		return nil, ErrUserDeviceNotFound
+	}
+
+	return &row.User, nil
+}
+
 // checkBan BANされているユーザでかを確認する
-func (h *Handler) checkBan(userID int64) (bool, error) {
+func (h *Handler) checkBan(ctx context.Context, userID int64) (bool, error) {
 	// ユーザーIDに基づいて適切なDBを選択
 	db := h.getDBForUserID(userID)
 
 	banUser := new(UserBan)
 	query := "SELECT * FROM user_bans WHERE user_id=?"
-	if err := db.Get(banUser, query, userID); err != nil {
+	if err := db.GetContext(ctx, banUser, query, userID); err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
 		}
@@ -579,7 +1615,7 @@ func getRequestTime(c echo.Context) (int64, error) {
 }
 
 // loginProcess ログイン処理
-func (h *Handler) loginProcess(tx *sqlx.Tx, userID int64, requestAt int64) (*User, []*UserLoginBonus, []*UserPresent, error) {
+func (h *Handler) loginProcess(ctx context.Context, tx *sqlx.Tx, userID int64, requestAt int64) (*User, []*UserLoginBonus, []*UserPresent, error) {
 	user := new(User)
 	query := "SELECT * FROM users WHERE id=?"
 	if err := tx.Get(user, query, userID); err != nil {
@@ -590,13 +1626,14 @@ func (h *Handler) loginProcess(tx *sqlx.Tx, userID int64, requestAt int64) (*Use
 	}
 
 	// ログインボーナス処理
-	loginBonuses, err := h.obtainLoginBonus(tx, userID, requestAt)
+	loginBonuses, err := h.obtainLoginBonus(ctx, tx, userID, requestAt)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
 	// 全員プレゼント取得
-	allPresents, err := h.obtainPresent(tx, userID, requestAt)
+	// 非同期付与が有効な場合、返したプレゼントはコミット後にenqueuePresentGrantsで付与すること
+	allPresents, err := h.obtainPresent(ctx, tx, userID, requestAt)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -620,22 +1657,34 @@ func (h *Handler) loginProcess(tx *sqlx.Tx, userID int64, requestAt int64) (*Use
 }
 
 // isCompleteTodayLogin 当日分のログイン処理が終わっているかを確認する
-func isCompleteTodayLogin(lastActivatedAt, requestAt time.Time) bool {
+// 日付の境界はlocのタイムゾーンで判定する
+func isCompleteTodayLogin(lastActivatedAt, requestAt time.Time, loc *time.Location) bool {
+	lastActivatedAt = lastActivatedAt.In(loc)
+	requestAt = requestAt.In(loc)
 	return lastActivatedAt.Year() == requestAt.Year() &&
 		lastActivatedAt.Month() == requestAt.Month() &&
 		lastActivatedAt.Day() == requestAt.Day()
 }
 
-// obtainLoginBonus ログインボーナス付与
-func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserLoginBonus, error) {
+// loginBonusGrant ログインで進めるログインボーナスの進捗と、その日の報酬
+type loginBonusGrant struct {
+	userBonus *UserLoginBonus
+	// isNew user_login_bonusesにまだないボーナス。付与する際にIDを採番して挿入する
+	isNew  bool
+	reward *LoginBonusRewardMaster
+}
+
+// planLoginBonus requestAtのログインで進めるログインボーナスと、その報酬を求める。DBには書き込まない
+// 新しく始まるボーナスのIDは付与する際に採番するため、0のまま返す
+func (h *Handler) planLoginBonus(ctx context.Context, q sqlx.QueryerContext, userID int64, requestAt int64) ([]*loginBonusGrant, error) {
 	loginBonuses := make([]*LoginBonusMaster, 0)
 	query := "SELECT * FROM login_bonus_masters WHERE start_at <= ? AND end_at >= ?"
-	if err := tx.Select(&loginBonuses, query, requestAt, requestAt); err != nil {
+	if err := sqlx.SelectContext(ctx, q, &loginBonuses, query, requestAt, requestAt); err != nil {
 		return nil, err
 	}
 
 	if len(loginBonuses) == 0 {
-		return make([]*UserLoginBonus, 0), nil
+		return make([]*loginBonusGrant, 0), nil
 	}
 
 	// ログインボーナスIDを一括取得
@@ -652,7 +1701,7 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 	}
 
 	existingBonuses := make([]*UserLoginBonus, 0)
-	if err := tx.Select(&existingBonuses, query, params...); err != nil {
+	if err := sqlx.SelectContext(ctx, q, &existingBonuses, query, params...); err != nil {
 		return nil, err
 	}
 
@@ -662,21 +1711,15 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 		existingMap[bonus.LoginBonusID] = bonus
 	}
 
-	sendLoginBonuses := make([]*UserLoginBonus, 0)
+	grants := make([]*loginBonusGrant, 0)
 	rewardItems := make([]*LoginBonusRewardMaster, 0)
 
 	// 各ログインボーナスを処理
 	for _, bonus := range loginBonuses {
 		userBonus, exists := existingMap[bonus.ID]
-		initBonus := !exists
 
 		if !exists {
-			ubID, err := h.generateID()
-			if err != nil {
-				return nil, err
-			}
 			userBonus = &UserLoginBonus{
-				ID:                 ubID,
 				UserID:             userID,
 				LoginBonusID:       bonus.ID,
 				LastRewardSequence: 0,
@@ -705,103 +1748,206 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 			LoginBonusID:   bonus.ID,
 			RewardSequence: userBonus.LastRewardSequence,
 		})
+		grants = append(grants, &loginBonusGrant{userBonus: userBonus, isNew: !exists})
+	}
+
+	// 報酬アイテムを一括取得（キャッシュ活用）
+	if len(rewardItems) > 0 {
+		rewardMap, err := h.getLoginBonusRewards(ctx, q, rewardItems)
+		if err != nil {
+			return nil, err
+		}
+		for _, grant := range grants {
+			key := fmt.Sprintf("%d_%d", grant.userBonus.LoginBonusID, grant.userBonus.LastRewardSequence)
+			rewardItem, exists := rewardMap[key]
+			if !exists {
+				return nil, ErrLoginBonusRewardNotFound
+			}
+			grant.reward = rewardItem
+		}
+	}
+
+	return grants, nil
+}
+
+// loginBonusRewardPresent ログインボーナスの報酬を、付与処理に渡すプレゼントの形にする
+func loginBonusRewardPresent(grant *loginBonusGrant) *UserPresent {
+	return &UserPresent{
+		ItemType: grant.reward.ItemType,
+		ItemID:   grant.reward.ItemID,
+		Amount:   int(grant.reward.Amount),
+		Source:   PresentSourceLoginBonus,
+		SourceID: &grant.userBonus.LoginBonusID,
+	}
+}
+
+// obtainLoginBonus ログインボーナス付与
+func (h *Handler) obtainLoginBonus(ctx context.Context, tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserLoginBonus, error) {
+	grants, err := h.planLoginBonus(ctx, tx, userID, requestAt)
+	if err != nil {
+		return nil, err
+	}
+
+	sendLoginBonuses := make([]*UserLoginBonus, 0, len(grants))
+	presents := make([]*UserPresent, 0, len(grants))
+	for _, grant := range grants {
+		userBonus := grant.userBonus
 
 		// 進捗の保存
-		if initBonus {
-			query = "INSERT INTO user_login_bonuses(id, user_id, login_bonus_id, last_reward_sequence, loop_count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			if _, err = tx.Exec(query, userBonus.ID, userBonus.UserID, userBonus.LoginBonusID, userBonus.LastRewardSequence, userBonus.LoopCount, userBonus.CreatedAt, userBonus.UpdatedAt); err != nil {
+		if grant.isNew {
+			ubID, err := h.generateID()
+			if err != nil {
+				return nil, err
+			}
+			userBonus.ID = ubID
+			query := "INSERT INTO user_login_bonuses(id, user_id, login_bonus_id, last_reward_sequence, loop_count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+			if err = h.retryOnIDCollision(func() error {
+				_, err := tx.Exec(query, userBonus.ID, userBonus.UserID, userBonus.LoginBonusID, userBonus.LastRewardSequence, userBonus.LoopCount, userBonus.CreatedAt, userBonus.UpdatedAt)
+				return err
+			}, &userBonus.ID); err != nil {
 				return nil, err
 			}
 		} else {
-			query = "UPDATE user_login_bonuses SET last_reward_sequence=?, loop_count=?, updated_at=? WHERE id=?"
+			query := "UPDATE user_login_bonuses SET last_reward_sequence=?, loop_count=?, updated_at=? WHERE id=?"
 			if _, err = tx.Exec(query, userBonus.LastRewardSequence, userBonus.LoopCount, userBonus.UpdatedAt, userBonus.ID); err != nil {
 				return nil, err
 			}
 		}
 
 		sendLoginBonuses = append(sendLoginBonuses, userBonus)
+		// プレゼント形式でアイテム付与情報を作成
+		presents = append(presents, loginBonusRewardPresent(grant))
 	}
 
-	// 報酬アイテムを一括取得（キャッシュ活用）
-	if len(rewardItems) > 0 {
-		rewardMap := make(map[string]*LoginBonusRewardMaster)
-		missingRewards := make([]*LoginBonusRewardMaster, 0)
+	// バッチでアイテム付与
+	if len(presents) > 0 {
+		if _, err = h.obtainItemsBatch(ctx, tx, presents, userID, requestAt); err != nil {
+			return nil, err
+		}
+	}
 
-		// まずキャッシュから取得を試行
-		for _, reward := range rewardItems {
-			if cachedReward, exists := h.Cache.GetLoginBonusReward(reward.LoginBonusID, reward.RewardSequence); exists {
-				key := fmt.Sprintf("%d_%d", reward.LoginBonusID, reward.RewardSequence)
-				rewardMap[key] = cachedReward
-			} else {
-				missingRewards = append(missingRewards, reward)
-			}
+	return sendLoginBonuses, nil
+}
+
+// masterLoadTimeout キャッシュにないマスタをまとめて読み込む際のタイムアウト
+var masterLoadTimeout time.Duration = time.Duration(getEnvInt("ISUCON_MASTER_LOAD_TIMEOUT_MS", 5000)) * time.Millisecond
+
+// loadMaster キャッシュにないマスタの読み込みをkeyごとに1つにまとめ、待っていたリクエストにも同じ結果を返す
+// 結果を共有するため、最初に読み込んだリクエストのcontextやトランザクションは使わず、メインのDBから独立したcontextで読む
+// 最初のリクエストがタイムアウトやキャンセルで中断されても、待っていたリクエストまで失敗しないようにするため
+// ctxからはクエリ数のカウンタのみ引き継ぎ、読み込んだリクエストのクエリとして数える
+func (h *Handler) loadMaster(ctx context.Context, key string, load func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	qc := queryCounterFrom(ctx)
+	v, err, _ := h.Cache.loads.Do(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.Background(), masterLoadTimeout)
+		defer cancel()
+		if qc != nil {
+			loadCtx = withQueryCounter(loadCtx, qc)
 		}
+		return load(loadCtx)
+	})
+	return v, err
+}
 
-		// キャッシュにないものはDBから取得
-		if len(missingRewards) > 0 {
-			rewardConditions := make([]string, len(missingRewards))
-			rewardParams := make([]interface{}, 0, len(missingRewards)*2)
+// getItemMaster アイテムマスターを取得する（キャッシュ活用）
+// マスタ更新時にキャッシュは破棄されるため、常に最新のマスタが返る
+func (h *Handler) getItemMaster(ctx context.Context, itemID int64) (*ItemMaster, error) {
+	if item, ok := h.Cache.GetItemMaster(itemID); ok {
+		return item, nil
+	}
 
-			for i, reward := range missingRewards {
-				rewardConditions[i] = "(login_bonus_id=? AND reward_sequence=?)"
-				rewardParams = append(rewardParams, reward.LoginBonusID, reward.RewardSequence)
+	v, err := h.loadMaster(ctx, fmt.Sprintf("item_master:%d", itemID), func(ctx context.Context) (interface{}, error) {
+		item := new(ItemMaster)
+		if err := h.DB.GetContext(ctx, item, "SELECT * FROM item_masters WHERE id=?", itemID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrItemNotFound
 			}
+			return nil, err
+		}
+		h.Cache.SetItemMaster(item)
+		return item, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ItemMaster), nil
+}
 
-			query = fmt.Sprintf("SELECT * FROM login_bonus_reward_masters WHERE %s",
-				strings.Join(rewardConditions, " OR "))
+// getLoginBonusRewards ログインボーナス報酬をまとめて取得する（キャッシュ活用）
+// keysにはLoginBonusIDとRewardSequenceのみ設定したものを渡す。戻り値は"{loginBonusID}_{rewardSequence}"をキーとするmap
+func (h *Handler) getLoginBonusRewards(ctx context.Context, q sqlx.QueryerContext, keys []*LoginBonusRewardMaster) (map[string]*LoginBonusRewardMaster, error) {
+	rewardMap := make(map[string]*LoginBonusRewardMaster)
+	missingRewards := make([]*LoginBonusRewardMaster, 0)
+
+	// まずキャッシュから取得を試行
+	for _, reward := range keys {
+		if cachedReward, exists := h.Cache.GetLoginBonusReward(reward.LoginBonusID, reward.RewardSequence); exists {
+			key := fmt.Sprintf("%d_%d", reward.LoginBonusID, reward.RewardSequence)
+			rewardMap[key] = cachedReward
+		} else {
+			missingRewards = append(missingRewards, reward)
+		}
+	}
 
-			actualRewards := make([]*LoginBonusRewardMaster, 0)
-			if err := tx.Select(&actualRewards, query, rewardParams...); err != nil {
-				return nil, err
-			}
+	// キャッシュにないものはDBから取得
+	if len(missingRewards) > 0 {
+		rewardConditions := make([]string, len(missingRewards))
+		rewardParams := make([]interface{}, 0, len(missingRewards)*2)
 
-			// DBから取得したものをキャッシュに保存し、マップに追加
-			for _, reward := range actualRewards {
-				h.Cache.SetLoginBonusReward(reward)
-				key := fmt.Sprintf("%d_%d", reward.LoginBonusID, reward.RewardSequence)
-				rewardMap[key] = reward
-			}
+		for i, reward := range missingRewards {
+			rewardConditions[i] = "(login_bonus_id=? AND reward_sequence=?)"
+			rewardParams = append(rewardParams, reward.LoginBonusID, reward.RewardSequence)
 		}
 
-		// アイテム付与をバッチ処理用に準備
-		presents := make([]*UserPresent, 0)
-		for _, userBonus := range sendLoginBonuses {
-			key := fmt.Sprintf("%d_%d", userBonus.LoginBonusID, userBonus.LastRewardSequence)
-			rewardItem, exists := rewardMap[key]
-			if !exists {
-				return nil, ErrLoginBonusRewardNotFound
-			}
+		query := fmt.Sprintf("SELECT * FROM login_bonus_reward_masters WHERE %s",
+			strings.Join(rewardConditions, " OR "))
 
-			// プレゼント形式でアイテム付与情報を作成
-			presents = append(presents, &UserPresent{
-				ItemType: rewardItem.ItemType,
-				ItemID:   rewardItem.ItemID,
-				Amount:   int(rewardItem.Amount),
-			})
+		actualRewards := make([]*LoginBonusRewardMaster, 0)
+		if err := sqlx.SelectContext(ctx, q, &actualRewards, query, rewardParams...); err != nil {
+			return nil, err
 		}
 
-		// バッチでアイテム付与
-		if len(presents) > 0 {
-			err = h.obtainItemsBatch(tx, presents, userID, requestAt)
-			if err != nil {
-				return nil, err
-			}
+		// DBから取得したものをキャッシュに保存し、マップに追加
+		for _, reward := range actualRewards {
+			h.Cache.SetLoginBonusReward(reward)
+			key := fmt.Sprintf("%d_%d", reward.LoginBonusID, reward.RewardSequence)
+			rewardMap[key] = reward
 		}
 	}
 
-	return sendLoginBonuses, nil
+	return rewardMap, nil
 }
 
-// obtainPresent プレゼント付与
-func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserPresent, error) {
+// sanitizePresentMessage プレゼントメッセージから制御文字を取り除き、最大文字数を超えていないか検証する
+// 超えている場合は黙って切り詰めず、エラーを返す
+func sanitizePresentMessage(message string) (string, error) {
+	sanitized := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, message)
+	if n := utf8.RuneCountInString(sanitized); n > presentMessageMaxLength {
+		return "", errors.Wrapf(ErrPresentMessageTooLong, "length=%d, max=%d", n, presentMessageMaxLength)
+	}
+	return sanitized, nil
+}
+
+// gachaPresentMessage ガチャの排出物に付けるプレゼントメッセージを組み立てる
+func gachaPresentMessage(gachaName string) (string, error) {
+	return sanitizePresentMessage(fmt.Sprintf("%sの付与アイテムです", gachaName))
+}
+
+// planPresentAll requestAtのログインで付与する、まだ受け取っていない全員プレゼントを求める。DBには書き込まない
+func planPresentAll(ctx context.Context, q sqlx.QueryerContext, userID int64, requestAt int64) ([]*PresentAllMaster, error) {
 	normalPresents := make([]*PresentAllMaster, 0)
 	query := "SELECT * FROM present_all_masters WHERE registered_start_at <= ? AND registered_end_at >= ?"
-	if err := tx.Select(&normalPresents, query, requestAt, requestAt); err != nil {
+	if err := sqlx.SelectContext(ctx, q, &normalPresents, query, requestAt, requestAt); err != nil {
 		return nil, err
 	}
 
 	if len(normalPresents) == 0 {
-		return make([]*UserPresent, 0), nil
+		return normalPresents, nil
 	}
 
 	// プレゼントIDを一括取得
@@ -818,7 +1964,7 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 	}
 
 	receivedIDs := make([]int64, 0)
-	if err := tx.Select(&receivedIDs, query, params...); err != nil {
+	if err := sqlx.SelectContext(ctx, q, &receivedIDs, query, params...); err != nil {
 		return nil, err
 	}
 
@@ -828,15 +1974,33 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 		receivedMap[id] = true
 	}
 
-	// 未受け取りのプレゼントを処理
-	obtainPresents := make([]*UserPresent, 0)
-	histories := make([]*UserPresentAllReceivedHistory, 0)
-
+	unreceived := make([]*PresentAllMaster, 0, len(normalPresents))
 	for _, np := range normalPresents {
 		if receivedMap[np.ID] {
 			// プレゼント配布済
 			continue
 		}
+		unreceived = append(unreceived, np)
+	}
+	return unreceived, nil
+}
+
+// obtainPresent プレゼント付与
+func (h *Handler) obtainPresent(ctx context.Context, tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserPresent, error) {
+	normalPresents, err := planPresentAll(ctx, tx, userID, requestAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 未受け取りのプレゼントを処理
+	obtainPresents := make([]*UserPresent, 0, len(normalPresents))
+	histories := make([]*UserPresentAllReceivedHistory, 0, len(normalPresents))
+
+	for _, np := range normalPresents {
+		presentMessage, err := sanitizePresentMessage(np.PresentMessage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "presentAllID=%d", np.ID)
+		}
 
 		pID, err := h.generateID()
 		if err != nil {
@@ -849,7 +2013,9 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 			ItemType:       np.ItemType,
 			ItemID:         np.ItemID,
 			Amount:         int(np.Amount),
-			PresentMessage: np.PresentMessage,
+			PresentMessage: presentMessage,
+			Source:         PresentSourcePresentAll,
+			SourceID:       &np.ID,
 			CreatedAt:      requestAt,
 			UpdatedAt:      requestAt,
 		}
@@ -871,64 +2037,203 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 		histories = append(histories, history)
 	}
 
-	// プレゼントを一括挿入
-	if len(obtainPresents) > 0 {
-		for _, up := range obtainPresents {
-			query = "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
-			if _, err := tx.Exec(query, up.ID, up.UserID, up.SentAt, up.ItemType, up.ItemID, up.Amount, up.PresentMessage, up.CreatedAt, up.UpdatedAt); err != nil {
-				return nil, err
-			}
+	// プレゼントと履歴をpresentInsertBatchSize件ずつ一括挿入する
+	// どちらも呼び出し元のトランザクションの中で挿入するため、途中で失敗した場合はプレゼントも履歴も残らない
+	// 非同期付与が有効な場合、プレゼントはコミット後に呼び出し元がキューに積む。履歴は二重付与を防ぐためここで挿入する
+	batchSize := presentInsertBatchSize
+	if batchSize <= 0 {
+		batchSize = len(histories)
+	}
+	for start := 0; start < len(histories); start += batchSize {
+		end := start + batchSize
+		if end > len(histories) {
+			end = len(histories)
 		}
 
-		// 履歴を一括挿入
-		for _, history := range histories {
-			query = "INSERT INTO user_present_all_received_history(id, user_id, present_all_id, received_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
-			if _, err := tx.Exec(query, history.ID, history.UserID, history.PresentAllID, history.ReceivedAt, history.CreatedAt, history.UpdatedAt); err != nil {
+		if !h.PresentQueue.Enabled() {
+			presents := obtainPresents[start:end]
+			query := `INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_at)
+					 VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :source, :source_id, :created_at, :updated_at)`
+			ids := make([]*int64, 0, len(presents))
+			for _, present := range presents {
+				ids = append(ids, &present.ID)
+			}
+			if err := h.retryOnIDCollision(func() error {
+				_, err := tx.NamedExec(query, presents)
+				return err
+			}, ids...); err != nil {
 				return nil, err
 			}
 		}
+
+		chunk := histories[start:end]
+		query := `INSERT INTO user_present_all_received_history(id, user_id, present_all_id, received_at, created_at, updated_at)
+				 VALUES (:id, :user_id, :present_all_id, :received_at, :created_at, :updated_at)`
+		ids := make([]*int64, 0, len(chunk))
+		for _, history := range chunk {
+			ids = append(ids, &history.ID)
+		}
+		if err := h.retryOnIDCollision(func() error {
+			_, err := tx.NamedExec(query, chunk)
+			return err
+		}, ids...); err != nil {
+			return nil, err
+		}
 	}
 
 	return obtainPresents, nil
 }
 
+// enqueuePresentGrants 非同期付与が有効な場合、コミット済みの全員プレゼントの付与をキューに積む
+func (h *Handler) enqueuePresentGrants(userID int64, presents []*UserPresent) {
+	if !h.PresentQueue.Enabled() {
+		return
+	}
+	h.PresentQueue.Enqueue(h.getShardIndex(userID), presents)
+}
+
+// capCoin 所持コインにamountを加算した結果と、所持上限(ISUCON_COIN_CAP)を超えて付与できなかった量を返す
+// 上限が設定されていない場合もint64の範囲で桁あふれしないよう切り詰める
+func capCoin(current, amount int64) (int64, int64) {
+	limit := int64(math.MaxInt64)
+	if coinCap > 0 {
+		limit = coinCap
+	}
+	if amount <= 0 {
+		return current + amount, 0
+	}
+	if current >= limit {
+		return current, amount
+	}
+	if room := limit - current; amount > room {
+		return limit, amount - room
+	}
+	return current + amount, 0
+}
+
+// handleCoinOverflow 所持上限を超えて付与できなかったコインを処理する
+// ISUCON_COIN_CAP_OVERFLOW=present の場合はプレゼントとして送り、それ以外の場合は破棄する
+func (h *Handler) handleCoinOverflow(ctx context.Context, db sqlx.ExecerContext, userID, overflow, requestAt int64) error {
+	if overflow <= 0 || coinOverflowMode != CoinOverflowModePresent {
+		return nil
+	}
+
+	// user_presents.amountはintのため、それを超える分は破棄する
+	if overflow > math.MaxInt32 {
+		overflow = math.MaxInt32
+	}
+	pID, err := h.generateID()
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	return h.retryOnIDCollision(func() error {
+		_, err := db.ExecContext(ctx, query, pID, userID, requestAt, ItemTypeCoin, 1, overflow, "所持上限を超えたISUCOINです", PresentSourceCoinOverflow, requestAt, requestAt)
+		return err
+	}, &pID)
+}
+
+// capItemAmount 所持数にamountを加算した結果と、所持数の上限(item_masters.max_stack)を超えて付与できなかった量を返す
+// 上限が設定されていない場合もuser_items.amount(int)の範囲で桁あふれしないよう切り詰める
+func capItemAmount(item *ItemMaster, current, amount int64) (int64, int64) {
+	limit := int64(math.MaxInt32)
+	if item.MaxStack != nil && *item.MaxStack >= 0 && int64(*item.MaxStack) < limit {
+		limit = int64(*item.MaxStack)
+	}
+	if amount <= 0 {
+		return current + amount, 0
+	}
+	if current >= limit {
+		return current, amount
+	}
+	if room := limit - current; amount > room {
+		return limit, amount - room
+	}
+	return current + amount, 0
+}
+
+// handleItemOverflow 所持数の上限を超えて付与できなかった強化素材を処理する
+// ISUCON_ITEM_STACK_OVERFLOW=present の場合はプレゼントとして送り、それ以外の場合は破棄する
+func (h *Handler) handleItemOverflow(ctx context.Context, db sqlx.ExecerContext, userID int64, item *ItemMaster, overflow, requestAt int64) error {
+	if overflow <= 0 || itemOverflowMode != CoinOverflowModePresent {
+		return nil
+	}
+
+	if overflow > math.MaxInt32 {
+		overflow = math.MaxInt32
+	}
+	pID, err := h.generateID()
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	return h.retryOnIDCollision(func() error {
+		_, err := db.ExecContext(ctx, query, pID, userID, requestAt, item.ItemType, item.ID, overflow, "所持上限を超えたアイテムです", PresentSourceItemOverflow, item.ID, requestAt, requestAt)
+		return err
+	}, &pID)
+}
+
+// isEnhanceMaterial user_itemsに所持数として積み上げるアイテム種別かどうか
+func isEnhanceMaterial(itemType int) bool {
+	return itemType == ItemTypeEnhanceA || itemType == ItemTypeEnhanceB
+}
+
 // obtainItem アイテム付与処理
-func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, obtainAmount int64, requestAt int64) ([]int64, []*UserCard, []*UserItem, error) {
-	obtainCoins := make([]int64, 0)
-	obtainCards := make([]*UserCard, 0)
-	obtainItems := make([]*UserItem, 0)
+// 付与によって作成・更新したカードとアイテム、所持上限により切り詰めたかどうかを返す
+func (h *Handler) obtainItem(ctx context.Context, tx *sqlx.Tx, userID, itemID int64, itemType int, obtainAmount int64, requestAt int64) (*ObtainedItems, error) {
+	obtained := &ObtainedItems{
+		Cards: make([]*UserCard, 0),
+		Items: make([]*UserItem, 0),
+	}
 
-	switch itemType {
-	case 1: // coin
+	switch {
+	case itemType == ItemTypeCoin:
 		user := new(User)
 		query := "SELECT * FROM users WHERE id=?"
 		if err := tx.Get(user, query, userID); err != nil {
 			if err == sql.ErrNoRows {
-				return nil, nil, nil, ErrUserNotFound
+				return nil, ErrUserNotFound
 			}
-			return nil, nil, nil, err
+			return nil, err
+		}
+
+		// 付与数が端数単位のコインは、端数を繰り越して1枚に満たない分は付与しない
+		scale, err := h.coinAmountScale(ctx, itemID)
+		if err != nil {
+			return nil, err
+		}
+		obtainAmount, err = h.applyAmountScale(ctx, tx, userID, itemID, scale, obtainAmount, requestAt)
+		if err != nil {
+			return nil, err
 		}
 
 		query = "UPDATE users SET isu_coin=? WHERE id=?"
-		totalCoin := user.IsuCoin + obtainAmount
+		totalCoin, overflow := capCoin(user.IsuCoin, obtainAmount)
 		if _, err := tx.Exec(query, totalCoin, user.ID); err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
-		obtainCoins = append(obtainCoins, obtainAmount)
-
-	case 2: // card(ハンマー)
+		if err := h.handleCoinOverflow(ctx, tx, userID, overflow, requestAt); err != nil {
+			return nil, err
+		}
+		obtained.Clamps.CoinClamped = overflow > 0
+
+	case itemType == ItemTypeCard:
 		query := "SELECT * FROM item_masters WHERE id=? AND item_type=?"
 		item := new(ItemMaster)
 		if err := tx.Get(item, query, itemID, itemType); err != nil {
 			if err == sql.ErrNoRows {
-				return nil, nil, nil, ErrItemNotFound
+				return nil, ErrItemNotFound
 			}
-			return nil, nil, nil, err
+			return nil, err
+		}
+		// amount_per_secがNULLのカードマスタは付与できない
+		if item.AmountPerSec == nil {
+			return nil, ErrInvalidItemMaster
 		}
 
 		cID, err := h.generateID()
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
 		card := &UserCard{
 			ID:           cID,
@@ -941,91 +2246,263 @@ func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, ob
 			UpdatedAt:    requestAt,
 		}
 		query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt); err != nil {
-			return nil, nil, nil, err
+		if err := h.retryOnIDCollision(func() error {
+			_, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt)
+			return err
+		}, &card.ID); err != nil {
+			return nil, err
 		}
-		obtainCards = append(obtainCards, card)
+		obtained.Cards = append(obtained.Cards, card)
 
-	case 3, 4: // 強化素材
+	case isEnhanceMaterial(itemType):
 		query := "SELECT * FROM item_masters WHERE id=? AND item_type=?"
 		item := new(ItemMaster)
 		if err := tx.Get(item, query, itemID, itemType); err != nil {
 			if err == sql.ErrNoRows {
-				return nil, nil, nil, ErrItemNotFound
+				return nil, ErrItemNotFound
 			}
-			return nil, nil, nil, err
+			return nil, err
+		}
+
+		amount, err := h.applyAmountScale(ctx, tx, userID, item.ID, amountScale(item), obtainAmount, requestAt)
+		if err != nil {
+			return nil, err
 		}
 
-		query = "SELECT * FROM user_items WHERE user_id=? AND item_id=?"
+		query = "SELECT * FROM user_items WHERE user_id=? AND item_id=? FOR UPDATE"
 		uitem := new(UserItem)
 		if err := tx.Get(uitem, query, userID, item.ID); err != nil {
 			if err != sql.ErrNoRows {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			uitem = nil
 		}
 
+		current := int64(0)
+		if uitem != nil {
+			current = int64(uitem.Amount)
+		}
+		total, overflow := capItemAmount(item, current, amount)
+		if err := h.handleItemOverflow(ctx, tx, userID, item, overflow, requestAt); err != nil {
+			return nil, err
+		}
+		obtained.Clamps.addItem(item.ID, overflow)
+
 		if uitem == nil {
 			uitemID, err := h.generateID()
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 			uitem = &UserItem{
 				ID:        uitemID,
 				UserID:    userID,
 				ItemType:  item.ItemType,
 				ItemID:    item.ID,
-				Amount:    int(obtainAmount),
+				Amount:    int(total),
 				CreatedAt: requestAt,
 				UpdatedAt: requestAt,
 			}
 			query = "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			if _, err := tx.Exec(query, uitem.ID, userID, uitem.ItemID, uitem.ItemType, uitem.Amount, requestAt, requestAt); err != nil {
-				return nil, nil, nil, err
+			if err := h.retryOnIDCollision(func() error {
+				_, err := tx.Exec(query, uitem.ID, userID, uitem.ItemID, uitem.ItemType, uitem.Amount, requestAt, requestAt)
+				return err
+			}, &uitem.ID); err != nil {
+				return nil, err
 			}
 
 		} else {
-			uitem.Amount += int(obtainAmount)
+			uitem.Amount = int(total)
 			uitem.UpdatedAt = requestAt
 			query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
 			if _, err := tx.Exec(query, uitem.Amount, uitem.UpdatedAt, uitem.ID); err != nil {
-				return nil, nil, nil, err
+				return nil, err
 			}
 		}
 
-		obtainItems = append(obtainItems, uitem)
+		obtained.Items = append(obtained.Items, uitem)
 
 	default:
-		return nil, nil, nil, ErrInvalidItemType
+		return nil, ErrInvalidItemType
+	}
+
+	return obtained, nil
+}
+
+// amountScale アイテムの付与数の単位を返す。未設定の場合は1(端数なし)
+func amountScale(item *ItemMaster) int64 {
+	if item.AmountScale == nil || *item.AmountScale <= 1 {
+		return 1
+	}
+	return int64(*item.AmountScale)
+}
+
+// coinAmountScale コインの付与数の単位を返す。コインのアイテムマスタがない場合は端数なしとして扱う
+// 強化素材など、アイテムマスタがないと付与できないアイテムにも使える
+func (h *Handler) coinAmountScale(ctx context.Context, itemID int64) (int64, error) {
+	item, err := h.getItemMaster(ctx, itemID)
+	if err != nil {
+		if err == ErrItemNotFound {
+			return 1, nil
+		}
+		return 0, err
+	}
+	return amountScale(item), nil
+}
+
+// formatScaledAmount 端数単位の数を表示用の10進数の文字列にする
+// 浮動小数点を使わずに整数のまま変換するため、桁が失われることはない。末尾の0は付けない
+// scaleが10のべき乗でない場合は10進数で割り切れないことがあるため、"整数部+分子/scale"の形で返す
+func formatScaledAmount(amount, scale int64) string {
+	if scale <= 1 {
+		return strconv.FormatInt(amount, 10)
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	whole, frac := amount/scale, amount%scale
+	if frac == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+
+	digits := 0
+	for s := scale; s > 1; s /= 10 {
+		if s%10 != 0 {
+			return fmt.Sprintf("%s%d+%d/%d", sign, whole, frac, scale)
+		}
+		digits++
+	}
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", digits, frac), "0")
+	return sign + strconv.FormatInt(whole, 10) + "." + fracStr
+}
+
+// itemAmountScale アイテム種別とIDから付与数の単位を返す。カードやアイテムマスタがないアイテムは端数なしとして扱う
+func (h *Handler) itemAmountScale(ctx context.Context, itemType int, itemID int64) (int64, error) {
+	if itemType != ItemTypeCoin && !isEnhanceMaterial(itemType) {
+		return 1, nil
+	}
+	return h.coinAmountScale(ctx, itemID)
+}
+
+// fillPresentDisplayAmounts 端数単位のプレゼントに表示用の付与数を設定する。端数なしのプレゼントは設定しない
+func (h *Handler) fillPresentDisplayAmounts(ctx context.Context, presents []*UserPresent) error {
+	for _, p := range presents {
+		scale, err := h.itemAmountScale(ctx, p.ItemType, p.ItemID)
+		if err != nil {
+			return err
+		}
+		if scale > 1 {
+			p.DisplayAmount = formatScaledAmount(int64(p.Amount), scale)
+		}
+	}
+	return nil
+}
+
+// splitScaledAmount 端数単位の付与数を、繰り越し中の端数と合わせて整数部と新しい端数に分ける
+// 浮動小数点を使わずに整数のまま計算するため、何回付与しても端数が失われることはない
+func splitScaledAmount(fraction, amount, scale int64) (int64, int64) {
+	total := fraction + amount
+	return total / scale, total % scale
+}
+
+// applyAmountScale 端数単位の付与数を実際に加算する数に変換し、1に満たない端数をuser_item_fractionsに繰り越す
+// scaleが1の場合は付与数をそのまま返す
+func (h *Handler) applyAmountScale(ctx context.Context, tx *sqlx.Tx, userID, itemID, scale, amount, requestAt int64) (int64, error) {
+	if scale <= 1 {
+		return amount, nil
+	}
+
+	var fraction int64
+	query := "SELECT fraction FROM user_item_fractions WHERE user_id=? AND item_id=? FOR UPDATE"
+	if err := tx.Get(&fraction, query, userID, itemID); err != nil && err != sql.ErrNoRows {
+		return 0, err
 	}
 
-	return obtainCoins, obtainCards, obtainItems, nil
+	whole, fraction := splitScaledAmount(fraction, amount, scale)
+	query = "INSERT INTO user_item_fractions(user_id, item_id, fraction, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE fraction=VALUES(fraction), updated_at=VALUES(updated_at)"
+	if _, err := tx.Exec(query, userID, itemID, fraction, requestAt); err != nil {
+		return 0, err
+	}
+	return whole, nil
 }
 
 // obtainItemsBatch アイテム付与処理のバッチ版
-func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID int64, requestAt int64) error {
+// 付与によって作成・更新したカードとアイテムを返す
+// プレゼントの並び順によらず結果が同じになるよう、コイン、カード、強化素材の順に、それぞれitem_id順で処理する
+// 同じitem_idのカードはプレゼントのid順に作成し、返すカード・アイテムもこの順に並ぶ
+func (h *Handler) obtainItemsBatch(ctx context.Context, tx *sqlx.Tx, presents []*UserPresent, userID int64, requestAt int64) (*ObtainedItems, error) {
+	obtained := &ObtainedItems{
+		Cards: make([]*UserCard, 0),
+		Items: make([]*UserItem, 0),
+	}
+
 	// アイテム種別ごとにグループ化
-	coinTotal := int64(0)
+	coinItems := make(map[int64]int64) // item_id -> total_amount
 	cardItems := make([]*UserPresent, 0)
 	materialItems := make(map[int64]int64) // item_id -> total_amount
 
 	for _, present := range presents {
-		switch present.ItemType {
-		case 1: // coin
-			coinTotal += int64(present.Amount)
-		case 2: // card(ハンマー)
+		// 0以下の付与数はコインやアイテムを減らしてしまうため付与しない
+		// マスタの設定ミスでログインなど他の付与まで失敗させないよう、エラーにはせず飛ばす
+		if present.Amount <= 0 {
+			log.Warnf("skip grant with invalid amount: presentID=%d, userID=%d, itemType=%d, itemID=%d, amount=%d",
+				present.ID, userID, present.ItemType, present.ItemID, present.Amount)
+			continue
+		}
+		switch {
+		case present.ItemType == ItemTypeCoin:
+			coinItems[present.ItemID] += int64(present.Amount)
+		case present.ItemType == ItemTypeCard:
 			cardItems = append(cardItems, present)
-		case 3, 4: // 強化素材
+		case isEnhanceMaterial(present.ItemType):
 			materialItems[present.ItemID] += int64(present.Amount)
 		}
 	}
+	// カードはこの順にIDを採番して作成するため、item_id順、同じitem_idはプレゼントのid順に並べる
+	sort.Slice(cardItems, func(i, j int) bool {
+		if cardItems[i].ItemID != cardItems[j].ItemID {
+			return cardItems[i].ItemID < cardItems[j].ItemID
+		}
+		return cardItems[i].ID < cardItems[j].ID
+	})
+
+	// 端数単位のコインは端数を繰り越したうえで合算する
+	coinItemIDs := make([]int64, 0, len(coinItems))
+	for itemID := range coinItems {
+		coinItemIDs = append(coinItemIDs, itemID)
+	}
+	sort.Slice(coinItemIDs, func(i, j int) bool { return coinItemIDs[i] < coinItemIDs[j] })
+	coinTotal := int64(0)
+	for _, itemID := range coinItemIDs {
+		scale, err := h.coinAmountScale(ctx, itemID)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := h.applyAmountScale(ctx, tx, userID, itemID, scale, coinItems[itemID], requestAt)
+		if err != nil {
+			return nil, err
+		}
+		coinTotal += amount
+	}
 
 	// コインの一括更新
 	if coinTotal > 0 {
-		query := "UPDATE users SET isu_coin = isu_coin + ? WHERE id = ?"
-		if _, err := tx.Exec(query, coinTotal, userID); err != nil {
-			return err
+		var currentCoin int64
+		if err := tx.Get(&currentCoin, "SELECT isu_coin FROM users WHERE id=? FOR UPDATE", userID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrUserNotFound
+			}
+			return nil, err
+		}
+		totalCoin, overflow := capCoin(currentCoin, coinTotal)
+		query := "UPDATE users SET isu_coin = ? WHERE id = ?"
+		if _, err := tx.Exec(query, totalCoin, userID); err != nil {
+			return nil, err
+		}
+		if err := h.handleCoinOverflow(ctx, tx, userID, overflow, requestAt); err != nil {
+			return nil, err
 		}
+		obtained.Clamps.CoinClamped = overflow > 0
 	}
 
 	// カードの一括挿入
@@ -1045,15 +2522,15 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 
 		// キャッシュにないものはDBから取得
 		if len(missingCardIDs) > 0 {
-			query := "SELECT * FROM item_masters WHERE id IN (?) AND item_type = 2"
-			query, params, err := sqlx.In(query, missingCardIDs)
+			query := "SELECT * FROM item_masters WHERE id IN (?) AND item_type = ?"
+			query, params, err := sqlx.In(query, missingCardIDs, ItemTypeCard)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			itemMasters := make([]*ItemMaster, 0)
 			if err := tx.Select(&itemMasters, query, params...); err != nil {
-				return err
+				return nil, err
 			}
 
 			// DBから取得したものをキャッシュに保存し、マップに追加
@@ -1068,13 +2545,16 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 		for _, item := range cardItems {
 			master, exists := masterMap[item.ItemID]
 			if !exists {
-				return ErrItemNotFound
+				return nil, ErrItemNotFound
+			}
+			if master.AmountPerSec == nil {
+				return nil, ErrInvalidItemMaster
 			}
 
 			for i := 0; i < item.Amount; i++ {
 				cID, err := h.generateID()
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				cardInserts = append(cardInserts, &UserCard{
@@ -1095,9 +2575,17 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 			query := `INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at)
 					  VALUES (:id, :user_id, :card_id, :amount_per_sec, :level, :total_exp, :created_at, :updated_at)`
 
-			if _, err := tx.NamedExec(query, cardInserts); err != nil {
+			ids := make([]*int64, 0, len(cardInserts))
+			for _, card := range cardInserts {
+				ids = append(ids, &card.ID)
+			}
+			if err := h.retryOnIDCollision(func() error {
+				_, err := tx.NamedExec(query, cardInserts)
 				return err
+			}, ids...); err != nil {
+				return nil, err
 			}
+			obtained.Cards = append(obtained.Cards, cardInserts...)
 		}
 	}
 
@@ -1108,16 +2596,20 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 		for itemID := range materialItems {
 			itemIDs = append(itemIDs, itemID)
 		}
+		// mapの走査順に依存しないようにitem_id順で処理する
+		sort.Slice(itemIDs, func(i, j int) bool { return itemIDs[i] < itemIDs[j] })
 
-		query := "SELECT * FROM user_items WHERE user_id = ? AND item_id IN (?)"
+		// 同じユーザーへの付与が並行した場合にデッドロックしないよう、更新対象の行を先にid順でロックしておく
+		// 以降のUPDATEはロック済みの行にしか触れないため、ロックの取得順がトランザクション間で揃う
+		query := "SELECT * FROM user_items WHERE user_id = ? AND item_id IN (?) ORDER BY id FOR UPDATE"
 		query, params, err := sqlx.In(query, userID, itemIDs)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		existingItems := make([]*UserItem, 0)
 		if err := tx.Select(&existingItems, query, params...); err != nil {
-			return err
+			return nil, err
 		}
 
 		// 既存アイテムをマップ化
@@ -1127,15 +2619,15 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 		}
 
 		// アイテムマスター情報を取得
-		query = "SELECT * FROM item_masters WHERE id IN (?) AND item_type IN (3, 4)"
-		query, params, err = sqlx.In(query, itemIDs)
+		query = "SELECT * FROM item_masters WHERE id IN (?) AND item_type IN (?, ?)"
+		query, params, err = sqlx.In(query, itemIDs, ItemTypeEnhanceA, ItemTypeEnhanceB)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		itemMasters := make([]*ItemMaster, 0)
 		if err := tx.Select(&itemMasters, query, params...); err != nil {
-			return err
+			return nil, err
 		}
 
 		masterMap := make(map[int64]*ItemMaster)
@@ -1147,22 +2639,39 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 		updateItems := make([]*UserItem, 0)
 		insertItems := make([]*UserItem, 0)
 
-		for itemID, amount := range materialItems {
+		for _, itemID := range itemIDs {
 			master, exists := masterMap[itemID]
 			if !exists {
-				return ErrItemNotFound
+				return nil, ErrItemNotFound
+			}
+			amount, err := h.applyAmountScale(ctx, tx, userID, itemID, amountScale(master), materialItems[itemID], requestAt)
+			if err != nil {
+				return nil, err
+			}
+			if amount == 0 {
+				continue
+			}
+
+			current := int64(0)
+			if existingItem, exists := existingMap[itemID]; exists {
+				current = int64(existingItem.Amount)
+			}
+			total, overflow := capItemAmount(master, current, amount)
+			if err := h.handleItemOverflow(ctx, tx, userID, master, overflow, requestAt); err != nil {
+				return nil, err
 			}
+			obtained.Clamps.addItem(itemID, overflow)
 
 			if existingItem, exists := existingMap[itemID]; exists {
 				// 既存アイテムの更新
-				existingItem.Amount += int(amount)
+				existingItem.Amount = int(total)
 				existingItem.UpdatedAt = requestAt
 				updateItems = append(updateItems, existingItem)
 			} else {
 				// 新規アイテムの挿入
 				uitemID, err := h.generateID()
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				insertItems = append(insertItems, &UserItem{
@@ -1170,7 +2679,7 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 					UserID:    userID,
 					ItemID:    itemID,
 					ItemType:  master.ItemType,
-					Amount:    int(amount),
+					Amount:    int(total),
 					CreatedAt: requestAt,
 					UpdatedAt: requestAt,
 				})
@@ -1179,6 +2688,7 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 
 		// 一括UPDATE（CASE文使用、sqlx.Inで安全に構築）
 		if len(updateItems) > 0 {
+			sort.Slice(updateItems, func(i, j int) bool { return updateItems[i].ID < updateItems[j].ID })
 			// IDリストを作成
 			ids := make([]int64, len(updateItems))
 			caseWhenAmount := make([]string, len(updateItems))
@@ -1205,12 +2715,13 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 			}
 			query, params, err := sqlx.In(baseQuery, idsInterface)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			if _, err := tx.Exec(query, params...); err != nil {
-				return err
+				return nil, err
 			}
+			obtained.Items = append(obtained.Items, updateItems...)
 		}
 
 		// NamedExecを使った一括INSERT
@@ -1218,13 +2729,66 @@ func (h *Handler) obtainItemsBatch(tx *sqlx.Tx, presents []*UserPresent, userID
 			query := `INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at)
 					  VALUES (:id, :user_id, :item_id, :item_type, :amount, :created_at, :updated_at)`
 
-			if _, err := tx.NamedExec(query, insertItems); err != nil {
+			ids := make([]*int64, 0, len(insertItems))
+			for _, item := range insertItems {
+				ids = append(ids, &item.ID)
+			}
+			if err := h.retryOnIDCollision(func() error {
+				_, err := tx.NamedExec(query, insertItems)
 				return err
+			}, ids...); err != nil {
+				return nil, err
 			}
+			obtained.Items = append(obtained.Items, insertItems...)
 		}
+		// 更新はロックの順に合わせてid順に行うため、返す際にitem_id順に並べ直す
+		sort.Slice(obtained.Items, func(i, j int) bool { return obtained.Items[i].ItemID < obtained.Items[j].ItemID })
 	}
 
-	return nil
+	return obtained, nil
+}
+
+// ObtainedItems obtainItem・obtainItemsBatchで作成・更新したカードとアイテム
+type ObtainedItems struct {
+	Cards []*UserCard
+	Items []*UserItem
+	// Clamps 所持上限により付与を切り詰めたかどうか
+	Clamps GrantClamps
+}
+
+// GrantClamps 所持上限により付与を切り詰めたかどうか。付与を伴うレスポンスに埋め込んで返す
+type GrantClamps struct {
+	CoinClamped bool `json:"coinClamped"` // 所持上限により付与したコインが切り詰められた場合true
+	// ClampedItems 所持数の上限により付与しきれなかった強化素材と、その量
+	ClampedItems []*ClampedItem `json:"clampedItems,omitempty"`
+}
+
+// ClampedItem 所持数の上限により付与しきれなかった強化素材
+type ClampedItem struct {
+	ItemID   int64 `json:"itemId"`
+	Overflow int64 `json:"overflow"`
+}
+
+// addItem 強化素材を付与しきれなかった量を記録する。同じ強化素材は合算する
+func (g *GrantClamps) addItem(itemID, overflow int64) {
+	if overflow <= 0 {
+		return
+	}
+	for _, item := range g.ClampedItems {
+		if item.ItemID == itemID {
+			item.Overflow += overflow
+			return
+		}
+	}
+	g.ClampedItems = append(g.ClampedItems, &ClampedItem{ItemID: itemID, Overflow: overflow})
+}
+
+// merge 別の付与で切り詰めた分を合わせる
+func (g *GrantClamps) merge(o GrantClamps) {
+	g.CoinClamped = g.CoinClamped || o.CoinClamped
+	for _, item := range o.ClampedItems {
+		g.addItem(item.ItemID, item.Overflow)
+	}
 }
 
 // initialize 初期化処理
@@ -1241,22 +2805,40 @@ func initialize(c echo.Context) error {
 
 	defer close(errCh)
 
-	for _, host := range dbHosts {
+	// force=1 はそのまま各ホストに渡し、初期化済みでも再投入させる
+	url := "http://%s:8080/initializeOne"
+	if c.QueryParam("force") == "1" {
+		url += "?force=1"
+	}
+
+	hosts := make([]*InitializeHostResult, len(dbHosts))
+	for i, host := range dbHosts {
 		wg.Add(1)
-		go func(host string) {
+		go func(i int, host string) {
 			defer wg.Done()
 
-			resp, err := http.Post(fmt.Sprintf("http://%s:8080/initializeOne", host), "application/json", nil)
+			resp, err := http.Post(fmt.Sprintf(url, host), "application/json", nil)
 			if err != nil {
 				errCh <- err
 				return
 			}
+			defer resp.Body.Close()
 
 			if resp.StatusCode != http.StatusOK {
 				errCh <- fmt.Errorf("CODE: %d", resp.StatusCode)
 				return
 			}
-		}(host)
+
+			res := new(InitializeResponse)
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				errCh <- err
+				return
+			}
+			hosts[i] = &InitializeHostResult{
+				Host:     host,
+				Reseeded: res.Reseeded,
+			}
+		}(i, host)
 	}
 
 	wg.Wait()
@@ -1266,42 +2848,84 @@ func initialize(c echo.Context) error {
 
 	return successResponse(c, &InitializeResponse{
 		Language: "go",
+		Hosts:    hosts,
 	})
 }
 
+// initializeOne このホストのDBを初期データに戻す
+// 最後に初期化した時点から初期データもユーザーデータも変わっていない場合は、init.shの再投入を省略する
+// force=1 の場合は常に再投入する
 func initializeOne(c echo.Context) error {
-	out, err := exec.Command("/bin/sh", "-c", SQLDirectory+"init.sh").CombinedOutput()
+	requestAt := time.Now().Unix()
+
+	dbx, err := connectDB(false)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer dbx.Close()
+
+	baseline, err := initializeBaseline(SQLDirectory)
 	if err != nil {
-		c.Logger().Errorf("init.sh 実行失敗: %s\nエラー: %v", string(out), err)
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	c.Logger().Infof("init.sh 実行成功: %s", string(out))
-	// キャッシュをクリア（グローバルなキャッシュインスタンスがある場合）
-	// 注意: この実装では各Handlerインスタンスが独自のキャッシュを持つため、
-	// 実際の運用では全てのHandlerインスタンスのキャッシュをクリアする必要がある
+	reseeded := false
+	if c.QueryParam("force") == "1" || !isInitializeFresh(dbx, baseline) {
+		out, err := exec.Command("/bin/sh", "-c", SQLDirectory+"init.sh").CombinedOutput()
+		if err != nil {
+			c.Logger().Errorf("init.sh 実行失敗: %s\nエラー: %v", string(out), err)
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		c.Logger().Infof("init.sh 実行成功: %s", string(out))
+		reseeded = true
+
+		if err := saveInitializeMarker(dbx, baseline, requestAt); err != nil {
+			// マーカーがなくても次回は再投入されるだけなので、初期化自体は成功とする
+			c.Logger().Errorf("failed to save initialize marker: %v", err)
+		}
+	} else {
+		c.Logger().Infof("init.sh は初期化済みのため省略")
+	}
+
+	// キャッシュをクリア
+	// マスタデータのキャッシュはプロセス内で共有されているため、ここでクリアすれば全てのHandlerに反映される
+	// 他ホストのプロセスのキャッシュは各ホストのinitializeOneでクリアされる
+	NewMasterDataCache().Clear()
 
 	return successResponse(c, &InitializeResponse{
 		Language: "go",
+		Reseeded: reseeded,
 	})
 }
 
 type InitializeResponse struct {
-	Language string `json:"language"`
+	Language string                  `json:"language"`
+	Reseeded bool                    `json:"reseeded,omitempty"`
+	Hosts    []*InitializeHostResult `json:"hosts,omitempty"`
+}
+
+type InitializeHostResult struct {
+	Host     string `json:"host"`
+	Reseeded bool   `json:"reseeded"`
 }
 
 // createUser ユーザの作成
 // POST /user
 func (h *Handler) createUser(c echo.Context) error {
+	ctx := dbContext(c)
+
 	defer c.Request().Body.Close()
 	req := new(CreateUserRequest)
 	if err := parseRequestBody(c, req); err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	if req.ViewerID == "" || req.PlatformType < 1 || req.PlatformType > 3 {
+	if req.ViewerID == "" {
 		return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
 	}
+	if err := validatePlatformType(req.PlatformType); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
 
 	requestAt, err := getRequestTime(c)
 	if err != nil {
@@ -1317,7 +2941,13 @@ func (h *Handler) createUser(c echo.Context) error {
 	// ユーザーIDに基づいて適切なDBを選択
 	db := h.getDBForUserID(uID)
 
-	tx, err := db.Beginx()
+	release, err := h.acquireWriteSlot(uID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -1349,20 +2979,24 @@ func (h *Handler) createUser(c echo.Context) error {
 		UpdatedAt:    requestAt,
 	}
 	query = "INSERT INTO user_devices(id, user_id, platform_id, platform_type, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err = tx.Exec(query, userDevice.ID, user.ID, req.ViewerID, req.PlatformType, requestAt, requestAt)
-	if err != nil {
+	if err = h.retryOnIDCollision(func() error {
+		_, err := tx.Exec(query, userDevice.ID, user.ID, req.ViewerID, req.PlatformType, requestAt, requestAt)
+		return err
+	}, &userDevice.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// 初期デッキ付与
-	initCard := new(ItemMaster)
-	query = "SELECT * FROM item_masters WHERE id=?"
-	if err = tx.Get(initCard, query, 2); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+	initCard, err := h.getItemMaster(ctx, 2)
+	if err != nil {
+		if err == ErrItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	if initCard.AmountPerSec == nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrInvalidItemMaster)
+	}
 
 	initCards := make([]*UserCard, 0, 3)
 	for i := 0; i < 3; i++ {
@@ -1381,7 +3015,10 @@ func (h *Handler) createUser(c echo.Context) error {
 			UpdatedAt:    requestAt,
 		}
 		query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt); err != nil {
+		if err := h.retryOnIDCollision(func() error {
+			_, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt)
+			return err
+		}, &card.ID); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 		initCards = append(initCards, card)
@@ -1401,12 +3038,15 @@ func (h *Handler) createUser(c echo.Context) error {
 		UpdatedAt: requestAt,
 	}
 	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, initDeck.ID, initDeck.UserID, initDeck.CardID1, initDeck.CardID2, initDeck.CardID3, initDeck.CreatedAt, initDeck.UpdatedAt); err != nil {
+	if err := h.retryOnIDCollision(func() error {
+		_, err := tx.Exec(query, initDeck.ID, initDeck.UserID, initDeck.CardID1, initDeck.CardID2, initDeck.CardID3, initDeck.CreatedAt, initDeck.UpdatedAt)
+		return err
+	}, &initDeck.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// ログイン処理
-	user, loginBonuses, presents, err := h.loginProcess(tx, user.ID, requestAt)
+	user, loginBonuses, presents, err := h.loginProcess(ctx, tx, user.ID, requestAt)
 	if err != nil {
 		if err == ErrUserNotFound || err == ErrItemNotFound || err == ErrLoginBonusRewardNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
@@ -1435,7 +3075,10 @@ func (h *Handler) createUser(c echo.Context) error {
 		ExpiredAt: requestAt + 86400,
 	}
 	query = "INSERT INTO user_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
-	if _, err = tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt); err != nil {
+	if err = h.retryOnIDCollision(func() error {
+		_, err := tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt)
+		return err
+	}, &sess.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1443,6 +3086,8 @@ func (h *Handler) createUser(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	h.LoginMetrics.Observe(len(loginBonuses), len(presents))
+	h.enqueuePresentGrants(user.ID, presents)
 
 	return successResponse(c, &CreateUserResponse{
 		UserID:           user.ID,
@@ -1469,6 +3114,8 @@ type CreateUserResponse struct {
 // login ログイン
 // POST /login
 func (h *Handler) login(c echo.Context) error {
+	ctx := dbContext(c)
+
 	defer c.Request().Body.Close()
 	req := new(LoginRequest)
 	if err := parseRequestBody(c, req); err != nil {
@@ -1485,14 +3132,14 @@ func (h *Handler) login(c echo.Context) error {
 
 	user := new(User)
 	query := "SELECT * FROM users WHERE id=?"
-	if err := db.Get(user, query, req.UserID); err != nil {
+	if err := db.GetContext(ctx, user, query, req.UserID); err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	isBan, err := h.checkBan(user.ID)
+	isBan, err := h.checkBan(ctx, user.ID)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -1500,14 +3147,20 @@ func (h *Handler) login(c echo.Context) error {
 		return errorResponse(c, http.StatusForbidden, ErrForbidden)
 	}
 
-	if err = h.checkViewerID(user.ID, req.ViewerID); err != nil {
+	if err = h.checkViewerID(ctx, user.ID, req.ViewerID); err != nil {
 		if err == ErrUserDeviceNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	tx, err := db.Beginx()
+	release, err := h.acquireWriteSlot(req.UserID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -1534,12 +3187,28 @@ func (h *Handler) login(c echo.Context) error {
 		ExpiredAt: requestAt + 86400,
 	}
 	query = "INSERT INTO user_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
-	if _, err = tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt); err != nil {
+	if err = h.retryOnIDCollision(func() error {
+		_, err := tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt)
+		return err
+	}, &sess.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 同一ユーザーの同時ログインでログインボーナスが二重に付与されないよう、ここからcommitまで直列化する
+	unlock := h.UserLocks.Lock(req.UserID)
+	defer unlock()
+
+	// ロック取得前に他のログインがcommitしている可能性があるため、最新の値を読み直す
+	query = "SELECT last_activated_at FROM users WHERE id=? FOR UPDATE"
+	if err = tx.Get(&user.LastActivatedAt, query, req.UserID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// 同日にすでにログインしているユーザはログイン処理をしない
-	if isCompleteTodayLogin(time.Unix(user.LastActivatedAt, 0), time.Unix(requestAt, 0)) {
+	if isCompleteTodayLogin(time.Unix(user.LastActivatedAt, 0), time.Unix(requestAt, 0), loginLocation) {
 		user.UpdatedAt = requestAt
 		user.LastActivatedAt = requestAt
 
@@ -1552,6 +3221,8 @@ func (h *Handler) login(c echo.Context) error {
 		if err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
+		unlock()
+		h.LoginMetrics.ObserveSameDay()
 
 		return successResponse(c, &LoginResponse{
 			ViewerID:         req.ViewerID,
@@ -1560,7 +3231,7 @@ func (h *Handler) login(c echo.Context) error {
 		})
 	}
 
-	user, loginBonuses, presents, err := h.loginProcess(tx, req.UserID, requestAt)
+	user, loginBonuses, presents, err := h.loginProcess(ctx, tx, req.UserID, requestAt)
 	if err != nil {
 		if err == ErrUserNotFound || err == ErrItemNotFound || err == ErrLoginBonusRewardNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
@@ -1575,6 +3246,9 @@ func (h *Handler) login(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	unlock()
+	h.LoginMetrics.Observe(len(loginBonuses), len(presents))
+	h.enqueuePresentGrants(req.UserID, presents)
 
 	return successResponse(c, &LoginResponse{
 		ViewerID:         req.ViewerID,
@@ -1597,6 +3271,8 @@ type LoginResponse struct {
 // listGacha ガチャ一覧
 // GET /user/{userID}/gacha/index
 func (h *Handler) listGacha(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
@@ -1607,41 +3283,41 @@ func (h *Handler) listGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	gachaMasterList := []*GachaMaster{}
-	query := "SELECT * FROM gacha_masters WHERE start_at <= ? AND end_at >= ? ORDER BY display_order ASC"
-	err = h.DB.Select(&gachaMasterList, query, requestAt, requestAt)
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	if len(gachaMasterList) == 0 {
-		return successResponse(c, &ListGachaResponse{
-			Gachas: []*GachaData{},
+	// ガチャ一覧はマスタバージョンと開催期間の区間ごとにしか変わらないのでキャッシュする
+	masterVersion := c.Request().Header.Get("x-master-version")
+	gachaDataList, cached := h.Cache.GetGachaList(masterVersion, requestAt)
+	if !cached {
+		// キャッシュが破棄された直後に同じ一覧を同時に読み込まないよう、マスタバージョンと時刻ごとにまとめる
+		v, err := h.loadMaster(ctx, fmt.Sprintf("gacha_list:%s:%d", masterVersion, requestAt), func(ctx context.Context) (interface{}, error) {
+			gachaDataList, validFrom, validUntil, err := h.loadGachaList(ctx, masterVersion, requestAt)
+			if err != nil {
+				return nil, err
+			}
+			h.Cache.SetGachaList(masterVersion, validFrom, validUntil, gachaDataList)
+			return gachaDataList, nil
 		})
-	}
-
-	gachaDataList := make([]*GachaData, 0)
-	query = "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC"
-	for _, v := range gachaMasterList {
-		var gachaItem []*GachaItemMaster
-		err = h.DB.Select(&gachaItem, query, v.ID)
 		if err != nil {
+			if err == ErrGachaItemNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
+			}
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
+		gachaDataList = v.([]*GachaData)
+	}
+	gachaDataList = markNewGachaItems(gachaDataList, requestAt)
 
-		if len(gachaItem) == 0 {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
-		}
-
-		gachaDataList = append(gachaDataList, &GachaData{
-			Gacha:     v,
-			GachaItem: gachaItem,
+	if len(gachaDataList) == 0 {
+		return successResponse(c, &ListGachaResponse{
+			Gachas: []*GachaData{},
 		})
 	}
 
 	// ガチャ実行用のワンタイムトークンの発行
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = h.DB.Exec(query, requestAt, userID); err != nil {
+	if !h.TokenIssues.Allow(userID, time.Now()) {
+		return tooManyTokenIssuesResponse(c)
+	}
+	query := "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err = h.DB.ExecContext(ctx, query, requestAt, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	tID, err := h.generateID()
@@ -1662,7 +3338,10 @@ func (h *Handler) listGacha(c echo.Context) error {
 		ExpiredAt: requestAt + 600,
 	}
 	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = h.DB.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
+	if err = h.retryOnIDCollision(func() error {
+		_, err := h.DB.ExecContext(ctx, query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt)
+		return err
+	}, &token.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1675,278 +3354,252 @@ func (h *Handler) listGacha(c echo.Context) error {
 	})
 }
 
-type ListGachaResponse struct {
-	OneTimeToken string       `json:"oneTimeToken"`
-	Gachas       []*GachaData `json:"gachas"`
-}
+// markNewGachaItems 作成からgachaNewItemWindow秒以内のガチャアイテムにisNewを付ける
+// キャッシュしている一覧は他のリクエストと共有しているため書き換えず、新着のアイテムがあるガチャのみ複製して返す
+func markNewGachaItems(gachas []*GachaData, requestAt int64) []*GachaData {
+	if gachaNewItemWindow <= 0 {
+		return gachas
+	}
+	isNew := func(item *GachaItemMaster) bool {
+		return requestAt-gachaNewItemWindow <= item.CreatedAt && item.CreatedAt <= requestAt
+	}
 
-type GachaData struct {
-	Gacha     *GachaMaster       `json:"gacha"`
-	GachaItem []*GachaItemMaster `json:"gachaItemList"`
+	marked := make([]*GachaData, len(gachas))
+	for i, g := range gachas {
+		marked[i] = g
+		for j, item := range g.GachaItem {
+			if !isNew(item) {
+				continue
+			}
+			items := make([]*GachaItemMaster, len(g.GachaItem))
+			copy(items, g.GachaItem)
+			for k := j; k < len(items); k++ {
+				if isNew(items[k]) {
+					newItem := *items[k]
+					newItem.IsNew = true
+					items[k] = &newItem
+				}
+			}
+			marked[i] = &GachaData{Gacha: g.Gacha, GachaItem: items}
+			break
+		}
+	}
+	return marked
 }
 
-// drawGacha ガチャを引く
-// POST /user/{userID}/gacha/draw/{gachaID}/{n}
-func (h *Handler) drawGacha(c echo.Context) error {
-	userID, err := getUserID(c)
+// loadGachaList 開催中のガチャ一覧をDBから取得する
+// あわせて、同じ一覧が有効な期間(validFrom〜validUntil)を返す
+func (h *Handler) loadGachaList(ctx context.Context, masterVersion string, requestAt int64) ([]*GachaData, int64, int64, error) {
+	gachaMasterList, validFrom, validUntil, err := h.getActiveGachas(ctx, masterVersion, requestAt)
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+		return nil, 0, 0, err
 	}
 
-	gachaID := c.Param("gachaID")
-	if gachaID == "" {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
-	}
-
-	gachaCount, err := strconv.ParseInt(c.Param("n"), 10, 64)
-	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+	if maxActiveGachas > 0 && len(gachaMasterList) > maxActiveGachas {
+		gachaMasterList = gachaMasterList[:maxActiveGachas]
 	}
-	if gachaCount != 1 && gachaCount != 10 {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid draw gacha times"))
+	if len(gachaMasterList) == 0 {
+		return []*GachaData{}, validFrom, validUntil, nil
 	}
 
-	defer c.Request().Body.Close()
-	req := new(DrawGachaRequest)
-	if err = parseRequestBody(c, req); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+	// ガチャごとに問い合わせないよう、全ガチャのアイテムをまとめて取得する
+	gachaIDs := make([]int64, len(gachaMasterList))
+	for i, v := range gachaMasterList {
+		gachaIDs[i] = v.ID
 	}
-
-	requestAt, err := getRequestTime(c)
+	query, params, err := sqlx.In("SELECT * FROM gacha_item_masters WHERE gacha_id IN (?) ORDER BY gacha_id, id ASC", gachaIDs)
 	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+		return nil, 0, 0, err
 	}
-
-	if err = h.checkOneTimeToken(userID, req.OneTimeToken, 1, requestAt); err != nil {
-		if err == ErrInvalidToken {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
+	gachaItems := make([]*GachaItemMaster, 0)
+	if err := h.DB.SelectContext(ctx, &gachaItems, query, params...); err != nil {
+		return nil, 0, 0, err
+	}
+	itemsByGacha := make(map[int64][]*GachaItemMaster, len(gachaMasterList))
+	for _, item := range gachaItems {
+		itemsByGacha[item.GachaID] = append(itemsByGacha[item.GachaID], item)
 	}
 
-	if err = h.checkViewerID(userID, req.ViewerID); err != nil {
-		if err == ErrUserDeviceNotFound {
-			return errorResponse(c, http.StatusNotFound, err)
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	consumedCoin := int64(gachaCount * 1000)
-
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err := h.getDBForUserID(userID).Get(user, query, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+	gachaDataList := make([]*GachaData, 0, len(gachaMasterList))
+	for _, v := range gachaMasterList {
+		gachaItem := itemsByGacha[v.ID]
+		if len(gachaItem) == 0 {
+			return nil, 0, 0, ErrGachaItemNotFound
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	if user.IsuCoin < consumedCoin {
-		return errorResponse(c, http.StatusConflict, fmt.Errorf("not enough isucon"))
-	}
-
-	query = "SELECT * FROM gacha_masters WHERE id=? AND start_at <= ? AND end_at >= ?"
-	gachaInfo := new(GachaMaster)
-	if err = h.DB.Get(gachaInfo, query, gachaID, requestAt, requestAt); err != nil {
-		if sql.ErrNoRows == err {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+		if err := h.fillGachaItemIcons(ctx, gachaItem); err != nil {
+			return nil, 0, 0, err
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
 
-	// gachaIDをint64に変換
-	gachaIDInt, err := strconv.ParseInt(gachaID, 10, 64)
-	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+		gachaDataList = append(gachaDataList, &GachaData{
+			Gacha:     v,
+			GachaItem: gachaItem,
+		})
 	}
 
-	// キャッシュからガチャアイテムを取得
-	gachaItemList, sum, cached := h.Cache.GetGachaItems(gachaIDInt)
-	if !cached {
-		// キャッシュにない場合はDBから取得
-		gachaItemList = make([]*GachaItemMaster, 0)
-		err = h.DB.Select(&gachaItemList, "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC", gachaID)
-		if err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-		if len(gachaItemList) == 0 {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
-		}
-
-		// キャッシュに保存
-		h.Cache.SetGachaItems(gachaIDInt, gachaItemList)
+	return gachaDataList, validFrom, validUntil, nil
+}
 
-		// weight合計値を再計算
-		sum = 0
-		for _, item := range gachaItemList {
-			sum += int64(item.Weight)
-		}
+// getActiveGachas requestAt時点で開催中のガチャと、その組み合わせが変わらない期間を返す
+// 全ガチャマスタの索引をキャッシュし、期間の絞り込みはDBではなく索引の二分探索で行う
+func (h *Handler) getActiveGachas(ctx context.Context, masterVersion string, requestAt int64) ([]*GachaMaster, int64, int64, error) {
+	idx, err := h.getGachaIndex(ctx, masterVersion)
+	if err != nil {
+		return nil, 0, 0, err
 	}
+	active, validFrom, validUntil := idx.active(requestAt)
+	return active, validFrom, validUntil, nil
+}
 
-	if sum == 0 {
-		return errorResponse(c, http.StatusInternalServerError, fmt.Errorf("invalid gacha weight sum"))
+// getActiveGacha requestAt時点で開催中のガチャマスタを取得する（キャッシュ活用）
+// 一覧を取得してから引くまでの間に終了したガチャは、キャッシュにあっても開催期間で弾く
+// 索引にないガチャのみDBを確認する
+func (h *Handler) getActiveGacha(ctx context.Context, masterVersion string, gachaID, requestAt int64) (*GachaMaster, error) {
+	idx, err := h.getGachaIndex(ctx, masterVersion)
+	if err != nil {
+		return nil, err
 	}
 
-	// random値の導出 & 抽選
-	result := make([]*GachaItemMaster, 0, gachaCount)
-	for i := 0; i < int(gachaCount); i++ {
-		random := rand.Int63n(sum)
-		boundary := 0
-		for _, v := range gachaItemList {
-			boundary += v.Weight
-			if random < int64(boundary) {
-				result = append(result, v)
-				break
+	gacha, ok := idx.get(gachaID)
+	if !ok {
+		gacha = new(GachaMaster)
+		if err := h.DB.GetContext(ctx, gacha, "SELECT * FROM gacha_masters WHERE id=?", gachaID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrGachaNotFound
 			}
+			return nil, err
 		}
 	}
-
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if requestAt < gacha.StartAt || gacha.EndAt < requestAt {
+		return nil, ErrGachaNotFound
 	}
-	defer tx.Rollback() //nolint:errcheck
+	return gacha, nil
+}
 
-	// プレゼントにガチャ結果を付与する（バッチ化）
-	presents := make([]*UserPresent, 0, gachaCount)
-	presentMessage := fmt.Sprintf("%sの付与アイテムです", gachaInfo.Name)
+// getGachaIndex 全ガチャマスタの索引を取得する（キャッシュ活用）
+func (h *Handler) getGachaIndex(ctx context.Context, masterVersion string) (*gachaIndex, error) {
+	if idx, ok := h.Cache.GetGachaIndex(masterVersion); ok {
+		return idx, nil
+	}
 
-	for _, v := range result {
-		pID, err := h.generateID()
-		if err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-		present := &UserPresent{
-			ID:             pID,
-			UserID:         userID,
-			SentAt:         requestAt,
-			ItemType:       v.ItemType,
-			ItemID:         v.ItemID,
-			Amount:         v.Amount,
-			PresentMessage: presentMessage,
-			CreatedAt:      requestAt,
-			UpdatedAt:      requestAt,
+	v, err := h.loadMaster(ctx, "gacha_index:"+masterVersion, func(ctx context.Context) (interface{}, error) {
+		gachas := make([]*GachaMaster, 0)
+		if err := h.DB.SelectContext(ctx, &gachas, "SELECT * FROM gacha_masters"); err != nil {
+			return nil, err
 		}
-		presents = append(presents, present)
+		idx := newGachaIndex(masterVersion, gachas)
+		h.Cache.SetGachaIndex(idx)
+		return idx, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(*gachaIndex), nil
+}
 
-	// プレゼントを一括挿入（NamedExecを使用）
-	if len(presents) > 0 {
-		query = `INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at)
-				 VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :created_at, :updated_at)`
-
-		for _, present := range presents {
-			if _, err := tx.NamedExec(query, present); err != nil {
-				return errorResponse(c, http.StatusInternalServerError, err)
+// fillGachaItemIcons ガチャアイテムにアイテムマスタのアイコンと、端数単位のアイテムの場合は表示用の付与数を設定する
+// アイテムマスタがないアイテム(コインなど)はアイコンなし・端数なしとする
+func (h *Handler) fillGachaItemIcons(ctx context.Context, items []*GachaItemMaster) error {
+	for _, item := range items {
+		master, err := h.getItemMaster(ctx, item.ItemID)
+		if err != nil {
+			if err == ErrItemNotFound {
+				continue
 			}
+			return err
+		}
+		item.IconURL = master.IconURL
+		if scale := amountScale(master); scale > 1 && item.ItemType != ItemTypeCard {
+			item.DisplayAmount = formatScaledAmount(int64(item.Amount), scale)
 		}
 	}
-
-	// コイン消費
-	query = "UPDATE users SET isu_coin=? WHERE id=?"
-	totalCoin := user.IsuCoin - consumedCoin
-	if _, err := tx.Exec(query, totalCoin, user.ID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	return successResponse(c, &DrawGachaResponse{
-		Presents: presents,
-	})
+	return nil
 }
 
-type DrawGachaRequest struct {
-	ViewerID     string `json:"viewerId"`
-	OneTimeToken string `json:"oneTimeToken"`
+type ListGachaResponse struct {
+	OneTimeToken string       `json:"oneTimeToken"`
+	Gachas       []*GachaData `json:"gachas"`
 }
 
-type DrawGachaResponse struct {
-	Presents []*UserPresent `json:"presents"`
+type GachaData struct {
+	Gacha     *GachaMaster       `json:"gacha"`
+	GachaItem []*GachaItemMaster `json:"gachaItemList"`
 }
 
-// listPresent プレゼント一覧
-// GET /user/{userID}/present/index/{n}
-func (h *Handler) listPresent(c echo.Context) error {
-	n, err := strconv.Atoi(c.Param("n"))
-	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid index number (n) parameter"))
-	}
-	if n == 0 {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("index number (n) should be more than or equal to 1"))
-	}
+// drawGacha ガチャを引く
+// POST /user/{userID}/gacha/draw/{gachaID}/{n}
+func (h *Handler) drawGacha(c echo.Context) error {
+	ctx := dbContext(c)
 
 	userID, err := getUserID(c)
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid userID parameter"))
+		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	offset := PresentCountPerPage * (n - 1)
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
-
-	presentList := []*UserPresent{}
-	query := `
-	SELECT * FROM user_presents 
-	WHERE user_id = ? AND deleted_at IS NULL
-	ORDER BY created_at DESC, id
-	LIMIT ? OFFSET ?`
-	if err = db.Select(&presentList, query, userID, PresentCountPerPage, offset); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	gachaID := c.Param("gachaID")
+	if gachaID == "" {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
 	}
 
-	var presentCount int
-	if err = db.Get(&presentCount, "SELECT COUNT(*) FROM user_presents WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	gachaCount, err := strconv.ParseInt(c.Param("n"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if !isValidGachaCount(gachaCount) {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid draw gacha times"))
 	}
 
-	isNext := false
-	if presentCount > (offset + PresentCountPerPage) {
-		isNext = true
+	defer c.Request().Body.Close()
+	req := new(DrawGachaRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	return successResponse(c, &ListPresentResponse{
-		Presents: presentList,
-		IsNext:   isNext,
-	})
-}
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
 
-type ListPresentResponse struct {
-	Presents []*UserPresent `json:"presents"`
-	IsNext   bool           `json:"isNext"`
-}
+	// 同じユーザーのガチャ実行を直列化し、コイン残高の確認から消費までの間に別のガチャが割り込まないようにする
+	unlock := h.GachaLocks.Lock(userID)
+	defer unlock()
 
-// receivePresent プレゼント受け取り
-// POST /user/{userID}/present/receive
-func (h *Handler) receivePresent(c echo.Context) error {
-	defer c.Request().Body.Close()
-	req := new(ReceivePresentRequest)
-	if err := parseRequestBody(c, req); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+	if err = h.checkOneTimeToken(ctx, userID, req.OneTimeToken, 1, requestAt); err != nil {
+		if isTokenError(err) {
+			return errorResponse(c, tokenErrorStatus(err), err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	userID, err := getUserID(c)
+	consumedCoin := gachaCount * gachaPricePerDraw
+
+	user, err := h.getUserWithViewerID(ctx, userID, req.ViewerID)
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+		if err == ErrUserDeviceNotFound || err == ErrUserNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if user.IsuCoin < consumedCoin {
+		return notEnoughCoinResponse(c, consumedCoin, user.IsuCoin)
 	}
 
-	requestAt, err := getRequestTime(c)
+	// gachaIDをint64に変換
+	gachaIDInt, err := strconv.ParseInt(gachaID, 10, 64)
 	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
 	}
 
-	if len(req.PresentIDs) == 0 {
-		return errorResponse(c, http.StatusUnprocessableEntity, fmt.Errorf("presentIds is empty"))
+	gachaInfo, err := h.getActiveGacha(ctx, c.Request().Header.Get("x-master-version"), gachaIDInt, requestAt)
+	if err != nil {
+		if err == ErrGachaNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	if err = h.checkViewerID(userID, req.ViewerID); err != nil {
-		if err == ErrUserDeviceNotFound {
+	gachaItemList, cumulative, err := h.getGachaItems(ctx, gachaIDInt)
+	if err != nil {
+		if err == ErrGachaItemNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
@@ -1955,61 +3608,70 @@ func (h *Handler) receivePresent(c echo.Context) error {
 	// ユーザーIDに基づいて適切なDBを選択
 	db := h.getDBForUserID(userID)
 
-	// 未取得のプレゼント取得
-	query := "SELECT * FROM user_presents WHERE id IN (?) AND deleted_at IS NULL"
-	query, params, err := sqlx.In(query, req.PresentIDs)
+	release, err := h.acquireWriteSlot(userID)
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
-	obtainPresent := []*UserPresent{}
-	if err = db.Select(&obtainPresent, query, params...); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+		return shardBusyResponse(c, err)
 	}
+	defer release()
 
-	if len(obtainPresent) == 0 {
-		return successResponse(c, &ReceivePresentResponse{
-			UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, nil, nil, nil, []*UserPresent{}),
-		})
-	}
-
-	tx, err := db.Beginx()
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	// プレゼントの削除処理をバッチ化
-	presentIDs := make([]int64, len(obtainPresent))
-	for i := range obtainPresent {
-		if obtainPresent[i].DeletedAt != nil {
-			return errorResponse(c, http.StatusInternalServerError, fmt.Errorf("received present"))
+	// コイン消費
+	// 別プロセスで同時にガチャが引かれた場合に備え、残高が足りる場合のみ減らす
+	// 直接付与でコインが排出された場合に、付与したコインで支払えてしまわないよう付与より先に減らす
+	query := "UPDATE users SET isu_coin=isu_coin-? WHERE id=? AND isu_coin>=?"
+	res, err := tx.Exec(query, consumedCoin, user.ID, consumedCoin)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if affected == 0 {
+		var have int64
+		if err := tx.Get(&have, "SELECT isu_coin FROM users WHERE id=?", user.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-		obtainPresent[i].UpdatedAt = requestAt
-		obtainPresent[i].DeletedAt = &requestAt
-		presentIDs[i] = obtainPresent[i].ID
+		return notEnoughCoinResponse(c, consumedCoin, have)
 	}
 
-	// プレゼントを一括で削除済みにマーク
-	query = "UPDATE user_presents SET deleted_at=?, updated_at=? WHERE id IN (?)"
-	query, params, err = sqlx.In(query, requestAt, requestAt, presentIDs)
+	// random値の導出 & 抽選
+	// 天井のあるガチャはユーザーの天井のカウントから抽選するため、カウントをロックしてから抽選する
+	pity, err := loadGachaPity(tx, userID, gachaInfo)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	_, err = tx.Exec(query, params...)
+	result, err := drawGachaItems(tx, userID, gachaInfo, gachaItemList, cumulative, int(gachaCount), pity, requestAt)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	// 消費するコインは引いた回数分なので、抽選できなかった場合にコインだけを消費しないようにする
+	if int64(len(result)) != gachaCount {
+		return errorResponse(c, http.StatusInternalServerError, ErrInvalidGachaWeight)
+	}
 
-	// アイテム付与処理をバッチ化
-	err = h.obtainItemsBatch(tx, obtainPresent, userID, requestAt)
+	// 抽選結果をプレゼントとして付与し、引き直しや排出統計のために抽選履歴を残す
+	// 直接付与の場合はプレゼントを作らないため、引き直しはできない
+	presents, drawID, err := h.insertGachaDraw(ctx, tx, userID, gachaInfo, result, consumedCoin, nil, pity, req.DirectGrant, requestAt)
 	if err != nil {
-		if err == ErrUserNotFound || err == ErrItemNotFound {
-			return errorResponse(c, http.StatusNotFound, err)
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 直接付与の場合は同じトランザクション内で付与し、付与後のコイン残高を返すためにユーザーを取り直す
+	var obtained *ObtainedItems
+	if req.DirectGrant {
+		obtained, err = h.obtainItemsBatch(ctx, tx, gachaGrants(userID, result, requestAt), userID, requestAt)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-		if err == ErrInvalidItemType {
-			return errorResponse(c, http.StatusBadRequest, err)
+		if err = tx.Get(user, "SELECT * FROM users WHERE id=?", user.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	err = tx.Commit()
@@ -2017,120 +3679,326 @@ func (h *Handler) receivePresent(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	return successResponse(c, &ReceivePresentResponse{
-		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, nil, nil, nil, obtainPresent),
-	})
+	response := &DrawGachaResponse{
+		Presents:      presents,
+		DrawID:        drawID,
+		AnimationSeed: gachaAnimationSeed(drawID),
+	}
+	if obtained != nil {
+		response.Presents = []*UserPresent{}
+		response.UpdatedResources = makeUpdatedResources(requestAt, user, nil, obtained.Cards, nil, obtained.Items, nil, nil)
+		response.GrantClamps = obtained.Clamps
+	}
+	return successResponse(c, response)
 }
 
-type ReceivePresentRequest struct {
-	ViewerID   string  `json:"viewerId"`
-	PresentIDs []int64 `json:"presentIds"`
+// gachaGrants 直接付与する抽選結果をobtainItemsBatchに渡す形にする。プレゼントとしては保存しないためIDは持たない
+func gachaGrants(userID int64, result []*GachaItemMaster, requestAt int64) []*UserPresent {
+	grants := make([]*UserPresent, 0, len(result))
+	for _, v := range result {
+		grants = append(grants, &UserPresent{
+			UserID:    userID,
+			SentAt:    requestAt,
+			ItemType:  v.ItemType,
+			ItemID:    v.ItemID,
+			Amount:    v.Amount,
+			Source:    PresentSourceGacha,
+			CreatedAt: requestAt,
+			UpdatedAt: requestAt,
+		})
+	}
+	return grants
 }
 
-type ReceivePresentResponse struct {
-	UpdatedResources *UpdatedResource `json:"updatedResources"`
+// isValidGachaCount 引ける回数か。1回か、gachaMaxDrawCount以下の10の倍数のみ引ける
+func isValidGachaCount(n int64) bool {
+	if n == 1 {
+		return true
+	}
+	return n > 0 && n%10 == 0 && n <= gachaMaxDrawCount
 }
 
-// listItem アイテムリスト
-// GET /user/{userID}/item
-func (h *Handler) listItem(c echo.Context) error {
-	userID, err := getUserID(c)
+// insertGachaDraw 抽選結果をプレゼントとして付与し、抽選と抽選履歴を記録する。付与したプレゼントと抽選IDを返す
+// rerollOfには引き直しの場合に引き直し元の抽選IDを、pityには抽選前の天井のカウントを渡す
+// directGrantの場合はプレゼントを作らずに抽選と抽選履歴だけを記録する。抽選結果の付与は呼び出し元で行う
+func (h *Handler) insertGachaDraw(ctx context.Context, tx *sqlx.Tx, userID int64, gacha *GachaMaster, result []*GachaItemMaster, consumedCoin int64, rerollOf *int64, pity int, directGrant bool, requestAt int64) ([]*UserPresent, int64, error) {
+	drawID, err := h.generateID()
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+		return nil, 0, err
+	}
+	draw := &UserGachaDraw{
+		ID:           drawID,
+		UserID:       userID,
+		GachaID:      gacha.ID,
+		GachaCount:   len(result),
+		ConsumedCoin: consumedCoin,
+		RerollOf:     rerollOf,
+		DrawnAt:      requestAt,
+		CreatedAt:    requestAt,
+		PityCount:    pity,
+	}
+	query := `INSERT INTO user_gacha_draws(id, user_id, gacha_id, gacha_count, consumed_coin, rerolled, reroll_of, drawn_at, created_at, pity_count)
+			  VALUES (:id, :user_id, :gacha_id, :gacha_count, :consumed_coin, :rerolled, :reroll_of, :drawn_at, :created_at, :pity_count)`
+	if err := h.retryOnIDCollision(func() error {
+		_, err := tx.NamedExec(query, draw)
+		return err
+	}, &draw.ID); err != nil {
+		return nil, 0, err
 	}
+	drawID = draw.ID
 
-	requestAt, err := getRequestTime(c)
+	// プレゼントにガチャ結果を付与する
+	presents := make([]*UserPresent, 0, len(result))
+	histories := make([]*UserGachaDrawHistory, 0, len(result))
+	presentMessage, err := gachaPresentMessage(gacha.Name)
 	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+		return nil, 0, errors.Wrapf(err, "gachaID=%d", gacha.ID)
 	}
-
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
-
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err = db.Get(user, query, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+	for _, v := range result {
+		var presentID *int64
+		if !directGrant {
+			pID, err := h.generateID()
+			if err != nil {
+				return nil, 0, err
+			}
+			presents = append(presents, &UserPresent{
+				ID:             pID,
+				UserID:         userID,
+				SentAt:         requestAt,
+				ItemType:       v.ItemType,
+				ItemID:         v.ItemID,
+				Amount:         v.Amount,
+				PresentMessage: presentMessage,
+				Source:         PresentSourceGacha,
+				SourceID:       &gacha.ID,
+				CreatedAt:      requestAt,
+				UpdatedAt:      requestAt,
+			})
+			// プレゼントのidを採番し直した場合も抽選履歴が同じプレゼントを指すよう、プレゼントのidを参照する
+			presentID = &presents[len(presents)-1].ID
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
+
+		hID, err := h.generateID()
+		if err != nil {
+			return nil, 0, err
+		}
+		histories = append(histories, &UserGachaDrawHistory{
+			ID:          hID,
+			UserID:      userID,
+			DrawID:      drawID,
+			GachaID:     gacha.ID,
+			GachaItemID: v.ID,
+			PresentID:   presentID,
+			ItemType:    v.ItemType,
+			ItemID:      v.ItemID,
+			Amount:      v.Amount,
+			DrawnAt:     requestAt,
+			CreatedAt:   requestAt,
+		})
+	}
+
+	// プレゼントと抽選履歴をgachaInsertChunkSize件ずつ一括挿入する
+	chunkSize := gachaInsertChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(histories)
+	}
+	for start := 0; start < len(histories); start += chunkSize {
+		end := start + chunkSize
+		if end > len(histories) {
+			end = len(histories)
+		}
+
+		if !directGrant {
+			presentChunk := presents[start:end]
+			query := `INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_at)
+					 VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :source, :source_id, :created_at, :updated_at)`
+			ids := make([]*int64, 0, len(presentChunk))
+			for _, present := range presentChunk {
+				ids = append(ids, &present.ID)
+			}
+			if err := h.retryOnIDCollision(func() error {
+				_, err := tx.NamedExec(query, presentChunk)
+				return err
+			}, ids...); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		historyChunk := histories[start:end]
+		query := `INSERT INTO user_gacha_draw_histories(id, user_id, draw_id, gacha_id, gacha_item_id, present_id, item_type, item_id, amount, drawn_at, created_at)
+				 VALUES (:id, :user_id, :draw_id, :gacha_id, :gacha_item_id, :present_id, :item_type, :item_id, :amount, :drawn_at, :created_at)`
+		ids := make([]*int64, 0, len(historyChunk))
+		for _, history := range historyChunk {
+			ids = append(ids, &history.ID)
+		}
+		if err := h.retryOnIDCollision(func() error {
+			_, err := tx.NamedExec(query, historyChunk)
+			return err
+		}, ids...); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return presents, drawID, nil
+}
+
+// rerollGacha 直前のガチャを引き直す
+// POST /user/{userID}/gacha/reroll
+// 直前の抽選で付与したプレゼントを取り消して同じガチャ・同じ回数で引き直す。引き直しは1回の抽選につき1度だけで、プレゼントを1つでも受け取っていれば引き直せない
+func (h *Handler) rerollGacha(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(RerollGachaRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	itemList := []*UserItem{}
-	query = "SELECT * FROM user_items WHERE user_id = ?"
-	if err = db.Select(&itemList, query, userID); err != nil {
+	// ガチャの実行と同じロックを取り、引き直し中に別の抽選が割り込まないようにする
+	unlock := h.GachaLocks.Lock(userID)
+	defer unlock()
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	cardList := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE user_id=?"
-	if err = db.Select(&cardList, query, userID); err != nil {
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	defer tx.Rollback() //nolint:errcheck
 
-	// アイテムの強化に使うためのワンタイムトークンを発行
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = db.Exec(query, requestAt, userID); err != nil {
+	lastDraw := new(UserGachaDraw)
+	query := "SELECT * FROM user_gacha_draws WHERE user_id=? ORDER BY id DESC LIMIT 1 FOR UPDATE"
+	if err = tx.Get(lastDraw, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrGachaDrawNotFound)
+		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	tID, err := h.generateID()
+	// 引き直した結果をさらに引き直すことはできない
+	if lastDraw.Rerolled || lastDraw.RerollOf != nil {
+		return errorResponse(c, http.StatusConflict, ErrGachaAlreadyRerolled)
+	}
+
+	gachaInfo, err := h.getActiveGacha(ctx, c.Request().Header.Get("x-master-version"), lastDraw.GachaID, requestAt)
 	if err != nil {
+		if err == ErrGachaNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	tk, err := generateUUID()
+
+	gachaItemList, cumulative, err := h.getGachaItems(ctx, lastDraw.GachaID)
 	if err != nil {
+		if err == ErrGachaItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	token := &UserOneTimeToken{
-		ID:        tID,
-		UserID:    userID,
-		Token:     tk,
-		TokenType: 2,
-		CreatedAt: requestAt,
-		UpdatedAt: requestAt,
-		ExpiredAt: requestAt + 600,
+
+	// 直前の抽選で付与したプレゼントを論理削除して取り消す。受け取り済みのものが1つでもあれば引き直せない
+	// 抽選履歴から参照されるため物理削除はしない
+	// 直接付与した抽選はプレゼントを持たず、付与済みなので引き直せない
+	historyPresentIDs := make([]*int64, 0, lastDraw.GachaCount)
+	query = "SELECT present_id FROM user_gacha_draw_histories WHERE draw_id=?"
+	if err = tx.Select(&historyPresentIDs, query, lastDraw.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = h.DB.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
+	presentIDs := make([]int64, 0, len(historyPresentIDs))
+	for _, id := range historyPresentIDs {
+		if id == nil {
+			return errorResponse(c, http.StatusConflict, ErrGachaPresentReceived)
+		}
+		presentIDs = append(presentIDs, *id)
+	}
+	if len(presentIDs) > 0 {
+		query, params, err := sqlx.In("UPDATE user_presents SET deleted_at=?, updated_at=? WHERE id IN (?) AND user_id=? AND deleted_at IS NULL", requestAt, requestAt, presentIDs, userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		res, err := tx.Exec(query, params...)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if affected != int64(len(presentIDs)) {
+			return errorResponse(c, http.StatusConflict, ErrGachaPresentReceived)
+		}
+	}
+
+	if _, err = tx.Exec("UPDATE user_gacha_draws SET rerolled=1 WHERE id=?", lastDraw.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// キャッシュにも保存
-	h.TokenCache.SetToken(token.Token, token.UserID, token.TokenType, token.ExpiredAt, token.CreatedAt)
+	// 返金したコインをそのまま引き直しに充てるため、コインの残高は変わらない
+	// 天井のカウントは直前の抽選の前の値に戻して引き直す
+	if _, err = loadGachaPity(tx, userID, gachaInfo); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	result, err := drawGachaItems(tx, userID, gachaInfo, gachaItemList, cumulative, lastDraw.GachaCount, lastDraw.PityCount, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
 
-	return successResponse(c, &ListItemResponse{
-		OneTimeToken: token.Token,
-		Items:        itemList,
-		User:         user,
-		Cards:        cardList,
+	presents, drawID, err := h.insertGachaDraw(ctx, tx, userID, gachaInfo, result, lastDraw.ConsumedCoin, &lastDraw.ID, lastDraw.PityCount, false, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &DrawGachaResponse{
+		Presents:      presents,
+		DrawID:        drawID,
+		AnimationSeed: gachaAnimationSeed(drawID),
 	})
 }
 
-type ListItemResponse struct {
-	OneTimeToken string      `json:"oneTimeToken"`
-	User         *User       `json:"user"`
-	Items        []*UserItem `json:"items"`
-	Cards        []*UserCard `json:"cards"`
+type RerollGachaRequest struct {
+	ViewerID string `json:"viewerId"`
 }
 
-// addExpToCard 装備強化
-// POST /user/{userID}/card/addexp/{cardID}
-func (h *Handler) addExpToCard(c echo.Context) error {
-	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
-	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
+// getGachaOdds ユーザーから見た現在のガチャの排出確率
+// GET /user/{userID}/gacha/{gachaID}/odds
+// 抽選と同じweightの累積和から確率を求める。ピックアップを反映し、天井の直前のユーザーにはレアのアイテムだけの確率を返す
+func (h *Handler) getGachaOdds(c echo.Context) error {
+	ctx := dbContext(c)
 
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	// read body
-	defer c.Request().Body.Close()
-	req := new(AddExpToCardRequest)
-	if err := parseRequestBody(c, req); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
 	}
 
 	requestAt, err := getRequestTime(c)
@@ -2138,147 +4006,1656 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	if err = h.checkOneTimeToken(userID, req.OneTimeToken, 2, requestAt); err != nil {
-		if err == ErrInvalidToken {
-			return errorResponse(c, http.StatusBadRequest, err)
+	gachaInfo, err := h.getActiveGacha(ctx, c.Request().Header.Get("x-master-version"), gachaID, requestAt)
+	if err != nil {
+		if err == ErrGachaNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	if err = h.checkViewerID(userID, req.ViewerID); err != nil {
-		if err == ErrUserDeviceNotFound {
+	gachaItemList, cumulative, err := h.getGachaItems(ctx, gachaID)
+	if err != nil {
+		if err == ErrGachaItemNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	card := new(TargetUserCardData)
-	query := `
-	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level
-	FROM user_cards as uc
-	INNER JOIN item_masters as im ON uc.card_id = im.id
-	WHERE uc.id = ? AND uc.user_id=?
-	`
-	if err = h.getDBForUserID(userID).Get(card, query, cardID, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, err)
+	ceiling := gachaPityCeiling(gachaInfo)
+	var pity int
+	if ceiling > 0 {
+		query := "SELECT count FROM user_gacha_pities WHERE user_id=? AND gacha_id=?"
+		if err = h.getDBForUserID(userID).GetContext(ctx, &pity, query, userID, gachaID); err != nil && err != sql.ErrNoRows {
+			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	effective, guaranteed := effectiveCumulativeWeights(gachaItemList, cumulative, pity, ceiling)
 
-	if card.Level == card.MaxLevel {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("target card is max level"))
+	return successResponse(c, &GachaOddsResponse{
+		GachaID:        gachaID,
+		TotalWeight:    totalWeight(effective),
+		PityCeiling:    ceiling,
+		PityCount:      pity,
+		PityGuaranteed: guaranteed,
+		Odds:           gachaOdds(gachaItemList, effective),
+	})
+}
+
+// gachaOdds weightの累積和から各アイテムの排出確率を求める
+// 累積和の差分がそのアイテムの当選区間の幅になるため、selectGachaItemsの抽選結果と一致する
+func gachaOdds(items []*GachaItemMaster, cumulative []int64) []*GachaItemOdds {
+	odds := make([]*GachaItemOdds, 0, len(items))
+	sum := totalWeight(cumulative)
+	if sum <= 0 || len(items) != len(cumulative) {
+		return odds
+	}
+
+	var prev int64
+	for i, item := range items {
+		odds = append(odds, &GachaItemOdds{
+			GachaItemID: item.ID,
+			ItemType:    item.ItemType,
+			ItemID:      item.ItemID,
+			Amount:      item.Amount,
+			Weight:      cumulative[i] - prev,
+			Probability: float64(cumulative[i]-prev) / float64(sum),
+		})
+		prev = cumulative[i]
 	}
+	return odds
+}
 
-	items := make([]*ConsumeUserItemData, 0)
-	query = `
-	SELECT ui.id, ui.user_id, ui.item_id, ui.item_type, ui.amount, ui.created_at, ui.updated_at, im.gained_exp
-	FROM user_items as ui
-	INNER JOIN item_masters as im ON ui.item_id = im.id
-	WHERE ui.item_type = 3 AND ui.id=? AND ui.user_id=?
-	`
-	for _, v := range req.Items {
-		item := new(ConsumeUserItemData)
-		if err = h.getDBForUserID(userID).Get(item, query, v.ID, userID); err != nil {
-			if err == sql.ErrNoRows {
-				return errorResponse(c, http.StatusNotFound, err)
-			}
-			return errorResponse(c, http.StatusInternalServerError, err)
+type GachaOddsResponse struct {
+	GachaID     int64 `json:"gachaId"`
+	TotalWeight int64 `json:"totalWeight"`
+	// PityCeiling 天井の回数。天井がない場合は0
+	PityCeiling int `json:"pityCeiling"`
+	// PityCount レアのアイテムが出ないまま続いた抽選の回数
+	PityCount int `json:"pityCount"`
+	// PityGuaranteed 次の1回が天井で、レアのアイテムだけから抽選されるか
+	PityGuaranteed bool             `json:"pityGuaranteed"`
+	Odds           []*GachaItemOdds `json:"odds"`
+}
+
+type GachaItemOdds struct {
+	GachaItemID int64   `json:"gachaItemId"`
+	ItemType    int     `json:"itemType"`
+	ItemID      int64   `json:"itemId"`
+	Amount      int     `json:"amount"`
+	Weight      int64   `json:"weight"`
+	Probability float64 `json:"probability"`
+}
+
+// getGachaItems ガチャアイテムとweightの累積和を取得する（キャッシュ活用）
+func (h *Handler) getGachaItems(ctx context.Context, gachaID int64) ([]*GachaItemMaster, []int64, error) {
+	// キャッシュからガチャアイテムを取得
+	gachaItemList, cumulative, cached := h.Cache.GetGachaItems(gachaID)
+	if cached {
+		return gachaItemList, cumulative, nil
+	}
+
+	// キャッシュにない場合はDBから取得
+	v, err := h.loadMaster(ctx, fmt.Sprintf("gacha_items:%d", gachaID), func(ctx context.Context) (interface{}, error) {
+		gachaItemList := make([]*GachaItemMaster, 0)
+		if err := h.DB.SelectContext(ctx, &gachaItemList, "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC", gachaID); err != nil {
+			return nil, err
+		}
+		if len(gachaItemList) == 0 {
+			return nil, ErrGachaItemNotFound
 		}
 
-		if v.Amount > item.Amount {
-			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+		// キャッシュに保存。抽選できないガチャはエラーになる
+		if err := h.Cache.SetGachaItems(gachaID, gachaItemList); err != nil {
+			return nil, err
 		}
-		item.ConsumeAmount = v.Amount
-		items = append(items, item)
+		return gachaItemList, nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	gachaItemList = v.([]*GachaItemMaster)
 
-	for _, v := range items {
-		card.TotalExp += v.GainedExp * v.ConsumeAmount
-	}
+	return gachaItemList, cumulativeWeights(gachaItemList), nil
+}
 
-	// lv up判定(lv upしたら生産性を加算)
-	for {
-		nextLvThreshold := int(float64(card.BaseExpPerLevel) * math.Pow(1.2, float64(card.Level-1)))
-		if nextLvThreshold > card.TotalExp {
-			break
+// validateGachaItems ガチャアイテムのweightを検証する
+// weightが0のアイテムは表示のみ(抽選されない)として許容するが、負のweightや全アイテムのweightが0のガチャは抽選できないためエラーとする
+// ピックアップの百分率も負の場合はエラーとし、ピックアップを反映したweightの合計で抽選できるか判定する
+func validateGachaItems(items []*GachaItemMaster) error {
+	var sum int64
+	for _, item := range items {
+		if item.Weight < 0 || (item.RateUpPercent != nil && *item.RateUpPercent < 0) {
+			return ErrInvalidGachaWeight
 		}
+		sum += gachaItemWeight(item)
+	}
+	if sum == 0 {
+		return ErrInvalidGachaWeight
+	}
+	return nil
+}
 
-		// lv up処理
-		card.Level += 1
-		card.AmountPerSec += (card.MaxAmountPerSec - card.BaseAmountPerSec) / (card.MaxLevel - 1)
+// gachaItemWeight ピックアップを反映した抽選に使うweight。百分率の端数を出さないよう、weightに百分率をそのまま掛ける
+func gachaItemWeight(item *GachaItemMaster) int64 {
+	rateUp := int64(100)
+	if item.RateUpPercent != nil {
+		rateUp = int64(*item.RateUpPercent)
 	}
+	return int64(item.Weight) * rateUp
+}
 
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
+// isRareGachaItem 天井の対象のレアなアイテムか
+func isRareGachaItem(item *GachaItemMaster) bool {
+	return item.IsRare != nil && *item.IsRare
+}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+// gachaPityCeiling ガチャの天井の回数。天井がない場合は0
+func gachaPityCeiling(gacha *GachaMaster) int {
+	if gacha.PityCeiling == nil || *gacha.PityCeiling <= 0 {
+		return 0
 	}
+	return *gacha.PityCeiling
+}
 
-	defer tx.Rollback() //nolint:errcheck
-
-	query = "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
-	if _, err = tx.Exec(query, card.AmountPerSec, card.Level, card.TotalExp, requestAt, card.ID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+// cumulativeWeights ガチャアイテムのweightの累積和を求める
+func cumulativeWeights(items []*GachaItemMaster) []int64 {
+	cumulative := make([]int64, len(items))
+	var sum int64
+	for i, item := range items {
+		sum += gachaItemWeight(item)
+		cumulative[i] = sum
 	}
+	return cumulative
+}
 
-	query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
-	for _, v := range items {
-		if _, err = tx.Exec(query, v.Amount-v.ConsumeAmount, requestAt, v.ID); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
+// pityCumulativeWeights 天井に達した回の抽選に使う、レアのアイテムだけのweightの累積和
+// 添字をitemsと揃えるため、レアでないアイテムはweightを0として含める
+func pityCumulativeWeights(items []*GachaItemMaster) []int64 {
+	cumulative := make([]int64, len(items))
+	var sum int64
+	for i, item := range items {
+		if isRareGachaItem(item) {
+			sum += gachaItemWeight(item)
 		}
+		cumulative[i] = sum
 	}
+	return cumulative
+}
 
-	resultCard := new(UserCard)
-	query = "SELECT * FROM user_cards WHERE id=?"
-	if err = tx.Get(resultCard, query, card.ID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found card"))
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
+// effectiveCumulativeWeights 天井のカウントがpityのユーザーが次の1回で使う累積和
+// 天井の直前(ceiling-1回続けてレアが出ていない)であればレアのアイテムだけから抽選する。抽選できるレアのアイテムがない場合は通常どおり
+func effectiveCumulativeWeights(items []*GachaItemMaster, cumulative []int64, pity, ceiling int) ([]int64, bool) {
+	if ceiling <= 0 || pity < ceiling-1 {
+		return cumulative, false
 	}
-	resultItems := make([]*UserItem, 0)
-	for _, v := range items {
-		resultItems = append(resultItems, &UserItem{
-			ID:        v.ID,
-			UserID:    v.UserID,
-			ItemID:    v.ItemID,
-			ItemType:  v.ItemType,
-			Amount:    v.Amount - v.ConsumeAmount,
-			CreatedAt: v.CreatedAt,
-			UpdatedAt: requestAt,
-		})
+	pityCumulative := pityCumulativeWeights(items)
+	if totalWeight(pityCumulative) <= 0 {
+		return cumulative, false
+	}
+	return pityCumulative, true
+}
+
+// totalWeight weightの累積和から合計値を求める
+func totalWeight(cumulative []int64) int64 {
+	if len(cumulative) == 0 {
+		return 0
 	}
+	return cumulative[len(cumulative)-1]
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+// selectGachaItems weightの累積和に応じてガチャアイテムをn回抽選する
+// 乱数以外の状態を持たないため、rngのseedを固定すれば結果は決定的になる
+// weightが0のアイテムは累積和が直前のアイテムと同じになるため、抽選されることはない
+// 結果をすべて保持するため、件数だけが必要な場合はeachGachaItemを使う
+func selectGachaItems(items []*GachaItemMaster, cumulative []int64, n int, rng *rand.Rand) []*GachaItemMaster {
+	sum := totalWeight(cumulative)
+	if sum <= 0 || len(items) != len(cumulative) {
+		return []*GachaItemMaster{}
 	}
 
-	return successResponse(c, &AddExpToCardResponse{
-		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, []*UserCard{resultCard}, nil, resultItems, nil, nil),
+	result := make([]*GachaItemMaster, 0, n)
+	eachGachaItem(items, cumulative, n, rng, func(item *GachaItemMaster) {
+		result = append(result, item)
 	})
+	return result
 }
 
-type AddExpToCardRequest struct {
-	ViewerID     string         `json:"viewerId"`
-	OneTimeToken string         `json:"oneTimeToken"`
-	Items        []*ConsumeItem `json:"items"`
+// eachGachaItem selectGachaItemsと同じ抽選をn回行い、当選したアイテムを1件ずつfnに渡す
+// 抽選結果を保持しないため、シミュレーションなどnが大きい場合もメモリはnによらない
+func eachGachaItem(items []*GachaItemMaster, cumulative []int64, n int, rng *rand.Rand, fn func(item *GachaItemMaster)) {
+	sum := totalWeight(cumulative)
+	if sum <= 0 || len(items) != len(cumulative) {
+		return
+	}
+	for i := 0; i < n; i++ {
+		fn(items[pickGachaItem(cumulative, sum, rng)])
+	}
 }
 
-type AddExpToCardResponse struct {
-	UpdatedResources *UpdatedResource `json:"updatedResources"`
+// pickGachaItem 累積和から1つ抽選し、当選したアイテムの添字を返す。sumは累積和の合計で、正であること
+func pickGachaItem(cumulative []int64, sum int64, rng *rand.Rand) int {
+	random := rng.Int63n(sum)
+	// random < cumulative[idx] となる最初のアイテムが当選
+	return sort.Search(len(cumulative), func(j int) bool {
+		return random < cumulative[j]
+	})
 }
 
-type ConsumeItem struct {
-	ID     int64 `json:"id"`
-	Amount int   `json:"amount"`
+// selectGachaItemsWithPity 天井のカウントをpityから進めながらn回抽選し、抽選結果と抽選後のカウントを返す
+// レアのアイテムが出た回でカウントは0に戻る。天井がない場合(ceiling=0)はselectGachaItemsと同じ
+func selectGachaItemsWithPity(items []*GachaItemMaster, cumulative []int64, n, pity, ceiling int, rng *rand.Rand) ([]*GachaItemMaster, int) {
+	if ceiling <= 0 {
+		return selectGachaItems(items, cumulative, n, rng), pity
+	}
+
+	result := make([]*GachaItemMaster, 0, n)
+	sum := totalWeight(cumulative)
+	if sum <= 0 || len(items) != len(cumulative) {
+		return result, pity
+	}
+	pityCumulative := pityCumulativeWeights(items)
+	pitySum := totalWeight(pityCumulative)
+
+	for i := 0; i < n; i++ {
+		var idx int
+		if pitySum > 0 && pity >= ceiling-1 {
+			idx = pickGachaItem(pityCumulative, pitySum, rng)
+		} else {
+			idx = pickGachaItem(cumulative, sum, rng)
+		}
+		result = append(result, items[idx])
+		if isRareGachaItem(items[idx]) {
+			pity = 0
+		} else {
+			pity++
+		}
+	}
+	return result, pity
 }
 
-type ConsumeUserItemData struct {
-	ID        int64 `db:"id"`
+// loadGachaPity 天井のあるガチャで、ユーザーの天井のカウントを抽選が終わるまでロックして読む。天井がない場合や未抽選の場合は0
+func loadGachaPity(tx *sqlx.Tx, userID int64, gacha *GachaMaster) (int, error) {
+	if gachaPityCeiling(gacha) == 0 {
+		return 0, nil
+	}
+	var pity int
+	query := "SELECT count FROM user_gacha_pities WHERE user_id=? AND gacha_id=? FOR UPDATE"
+	if err := tx.Get(&pity, query, userID, gacha.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return pity, nil
+}
+
+// drawGachaItems 天井のカウントをpityから進めながらn回抽選し、天井のあるガチャは抽選後のカウントを保存する
+func drawGachaItems(tx *sqlx.Tx, userID int64, gacha *GachaMaster, items []*GachaItemMaster, cumulative []int64, n, pity int, requestAt int64) ([]*GachaItemMaster, error) {
+	ceiling := gachaPityCeiling(gacha)
+	rng := acquireRand()
+	result, pityAfter := selectGachaItemsWithPity(items, cumulative, n, pity, ceiling, rng)
+	releaseRand(rng)
+
+	if ceiling > 0 {
+		query := "INSERT INTO user_gacha_pities(user_id, gacha_id, count, updated_at) VALUES (?, ?, ?, ?)" +
+			" ON DUPLICATE KEY UPDATE count=VALUES(count), updated_at=VALUES(updated_at)"
+		if _, err := tx.Exec(query, userID, gacha.ID, pityAfter, requestAt); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// randPool 抽選用の乱数生成器のプール。*rand.Randはgoroutine safeではないため使い回す際はプールから取得する
+var randPool = sync.Pool{
+	New: func() interface{} {
+		return rand.New(rand.NewSource(rand.Int63()))
+	},
+}
+
+// acquireRand プールから乱数生成器を取得する
+func acquireRand() *rand.Rand {
+	return randPool.Get().(*rand.Rand)
+}
+
+// releaseRand 乱数生成器をプールに戻す
+func releaseRand(rng *rand.Rand) {
+	randPool.Put(rng)
+}
+
+type DrawGachaRequest struct {
+	ViewerID     string `json:"viewerId"`
+	OneTimeToken string `json:"oneTimeToken"`
+	// DirectGrant trueの場合は抽選結果をプレゼントボックスを経由せずに直接付与する
+	DirectGrant bool `json:"directGrant"`
+}
+
+type DrawGachaResponse struct {
+	Presents []*UserPresent `json:"presents"`
+	DrawID   int64          `json:"drawId"`
+	// AnimationSeed 抽選結果の演出用のシード。抽選ごとに決まり、同じ抽選には同じ値を返す
+	AnimationSeed string `json:"animationSeed,omitempty"`
+	// UpdatedResources 直接付与した場合のみ、付与後のユーザー・カード・アイテムを返す
+	UpdatedResources *UpdatedResource `json:"updatedResources,omitempty"`
+	// GrantClamps 直接付与した場合のみ、所持上限により付与を切り詰めたかどうかを返す
+	GrantClamps
+}
+
+// listPresent プレゼント一覧
+// GET /user/{userID}/present/index/{n}
+func (h *Handler) listPresent(c echo.Context) error {
+	ctx := dbContext(c)
+
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid index number (n) parameter"))
+	}
+	if n == 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("index number (n) should be more than or equal to 1"))
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid userID parameter"))
+	}
+
+	offset := PresentCountPerPage * (n - 1)
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	presentList := []*UserPresent{}
+	query := `
+	SELECT * FROM user_presents 
+	WHERE user_id = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?`
+	if err = db.SelectContext(ctx, &presentList, query, userID, PresentCountPerPage, offset); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = h.fillPresentDisplayAmounts(ctx, presentList); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	var presentCount int
+	if err = db.GetContext(ctx, &presentCount, "SELECT COUNT(*) FROM user_presents WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	isNext := false
+	if presentCount > (offset + PresentCountPerPage) {
+		isNext = true
+	}
+
+	return successResponse(c, &ListPresentResponse{
+		Presents: presentList,
+		IsNext:   isNext,
+	})
+}
+
+type ListPresentResponse struct {
+	Presents []*UserPresent `json:"presents"`
+	IsNext   bool           `json:"isNext"`
+}
+
+// listPresentAll 配布期間中の全員プレゼント一覧
+// 受け取り済みかどうかを合わせて返す。付与はloginで行うため、ここでは付与しない
+// GET /user/{userID}/present-all
+func (h *Handler) listPresentAll(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	presentAlls, err := h.getActivePresentAlls(ctx, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	received := make(map[int64]bool, len(presentAlls))
+	if len(presentAlls) > 0 {
+		presentAllIDs := make([]int64, 0, len(presentAlls))
+		for _, v := range presentAlls {
+			presentAllIDs = append(presentAllIDs, v.ID)
+		}
+		query := "SELECT present_all_id FROM user_present_all_received_history WHERE user_id=? AND present_all_id IN (?)"
+		query, params, err := sqlx.In(query, userID, presentAllIDs)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		receivedIDs := make([]int64, 0)
+		if err = h.getDBForUserID(userID).SelectContext(ctx, &receivedIDs, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		for _, id := range receivedIDs {
+			received[id] = true
+		}
+	}
+
+	list := make([]*PresentAllData, 0, len(presentAlls))
+	for _, v := range presentAlls {
+		list = append(list, &PresentAllData{
+			PresentAll: v,
+			Received:   received[v.ID],
+		})
+	}
+
+	return successResponse(c, &ListPresentAllResponse{
+		PresentAlls: list,
+	})
+}
+
+// getActivePresentAlls 配布期間中の全員プレゼントマスタを取得する（キャッシュ活用）
+func (h *Handler) getActivePresentAlls(ctx context.Context, requestAt int64) ([]*PresentAllMaster, error) {
+	if active, ok := h.Cache.GetActivePresentAlls(requestAt); ok {
+		return active, nil
+	}
+
+	v, err := h.loadMaster(ctx, "present_alls", func(ctx context.Context) (interface{}, error) {
+		presentAlls := make([]*PresentAllMaster, 0)
+		if err := h.DB.SelectContext(ctx, &presentAlls, "SELECT * FROM present_all_masters ORDER BY id"); err != nil {
+			return nil, err
+		}
+		h.Cache.SetPresentAlls(presentAlls)
+		return presentAlls, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return filterActivePresentAlls(v.([]*PresentAllMaster), requestAt), nil
+}
+
+type PresentAllData struct {
+	PresentAll *PresentAllMaster `json:"presentAll"`
+	Received   bool              `json:"received"`
+}
+
+type ListPresentAllResponse struct {
+	PresentAlls []*PresentAllData `json:"presentAlls"`
+}
+
+// receivePresent プレゼント受け取り
+// POST /user/{userID}/present/receive
+func (h *Handler) receivePresent(c echo.Context) error {
+	ctx := dbContext(c)
+
+	defer c.Request().Body.Close()
+	req := new(ReceivePresentRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if len(req.PresentIDs) == 0 {
+		return errorResponse(c, http.StatusUnprocessableEntity, fmt.Errorf("presentIds is empty"))
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	// 未取得のプレゼント取得
+	// 他のユーザーのプレゼントIDが含まれていても、存在しないプレゼントと同じく無視する
+	query := "SELECT * FROM user_presents WHERE id IN (?) AND user_id=? AND deleted_at IS NULL"
+	query, params, err := sqlx.In(query, req.PresentIDs, userID)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	obtainPresent := []*UserPresent{}
+	if err = db.SelectContext(ctx, &obtainPresent, query, params...); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	// 付与数が0以下のプレゼントは受け取らずに残し、failedPresentsとして返す
+	failedPresents := make([]*FailedPresent, 0)
+	validPresents := make([]*UserPresent, 0, len(obtainPresent))
+	for _, p := range obtainPresent {
+		if p.Amount <= 0 {
+			c.Logger().Warnf("skip present with invalid amount: presentID=%d, userID=%d, amount=%d", p.ID, userID, p.Amount)
+			failedPresents = append(failedPresents, &FailedPresent{
+				PresentID: p.ID,
+				Reason:    ErrInvalidPresentAmount.Error(),
+			})
+			continue
+		}
+		validPresents = append(validPresents, p)
+	}
+	obtainPresent = validPresents
+
+	if len(obtainPresent) == 0 {
+		return successResponse(c, &ReceivePresentResponse{
+			UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, nil, nil, nil, []*UserPresent{}),
+			FailedPresents:   failedPresents,
+		})
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	for i := range obtainPresent {
+		if obtainPresent[i].DeletedAt != nil {
+			return errorResponse(c, http.StatusInternalServerError, fmt.Errorf("received present"))
+		}
+	}
+
+	// 大量のプレゼントを一度に受け取る場合は、ロックを長時間保持しないよう一定件数ごとに分けてコミットする
+	chunkSize := len(obtainPresent)
+	if len(obtainPresent) > presentReceiveChunkThreshold && presentReceiveChunkSize > 0 {
+		chunkSize = presentReceiveChunkSize
+	}
+
+	received := make([]*UserPresent, 0, len(obtainPresent))
+	var clamps GrantClamps
+	for chunk, start := 0, 0; start < len(obtainPresent); chunk, start = chunk+1, start+chunkSize {
+		end := start + chunkSize
+		if end > len(obtainPresent) {
+			end = len(obtainPresent)
+		}
+
+		presents, held, obtained, err := h.receivePresentChunk(ctx, db, userID, obtainPresent[start:end], requestAt)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if err == ErrUserNotFound || err == ErrItemNotFound {
+				code = http.StatusNotFound
+			}
+			if err == ErrInvalidItemType {
+				code = http.StatusBadRequest
+			}
+			if len(received) == 0 {
+				return errorResponse(c, code, err)
+			}
+			// 一部のチャンクは既にコミット済みなので、どこまで受け取れたかを返す
+			return receivePresentPartialFailureResponse(c, code, err, chunk, requestAt, received)
+		}
+		received = append(received, presents...)
+		for _, p := range held {
+			failedPresents = append(failedPresents, &FailedPresent{
+				PresentID: p.ID,
+				Reason:    ErrOverflowPresentHeld.Error(),
+			})
+		}
+		clamps.merge(obtained.Clamps)
+	}
+
+	return successResponse(c, &ReceivePresentResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, nil, nil, nil, received),
+		FailedPresents:   failedPresents,
+		GrantClamps:      clamps,
+	})
+}
+
+// receivePresentChunk プレゼントを受け取り済みにしてアイテムを付与し、1つのトランザクションとしてコミットする
+// 受け取ったプレゼントと、所持上限に空きがないため受け取らずに残したプレゼントを返す
+func (h *Handler) receivePresentChunk(ctx context.Context, db *sqlx.DB, userID int64, presents []*UserPresent, requestAt int64) ([]*UserPresent, []*UserPresent, *ObtainedItems, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	presents, held, err := h.holdOverflowPresents(ctx, tx, userID, presents)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(presents) == 0 {
+		return presents, held, &ObtainedItems{}, nil
+	}
+
+	// プレゼントの削除処理をバッチ化
+	presentIDs := make([]int64, len(presents))
+	for i := range presents {
+		presentIDs[i] = presents[i].ID
+	}
+
+	// プレゼントを一括で削除済みにマーク
+	query := "UPDATE user_presents SET deleted_at=?, updated_at=? WHERE id IN (?) AND user_id=?"
+	query, params, err := sqlx.In(query, requestAt, requestAt, presentIDs, userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err = tx.Exec(query, params...); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// アイテム付与処理をバッチ化
+	obtained, err := h.obtainItemsBatch(ctx, tx, presents, userID, requestAt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// コミットできたものだけ受け取り済みとして返す
+	for i := range presents {
+		presents[i].UpdatedAt = requestAt
+		presents[i].DeletedAt = &requestAt
+	}
+
+	return presents, held, obtained, nil
+}
+
+// holdOverflowPresents 所持上限を超えた分として送ったプレゼントのうち、上限に空きがないため受け取れないものを分ける
+// 上限に達したまま受け取ると、付与しきれなかった分が同じプレゼントとして作り直されるだけで受け取りが終わらないため、
+// 空きができるまで受け取らずに残す。受け取るプレゼントと残すプレゼントを返す
+func (h *Handler) holdOverflowPresents(ctx context.Context, tx *sqlx.Tx, userID int64, presents []*UserPresent) ([]*UserPresent, []*UserPresent, error) {
+	coinFull := false
+	checkedCoin := false
+	fullItems := make(map[int64]bool)
+	for _, p := range presents {
+		switch {
+		case p.Source == PresentSourceCoinOverflow && !checkedCoin:
+			var currentCoin int64
+			if err := tx.GetContext(ctx, &currentCoin, "SELECT isu_coin FROM users WHERE id=? FOR UPDATE", userID); err != nil {
+				if err == sql.ErrNoRows {
+					return nil, nil, ErrUserNotFound
+				}
+				return nil, nil, err
+			}
+			_, overflow := capCoin(currentCoin, 1)
+			coinFull, checkedCoin = overflow > 0, true
+
+		case p.Source == PresentSourceItemOverflow:
+			if _, ok := fullItems[p.ItemID]; ok {
+				continue
+			}
+			item, err := h.getItemMaster(ctx, p.ItemID)
+			if err != nil {
+				return nil, nil, err
+			}
+			var current int64
+			query := "SELECT amount FROM user_items WHERE user_id=? AND item_id=? FOR UPDATE"
+			if err := tx.GetContext(ctx, &current, query, userID, p.ItemID); err != nil && err != sql.ErrNoRows {
+				return nil, nil, err
+			}
+			_, overflow := capItemAmount(item, current, 1)
+			fullItems[p.ItemID] = overflow > 0
+		}
+	}
+
+	receivable, held := splitOverflowPresents(presents, coinFull, fullItems)
+	return receivable, held, nil
+}
+
+// splitOverflowPresents 所持上限を超えた分として送ったプレゼントのうち、上限に空きがないものを残すプレゼントとして分ける
+// fullItemsは所持数が上限に達している強化素材のitem_id
+func splitOverflowPresents(presents []*UserPresent, coinFull bool, fullItems map[int64]bool) ([]*UserPresent, []*UserPresent) {
+	receivable := make([]*UserPresent, 0, len(presents))
+	held := make([]*UserPresent, 0)
+	for _, p := range presents {
+		if (p.Source == PresentSourceCoinOverflow && coinFull) || (p.Source == PresentSourceItemOverflow && fullItems[p.ItemID]) {
+			held = append(held, p)
+			continue
+		}
+		receivable = append(receivable, p)
+	}
+	return receivable, held
+}
+
+// receivePresentPartialFailureResponse 途中のチャンクで失敗した場合のレスポンス
+// failedChunkより前のチャンクはコミット済みで、その分のプレゼントはupdatedResourcesに含まれる
+func receivePresentPartialFailureResponse(c echo.Context, statusCode int, err error, failedChunk int, requestAt int64, received []*UserPresent) error {
+	c.Logger().Errorf("status=%d, failedChunk=%d, received=%d, err=%+v", statusCode, failedChunk, len(received), errors.WithStack(err))
+
+	return c.JSON(statusCode, &ReceivePresentPartialFailureResponse{
+		StatusCode:       statusCode,
+		Message:          err.Error(),
+		Code:             responseErrorCode(c, statusCode, err),
+		FailedChunk:      failedChunk,
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, nil, nil, nil, received),
+	})
+}
+
+type ReceivePresentRequest struct {
+	ViewerID   string  `json:"viewerId"`
+	PresentIDs []int64 `json:"presentIds"`
+}
+
+type ReceivePresentResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+	FailedPresents   []*FailedPresent `json:"failedPresents,omitempty"`
+	GrantClamps
+}
+
+// FailedPresent 受け取れなかったプレゼントと理由
+type FailedPresent struct {
+	PresentID int64  `json:"presentId"`
+	Reason    string `json:"reason"`
+}
+
+type ReceivePresentPartialFailureResponse struct {
+	StatusCode       int              `json:"status_code"`
+	Message          string           `json:"message"`
+	Code             string           `json:"code,omitempty"`
+	FailedChunk      int              `json:"failedChunk"`
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
+
+// checkPresents プレゼントを受け取れるかの確認
+// POST /user/{userID}/present/check
+// 受け取りボタンを出す前に、指定したプレゼントがまだ受け取れるかをまとめて確認する。何も更新しない
+// 他のユーザーのプレゼントは、同じシャードにある場合のみwrong_ownerとなり、それ以外はnot_foundとなる
+// プレゼントには期限がないため、期限切れという状態はない
+// 受け取り済みのプレゼントは保持期間(ISUCON_RECEIVED_PRESENT_RETENTION_SEC)を過ぎると POST /admin/purge で物理削除され、receivedではなくnot_foundとなる
+func (h *Handler) checkPresents(c echo.Context) error {
+	ctx := dbContext(c)
+
+	defer c.Request().Body.Close()
+	req := new(CheckPresentsRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	if len(req.PresentIDs) == 0 {
+		return errorResponse(c, http.StatusUnprocessableEntity, fmt.Errorf("presentIds is empty"))
+	}
+	if len(req.PresentIDs) > PresentCheckMaxCount {
+		return errorResponse(c, http.StatusUnprocessableEntity, fmt.Errorf("too many presentIds: max=%d", PresentCheckMaxCount))
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM user_presents WHERE id IN (?)", req.PresentIDs)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	presents := make([]*UserPresent, 0, len(req.PresentIDs))
+	if err = h.getDBForUserID(userID).SelectContext(ctx, &presents, query, params...); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	presentMap := make(map[int64]*UserPresent, len(presents))
+	for _, p := range presents {
+		presentMap[p.ID] = p
+	}
+
+	// リクエストの順で、重複したIDは1つにまとめて返す
+	statuses := make([]*PresentStatus, 0, len(req.PresentIDs))
+	seen := make(map[int64]bool, len(req.PresentIDs))
+	for _, id := range req.PresentIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		statuses = append(statuses, &PresentStatus{
+			PresentID: id,
+			Status:    presentStatus(presentMap[id], userID),
+		})
+	}
+
+	return successResponse(c, &CheckPresentsResponse{
+		Presents: statuses,
+	})
+}
+
+// presentStatus プレゼントをuserIDのユーザーが受け取れるかどうか
+// receivePresentで受け取れないものと同じ条件で判定する
+func presentStatus(p *UserPresent, userID int64) string {
+	switch {
+	case p == nil:
+		return PresentStatusNotFound
+	case p.UserID != userID:
+		return PresentStatusWrongOwner
+	case p.DeletedAt != nil:
+		return PresentStatusReceived
+	case p.Amount <= 0:
+		return PresentStatusInvalidAmount
+	default:
+		return PresentStatusClaimable
+	}
+}
+
+const (
+	PresentStatusClaimable     string = "claimable"
+	PresentStatusReceived      string = "received"
+	PresentStatusNotFound      string = "not_found"
+	PresentStatusWrongOwner    string = "wrong_owner"
+	PresentStatusInvalidAmount string = "invalid_amount"
+)
+
+type CheckPresentsRequest struct {
+	ViewerID   string  `json:"viewerId"`
+	PresentIDs []int64 `json:"presentIds"`
+}
+
+type CheckPresentsResponse struct {
+	Presents []*PresentStatus `json:"presents"`
+}
+
+type PresentStatus struct {
+	PresentID int64  `json:"presentId"`
+	Status    string `json:"status"`
+}
+
+// getNetworth 資産額の見積もり
+// 所持コインに、カードの生産性の合計とアイテムの所持数をそれぞれの価値で換算したものを加えて返す
+// 大量にカードやアイテムを持つユーザーでも行を読み込まないよう、シャード上でSQLで集計する
+// GET /user/{userID}/networth
+func (h *Handler) getNetworth(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	db := h.getDBForUserID(userID)
+
+	var coins int64
+	if err = db.GetContext(ctx, &coins, "SELECT isu_coin FROM users WHERE id=?", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	cards := new(networthCards)
+	query := "SELECT COUNT(*) AS card_count, COALESCE(SUM(amount_per_sec), 0) AS total_amount_per_sec FROM user_cards WHERE user_id=? AND deleted_at IS NULL"
+	if err = db.GetContext(ctx, cards, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	items := make([]*networthItem, 0)
+	query = "SELECT item_id, COALESCE(SUM(amount), 0) AS amount FROM user_items WHERE user_id=? AND deleted_at IS NULL GROUP BY item_id"
+	if err = db.SelectContext(ctx, &items, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	cardValue := cards.TotalAmountPerSec * networthCardFactor
+	itemValue := int64(0)
+	for _, item := range items {
+		value, ok := networthItemValues[item.ItemID]
+		if !ok {
+			value = networthMaterialValue
+		}
+		itemValue += item.Amount * value
+	}
+
+	return successResponse(c, &NetworthResponse{
+		Coins:     coins,
+		CardCount: cards.CardCount,
+		CardValue: cardValue,
+		ItemValue: itemValue,
+		Total:     coins + cardValue + itemValue,
+	})
+}
+
+// networthCards 資産額の見積もりのためのカードの集計
+type networthCards struct {
+	CardCount         int64 `db:"card_count"`
+	TotalAmountPerSec int64 `db:"total_amount_per_sec"`
+}
+
+// networthItem 資産額の見積もりのためのアイテムごとの所持数
+type networthItem struct {
+	ItemID int64 `db:"item_id"`
+	Amount int64 `db:"amount"`
+}
+
+type NetworthResponse struct {
+	Coins     int64 `json:"coins"`
+	CardCount int64 `json:"cardCount"`
+	CardValue int64 `json:"cardValue"`
+	ItemValue int64 `json:"itemValue"`
+	Total     int64 `json:"total"`
+}
+
+// listItem アイテムリスト
+// ?fields=items,cards のように指定した場合は、指定したフィールドのみ返す。指定しなかった一覧は取得もしない
+// GET /user/{userID}/item
+func (h *Handler) listItem(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	fields, err := parseFieldsParam(c, &ListItemResponse{})
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	user := new(User)
+	query := "SELECT * FROM users WHERE id=?"
+	if err = db.GetContext(ctx, user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// アイテムの強化に使うためのワンタイムトークンを発行
+	if !h.TokenIssues.Allow(userID, time.Now()) {
+		return tooManyTokenIssuesResponse(c)
+	}
+	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err = db.ExecContext(ctx, query, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	tID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	tk, err := generateUUID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	token := &UserOneTimeToken{
+		ID:        tID,
+		UserID:    userID,
+		Token:     tk,
+		TokenType: 2,
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+		ExpiredAt: requestAt + 600,
+	}
+	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if err = h.retryOnIDCollision(func() error {
+		_, err := h.DB.ExecContext(ctx, query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt)
+		return err
+	}, &token.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// キャッシュにも保存
+	h.TokenCache.SetToken(token.Token, token.UserID, token.TokenType, token.ExpiredAt, token.CreatedAt)
+
+	// 所持数が多いユーザーでも全件をメモリに載せないよう、カーソルで読みながら逐次書き出す
+	// レスポンスヘッダを書き出した後はステータスを変更できないので、クエリはすべてヘッダ送出前に実行しておく
+	var itemRows, cardRows *sqlx.Rows
+	var fillItem func(item *UserItem) error
+	if fields == nil || fields["items"] {
+		fractions := make([]*UserItemFraction, 0)
+		if err = db.SelectContext(ctx, &fractions, "SELECT item_id, fraction FROM user_item_fractions WHERE user_id=?", userID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		fillItem = h.itemDisplayAmountFiller(ctx, fractions)
+
+		itemRows, err = db.QueryxContext(ctx, "SELECT * FROM user_items WHERE user_id = ?", userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		defer itemRows.Close()
+	}
+	if fields == nil || fields["cards"] {
+		cardRows, err = db.QueryxContext(ctx, "SELECT * FROM user_cards WHERE user_id=?", userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		defer cardRows.Close()
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	if err := writeListItemResponse(res, token.Token, user, itemRows, cardRows, fields, fillItem); err != nil {
+		// ヘッダ送出済みのためエラーレスポンスは返せない。途中までのJSONを200として受け取られないよう、接続を切って打ち切る
+		c.Logger().Errorf("failed to stream listItem response: userID=%d, err=%+v", userID, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// itemDisplayAmountFiller 端数単位のアイテムに、繰り越し中の端数を含めた表示用の所持数を設定する関数を返す
+func (h *Handler) itemDisplayAmountFiller(ctx context.Context, fractions []*UserItemFraction) func(item *UserItem) error {
+	fractionMap := make(map[int64]int64, len(fractions))
+	for _, f := range fractions {
+		fractionMap[f.ItemID] = f.Fraction
+	}
+	return func(item *UserItem) error {
+		scale, err := h.itemAmountScale(ctx, item.ItemType, item.ItemID)
+		if err != nil {
+			return err
+		}
+		if scale > 1 {
+			item.DisplayAmount = formatScaledAmount(int64(item.Amount)*scale+fractionMap[item.ItemID], scale)
+		}
+		return nil
+	}
+}
+
+// UserItemFraction 端数単位のアイテムの、繰り越し中の1未満の端数
+type UserItemFraction struct {
+	ItemID   int64 `db:"item_id"`
+	Fraction int64 `db:"fraction"`
+}
+
+// writeListItemResponse ListItemResponseと同じ形のJSONをwに逐次書き出す
+// fieldsがnilでない場合は、fieldsに含まれるフィールドのみ書き出す。items・cardsを含まない場合、itemRows・cardRowsはnilでよい
+// fillItemがnilでない場合は、書き出す前にアイテムごとに呼ぶ
+func writeListItemResponse(w io.Writer, token string, user *User, itemRows, cardRows *sqlx.Rows, fields map[string]bool, fillItem func(item *UserItem) error) error {
+	enc := json.NewEncoder(w)
+	include := func(name string) bool {
+		return fields == nil || fields[name]
+	}
+	sep := "{"
+	writeKey := func(name string) error {
+		_, err := io.WriteString(w, sep+`"`+name+`":`)
+		sep = ","
+		return err
+	}
+
+	if include("oneTimeToken") {
+		if err := writeKey("oneTimeToken"); err != nil {
+			return err
+		}
+		if err := enc.Encode(token); err != nil {
+			return err
+		}
+	}
+	if include("user") {
+		if err := writeKey("user"); err != nil {
+			return err
+		}
+		if err := enc.Encode(user); err != nil {
+			return err
+		}
+	}
+
+	if include("items") {
+		if err := writeKey("items"); err != nil {
+			return err
+		}
+		var fill func(dest interface{}) error
+		if fillItem != nil {
+			fill = func(dest interface{}) error { return fillItem(dest.(*UserItem)) }
+		}
+		if err := streamJSONArray(w, enc, itemRows, func() interface{} { return new(UserItem) }, fill); err != nil {
+			return err
+		}
+	}
+
+	if include("cards") {
+		if err := writeKey("cards"); err != nil {
+			return err
+		}
+		if err := streamJSONArray(w, enc, cardRows, func() interface{} { return new(UserCard) }, nil); err != nil {
+			return err
+		}
+	}
+
+	if sep == "{" {
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// streamJSONArray rowsを1行ずつnewDestで確保した構造体に読み込み、JSON配列としてwに書き出す
+// fillがnilでない場合は、読み込んだ構造体を書き出す前に渡す
+func streamJSONArray(w io.Writer, enc *json.Encoder, rows *sqlx.Rows, newDest func() interface{}, fill func(dest interface{}) error) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for first := true; rows.Next(); first = false {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		dest := newDest()
+		if err := rows.StructScan(dest); err != nil {
+			return err
+		}
+		if fill != nil {
+			if err := fill(dest); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(dest); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// ListItemResponse listItemのレスポンス
+// 実際のレスポンスはwriteListItemResponseで同じ形のJSONを逐次書き出している
+type ListItemResponse struct {
+	OneTimeToken string      `json:"oneTimeToken"`
+	User         *User       `json:"user"`
+	Items        []*UserItem `json:"items"`
+	Cards        []*UserCard `json:"cards"`
+}
+
+// exchangeItem アイテム交換
+// 強化素材をexchange_mastersのレートで別のアイテムに交換する
+// POST /user/{userID}/item/exchange
+func (h *Handler) exchangeItem(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(ExchangeItemRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	if req.Amount <= 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid exchange amount"))
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	exchange := new(ExchangeMaster)
+	query := "SELECT * FROM exchange_masters WHERE from_item_id=?"
+	if err = tx.Get(exchange, query, req.FromItemID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found exchange rate"))
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if exchange.FromAmount <= 0 || req.Amount%exchange.FromAmount != 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("amount must be a multiple of %d", exchange.FromAmount))
+	}
+
+	// 交換に使えるのは強化素材のみ。コインやカードを指すレートがあっても交換しない
+	fromMaster, err := h.getItemMaster(ctx, req.FromItemID)
+	if err != nil {
+		if err == ErrItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if !isEnhanceMaterial(fromMaster.ItemType) {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidItemType)
+	}
+
+	fromItem := new(UserItem)
+	query = "SELECT * FROM user_items WHERE user_id=? AND item_id=? FOR UPDATE"
+	if err = tx.Get(fromItem, query, userID, req.FromItemID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if fromItem.Amount < req.Amount {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+	}
+
+	fromItem.Amount -= req.Amount
+	fromItem.UpdatedAt = requestAt
+	query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, fromItem.Amount, fromItem.UpdatedAt, fromItem.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	obtainAmount := int64(req.Amount/exchange.FromAmount) * int64(exchange.ToAmount)
+	obtained, err := h.obtainItem(ctx, tx, userID, exchange.ToItemID, exchange.ToItemType, obtainAmount, requestAt)
+	if err != nil {
+		if err == ErrUserNotFound || err == ErrItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		if err == ErrInvalidItemType {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	user := new(User)
+	query = "SELECT * FROM users WHERE id=?"
+	if err = tx.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &ExchangeItemResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, user, nil, obtained.Cards, nil, append([]*UserItem{fromItem}, obtained.Items...), nil, nil),
+		GrantClamps:      obtained.Clamps,
+	})
+}
+
+type ExchangeItemRequest struct {
+	ViewerID   string `json:"viewerId"`
+	FromItemID int64  `json:"fromItemId"`
+	Amount     int    `json:"amount"`
+}
+
+type ExchangeItemResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+	GrantClamps
+}
+
+// useItem 時短アイテムの使用
+// 短縮時間分だけ最終リワード取得日時を巻き戻し、次回のリワード受け取りまでの待ち時間を短縮する
+// POST /user/{userID}/item/use/{itemID}
+func (h *Handler) useItem(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	itemID, err := strconv.ParseInt(c.Param("itemID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(UseItemRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Amount == 0 {
+		req.Amount = 1
+	}
+	if req.Amount < 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid use amount"))
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	item := new(UseUserItemData)
+	query := `
+	SELECT ui.id, ui.user_id, ui.item_id, ui.item_type, ui.amount, ui.created_at, ui.updated_at, im.shortening_min
+	FROM user_items as ui
+	INNER JOIN item_masters as im ON ui.item_id = im.id
+	WHERE ui.item_type = ? AND ui.item_id=? AND ui.user_id=?
+	FOR UPDATE
+	`
+	if err = tx.Get(item, query, ItemTypeEnhanceB, itemID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if item.ShorteningMin == nil || *item.ShorteningMin <= 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidItemType)
+	}
+	if item.Amount < req.Amount {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+	}
+
+	query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, item.Amount-req.Amount, requestAt, item.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	shorteningSec := *item.ShorteningMin * 60 * int64(req.Amount)
+	query = "UPDATE users SET last_getreward_at=last_getreward_at-?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, shorteningSec, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	user := new(User)
+	query = "SELECT * FROM users WHERE id=?"
+	if err = tx.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	resultItem := &UserItem{
+		ID:        item.ID,
+		UserID:    item.UserID,
+		ItemID:    item.ItemID,
+		ItemType:  item.ItemType,
+		Amount:    item.Amount - req.Amount,
+		CreatedAt: item.CreatedAt,
+		UpdatedAt: requestAt,
+	}
+
+	return successResponse(c, &UseItemResponse{
+		ShortenedSec:     shorteningSec,
+		PastTime:         requestAt - user.LastGetRewardAt,
+		UpdatedResources: makeUpdatedResources(requestAt, user, nil, nil, nil, []*UserItem{resultItem}, nil, nil),
+	})
+}
+
+type UseItemRequest struct {
+	ViewerID string `json:"viewerId"`
+	Amount   int    `json:"amount"`
+}
+
+type UseItemResponse struct {
+	ShortenedSec     int64            `json:"shortenedSec"`
+	PastTime         int64            `json:"pastTime"` // 短縮後の経過時間を秒単位で
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
+
+type UseUserItemData struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	ItemID        int64  `db:"item_id"`
+	ItemType      int    `db:"item_type"`
+	Amount        int    `db:"amount"`
+	CreatedAt     int64  `db:"created_at"`
+	UpdatedAt     int64  `db:"updated_at"`
+	ShorteningMin *int64 `db:"shortening_min"`
+}
+
+// addExpToCard 装備強化
+// POST /user/{userID}/card/addexp/{cardID}
+func (h *Handler) addExpToCard(c echo.Context) error {
+	ctx := dbContext(c)
+
+	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	// read body
+	defer c.Request().Body.Close()
+	req := new(AddExpToCardRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkOneTimeToken(ctx, userID, req.OneTimeToken, 2, requestAt); err != nil {
+		if isTokenError(err) {
+			return errorResponse(c, tokenErrorStatus(err), err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	card := new(TargetUserCardData)
+	query := `
+	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level, im.amount_growth_type, im.exp_growth_rate
+	FROM user_cards as uc
+	INNER JOIN item_masters as im ON uc.card_id = im.id
+	WHERE uc.id = ? AND uc.user_id=?
+	`
+	if err = h.getDBForUserID(userID).GetContext(ctx, card, query, cardID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if card.Level == card.MaxLevel {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("target card is max level"))
+	}
+
+	// 同じアイテムが複数回指定された場合は消費量を合算し、合計が所持数を超えないか確認する
+	consumeIDs := make([]int64, 0, len(req.Items))
+	consumeAmounts := make(map[int64]int, len(req.Items))
+	for _, v := range req.Items {
+		if _, ok := consumeAmounts[v.ID]; !ok {
+			consumeIDs = append(consumeIDs, v.ID)
+		}
+		consumeAmounts[v.ID] += v.Amount
+	}
+	if addExpMaxDistinctItems > 0 && len(consumeIDs) > addExpMaxDistinctItems {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("too many items: max=%d", addExpMaxDistinctItems))
+	}
+
+	// 強化には種別の異なる強化素材(ItemTypeEnhanceA・ItemTypeEnhanceB)を混ぜて使える
+	// 獲得経験値はアイテムごとのgained_expで、設定されていないアイテムは経験値0として消費する
+	items := make([]*ConsumeUserItemData, 0, len(consumeIDs))
+	if len(consumeIDs) > 0 {
+		query = `
+		SELECT ui.id, ui.user_id, ui.item_id, ui.item_type, ui.amount, ui.created_at, ui.updated_at, IFNULL(im.gained_exp, 0) as 'gained_exp'
+		FROM user_items as ui
+		INNER JOIN item_masters as im ON ui.item_id = im.id
+		WHERE ui.item_type IN (?, ?) AND ui.id IN (?) AND ui.user_id=?
+		`
+		query, params, err := sqlx.In(query, ItemTypeEnhanceA, ItemTypeEnhanceB, consumeIDs, userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		ownedItems := make([]*ConsumeUserItemData, 0, len(consumeIDs))
+		if err = h.getDBForUserID(userID).SelectContext(ctx, &ownedItems, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		ownedMap := make(map[int64]*ConsumeUserItemData, len(ownedItems))
+		for _, item := range ownedItems {
+			ownedMap[item.ID] = item
+		}
+
+		for _, id := range consumeIDs {
+			item, ok := ownedMap[id]
+			if !ok {
+				return errorResponse(c, http.StatusNotFound, sql.ErrNoRows)
+			}
+			if consumeAmounts[id] > item.Amount {
+				return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+			}
+			item.ConsumeAmount = consumeAmounts[id]
+			items = append(items, item)
+		}
+	}
+
+	// 種別に関わらず、アイテムごとの獲得経験値×消費量を合算する
+	for _, v := range items {
+		card.TotalExp += v.GainedExp * v.ConsumeAmount
+	}
+
+	// lv up判定(lv upしたら生産性を更新)
+	levelBefore := card.Level
+	levelUpCard(card)
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	query = "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, card.AmountPerSec, card.Level, card.TotalExp, requestAt, card.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if levelBefore < card.MaxLevel && card.Level == card.MaxLevel {
+		event := &CardMaxLevelEvent{UserCardID: card.ID, CardID: card.CardID, Level: card.Level, ReachedAt: requestAt}
+		if err = insertOutboxEvent(tx, EventTypeCardMaxLevel, &userID, event, requestAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
+	for _, v := range items {
+		if _, err = tx.Exec(query, v.Amount-v.ConsumeAmount, requestAt, v.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	resultCard := new(UserCard)
+	query = "SELECT * FROM user_cards WHERE id=?"
+	if err = tx.Get(resultCard, query, card.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found card"))
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	resultItems := make([]*UserItem, 0)
+	for _, v := range items {
+		resultItems = append(resultItems, &UserItem{
+			ID:        v.ID,
+			UserID:    v.UserID,
+			ItemID:    v.ItemID,
+			ItemType:  v.ItemType,
+			Amount:    v.Amount - v.ConsumeAmount,
+			CreatedAt: v.CreatedAt,
+			UpdatedAt: requestAt,
+		})
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if isMinimalResponse(c) {
+		return noContentResponse(c, http.StatusNoContent)
+	}
+
+	return successResponse(c, &AddExpToCardResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, []*UserCard{resultCard}, nil, resultItems, nil, nil),
+	})
+}
+
+type AddExpToCardRequest struct {
+	ViewerID     string         `json:"viewerId"`
+	OneTimeToken string         `json:"oneTimeToken"`
+	Items        []*ConsumeItem `json:"items"`
+}
+
+type AddExpToCardResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
+
+// CardMaxLevelEvent カードが最大レベルに達したイベントの内容
+type CardMaxLevelEvent struct {
+	UserCardID int64 `json:"userCardId"`
+	CardID     int64 `json:"cardId"`
+	Level      int   `json:"level"`
+	ReachedAt  int64 `json:"reachedAt"`
+}
+
+type ConsumeItem struct {
+	ID     int64 `json:"id"`
+	Amount int   `json:"amount"`
+}
+
+type ConsumeUserItemData struct {
+	ID        int64 `db:"id"`
 	UserID    int64 `db:"user_id"`
 	ItemID    int64 `db:"item_id"`
 	ItemType  int   `db:"item_type"`
@@ -2287,263 +5664,1535 @@ type ConsumeUserItemData struct {
 	UpdatedAt int64 `db:"updated_at"`
 	GainedExp int   `db:"gained_exp"`
 
-	ConsumeAmount int // 消費量
+	ConsumeAmount int // 消費量
+}
+
+type TargetUserCardData struct {
+	ID               int64 `db:"id"`
+	UserID           int64 `db:"user_id"`
+	CardID           int64 `db:"card_id"`
+	AmountPerSec     int   `db:"amount_per_sec"`
+	Level            int   `db:"level"`
+	TotalExp         int   `db:"total_exp"`
+	BaseAmountPerSec int   `db:"base_amount_per_sec"`
+	MaxLevel         int   `db:"max_level"`
+	MaxAmountPerSec  int   `db:"max_amount_per_sec"`
+	BaseExpPerLevel  int   `db:"base_exp_per_level"`
+
+	AmountGrowthType *int     `db:"amount_growth_type"`
+	ExpGrowthRate    *float64 `db:"exp_growth_rate"`
+}
+
+// levelUpCard 累計経験値に応じてカードのレベルと生産性を更新する
+func levelUpCard(card *TargetUserCardData) {
+	for card.Level < card.MaxLevel {
+		nextLvThreshold := calcLevelUpExp(card, card.Level)
+		if nextLvThreshold > card.TotalExp {
+			break
+		}
+
+		// lv up処理
+		card.Level += 1
+		card.AmountPerSec = calcAmountPerSec(card, card.Level)
+	}
+}
+
+// calcLevelUpExp 指定したレベルから次のレベルに上がるのに必要な累計経験値を計算する
+func calcLevelUpExp(card *TargetUserCardData, level int) int {
+	expGrowthRate := DefaultExpGrowthRate
+	if card.ExpGrowthRate != nil {
+		expGrowthRate = *card.ExpGrowthRate
+	}
+	return int(float64(card.BaseExpPerLevel) * math.Pow(expGrowthRate, float64(level-1)))
+}
+
+// calcAmountPerSec 指定したレベルでのカードの生産性を計算する
+// 端数は四捨五入し、max levelでは必ずmax_amount_per_secになる
+func calcAmountPerSec(card *TargetUserCardData, level int) int {
+	if level >= card.MaxLevel || card.MaxLevel <= 1 {
+		return card.MaxAmountPerSec
+	}
+	if level <= 1 {
+		return card.BaseAmountPerSec
+	}
+
+	progress := float64(level-1) / float64(card.MaxLevel-1)
+	base := float64(card.BaseAmountPerSec)
+	max := float64(card.MaxAmountPerSec)
+
+	if card.AmountGrowthType != nil && *card.AmountGrowthType == AmountGrowthTypeExponential && base > 0 && max > 0 {
+		return int(math.Round(base * math.Pow(max/base, progress)))
+	}
+	return int(math.Round(base + (max-base)*progress))
+}
+
+// getCardCurve 装備の強化曲線
+// 現在のレベルから最大レベルまで、各レベルに達するのに必要な累計経験値とその生産性を返す
+// levelUpCardと同じ計算を使うため、強化した結果と一致する
+// GET /user/{userID}/card/{cardID}/curve
+func (h *Handler) getCardCurve(c echo.Context) error {
+	ctx := dbContext(c)
+
+	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	card := new(TargetUserCardData)
+	query := `
+	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level, im.amount_growth_type, im.exp_growth_rate
+	FROM user_cards as uc
+	INNER JOIN item_masters as im ON uc.card_id = im.id
+	WHERE uc.id = ? AND uc.user_id=? AND uc.deleted_at IS NULL
+	`
+	if err = h.getDBForUserID(userID).GetContext(ctx, card, query, cardID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	levels := make([]*CardCurveLevel, 0)
+	for level := card.Level; level <= card.MaxLevel; level++ {
+		requiredExp := 0
+		if level > card.Level {
+			requiredExp = calcLevelUpExp(card, level-1)
+		}
+		remainingExp := requiredExp - card.TotalExp
+		if remainingExp < 0 {
+			remainingExp = 0
+		}
+		amountPerSec := card.AmountPerSec
+		if level > card.Level {
+			amountPerSec = calcAmountPerSec(card, level)
+		}
+		levels = append(levels, &CardCurveLevel{
+			Level:        level,
+			RequiredExp:  requiredExp,
+			RemainingExp: remainingExp,
+			AmountPerSec: amountPerSec,
+		})
+	}
+
+	return successResponse(c, &CardCurveResponse{
+		UserCardID: card.ID,
+		CardID:     card.CardID,
+		Level:      card.Level,
+		MaxLevel:   card.MaxLevel,
+		TotalExp:   card.TotalExp,
+		Levels:     levels,
+	})
+}
+
+type CardCurveResponse struct {
+	UserCardID int64             `json:"userCardId"`
+	CardID     int64             `json:"cardId"`
+	Level      int               `json:"level"`
+	MaxLevel   int               `json:"maxLevel"`
+	TotalExp   int               `json:"totalExp"`
+	Levels     []*CardCurveLevel `json:"levels"`
+}
+
+// CardCurveLevel 強化曲線の1レベル分
+// requiredExpはそのレベルに達するのに必要な累計経験値、remainingExpは現在の累計経験値からの不足分
+// 現在のレベルはrequiredExpを0とし、生産性は現在の値を返す
+type CardCurveLevel struct {
+	Level        int `json:"level"`
+	RequiredExp  int `json:"requiredExp"`
+	RemainingExp int `json:"remainingExp"`
+	AmountPerSec int `json:"amountPerSec"`
+}
+
+// respecCard 装備のリセット
+// POST /user/{userID}/card/respec/{cardID}
+// カードをレベル1に戻し、累計経験値のcardRespecRefundPercent%分を強化素材として返却する
+func (h *Handler) respecCard(c echo.Context) error {
+	ctx := dbContext(c)
+
+	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(RespecCardRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkOneTimeToken(ctx, userID, req.OneTimeToken, 2, requestAt); err != nil {
+		if isTokenError(err) {
+			return errorResponse(c, tokenErrorStatus(err), err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	db := h.getDBForUserID(userID)
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 同時に強化された場合に経験値を二重に返却しないよう、カードをロックしてから読む
+	card := new(TargetUserCardData)
+	query := `
+	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level, im.amount_growth_type, im.exp_growth_rate
+	FROM user_cards as uc
+	INNER JOIN item_masters as im ON uc.card_id = im.id
+	WHERE uc.id = ? AND uc.user_id=? AND uc.deleted_at IS NULL
+	FOR UPDATE
+	`
+	if err = tx.Get(card, query, cardID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if !cardRespecAllowEquipped {
+		var equipped int
+		query = "SELECT COUNT(*) FROM user_decks WHERE user_id=? AND deleted_at IS NULL AND (user_card_id_1=? OR user_card_id_2=? OR user_card_id_3=?)"
+		if err = tx.Get(&equipped, query, userID, card.ID, card.ID, card.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if equipped > 0 {
+			return errorResponse(c, http.StatusConflict, ErrCardEquipped)
+		}
+	}
+
+	// 返却に使う強化素材。経験値の大きいものから順に、返却する経験値を超えない範囲で割り当てる
+	materials := make([]*ItemMaster, 0)
+	query = "SELECT * FROM item_masters WHERE item_type=? AND gained_exp > 0 ORDER BY gained_exp DESC, id"
+	if err = tx.Select(&materials, query, ItemTypeEnhanceA); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	refundExp, refunds := calcRespecRefund(card.TotalExp, cardRespecRefundPercent, materials)
+
+	// レベル1に戻し、生産性をマスタの初期値に戻す
+	query = "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, calcAmountPerSec(card, 1), 1, 0, requestAt, card.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	resultItems := make([]*UserItem, 0, len(refunds))
+	var clamps GrantClamps
+	for _, refund := range refunds {
+		obtained, err := h.obtainItem(ctx, tx, userID, refund.Item.ID, refund.Item.ItemType, int64(refund.Amount), requestAt)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		resultItems = append(resultItems, obtained.Items...)
+		clamps.merge(obtained.Clamps)
+	}
+
+	resultCard := new(UserCard)
+	query = "SELECT * FROM user_cards WHERE id=?"
+	if err = tx.Get(resultCard, query, card.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &RespecCardResponse{
+		RefundedExp:      refundExp,
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, []*UserCard{resultCard}, nil, resultItems, nil, nil),
+		GrantClamps:      clamps,
+	})
+}
+
+// calcRespecRefund カードのリセット時に返却する経験値と強化素材を求める
+// materialsは経験値の大きい順に並んでいること。どの強化素材にも満たない端数の経験値は返却しない
+func calcRespecRefund(totalExp, refundPercent int, materials []*ItemMaster) (int, []*RespecRefund) {
+	if totalExp <= 0 || refundPercent <= 0 {
+		return 0, []*RespecRefund{}
+	}
+	if refundPercent > 100 {
+		refundPercent = 100
+	}
+
+	remaining := totalExp * refundPercent / 100
+	refunds := make([]*RespecRefund, 0)
+	refundExp := 0
+	for _, m := range materials {
+		if m.GainedExp == nil || *m.GainedExp <= 0 {
+			continue
+		}
+		amount := remaining / *m.GainedExp
+		if amount == 0 {
+			continue
+		}
+		refunds = append(refunds, &RespecRefund{Item: m, Amount: amount})
+		remaining -= amount * *m.GainedExp
+		refundExp += amount * *m.GainedExp
+	}
+	return refundExp, refunds
+}
+
+type RespecRefund struct {
+	Item   *ItemMaster
+	Amount int
+}
+
+type RespecCardRequest struct {
+	ViewerID     string `json:"viewerId"`
+	OneTimeToken string `json:"oneTimeToken"`
+}
+
+type RespecCardResponse struct {
+	// RefundedExp 強化素材として返却した経験値の合計
+	RefundedExp      int              `json:"refundedExp"`
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+	// GrantClamps 所持数の上限により返却しきれなかった強化素材
+	GrantClamps
+}
+
+// updateDeck 装備変更
+// POST /user/{userID}/card
+func (h *Handler) updateDeck(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(UpdateDeckRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	if len(req.CardIDs) != DeckCardNumber {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid number of cards"))
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	if err = validateDeckCards(ctx, db, userID, req.CardIDs); err != nil {
+		if errors.Cause(err) == ErrDeckCardMissing {
+			return deckCardMissingResponse(c, http.StatusBadRequest, err)
+		}
+		if err == ErrInvalidDeckCards {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	defer tx.Rollback() //nolint:errcheck
+
+	newDeck, err := h.replaceDeck(ctx, tx, userID, req.CardIDs, requestAt)
+	if err != nil {
+		if errors.Cause(err) == ErrDeckCardMissing {
+			return deckCardMissingResponse(c, http.StatusBadRequest, err)
+		}
+		if err == ErrInvalidDeckCards {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if isMinimalResponse(c) {
+		return noContentResponse(c, http.StatusNoContent)
+	}
+
+	return successResponse(c, &UpdateDeckResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{newDeck}, nil, nil, nil),
+	})
+}
+
+type UpdateDeckRequest struct {
+	ViewerID string  `json:"viewerId"`
+	CardIDs  []int64 `json:"cardIds"`
+}
+
+type UpdateDeckResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
+
+// validateDeckCards デッキに装備するカードが全てユーザーの所持する、削除されていないカードで、重複がないか検証する
+// 枚数が違う・重複がある場合はErrInvalidDeckCards、所持していないカードがある場合はそのスロットをDeckCardMissingErrorで返す
+func validateDeckCards(ctx context.Context, q sqlx.QueryerContext, userID int64, cardIDs []int64) error {
+	if len(cardIDs) != DeckCardNumber {
+		return ErrInvalidDeckCards
+	}
+	seen := make(map[int64]bool, len(cardIDs))
+	for _, id := range cardIDs {
+		if seen[id] {
+			return ErrInvalidDeckCards
+		}
+		seen[id] = true
+	}
+
+	query := "SELECT id FROM user_cards WHERE id IN (?) AND user_id=? AND deleted_at IS NULL"
+	query, params, err := sqlx.In(query, cardIDs, userID)
+	if err != nil {
+		return err
+	}
+	ownedIDs := make([]int64, 0, len(cardIDs))
+	if err := sqlx.SelectContext(ctx, q, &ownedIDs, query, params...); err != nil {
+		return err
+	}
+	return checkDeckCardsOwned(cardIDs, ownedIDs)
+}
+
+// DeckCardMissingError デッキのスロットのカードを所持していない(売却・削除済みなど)エラー
+// クライアントが選び直しを促せるよう、どのスロットのカードかを持つ。errors.CauseはErrDeckCardMissingを返す
+type DeckCardMissingError struct {
+	Slot       int // 1始まり
+	UserCardID int64
+}
+
+func (e *DeckCardMissingError) Error() string {
+	return fmt.Sprintf("slot=%d, userCardId=%d: %s", e.Slot, e.UserCardID, ErrDeckCardMissing.Error())
+}
+
+func (e *DeckCardMissingError) Cause() error {
+	return ErrDeckCardMissing
+}
+
+// checkDeckCardsOwned デッキのカードが全てownedIDs(所持している、削除されていないカード)に含まれるか確認し、
+// 含まれないカードがあれば最初のスロットをDeckCardMissingErrorで返す
+func checkDeckCardsOwned(cardIDs []int64, ownedIDs []int64) error {
+	owned := make(map[int64]bool, len(ownedIDs))
+	for _, id := range ownedIDs {
+		owned[id] = true
+	}
+	for i, id := range cardIDs {
+		if !owned[id] {
+			return &DeckCardMissingError{Slot: i + 1, UserCardID: id}
+		}
+	}
+	return nil
+}
+
+// replaceDeck 装備中のデッキを外し、指定したカードで新しいデッキを作る
+// 検証に失敗した場合にデッキがない状態にならないよう、装備中のデッキを外す前に同じトランザクション内でカードを検証し直す
+func (h *Handler) replaceDeck(ctx context.Context, tx *sqlx.Tx, userID int64, cardIDs []int64, requestAt int64) (*UserDeck, error) {
+	if err := validateDeckCards(ctx, tx, userID, cardIDs); err != nil {
+		return nil, err
+	}
+
+	query := "UPDATE user_decks SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err := tx.Exec(query, requestAt, requestAt, userID); err != nil {
+		return nil, err
+	}
+
+	udID, err := h.generateID()
+	if err != nil {
+		return nil, err
+	}
+	newDeck := &UserDeck{
+		ID:        udID,
+		UserID:    userID,
+		CardID1:   cardIDs[0],
+		CardID2:   cardIDs[1],
+		CardID3:   cardIDs[2],
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+	}
+	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if err := h.retryOnIDCollision(func() error {
+		_, err := tx.Exec(query, newDeck.ID, newDeck.UserID, newDeck.CardID1, newDeck.CardID2, newDeck.CardID3, newDeck.CreatedAt, newDeck.UpdatedAt)
+		return err
+	}, &newDeck.ID); err != nil {
+		return nil, err
+	}
+	return newDeck, nil
+}
+
+// saveDeckPreset デッキの組み合わせに名前を付けて保存する
+// cardIdsを省略した場合は装備中のデッキを保存する。同じ名前のプリセットがあれば上書きする
+// POST /user/{userID}/deck/preset
+func (h *Handler) saveDeckPreset(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(SaveDeckPresetRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > DeckPresetNameMaxLength {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDeckPresetName)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	db := h.getDBForUserID(userID)
+
+	cardIDs := req.CardIDs
+	if len(cardIDs) == 0 {
+		deck := new(UserDeck)
+		if err = db.GetContext(ctx, deck, "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL", userID); err != nil {
+			if err == sql.ErrNoRows {
+				return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found deck"))
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		cardIDs = []int64{deck.CardID1, deck.CardID2, deck.CardID3}
+	}
+	if err = validateDeckCards(ctx, db, userID, cardIDs); err != nil {
+		if errors.Cause(err) == ErrDeckCardMissing {
+			return deckCardMissingResponse(c, http.StatusBadRequest, err)
+		}
+		if err == ErrInvalidDeckCards {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 上限数の確認と保存の間に別のリクエストで保存されないよう、既存のプリセットをロックする
+	names := make([]string, 0)
+	if err = tx.Select(&names, "SELECT name FROM user_deck_presets WHERE user_id=? FOR UPDATE", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	exists := false
+	for _, name := range names {
+		if name == req.Name {
+			exists = true
+			break
+		}
+	}
+	if !exists && len(names) >= DeckPresetMaxCount {
+		return errorResponse(c, http.StatusConflict, ErrDeckPresetLimitExceeded)
+	}
+
+	pID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	preset := &UserDeckPreset{
+		ID:        pID,
+		UserID:    userID,
+		Name:      req.Name,
+		CardID1:   cardIDs[0],
+		CardID2:   cardIDs[1],
+		CardID3:   cardIDs[2],
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+	}
+	query := `INSERT INTO user_deck_presets(id, user_id, name, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at)
+			  VALUES (:id, :user_id, :name, :user_card_id_1, :user_card_id_2, :user_card_id_3, :created_at, :updated_at)
+			  ON DUPLICATE KEY UPDATE user_card_id_1=VALUES(user_card_id_1), user_card_id_2=VALUES(user_card_id_2), user_card_id_3=VALUES(user_card_id_3), updated_at=VALUES(updated_at)`
+	if _, err = tx.NamedExec(query, preset); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 上書きした場合はIDと作成日時が既存のものになるため、保存後の値を返す
+	if err = tx.Get(preset, "SELECT * FROM user_deck_presets WHERE user_id=? AND name=?", userID, req.Name); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &SaveDeckPresetResponse{
+		Preset: preset,
+	})
+}
+
+// listDeckPresets 保存したデッキプリセットの一覧
+// GET /user/{userID}/deck/presets
+func (h *Handler) listDeckPresets(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	presets := make([]*UserDeckPreset, 0)
+	query := "SELECT * FROM user_deck_presets WHERE user_id=? ORDER BY created_at ASC, id ASC"
+	if err = h.getDBForUserID(userID).SelectContext(ctx, &presets, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &ListDeckPresetsResponse{
+		Presets: presets,
+	})
+}
+
+// activateDeckPreset 保存したデッキプリセットを装備する
+// 保存後にカードを手放している場合があるため、装備時に改めて所持を確認する
+// POST /user/{userID}/deck/preset/{name}/activate
+func (h *Handler) activateDeckPreset(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	name, err := url.PathUnescape(c.Param("name"))
+	if err != nil || name == "" {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDeckPresetName)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(ActivateDeckPresetRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	db := h.getDBForUserID(userID)
+
+	preset := new(UserDeckPreset)
+	if err = db.GetContext(ctx, preset, "SELECT * FROM user_deck_presets WHERE user_id=? AND name=?", userID, name); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrDeckPresetNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	cardIDs := []int64{preset.CardID1, preset.CardID2, preset.CardID3}
+	if err = validateDeckCards(ctx, db, userID, cardIDs); err != nil {
+		if errors.Cause(err) == ErrDeckCardMissing {
+			return deckCardMissingResponse(c, http.StatusConflict, err)
+		}
+		if err == ErrInvalidDeckCards {
+			return errorResponse(c, http.StatusConflict, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	newDeck, err := h.replaceDeck(ctx, tx, userID, cardIDs, requestAt)
+	if err != nil {
+		if errors.Cause(err) == ErrDeckCardMissing {
+			return deckCardMissingResponse(c, http.StatusConflict, err)
+		}
+		if err == ErrInvalidDeckCards {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &UpdateDeckResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{newDeck}, nil, nil, nil),
+	})
+}
+
+type SaveDeckPresetRequest struct {
+	ViewerID string  `json:"viewerId"`
+	Name     string  `json:"name"`
+	CardIDs  []int64 `json:"cardIds"`
+}
+
+type SaveDeckPresetResponse struct {
+	Preset *UserDeckPreset `json:"preset"`
+}
+
+type ListDeckPresetsResponse struct {
+	Presets []*UserDeckPreset `json:"presets"`
+}
+
+type ActivateDeckPresetRequest struct {
+	ViewerID string `json:"viewerId"`
+}
+
+// reward ゲーム報酬受取
+// POST /user/{userID}/reward
+func (h *Handler) reward(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(RewardRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	user, err := h.getUserWithViewerID(ctx, userID, req.ViewerID)
+	if err != nil {
+		if err == ErrUserDeviceNotFound || err == ErrUserNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	deck := new(UserDeck)
+	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
+	if err = db.GetContext(ctx, deck, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// デッキのカードを売却・削除している場合は、選び直しを促せるようどのスロットかを返す
+	cards := make([]*UserCard, 0)
+	query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?) AND user_id=? AND deleted_at IS NULL"
+	if err = db.SelectContext(ctx, &cards, query, deck.CardID1, deck.CardID2, deck.CardID3, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	ownedIDs := make([]int64, 0, len(cards))
+	for _, card := range cards {
+		ownedIDs = append(ownedIDs, card.ID)
+	}
+	if err = checkDeckCardsOwned([]int64{deck.CardID1, deck.CardID2, deck.CardID3}, ownedIDs); err != nil {
+		return deckCardMissingResponse(c, http.StatusConflict, err)
+	}
+	if len(cards) != DeckCardNumber {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid cards length"))
+	}
+
+	historyID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	// コインの付与と受け取り履歴は同じトランザクションで書く
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 同時に受け取った場合に同じ経過時間で二重に付与しないよう、ユーザーの行をロックして最新の値から計算する
+	query = "SELECT isu_coin, last_getreward_at FROM users WHERE id=? FOR UPDATE"
+	if err = tx.QueryRowx(query, userID).Scan(&user.IsuCoin, &user.LastGetRewardAt); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	pastTime := requestAt - user.LastGetRewardAt
+	amountPerSec := computeDeckProduction(cards).Total
+	getCoin := pastTime * amountPerSec
+	if pastTime > 0 && amountPerSec > 0 && pastTime > math.MaxInt64/amountPerSec {
+		// int64に収まらない場合は桁あふれさせず最大値として扱い、上限で切り詰める
+		getCoin = math.MaxInt64
+	}
+
+	var overflow int64
+	user.IsuCoin, overflow = capCoin(user.IsuCoin, getCoin)
+	user.LastGetRewardAt = requestAt
+
+	query = "UPDATE users SET isu_coin=?, last_getreward_at=? WHERE id=?"
+	if _, err = tx.Exec(query, user.IsuCoin, user.LastGetRewardAt, user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if err = h.handleCoinOverflow(ctx, tx, userID, overflow, requestAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	history := &RewardHistory{
+		ID:               historyID,
+		UserID:           userID,
+		Amount:           getCoin,
+		Overflow:         overflow,
+		PastTime:         pastTime,
+		DeckAmountPerSec: amountPerSec,
+		ClaimedAt:        requestAt,
+		CreatedAt:        requestAt,
+	}
+	query = `INSERT INTO reward_histories(id, user_id, amount, overflow, past_time, deck_amount_per_sec, claimed_at, created_at)
+			 VALUES (:id, :user_id, :amount, :overflow, :past_time, :deck_amount_per_sec, :claimed_at, :created_at)`
+	if _, err = tx.NamedExec(query, history); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if isMinimalResponse(c) {
+		return noContentResponse(c, http.StatusNoContent)
+	}
+
+	return successResponse(c, &RewardResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, user, nil, nil, nil, nil, nil, nil),
+		CoinClamped:      overflow > 0,
+	})
 }
 
-type TargetUserCardData struct {
-	ID               int64 `db:"id"`
-	UserID           int64 `db:"user_id"`
-	CardID           int64 `db:"card_id"`
-	AmountPerSec     int   `db:"amount_per_sec"`
-	Level            int   `db:"level"`
-	TotalExp         int   `db:"total_exp"`
-	BaseAmountPerSec int   `db:"base_amount_per_sec"`
-	MaxLevel         int   `db:"max_level"`
-	MaxAmountPerSec  int   `db:"max_amount_per_sec"`
-	BaseExpPerLevel  int   `db:"base_exp_per_level"`
+type RewardRequest struct {
+	ViewerID string `json:"viewerId"`
 }
 
-// updateDeck 装備変更
-// POST /user/{userID}/card
-func (h *Handler) updateDeck(c echo.Context) error {
+type RewardResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+	CoinClamped      bool             `json:"coinClamped"` // 所持上限により付与したコインが切り詰められた場合true
+}
+
+// listRewardHistory 放置報酬の受け取り履歴
+// GET /user/{userID}/reward/history?n={page}
+// 新しい順に、RewardHistoryCountPerPage件ずつ返す。nを省略した場合は1ページ目
+func (h *Handler) listRewardHistory(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	n := 1
+	if param := c.QueryParam("n"); param != "" {
+		n, err = strconv.Atoi(param)
+		if err != nil || n < 1 {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("index number (n) should be more than or equal to 1"))
+		}
+	}
+	offset := RewardHistoryCountPerPage * (n - 1)
+
+	// 次のページがあるかを判定するため1件多く取得する
+	histories := make([]*RewardHistory, 0, RewardHistoryCountPerPage+1)
+	query := "SELECT * FROM reward_histories WHERE user_id=? ORDER BY claimed_at DESC, id DESC LIMIT ? OFFSET ?"
+	if err = h.getDBForUserID(userID).SelectContext(ctx, &histories, query, userID, RewardHistoryCountPerPage+1, offset); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	isNext := len(histories) > RewardHistoryCountPerPage
+	if isNext {
+		histories = histories[:RewardHistoryCountPerPage]
+	}
+
+	return successResponse(c, &ListRewardHistoryResponse{
+		Histories: histories,
+		IsNext:    isNext,
+	})
+}
+
+type ListRewardHistoryResponse struct {
+	Histories []*RewardHistory `json:"histories"`
+	IsNext    bool             `json:"isNext"`
+}
+
+type RewardHistory struct {
+	ID               int64 `json:"id" db:"id"`
+	UserID           int64 `json:"userId" db:"user_id"`
+	Amount           int64 `json:"amount" db:"amount"`
+	Overflow         int64 `json:"overflow" db:"overflow"`
+	PastTime         int64 `json:"pastTime" db:"past_time"`
+	DeckAmountPerSec int64 `json:"deckAmountPerSec" db:"deck_amount_per_sec"`
+	ClaimedAt        int64 `json:"claimedAt" db:"claimed_at"`
+	CreatedAt        int64 `json:"createdAt" db:"created_at"`
+}
+
+// home ホーム取得
+// ?fields=user,totalAmountPerSec のように指定した場合は、指定したフィールドのみ返す
+// GET /user/{userID}/home
+func (h *Handler) home(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	fields, err := parseFieldsParam(c, &HomeResponse{})
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	// ユーザーの取得はデッキの集計と並行して行う
+	type userResult struct {
+		user *User
+		err  error
+	}
+	userCh := make(chan userResult, 1)
+	go func() {
+		user := new(User)
+		err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id=?", userID)
+		userCh <- userResult{user, err}
+	}()
+
+	// 生産性はrewardと同じ計算にするため、合計はSQLで集計せず装備カードから求める
+	var deck *UserDeck
+	var production *DeckProduction
+	totalAmountPerSec := 0
+	userDeck := new(UserDeck)
+	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
+	if err = db.GetContext(ctx, userDeck, query, userID); err != nil {
+		if err != sql.ErrNoRows {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	} else {
+		cards := make([]*UserCard, 0)
+		query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?)"
+		if err = db.SelectContext(ctx, &cards, query, userDeck.CardID1, userDeck.CardID2, userDeck.CardID3); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		deck = userDeck
+		production = computeDeckProduction(cards)
+		totalAmountPerSec = int(production.Total)
+	}
+
+	res := <-userCh
+	if res.err != nil {
+		if res.err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, res.err)
+	}
+	user := res.user
+	pastTime := requestAt - user.LastGetRewardAt
+
+	return sparseResponse(c, fields, &HomeResponse{
+		Now:               requestAt,
+		User:              user,
+		Deck:              deck,
+		TotalAmountPerSec: totalAmountPerSec,
+		Production:        production,
+		PastTime:          pastTime,
+	})
+}
+
+type HomeResponse struct {
+	Now               int64           `json:"now"`
+	User              *User           `json:"user"`
+	Deck              *UserDeck       `json:"deck,omitempty"`
+	TotalAmountPerSec int             `json:"totalAmountPerSec"`
+	Production        *DeckProduction `json:"production,omitempty"` // シナジーのボーナスを含む生産性の内訳
+	PastTime          int64           `json:"pastTime"`             // 経過時間を秒単位で
+}
+
+// logout ログアウト
+// 現在のセッションを無効にし、発行済みのワンタイムトークンも失効させる
+// 無効にしたセッションはcheckSessionMiddlewareでdeleted_atを見て弾くため、以降のリクエストは401になる
+// POST /user/{userID}/logout
+func (h *Handler) logout(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	sessID := c.Request().Header.Get("x-session")
+	db := h.getDBForUserID(userID)
+
+	query := "UPDATE user_sessions SET deleted_at=? WHERE session_id=? AND user_id=? AND deleted_at IS NULL"
+	if _, err = db.ExecContext(ctx, query, requestAt, sessID, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// ワンタイムトークンはメインのDBに書き、シャードで検証しているため、両方で失効させる
+	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err = h.DB.ExecContext(ctx, query, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if db != h.DB {
+		if _, err = db.ExecContext(ctx, query, requestAt, userID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+	h.TokenCache.DeleteUserTokens(userID)
+
+	return noContentResponse(c, http.StatusNoContent)
+}
+
+// updateUserName 表示名を設定する
+// ISUCON_UNIQUE_USER_NAME=1 の場合は、他のユーザーが使っている表示名は設定できない
+// POST /user/{userID}/name
+func (h *Handler) updateUserName(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	defer c.Request().Body.Close()
-	req := new(UpdateDeckRequest)
-	if err := parseRequestBody(c, req); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
+	defer c.Request().Body.Close()
+	req := new(UpdateUserNameRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	name, err := validateUserName(req.Name)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+
+	// 表示名の予約はシャードをまたぐため、ユーザーの更新より先にメインのDBで行う
+	// ユーザーの更新に失敗した場合は予約だけが残るが、同じユーザーが再度設定すれば使える
+	if uniqueUserNames {
+		if err := h.reserveUserName(ctx, userID, name, requestAt); err != nil {
+			if err == ErrUserNameTaken {
+				return errorResponse(c, http.StatusConflict, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	query := "UPDATE users SET name=?, updated_at=? WHERE id=? AND deleted_at IS NULL"
+	if _, err := h.getDBForUserID(userID).ExecContext(ctx, query, name, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if uniqueUserNames {
+		if _, err := h.DB.ExecContext(ctx, "DELETE FROM user_names WHERE user_id=? AND name<>?", userID, name); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	return successResponse(c, &UpdateUserNameResponse{
+		Name: name,
+	})
+}
+
+// validateUserName 表示名の前後の空白を取り除き、設定できる表示名かを確認する
+func validateUserName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > UserNameMaxLength {
+		return "", ErrInvalidUserName
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalidUserName
+		}
+	}
+	if userNameFilter != nil && userNameFilter(name) {
+		return "", ErrInvalidUserName
+	}
+	return name, nil
+}
+
+// reserveUserName 表示名をユーザーのものとして予約する。他のユーザーが予約済みの場合はErrUserNameTakenを返す
+func (h *Handler) reserveUserName(ctx context.Context, userID int64, name string, requestAt int64) error {
+	query := "INSERT IGNORE INTO user_names(name, user_id, created_at) VALUES (?, ?, ?)"
+	if _, err := h.DB.ExecContext(ctx, query, name, userID, requestAt); err != nil {
+		return err
+	}
+
+	var ownerID int64
+	if err := h.DB.GetContext(ctx, &ownerID, "SELECT user_id FROM user_names WHERE name=?", name); err != nil {
+		return err
+	}
+	if ownerID != userID {
+		return ErrUserNameTaken
+	}
+	return nil
+}
+
+type UpdateUserNameRequest struct {
+	ViewerID string `json:"viewerId"`
+	Name     string `json:"name"`
+}
+
+type UpdateUserNameResponse struct {
+	Name string `json:"name"`
+}
+
+// getUserProfiles 複数ユーザーの公開プロフィールをまとめて取得する
+// コインなどの非公開の情報は含めない。BANされたユーザー・削除されたユーザーは存在しないユーザーと同じく null を返す
+// POST /users/profiles
+func (h *Handler) getUserProfiles(c echo.Context) error {
+	ctx := dbContext(c)
+
+	defer c.Request().Body.Close()
+	req := new(UserProfilesRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if len(req.UserIDs) == 0 || len(req.UserIDs) > UserProfilesMaxCount {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+	}
+
+	// シャードごとにユーザーIDをまとめる
+	profiles := make(map[int64]*UserProfile, len(req.UserIDs))
+	shardUserIDs := make(map[int][]int64)
+	for _, userID := range req.UserIDs {
+		if _, exists := profiles[userID]; exists {
+			continue
+		}
+		profiles[userID] = nil
+		shard := h.getShardIndex(userID)
+		shardUserIDs[shard] = append(shardUserIDs[shard], userID)
+	}
+
+	errCh := make(chan error, len(shardUserIDs))
+	respCh := make(chan []*UserProfile, len(shardUserIDs))
+	wg := sync.WaitGroup{}
+	for shard, userIDs := range shardUserIDs {
+		wg.Add(1)
+		go func(db *sqlx.DB, userIDs []int64) {
+			defer wg.Done()
+			res, err := selectUserProfiles(ctx, db, userIDs)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			respCh <- res
+		}(h.DBs[shard], userIDs)
+	}
+	wg.Wait()
+	close(errCh)
+	close(respCh)
+
+	if err := <-errCh; err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	for res := range respCh {
+		for _, profile := range res {
+			profiles[profile.UserID] = profile
+		}
+	}
+
+	return successResponse(c, &UserProfilesResponse{
+		Profiles: profiles,
+	})
+}
+
+// selectUserProfiles 1つのシャードから公開プロフィールを取得する
+func selectUserProfiles(ctx context.Context, db *sqlx.DB, userIDs []int64) ([]*UserProfile, error) {
+	query := `
+	SELECT u.id, u.name, u.registered_at, COALESCE(SUM(uc.amount_per_sec), 0) AS total_amount_per_sec
+	FROM users AS u
+	LEFT JOIN user_decks AS d ON d.user_id = u.id AND d.deleted_at IS NULL
+	LEFT JOIN user_cards AS uc ON uc.id IN (d.user_card_id_1, d.user_card_id_2, d.user_card_id_3)
+	WHERE u.id IN (?) AND u.deleted_at IS NULL
+	AND NOT EXISTS (SELECT 1 FROM user_bans AS b WHERE b.user_id = u.id)
+	GROUP BY u.id`
+	query, params, err := sqlx.In(query, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make([]*UserProfile, 0, len(userIDs))
+	if err := db.SelectContext(ctx, &profiles, query, params...); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+type UserProfilesRequest struct {
+	UserIDs []int64 `json:"userIds"`
+}
+
+type UserProfilesResponse struct {
+	Profiles map[int64]*UserProfile `json:"profiles"`
+}
+
+type UserProfile struct {
+	UserID            int64   `json:"userId" db:"id"`
+	Name              *string `json:"name" db:"name"`
+	TotalAmountPerSec int     `json:"totalAmountPerSec" db:"total_amount_per_sec"`
+	RegisteredAt      int64   `json:"registeredAt" db:"registered_at"`
+}
 
-	if len(req.CardIDs) != DeckCardNumber {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid number of cards"))
-	}
+// getSchedule 開催中・開催予定のガチャとログインボーナスの終了・開始までの秒数
+// endingSoonは開催中のものを終了が近い順、startingSoonは開催予定のものを開始が近い順で返す
+// GET /user/{userID}/schedule
+func (h *Handler) getSchedule(c echo.Context) error {
+	ctx := dbContext(c)
 
 	requestAt, err := getRequestTime(c)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	if err = h.checkViewerID(userID, req.ViewerID); err != nil {
-		if err == ErrUserDeviceNotFound {
-			return errorResponse(c, http.StatusNotFound, err)
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
-
-	query := "SELECT * FROM user_cards WHERE id IN (?)"
-	query, params, err := sqlx.In(query, req.CardIDs)
+	idx, err := h.getGachaIndex(ctx, c.Request().Header.Get("x-master-version"))
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
-	cards := make([]*UserCard, 0)
-	if err = db.Select(&cards, query, params...); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if len(cards) != DeckCardNumber {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid card ids"))
-	}
-
-	tx, err := db.Beginx()
+	loginBonuses, err := h.getLoginBonuses(ctx)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	defer tx.Rollback() //nolint:errcheck
-
-	query = "UPDATE user_decks SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = tx.Exec(query, requestAt, requestAt, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
+	endingSoon := make([]*ScheduleEntry, 0)
+	startingSoon := make([]*ScheduleEntry, 0)
 
-	udID, err := h.generateID()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	active, _, _ := idx.active(requestAt)
+	for _, g := range active {
+		endingSoon = append(endingSoon, &ScheduleEntry{
+			Type: ScheduleTypeGacha, ID: g.ID, Name: g.Name, StartAt: g.StartAt, EndAt: g.EndAt, Seconds: g.EndAt - requestAt,
+		})
 	}
-	newDeck := &UserDeck{
-		ID:        udID,
-		UserID:    userID,
-		CardID1:   req.CardIDs[0],
-		CardID2:   req.CardIDs[1],
-		CardID3:   req.CardIDs[2],
-		CreatedAt: requestAt,
-		UpdatedAt: requestAt,
+	for _, g := range idx.upcoming(requestAt) {
+		startingSoon = append(startingSoon, &ScheduleEntry{
+			Type: ScheduleTypeGacha, ID: g.ID, Name: g.Name, StartAt: g.StartAt, EndAt: g.EndAt, Seconds: g.StartAt - requestAt,
+		})
 	}
-	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, newDeck.ID, newDeck.UserID, newDeck.CardID1, newDeck.CardID2, newDeck.CardID3, newDeck.CreatedAt, newDeck.UpdatedAt); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	for _, b := range loginBonuses {
+		entry := &ScheduleEntry{Type: ScheduleTypeLoginBonus, ID: b.ID, StartAt: b.StartAt, EndAt: b.EndAt}
+		switch {
+		case b.StartAt <= requestAt && requestAt <= b.EndAt:
+			entry.Seconds = b.EndAt - requestAt
+			endingSoon = append(endingSoon, entry)
+		case requestAt < b.StartAt:
+			entry.Seconds = b.StartAt - requestAt
+			startingSoon = append(startingSoon, entry)
+		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	sortScheduleEntries(endingSoon)
+	sortScheduleEntries(startingSoon)
+
+	return successResponse(c, &ScheduleResponse{
+		Now:          requestAt,
+		EndingSoon:   endingSoon,
+		StartingSoon: startingSoon,
+	})
+}
+
+// sortScheduleEntries 残り秒数が短い順に並べる
+func sortScheduleEntries(entries []*ScheduleEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Seconds != entries[j].Seconds {
+			return entries[i].Seconds < entries[j].Seconds
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// getLoginBonuses ログインボーナスマスタをすべて取得する（キャッシュ活用）
+func (h *Handler) getLoginBonuses(ctx context.Context) ([]*LoginBonusMaster, error) {
+	if loginBonuses, ok := h.Cache.GetLoginBonuses(); ok {
+		return loginBonuses, nil
 	}
 
-	return successResponse(c, &UpdateDeckResponse{
-		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{newDeck}, nil, nil, nil),
+	v, err := h.loadMaster(ctx, "login_bonuses", func(ctx context.Context) (interface{}, error) {
+		loginBonuses := make([]*LoginBonusMaster, 0)
+		if err := h.DB.SelectContext(ctx, &loginBonuses, "SELECT * FROM login_bonus_masters ORDER BY id"); err != nil {
+			return nil, err
+		}
+		h.Cache.SetLoginBonuses(loginBonuses)
+		return loginBonuses, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*LoginBonusMaster), nil
 }
 
-type UpdateDeckRequest struct {
-	ViewerID string  `json:"viewerId"`
-	CardIDs  []int64 `json:"cardIds"`
+type ScheduleResponse struct {
+	Now          int64            `json:"now"`
+	EndingSoon   []*ScheduleEntry `json:"endingSoon"`
+	StartingSoon []*ScheduleEntry `json:"startingSoon"`
 }
 
-type UpdateDeckResponse struct {
-	UpdatedResources *UpdatedResource `json:"updatedResources"`
+type ScheduleEntry struct {
+	Type    string `json:"type"`
+	ID      int64  `json:"id"`
+	Name    string `json:"name,omitempty"`
+	StartAt int64  `json:"startAt"`
+	EndAt   int64  `json:"endAt"`
+	Seconds int64  `json:"seconds"` // endingSoonは終了まで、startingSoonは開始までの秒数
 }
 
-// reward ゲーム報酬受取
-// POST /user/{userID}/reward
-func (h *Handler) reward(c echo.Context) error {
+// listLoginBonusHistory ログインボーナスの受け取り履歴
+// user_login_bonusesは最終受け取り番号のみ保持しているため、現在のループで受け取った報酬は1〜last_reward_sequenceとして復元する
+// GET /user/{userID}/loginbonus/history
+func (h *Handler) listLoginBonusHistory(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	defer c.Request().Body.Close()
-	req := new(RewardRequest)
-	if err := parseRequestBody(c, req); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
-
 	requestAt, err := getRequestTime(c)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	if err = h.checkViewerID(userID, req.ViewerID); err != nil {
-		if err == ErrUserDeviceNotFound {
-			return errorResponse(c, http.StatusNotFound, err)
-		}
+	// ユーザーIDに基づいて適切なDBを選択
+	db := h.getDBForUserID(userID)
+
+	userBonuses := make([]*UserLoginBonus, 0)
+	query := "SELECT * FROM user_login_bonuses WHERE user_id=? AND deleted_at IS NULL ORDER BY login_bonus_id"
+	if err = db.SelectContext(ctx, &userBonuses, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
+	if len(userBonuses) == 0 {
+		return successResponse(c, &ListLoginBonusHistoryResponse{
+			LoginBonuses: []*LoginBonusHistory{},
+		})
+	}
 
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err = db.Get(user, query, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
-		}
+	bonusIDs := make([]int64, len(userBonuses))
+	for i, ub := range userBonuses {
+		bonusIDs[i] = ub.LoginBonusID
+	}
+
+	// 開催中・開催済みのログインボーナスのみ対象
+	query, params, err := sqlx.In("SELECT * FROM login_bonus_masters WHERE id IN (?) AND start_at <= ?", bonusIDs, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	bonusMasters := make([]*LoginBonusMaster, 0)
+	if err = h.DB.SelectContext(ctx, &bonusMasters, query, params...); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	masterMap := make(map[int64]*LoginBonusMaster, len(bonusMasters))
+	for _, m := range bonusMasters {
+		masterMap[m.ID] = m
+	}
 
-	deck := new(UserDeck)
-	query = "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = db.Get(deck, query, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, err)
+	rewardKeys := make([]*LoginBonusRewardMaster, 0)
+	for _, ub := range userBonuses {
+		if _, exists := masterMap[ub.LoginBonusID]; !exists {
+			continue
+		}
+		for seq := 1; seq <= ub.LastRewardSequence; seq++ {
+			rewardKeys = append(rewardKeys, &LoginBonusRewardMaster{
+				LoginBonusID:   ub.LoginBonusID,
+				RewardSequence: seq,
+			})
 		}
-		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	cards := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?)"
-	if err = db.Select(&cards, query, deck.CardID1, deck.CardID2, deck.CardID3); err != nil {
+	rewardMap, err := h.getLoginBonusRewards(ctx, h.DB, rewardKeys)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if len(cards) != 3 {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid cards length"))
-	}
 
-	pastTime := requestAt - user.LastGetRewardAt
-	getCoin := int(pastTime) * (cards[0].AmountPerSec + cards[1].AmountPerSec + cards[2].AmountPerSec)
+	histories := make([]*LoginBonusHistory, 0, len(userBonuses))
+	for _, ub := range userBonuses {
+		master, exists := masterMap[ub.LoginBonusID]
+		if !exists {
+			continue
+		}
 
-	user.IsuCoin += int64(getCoin)
-	user.LastGetRewardAt = requestAt
+		claimed := make([]*LoginBonusRewardMaster, 0, ub.LastRewardSequence)
+		for seq := 1; seq <= ub.LastRewardSequence; seq++ {
+			reward, exists := rewardMap[fmt.Sprintf("%d_%d", ub.LoginBonusID, seq)]
+			if !exists {
+				return errorResponse(c, http.StatusNotFound, ErrLoginBonusRewardNotFound)
+			}
+			claimed = append(claimed, reward)
+		}
 
-	query = "UPDATE users SET isu_coin=?, last_getreward_at=? WHERE id=?"
-	if _, err = db.Exec(query, user.IsuCoin, user.LastGetRewardAt, user.ID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+		histories = append(histories, &LoginBonusHistory{
+			LoginBonus:         master,
+			LoopCount:          ub.LoopCount,
+			LastRewardSequence: ub.LastRewardSequence,
+			ClaimedRewards:     claimed,
+		})
 	}
 
-	return successResponse(c, &RewardResponse{
-		UpdatedResources: makeUpdatedResources(requestAt, user, nil, nil, nil, nil, nil, nil),
+	return successResponse(c, &ListLoginBonusHistoryResponse{
+		LoginBonuses: histories,
 	})
 }
 
-type RewardRequest struct {
-	ViewerID string `json:"viewerId"`
+type ListLoginBonusHistoryResponse struct {
+	LoginBonuses []*LoginBonusHistory `json:"loginBonuses"`
 }
 
-type RewardResponse struct {
-	UpdatedResources *UpdatedResource `json:"updatedResources"`
+type LoginBonusHistory struct {
+	LoginBonus         *LoginBonusMaster `json:"loginBonus"`
+	LoopCount          int               `json:"loopCount"`
+	LastRewardSequence int               `json:"lastRewardSequence"`
+	// 現在のループで受け取った報酬。過去のループでは全ての報酬を受け取り済み
+	ClaimedRewards []*LoginBonusRewardMaster `json:"claimedRewards"`
 }
 
-// home ホーム取得
-// GET /user/{userID}/home
-func (h *Handler) home(c echo.Context) error {
+// validateOneTimeToken ワンタイムトークンの有効性確認(トークンは消費しない)
+// GET /user/{userID}/token/{tokenType}/valid?token={token}
+func (h *Handler) validateOneTimeToken(c echo.Context) error {
+	ctx := dbContext(c)
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	requestAt, err := getRequestTime(c)
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	tokenType, err := strconv.Atoi(c.Param("tokenType"))
+	if err != nil || (tokenType != 1 && tokenType != 2) {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid token type"))
 	}
 
-	// ユーザーIDに基づいて適切なDBを選択
-	db := h.getDBForUserID(userID)
-
-	deck := new(UserDeck)
-	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = db.Get(deck, query, userID); err != nil {
-		if err != sql.ErrNoRows {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-		deck = nil
+	token := c.QueryParam("token")
+	if token == "" {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("token is empty"))
 	}
 
-	cards := make([]*UserCard, 0)
-	if deck != nil {
-		cardIds := []int64{deck.CardID1, deck.CardID2, deck.CardID3}
-		query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?)", cardIds)
-		if err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-		if err = db.Select(&cards, query, params...); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	}
-	totalAmountPerSec := 0
-	for _, v := range cards {
-		totalAmountPerSec += v.AmountPerSec
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	user := new(User)
-	query = "SELECT * FROM users WHERE id=?"
-	if err = db.Get(user, query, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+	expiredAt, err := h.peekOneTimeToken(ctx, userID, token, tokenType, requestAt)
+	if err != nil {
+		if isTokenError(err) {
+			return successResponse(c, &ValidateOneTimeTokenResponse{
+				Valid: false,
+			})
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	pastTime := requestAt - user.LastGetRewardAt
 
-	return successResponse(c, &HomeResponse{
-		Now:               requestAt,
-		User:              user,
-		Deck:              deck,
-		TotalAmountPerSec: totalAmountPerSec,
-		PastTime:          pastTime,
+	return successResponse(c, &ValidateOneTimeTokenResponse{
+		Valid:     true,
+		ExpiredAt: expiredAt,
 	})
 }
 
-type HomeResponse struct {
-	Now               int64     `json:"now"`
-	User              *User     `json:"user"`
-	Deck              *UserDeck `json:"deck,omitempty"`
-	TotalAmountPerSec int       `json:"totalAmountPerSec"`
-	PastTime          int64     `json:"pastTime"` // 経過時間を秒単位で
+type ValidateOneTimeTokenResponse struct {
+	Valid     bool  `json:"valid"`
+	ExpiredAt int64 `json:"expiredAt,omitempty"`
 }
 
 // //////////////////////////////////////
@@ -2556,32 +7205,139 @@ func (h *Handler) health(c echo.Context) error {
 
 // errorResponse エラーレスポンス
 func errorResponse(c echo.Context, statusCode int, err error) error {
+	// 期限切れで失敗した場合は、ハンドラが戻ってからrequestTimeoutMiddlewareが503を返す
+	if isDBTimedOut(c) {
+		return err
+	}
 	c.Logger().Errorf("status=%d, err=%+v", statusCode, errors.WithStack(err))
 
 	return c.JSON(statusCode, struct {
 		StatusCode int    `json:"status_code"`
 		Message    string `json:"message"`
+		Code       string `json:"code,omitempty"`
 	}{
 		StatusCode: statusCode,
 		Message:    err.Error(),
+		Code:       responseErrorCode(c, statusCode, err),
+	})
+}
+
+// tooManyTokenIssuesResponse ワンタイムトークンの発行が多すぎる場合のレスポンス
+func tooManyTokenIssuesResponse(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", "1")
+	return errorResponse(c, http.StatusTooManyRequests, ErrTooManyTokenIssues)
+}
+
+// notEnoughCoinResponse コインが足りない場合のレスポンス
+// 購入を促せるよう、必要なコインと所持しているコイン、不足分を返す
+func notEnoughCoinResponse(c echo.Context, required, have int64) error {
+	c.Logger().Errorf("status=%d, err=%+v", http.StatusConflict, errors.WithStack(ErrNotEnoughCoin))
+
+	shortfall := required - have
+	if shortfall < 0 {
+		shortfall = 0
+	}
+	return c.JSON(http.StatusConflict, &NotEnoughCoinResponse{
+		StatusCode: http.StatusConflict,
+		Message:    ErrNotEnoughCoin.Error(),
+		Code:       responseErrorCode(c, http.StatusConflict, ErrNotEnoughCoin),
+		Required:   required,
+		Have:       have,
+		Shortfall:  shortfall,
+	})
+}
+
+// deckCardMissingResponse デッキのカードを所持していない場合のレスポンス
+// クライアントが選び直しを促せるよう、所持していないカードのスロットとIDを返す
+func deckCardMissingResponse(c echo.Context, statusCode int, err error) error {
+	var missing *DeckCardMissingError
+	if !errors.As(err, &missing) {
+		return errorResponse(c, statusCode, err)
+	}
+	c.Logger().Errorf("status=%d, err=%+v", statusCode, errors.WithStack(err))
+
+	return c.JSON(statusCode, &DeckCardMissingResponse{
+		StatusCode: statusCode,
+		Message:    err.Error(),
+		Code:       responseErrorCode(c, statusCode, err),
+		Slot:       missing.Slot,
+		UserCardID: missing.UserCardID,
 	})
 }
 
+type DeckCardMissingResponse struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	Slot       int    `json:"slot"`
+	UserCardID int64  `json:"userCardId"`
+}
+
+type NotEnoughCoinResponse struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	Required   int64  `json:"required"`
+	Have       int64  `json:"have"`
+	Shortfall  int64  `json:"shortfall"`
+}
+
 // successResponse 成功時のレスポンス
 func successResponse(c echo.Context, v interface{}) error {
 	return c.JSON(http.StatusOK, v)
 }
 
+// shardBusyResponse 書き込み枠を確保できなかった場合のレスポンス
+func shardBusyResponse(c echo.Context, err error) error {
+	c.Response().Header().Set("Retry-After", "1")
+	return errorResponse(c, http.StatusServiceUnavailable, err)
+}
+
 // noContentResponse
 func noContentResponse(c echo.Context, status int) error {
 	return c.NoContent(status)
 }
 
+// isMinimalResponse ?minimal=1 が指定された場合、更新系APIは結果を返さず204を返す
+// 状態を別途取得し直すクライアント向けに通信量を減らすためのもの
+func isMinimalResponse(c echo.Context) bool {
+	return c.QueryParam("minimal") == "1"
+}
+
 // generateID ユニークなIDを生成する
 func (h *Handler) generateID() (int64, error) {
-	id := snowflakeNode.Generate()
+	return h.IDGen.Generate()
+}
+
+// retryOnIDCollision generateIDで採番したidを使ってINSERTし、idが既存の行と重複した場合はidを採番し直して再実行する
+// 複数のノードで同じnode idを使っているとidが重複しうるため、500にせず最大IDCollisionMaxRetries回まで再実行する
+// MySQLは重複キーのエラーではトランザクション全体をロールバックしないため、トランザクションの中でもそのまま再実行できる
+// ユーザーのidはシャードの選択に使うため、採番し直すとトランザクションを開始したシャードとずれる。usersのINSERTには使わないこと
+func (h *Handler) retryOnIDCollision(insert func() error, ids ...*int64) error {
+	for retry := 0; ; retry++ {
+		err := insert()
+		if err == nil || retry >= IDCollisionMaxRetries || !isDuplicatePrimaryKey(err) {
+			return err
+		}
+		for _, id := range ids {
+			newID, err := h.generateID()
+			if err != nil {
+				return err
+			}
+			*id = newID
+		}
+	}
+}
 
-	return id.Int64(), nil
+// isDuplicatePrimaryKey MySQLの重複キーのエラー(1062)のうち、主キーの重複によるものかどうか
+// ユニークキーの重複は採番し直しても解消しないため含めない
+func isDuplicatePrimaryKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+		return false
+	}
+	// MySQL 8.0.19以降は 'テーブル名.PRIMARY'、それより前は 'PRIMARY' となる
+	return strings.HasSuffix(mysqlErr.Message, "PRIMARY'")
 }
 
 // generateUUID UUIDの生成
@@ -2608,27 +7364,112 @@ func getEnv(key, defaultVal string) string {
 	}
 }
 
+// loadLocation タイムゾーン名からLocationを取得する。未指定の場合はJSTとする
+// 不正な場合もJSTを返し、読み込めなかったエラーをあわせて返す
+func loadLocation(name string) (*time.Location, error) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	if name == "" {
+		return jst, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return jst, errors.Wrapf(err, "location=%s", name)
+	}
+	return loc, nil
+}
+
+// parseItemValues "item_id:value"のカンマ区切りをアイテムごとの値に変換する
+// 解釈できない要素は無視し、無視した要素を返す。空の要素は無視した要素に含めない
+func parseItemValues(s string) (map[int64]int64, []string) {
+	values := make(map[int64]int64)
+	ignored := make([]string, 0)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, ":")
+		if !ok {
+			ignored = append(ignored, kv)
+			continue
+		}
+		itemID, errID := strconv.ParseInt(k, 10, 64)
+		value, errValue := strconv.ParseInt(v, 10, 64)
+		if errID != nil || errValue != nil {
+			ignored = append(ignored, kv)
+			continue
+		}
+		values[itemID] = value
+	}
+	return values, ignored
+}
+
+// getEnvInt 環境変数から整数値を取得する
+func getEnvInt(key string, defaultVal int) int {
+	v, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultVal)))
+	if err != nil {
+		return defaultVal
+	}
+	return v
+}
+
 // getDBForUserID ユーザーIDに基づいて適切なDBを選択する
+// 返すのは書き込みを受けるシャードのプライマリなので、直前の書き込みを必ず読める
 func (h *Handler) getDBForUserID(userID int64) *sqlx.DB {
 	if len(h.DBs) == 0 {
 		return h.DB
 	}
 
+	return h.DBs[h.getShardIndex(userID)]
+}
+
+// getShardIndex ユーザーIDに基づいてシャードのインデックスを求める
+func (h *Handler) getShardIndex(userID int64) int {
 	// ユーザーIDに基づいてシャーディング
 	// snowflake IDの場合、上位ビットはタイムスタンプなので、下位ビットを使用する
-	index := int(userID>>23) % len(h.DBs)
-	return h.DBs[index]
+	return int(userID>>23) % len(h.DBs)
+}
+
+// acquireWriteSlot ユーザーのシャードへの書き込みトランザクション枠を確保する
+// 確保できた場合は解放用の関数を返す。一定時間内に確保できなければErrShardBusyを返す
+func (h *Handler) acquireWriteSlot(userID int64) (func(), error) {
+	if len(h.WriteSems) == 0 || len(h.DBs) == 0 {
+		return func() {}, nil
+	}
+
+	sem := h.WriteSems[h.getShardIndex(userID)%len(h.WriteSems)]
+	if !sem.Acquire(writeSlotAcquireTimeout) {
+		return nil, ErrShardBusy
+	}
+	return sem.Release, nil
 }
 
 // parseRequestBody リクエストボディをパースする
+// ボディの大きさとJSONのネストの深さを制限し、パースした後にリクエストごとの配列の長さの上限を検証する
 func parseRequestBody(c echo.Context, dist interface{}) error {
-	buf, err := io.ReadAll(c.Request().Body)
+	buf, err := io.ReadAll(io.LimitReader(c.Request().Body, int64(maxRequestBodyBytes)+1))
 	if err != nil {
 		return ErrInvalidRequestBody
 	}
-	if err = json.Unmarshal(buf, &dist); err != nil {
+	if len(buf) > maxRequestBodyBytes {
+		return errors.Wrapf(ErrInvalidRequestBody, "body too large: max=%d bytes", maxRequestBodyBytes)
+	}
+	if jsonDepthExceeds(buf, maxRequestJSONDepth) {
+		return errors.Wrapf(ErrInvalidRequestBody, "json too deeply nested: max=%d", maxRequestJSONDepth)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	if disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err = decoder.Decode(&dist); err != nil {
 		return ErrInvalidRequestBody
 	}
+
+	if limiter, ok := dist.(requestLimiter); ok {
+		return limiter.validateLimits()
+	}
 	return nil
 }
 
@@ -2655,6 +7496,10 @@ func makeUpdatedResources(
 	userLoginBonuses []*UserLoginBonus,
 	userPresents []*UserPresent,
 ) *UpdatedResource {
+	// クライアントで差分を取りやすいようにid順で返す
+	sort.Slice(userCards, func(i, j int) bool { return userCards[i].ID < userCards[j].ID })
+	sort.Slice(userItems, func(i, j int) bool { return userItems[i].ID < userItems[j].ID })
+
 	return &UpdatedResource{
 		Now:              requestAt,
 		User:             user,
@@ -2671,14 +7516,15 @@ func makeUpdatedResources(
 // entity
 
 type User struct {
-	ID              int64  `json:"id" db:"id"`
-	IsuCoin         int64  `json:"isuCoin" db:"isu_coin"`
-	LastGetRewardAt int64  `json:"lastGetRewardAt" db:"last_getreward_at"`
-	LastActivatedAt int64  `json:"lastActivatedAt" db:"last_activated_at"`
-	RegisteredAt    int64  `json:"registeredAt" db:"registered_at"`
-	CreatedAt       int64  `json:"createdAt" db:"created_at"`
-	UpdatedAt       int64  `json:"updatedAt" db:"updated_at"`
-	DeletedAt       *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
+	ID              int64   `json:"id" db:"id"`
+	IsuCoin         int64   `json:"isuCoin" db:"isu_coin"`
+	LastGetRewardAt int64   `json:"lastGetRewardAt" db:"last_getreward_at"`
+	LastActivatedAt int64   `json:"lastActivatedAt" db:"last_activated_at"`
+	RegisteredAt    int64   `json:"registeredAt" db:"registered_at"`
+	Name            *string `json:"name" db:"name"`
+	CreatedAt       int64   `json:"createdAt" db:"created_at"`
+	UpdatedAt       int64   `json:"updatedAt" db:"updated_at"`
+	DeletedAt       *int64  `json:"deletedAt,omitempty" db:"deleted_at"`
 }
 
 type UserDevice struct {
@@ -2711,6 +7557,17 @@ type UserCard struct {
 	DeletedAt    *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
 }
 
+type UserDeckPreset struct {
+	ID        int64  `json:"id" db:"id"`
+	UserID    int64  `json:"userId" db:"user_id"`
+	Name      string `json:"name" db:"name"`
+	CardID1   int64  `json:"cardId1" db:"user_card_id_1"`
+	CardID2   int64  `json:"cardId2" db:"user_card_id_2"`
+	CardID3   int64  `json:"cardId3" db:"user_card_id_3"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt int64  `json:"updatedAt" db:"updated_at"`
+}
+
 type UserDeck struct {
 	ID        int64  `json:"id" db:"id"`
 	UserID    int64  `json:"userId" db:"user_id"`
@@ -2731,6 +7588,9 @@ type UserItem struct {
 	CreatedAt int64  `json:"createdAt" db:"created_at"`
 	UpdatedAt int64  `json:"updatedAt" db:"updated_at"`
 	DeletedAt *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
+
+	// DisplayAmount 端数単位のアイテムの場合のみ、繰り越し中の端数を含めた表示用の所持数
+	DisplayAmount string `json:"displayAmount,omitempty" db:"-"`
 }
 
 type UserLoginBonus struct {
@@ -2752,9 +7612,14 @@ type UserPresent struct {
 	ItemID         int64  `json:"itemId" db:"item_id"`
 	Amount         int    `json:"amount" db:"amount"`
 	PresentMessage string `json:"presentMessage" db:"present_message"`
+	Source         int    `json:"source" db:"source"`
+	SourceID       *int64 `json:"sourceId,omitempty" db:"source_id"`
 	CreatedAt      int64  `json:"createdAt" db:"created_at"`
 	UpdatedAt      int64  `json:"updatedAt" db:"updated_at"`
 	DeletedAt      *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
+
+	// DisplayAmount 端数単位のアイテムの場合のみ、amountを単位で割った表示用の付与数
+	DisplayAmount string `json:"displayAmount,omitempty" db:"-"`
 }
 
 type UserPresentAllReceivedHistory struct {
@@ -2792,12 +7657,16 @@ type UserOneTimeToken struct {
 // master entity
 
 type GachaMaster struct {
-	ID           int64  `json:"id" db:"id"`
-	Name         string `json:"name" db:"name"`
-	StartAt      int64  `json:"startAt" db:"start_at"`
-	EndAt        int64  `json:"endAt" db:"end_at"`
-	DisplayOrder int    `json:"displayOrder" db:"display_order"`
-	CreatedAt    int64  `json:"createdAt" db:"created_at"`
+	ID           int64   `json:"id" db:"id"`
+	Name         string  `json:"name" db:"name"`
+	StartAt      int64   `json:"startAt" db:"start_at"`
+	EndAt        int64   `json:"endAt" db:"end_at"`
+	DisplayOrder int     `json:"displayOrder" db:"display_order"`
+	CreatedAt    int64   `json:"createdAt" db:"created_at"`
+	IconURL      *string `json:"iconUrl,omitempty" db:"icon_url"`
+	BannerURL    *string `json:"bannerUrl,omitempty" db:"banner_url"`
+	// PityCeiling 天井の回数。NULLの場合は天井なし
+	PityCeiling *int `json:"pityCeiling,omitempty" db:"pity_ceiling"`
 }
 
 type GachaItemMaster struct {
@@ -2806,8 +7675,46 @@ type GachaItemMaster struct {
 	ItemType  int   `json:"itemType" db:"item_type"`
 	ItemID    int64 `json:"itemId" db:"item_id"`
 	Amount    int   `json:"amount" db:"amount"`
-	Weight    int   `json:"weight" db:"weight"`
+	Weight    int   `json:"weight" db:"weight"` // 0の場合は一覧に表示されるが抽選されない
 	CreatedAt int64 `json:"createdAt" db:"created_at"`
+	// RateUpPercent ピックアップによる確率アップ。weightに掛ける百分率で、NULLの場合は100
+	RateUpPercent *int `json:"rateUpPercent,omitempty" db:"rate_up_percent"`
+	// IsRare 天井の対象のレアなアイテムか
+	IsRare *bool `json:"isRare,omitempty" db:"is_rare"`
+
+	// ガチャ一覧の表示用に、アイテムマスタのアイコンを詰めて返す
+	IconURL *string `json:"iconUrl,omitempty" db:"-"`
+	// IsNew ガチャ一覧の表示用に、最近追加したアイテムかどうか。リクエスト時刻によって変わるため、キャッシュにはfalseのまま持つ
+	IsNew bool `json:"isNew" db:"-"`
+	// DisplayAmount ガチャ一覧の表示用に、端数単位のアイテムの場合のみamountを単位で割った付与数
+	DisplayAmount string `json:"displayAmount,omitempty" db:"-"`
+}
+
+type UserGachaDraw struct {
+	ID           int64  `json:"id" db:"id"`
+	UserID       int64  `json:"userId" db:"user_id"`
+	GachaID      int64  `json:"gachaId" db:"gacha_id"`
+	GachaCount   int    `json:"gachaCount" db:"gacha_count"`
+	ConsumedCoin int64  `json:"consumedCoin" db:"consumed_coin"`
+	Rerolled     bool   `json:"rerolled" db:"rerolled"`
+	RerollOf     *int64 `json:"rerollOf,omitempty" db:"reroll_of"`
+	DrawnAt      int64  `json:"drawnAt" db:"drawn_at"`
+	CreatedAt    int64  `json:"createdAt" db:"created_at"`
+	PityCount    int    `json:"pityCount" db:"pity_count"`
+}
+
+type UserGachaDrawHistory struct {
+	ID          int64  `json:"id" db:"id"`
+	UserID      int64  `json:"userId" db:"user_id"`
+	DrawID      int64  `json:"drawId" db:"draw_id"`
+	GachaID     int64  `json:"gachaId" db:"gacha_id"`
+	GachaItemID int64  `json:"gachaItemId" db:"gacha_item_id"`
+	PresentID   *int64 `json:"presentId" db:"present_id"`
+	ItemType    int    `json:"itemType" db:"item_type"`
+	ItemID      int64  `json:"itemId" db:"item_id"`
+	Amount      int    `json:"amount" db:"amount"`
+	DrawnAt     int64  `json:"drawnAt" db:"drawn_at"`
+	CreatedAt   int64  `json:"createdAt" db:"created_at"`
 }
 
 type ItemMaster struct {
@@ -2822,6 +7729,23 @@ type ItemMaster struct {
 	GainedExp       *int   `json:"gainedExp" db:"gained_exp"`
 	ShorteningMin   *int64 `json:"shorteningMin" db:"shortening_min"`
 	// CreatedAt       int64 `json:"createdAt"`
+
+	AmountGrowthType *int     `json:"amountGrowthType" db:"amount_growth_type"`
+	ExpGrowthRate    *float64 `json:"expGrowthRate" db:"exp_growth_rate"`
+	AmountScale      *int     `json:"amountScale" db:"amount_scale"`
+	IconURL          *string  `json:"iconUrl,omitempty" db:"icon_url"`
+	BannerURL        *string  `json:"bannerUrl,omitempty" db:"banner_url"`
+	MaxStack         *int     `json:"maxStack" db:"max_stack"`
+}
+
+type ExchangeMaster struct {
+	ID         int64 `json:"id" db:"id"`
+	FromItemID int64 `json:"fromItemId" db:"from_item_id"`
+	FromAmount int   `json:"fromAmount" db:"from_amount"`
+	ToItemType int   `json:"toItemType" db:"to_item_type"`
+	ToItemID   int64 `json:"toItemId" db:"to_item_id"`
+	ToAmount   int   `json:"toAmount" db:"to_amount"`
+	CreatedAt  int64 `json:"createdAt" db:"created_at"`
 }
 
 type LoginBonusMaster struct {
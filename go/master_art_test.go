@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// newTestGachaArtDB アイコンとバナーのあるガチャ1と、ないガチャ2の一覧に応答する
+func newTestGachaArtDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM gacha_masters", []string{"id", "name", "start_at", "end_at", "icon_url", "banner_url"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), "gacha1", int64(0), int64(2000), "https://example.com/gacha1.png", "https://example.com/gacha1-banner.png"},
+			{int64(2), "gacha2", int64(0), int64(2000), nil, nil},
+		}
+	})
+	fake.onQuery("FROM gacha_item_masters", []string{"id", "gacha_id", "item_type", "item_id", "amount", "weight"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(11), int64(1), int64(ItemTypeEnhanceA), int64(10), int64(1), int64(1)},
+			{int64(21), int64(2), int64(ItemTypeEnhanceA), int64(20), int64(1), int64(1)},
+		}
+	})
+	fake.onQuery("FROM item_masters", []string{"id", "item_type", "icon_url", "banner_url"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] == int64(10) {
+			return [][]driver.Value{{args[0], int64(ItemTypeEnhanceA), "https://example.com/item10.png", "https://example.com/item10-banner.png"}}
+		}
+		return [][]driver.Value{{args[0], int64(ItemTypeEnhanceA), nil, nil}}
+	})
+	fake.onExec("UPDATE user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestGachaArtRoundTrip(t *testing.T) {
+	h := newTestHandler(t, newTestGachaArtDB())
+	h.TokenIssues = NewTokenIssueCounter()
+
+	// 1回目はDBから読み込み、2回目はキャッシュから返す
+	for _, state := range []string{"cold", "warm"} {
+		rec := getJSON("/user/:userID/gacha/index", h.listGacha, "/user/100/gacha/index")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", state, rec.Code, rec.Body.String())
+		}
+		var res struct {
+			Gachas []struct {
+				Gacha     map[string]interface{}   `json:"gacha"`
+				GachaItem []map[string]interface{} `json:"gachaItemList"`
+			} `json:"gachas"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Gachas) != 2 {
+			t.Fatalf("%s: body = %s, want 2 gachas", state, rec.Body.String())
+		}
+
+		withArt, withoutArt := res.Gachas[0], res.Gachas[1]
+		if withArt.Gacha["iconUrl"] != "https://example.com/gacha1.png" || withArt.Gacha["bannerUrl"] != "https://example.com/gacha1-banner.png" {
+			t.Errorf("%s: gacha1 = %v, want its icon and banner", state, withArt.Gacha)
+		}
+		if withArt.GachaItem[0]["iconUrl"] != "https://example.com/item10.png" {
+			t.Errorf("%s: gacha1 item = %v, want the item master's icon", state, withArt.GachaItem[0])
+		}
+		// アートのないマスタはフィールドごと省く
+		_, icon := withoutArt.Gacha["iconUrl"]
+		_, banner := withoutArt.Gacha["bannerUrl"]
+		_, itemIcon := withoutArt.GachaItem[0]["iconUrl"]
+		if icon || banner || itemIcon {
+			t.Errorf("%s: gacha2 = %v, items = %v, want no art fields", state, withoutArt.Gacha, withoutArt.GachaItem)
+		}
+	}
+
+	item, ok := h.Cache.GetItemMaster(10)
+	if !ok || item.IconURL == nil || *item.IconURL != "https://example.com/item10.png" || item.BannerURL == nil || *item.BannerURL != "https://example.com/item10-banner.png" {
+		t.Errorf("cached item master = %+v, want its icon and banner", item)
+	}
+}
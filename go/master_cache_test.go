@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMasterDataCacheSharedAcrossHandlers(t *testing.T) {
+	api := &Handler{Cache: NewMasterDataCache()}
+	admin := &Handler{Cache: NewMasterDataCache()}
+	t.Cleanup(api.Cache.Clear)
+
+	if api.Cache != admin.Cache {
+		t.Fatal("handlers got different cache instances")
+	}
+
+	// 一方のハンドラで読み込んだマスタは、もう一方からも見える
+	api.Cache.SetItemMaster(&ItemMaster{ID: 1, ItemType: ItemTypeCoin})
+	if _, ok := admin.Cache.GetItemMaster(1); !ok {
+		t.Error("item master set through one handler is missing from the other")
+	}
+
+	// 一度のClearで全てのハンドラのキャッシュが破棄される
+	admin.Cache.Clear()
+	if _, ok := api.Cache.GetItemMaster(1); ok {
+		t.Error("item master survived a clear through another handler")
+	}
+}
+
+func TestAdminClearCacheEmptiesWarmCaches(t *testing.T) {
+	h := &Handler{Cache: newTestMasterDataCache(), TokenCache: NewTokenCache()}
+	h.Cache.SetItemMaster(&ItemMaster{ID: 1, ItemType: ItemTypeCoin})
+	h.Cache.SetItemMaster(&ItemMaster{ID: 2, ItemType: ItemTypeCard})
+	h.Cache.SetLoginBonusReward(&LoginBonusRewardMaster{LoginBonusID: 1, RewardSequence: 1})
+	if err := h.Cache.SetGachaItems(1, []*GachaItemMaster{{ID: 1, GachaID: 1, Weight: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	h.TokenCache.SetToken("token1", 100, 1, 2000, 0)
+	h.TokenCache.SetToken("token2", 100, 2, 2000, 0)
+
+	// DBには触れないため、ハンドラにDBは設定しない
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/admin/cache/clear", nil), rec)
+	if err := h.adminClearCache(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	// クリアする前のエントリ数を返す
+	res := new(AdminClearCacheResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.MasterData.ItemMasters != 2 || res.MasterData.LoginBonusRewards != 1 || res.MasterData.GachaItems != 1 || res.Tokens != 2 {
+		t.Errorf("cleared = %+v, tokens %d, want 2 item masters, 1 reward, 1 gacha and 2 tokens", res.MasterData, res.Tokens)
+	}
+
+	if stats := h.Cache.Stats(); stats.ItemMasters != 0 || stats.LoginBonusRewards != 0 || stats.GachaItems != 0 {
+		t.Errorf("stats after clear = %+v, want an empty cache", stats)
+	}
+	if n := h.TokenCache.Clear(); n != 0 {
+		t.Errorf("%d tokens left after clear, want none", n)
+	}
+}
+
+// clearTestCache adminClearCacheを呼び、レスポンスを返す
+func clearTestCache(t *testing.T, h *Handler, path string) *AdminClearCacheResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, path, nil), rec)
+	if err := h.adminClearCache(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(AdminClearCacheResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAdminClearCacheWarnsAboutShardTokens(t *testing.T) {
+	main := (&fakeSQL{}).open()
+	shard := (&fakeSQL{}).open()
+	tests := []struct {
+		name string
+		dbs  []*sqlx.DB
+		want string
+	}{
+		{name: "single db", dbs: []*sqlx.DB{main}, want: ""},
+		{name: "separate shard", dbs: []*sqlx.DB{main, shard}, want: ClearCacheTokensWarning},
+	}
+	for _, tt := range tests {
+		h := &Handler{DB: main, DBs: tt.dbs, Cache: newTestMasterDataCache(), TokenCache: NewTokenCache()}
+		h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+		if res := clearTestCache(t, h, "/admin/cache/clear"); res.Warning != tt.want {
+			t.Errorf("%s: warning = %q, want %q", tt.name, res.Warning, tt.want)
+		}
+		// クリアするトークンがなければ使えなくなるものもない
+		if res := clearTestCache(t, h, "/admin/cache/clear"); res.Warning != "" {
+			t.Errorf("%s: warning without tokens = %q, want none", tt.name, res.Warning)
+		}
+	}
+}
+
+// hangingTransport リクエストがキャンセルされるまで応答しないホスト
+type hangingTransport struct{}
+
+func (hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestAdminClearCacheFanoutTimesOut(t *testing.T) {
+	prevHosts, prevClient := dbHosts, adminFanoutClient
+	dbHosts = []string{"db1", "db2"}
+	adminFanoutClient = &http.Client{Timeout: 50 * time.Millisecond, Transport: hangingTransport{}}
+	t.Cleanup(func() { dbHosts, adminFanoutClient = prevHosts, prevClient })
+
+	h := &Handler{Cache: newTestMasterDataCache(), TokenCache: NewTokenCache()}
+	rec := httptest.NewRecorder()
+	done := make(chan error, 1)
+	go func() {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/admin/cache/clear?fanout=1", nil), rec)
+		done <- h.adminClearCache(c)
+	}()
+
+	// 応答しないホストはエラーとして返し、管理者のリクエストは止めない
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := new(AdminClearCacheResponse)
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Hosts) != 2 || res.Hosts[0].Error == "" || res.Hosts[1].Error == "" {
+			t.Errorf("hosts = %+v, want both hosts reported as failed", res.Hosts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clearing the cache blocked on a hung host")
+	}
+}
+
+func TestActiveGachaIDsAtWindowBoundaries(t *testing.T) {
+	c := newTestMasterDataCache()
+	c.SetGachaIndex(newGachaIndex("1", []*GachaMaster{
+		{ID: 1, StartAt: 100, EndAt: 200, DisplayOrder: 2},
+		{ID: 2, StartAt: 150, EndAt: 300, DisplayOrder: 1},
+		{ID: 3, StartAt: 200, EndAt: 200, DisplayOrder: 3},
+		{ID: 4, StartAt: 301, EndAt: 400, DisplayOrder: 4},
+	}))
+
+	// start_atとend_atちょうどの時刻も開催中に含める
+	tests := []struct {
+		now  int64
+		want []int64
+	}{
+		{now: 99, want: []int64{}},
+		{now: 100, want: []int64{1}},
+		{now: 150, want: []int64{2, 1}},
+		{now: 200, want: []int64{2, 1, 3}},
+		{now: 201, want: []int64{2}},
+		{now: 300, want: []int64{2}},
+		{now: 301, want: []int64{4}},
+		{now: 400, want: []int64{4}},
+		{now: 401, want: []int64{}},
+	}
+	for _, tt := range tests {
+		got, ok := c.ActiveGachaIDs("1", tt.now)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ActiveGachaIDs(%d) = %v, %v, want %v", tt.now, got, ok, tt.want)
+		}
+	}
+
+	// 開催中のガチャが変わらない期間は、次に始まる・終わる時刻の手前まで
+	if _, validFrom, validUntil, _ := c.GetActiveGachas("1", 150); validFrom != 150 || validUntil != 199 {
+		t.Errorf("gachas at 150 valid for [%d, %d], want [150, 199]", validFrom, validUntil)
+	}
+	if _, ok := c.ActiveGachaIDs("2", 150); ok {
+		t.Error("index for another master version used, want a cache miss")
+	}
+}
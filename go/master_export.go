@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// //////////////////////////////////////
+// master export
+
+// findMasterCSVTable テーブル名からマスタのCSVの定義を探す
+func findMasterCSVTable(table string) (*masterCSVTable, bool) {
+	for _, t := range masterCSVTables {
+		if t.table == table {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// masterExportProgressRows エクスポートの途中経過を更新する間隔(行数)
+const masterExportProgressRows = 1000
+
+// exportMasterCSV マスタのテーブルをCSVとして書き出し、書き出した行数を返す
+// 取り込みと同じ列順で、1行目はヘッダ。NULLは空文字として書き出す
+// 全件をメモリに載せないよう、カーソルで1行ずつ読みながら書き出す
+// ctxがキャンセルされた場合はそこで止めてエラーを返す。progressがnilでなければ一定行数ごとに書き出した行数を渡す
+func exportMasterCSV(ctx context.Context, db sqlx.QueryerContext, t *masterCSVTable, w io.Writer, progress func(rows int)) (int, error) {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(t.columns); err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY id", strings.Join(t.columns, ", "), t.table)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	values := make([]sql.NullString, len(t.columns))
+	dest := make([]interface{}, len(t.columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(t.columns))
+
+	count := 0
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		for i, v := range values {
+			record[i] = v.String
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return count, err
+		}
+		count++
+		if progress != nil && count%masterExportProgressRows == 0 {
+			progress(count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	csvWriter.Flush()
+	return count, csvWriter.Error()
+}
+
+// masterExportChecksum マスタのテーブルを書き出した場合のCSVの行数とSHA-256を求める
+// チェックサムは圧縮前のCSVに対するもの
+func masterExportChecksum(ctx context.Context, db sqlx.QueryerContext, t *masterCSVTable) (int, string, error) {
+	hash := sha256.New()
+	rows, err := exportMasterCSV(ctx, db, t, hash, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	return rows, hex.EncodeToString(hash.Sum(nil)), nil
+}
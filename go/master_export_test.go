@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// newTestVersionMasterDB 2行のversion_mastersを返す
+func newTestVersionMasterDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT COUNT(*) FROM version_masters", []string{"COUNT(*)"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(2)}}
+	})
+	fake.onQuery("FROM version_masters", []string{"id", "status", "master_version"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), int64(0), "1"},
+			{int64(2), int64(1), "2"},
+		}
+	})
+	return fake
+}
+
+func TestAdminExportMasterTable(t *testing.T) {
+	h := newTestIDHandler(t)
+	h.DB = newTestVersionMasterDB().open()
+	h.Jobs = NewJobs()
+
+	rec := getJSON("/admin/master/export/:table", h.adminExportMasterTable, "/admin/master/export/version_masters")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	compressed := rec.Body.Bytes()
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "id,status,master_version\n1,0,1\n2,1,2\n"; string(csv) != want {
+		t.Errorf("csv = %q, want %q", csv, want)
+	}
+
+	// トレーラの行数とチェックサムは圧縮前のCSVのもので、目録と一致する
+	sum := sha256.Sum256(csv)
+	trailer := rec.Result().Trailer
+	if trailer.Get("X-Master-Rows") != "2" || trailer.Get("X-Master-Sha256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("trailer = %v, want 2 rows and the csv's sha256", trailer)
+	}
+	table := masterCSVTableFor(t, "versionMaster")
+	rows, checksum, err := masterExportChecksum(context.Background(), h.DB, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 || checksum != trailer.Get("X-Master-Sha256") {
+		t.Errorf("manifest = %d rows, %s, want it to match the export", rows, checksum)
+	}
+
+	// 圧縮したままの書き出しをそのまま取り込める
+	var imported []driver.Value
+	fake := &fakeSQL{}
+	fake.onExec("INSERT INTO version_masters", func(args []driver.Value) (int64, error) {
+		imported = append(imported, args...)
+		return int64(len(args) / 3), nil
+	})
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if n, err := importMasterCSV(context.Background(), tx, bytes.NewReader(compressed), table, func(int) {}); err != nil || n != 2 {
+		t.Fatalf("imported %d rows: %v, want 2", n, err)
+	}
+	if want := []driver.Value{"1", "0", "1", "2", "1", "2"}; !reflect.DeepEqual(imported, want) {
+		t.Errorf("imported %v, want %v", imported, want)
+	}
+}
+
+func TestAdminExportMasterTableNotFound(t *testing.T) {
+	h := &Handler{DB: (&fakeSQL{}).open(), Jobs: NewJobs()}
+
+	rec := getJSON("/admin/master/export/:table", h.adminExportMasterTable, "/admin/master/export/user_items")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for a non-master table", rec.Code)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// master import
+
+// masterImportBatchSize マスタのCSVを何行ごとにまとめてINSERTするか
+const masterImportBatchSize = 500
+
+// masterCSVTable マスタのCSVとテーブルの対応
+type masterCSVTable struct {
+	formName string
+	table    string
+	columns  []string
+	// minColumns CSVの1行に最低限必要な列数。後から追加された省略可能な列は含めない
+	minColumns int
+	// toRow CSVの1行をINSERTする値に変換する。不正な行の場合はエラーを返す
+	toRow func(record []string) (map[string]interface{}, error)
+}
+
+// insertQuery 既存の行を上書きするINSERT文を組み立てる
+func (t *masterCSVTable) insertQuery() string {
+	values := make([]string, len(t.columns))
+	updates := make([]string, 0, len(t.columns)-1)
+	for i, col := range t.columns {
+		values[i] = ":" + col
+		if col != "id" {
+			updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", col, col))
+		}
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("INSERT INTO %s(%s)", t.table, strings.Join(t.columns, ", ")),
+		fmt.Sprintf("VALUES (%s)", strings.Join(values, ", ")),
+		"ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "),
+	}, " ")
+}
+
+// masterCSVTables 更新対象のマスタ
+// 有効なマスタバージョンは他のマスタを全て取り込んで検証した後に切り替えるため、version_mastersは最後に置く
+var masterCSVTables = []*masterCSVTable{
+	{
+		formName:   "itemMaster",
+		table:      "item_masters",
+		columns:    []string{"id", "item_type", "name", "description", "amount_per_sec", "max_level", "max_amount_per_sec", "base_exp_per_level", "gained_exp", "shortening_min", "amount_growth_type", "exp_growth_rate", "amount_scale", "icon_url", "banner_url", "max_stack"},
+		minColumns: 10,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"id":                 v[0],
+				"item_type":          v[1],
+				"name":               v[2],
+				"description":        v[3],
+				"amount_per_sec":     v[4],
+				"max_level":          v[5],
+				"max_amount_per_sec": v[6],
+				"base_exp_per_level": v[7],
+				"gained_exp":         v[8],
+				"shortening_min":     v[9],
+				"amount_growth_type": optionalCSVValue(v, 10),
+				"exp_growth_rate":    optionalCSVValue(v, 11),
+				"amount_scale":       optionalCSVValue(v, 12),
+				"icon_url":           optionalCSVValue(v, 13),
+				"banner_url":         optionalCSVValue(v, 14),
+				"max_stack":          optionalCSVValue(v, 15),
+			}, nil
+		},
+	},
+	{
+		formName:   "gachaMaster",
+		table:      "gacha_masters",
+		columns:    []string{"id", "name", "start_at", "end_at", "display_order", "created_at", "icon_url", "banner_url", "pity_ceiling"},
+		minColumns: 6,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			// ガチャ名はプレゼントメッセージに埋め込まれるため、プレゼント作成時に弾かれないよう更新時に検証する
+			name, err := sanitizePresentMessage(v[1])
+			if err == nil {
+				_, err = gachaPresentMessage(name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"id":            v[0],
+				"name":          name,
+				"start_at":      v[2],
+				"end_at":        v[3],
+				"display_order": v[4],
+				"created_at":    v[5],
+				"icon_url":      optionalCSVValue(v, 6),
+				"banner_url":    optionalCSVValue(v, 7),
+				"pity_ceiling":  optionalCSVValue(v, 8),
+			}, nil
+		},
+	},
+	{
+		formName:   "gachaItemMaster",
+		table:      "gacha_item_masters",
+		columns:    []string{"id", "gacha_id", "item_type", "item_id", "amount", "weight", "created_at", "rate_up_percent", "is_rare"},
+		minColumns: 7,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"id":              v[0],
+				"gacha_id":        v[1],
+				"item_type":       v[2],
+				"item_id":         v[3],
+				"amount":          v[4],
+				"weight":          v[5],
+				"created_at":      v[6],
+				"rate_up_percent": optionalCSVValue(v, 7),
+				"is_rare":         optionalCSVValue(v, 8),
+			}, nil
+		},
+	},
+	{
+		formName:   "presentAllMaster",
+		table:      "present_all_masters",
+		columns:    []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message", "created_at"},
+		minColumns: 8,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			presentMessage, err := sanitizePresentMessage(v[6])
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"id":                  v[0],
+				"registered_start_at": v[1],
+				"registered_end_at":   v[2],
+				"item_type":           v[3],
+				"item_id":             v[4],
+				"amount":              v[5],
+				"present_message":     presentMessage,
+				"created_at":          v[7],
+			}, nil
+		},
+	},
+	{
+		formName:   "loginBonusMaster",
+		table:      "login_bonus_masters",
+		columns:    []string{"id", "start_at", "end_at", "column_count", "looped", "created_at"},
+		minColumns: 6,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			looped := 0
+			if v[4] == "TRUE" {
+				looped = 1
+			}
+			return map[string]interface{}{
+				"id":           v[0],
+				"start_at":     v[1],
+				"end_at":       v[2],
+				"column_count": v[3],
+				"looped":       looped,
+				"created_at":   v[5],
+			}, nil
+		},
+	},
+	{
+		formName:   "loginBonusRewardMaster",
+		table:      "login_bonus_reward_masters",
+		columns:    []string{"id", "login_bonus_id", "reward_sequence", "item_type", "item_id", "amount", "created_at"},
+		minColumns: 7,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"id":              v[0],
+				"login_bonus_id":  v[1],
+				"reward_sequence": v[2],
+				"item_type":       v[3],
+				"item_id":         v[4],
+				"amount":          v[5],
+				"created_at":      v[6],
+			}, nil
+		},
+	},
+	{
+		formName:   "versionMaster",
+		table:      "version_masters",
+		columns:    []string{"id", "status", "master_version"},
+		minColumns: 3,
+		toRow: func(v []string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"id":             v[0],
+				"status":         v[1],
+				"master_version": v[2],
+			}, nil
+		},
+	},
+}
+
+// optionalCSVValue 後から追加された省略可能な列の値を取得する。列がない・空の場合はNULLとする
+func optionalCSVValue(record []string, index int) interface{} {
+	if index >= len(record) || record[index] == "" {
+		return nil
+	}
+	return record[index]
+}
+
+// masterCSVOpener アップロードされたCSVを開く。シャードごとに別々に読むため、呼ぶたびに先頭から読めるものを返す
+type masterCSVOpener func() (io.ReadCloser, error)
+
+// masterUploadFromForm リクエストのフォームからアップロードされたCSVを取得する
+// multipartの解析は並行して呼ぶと競合するため、シャードごとの処理を始める前に呼ぶこと
+func masterUploadFromForm(form *multipart.Form) map[string]masterCSVOpener {
+	upload := make(map[string]masterCSVOpener)
+	if form == nil {
+		return upload
+	}
+	for _, t := range masterCSVTables {
+		files := form.File[t.formName]
+		if len(files) == 0 {
+			continue
+		}
+		fh := files[0]
+		upload[t.formName] = func() (io.ReadCloser, error) {
+			return fh.Open()
+		}
+	}
+	return upload
+}
+
+// saveMasterUpload 非同期で取り込むためにアップロードされたCSVを一時ファイルに保存する
+// リクエストの一時ファイルはレスポンスを返すと削除されるため、取り込みが終わるまで残るようにコピーする
+// 戻り値の関数で一時ファイルを削除する
+func saveMasterUpload(upload map[string]masterCSVOpener) (map[string]masterCSVOpener, func(), error) {
+	paths := make([]string, 0, len(upload))
+	cleanup := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+
+	saved := make(map[string]masterCSVOpener, len(upload))
+	for name, open := range upload {
+		src, err := open()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		dst, err := os.CreateTemp("", "master-*.csv")
+		if err != nil {
+			src.Close()
+			cleanup()
+			return nil, nil, err
+		}
+		paths = append(paths, dst.Name())
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		path := dst.Name()
+		saved[name] = func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}
+	}
+	return saved, cleanup, nil
+}
+
+// importMasterCSV CSVを1行ずつ読み、masterImportBatchSize行ごとにまとめてINSERTする
+// ファイル全体をメモリに載せないため、大きなCSVでも使用メモリは一定に収まる
+// 取り込んだ行数をprogressに通知し、取り込んだ行数を返す
+func importMasterCSV(ctx context.Context, tx *sqlx.Tx, r io.Reader, t *masterCSVTable, progress func(rows int)) (int, error) {
+	// エクスポートしたgzip圧縮のCSVもそのまま取り込めるようにする
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	csvReader := csv.NewReader(r)
+	// 後から追加された省略可能な列があるため、行ごとの列数は揃っていなくてよい
+	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
+
+	// 1行目はヘッダ
+	if _, err := csvReader.Read(); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	query := t.insertQuery()
+	batch := make([]map[string]interface{}, 0, masterImportBatchSize)
+	rows := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// キャンセルされた場合はバッチの区切りで止める
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := tx.NamedExec(query, batch); err != nil {
+			return err
+		}
+		rows += len(batch)
+		progress(rows)
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+		if len(record) < t.minColumns {
+			return rows, errors.Wrapf(ErrInvalidMasterCSV, "%s line %d: expected at least %d columns, got %d", t.formName, line, t.minColumns, len(record))
+		}
+		row, err := t.toRow(record)
+		if err != nil {
+			return rows, errors.Wrapf(err, "%s line %d", t.formName, line)
+		}
+		batch = append(batch, row)
+		if len(batch) >= masterImportBatchSize {
+			if err := flush(); err != nil {
+				return rows, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return rows, err
+	}
+	return rows, nil
+}
+
+// validateImportedMasters 取り込んだマスタを検証する。コミット前のトランザクション内で呼ぶ
+func validateImportedMasters(tx *sqlx.Tx) error {
+	var activeCount int
+	if err := tx.Get(&activeCount, "SELECT COUNT(*) FROM version_masters WHERE status=1"); err != nil {
+		return err
+	}
+	if activeCount != 1 {
+		return errors.Wrapf(ErrInvalidMasterCSV, "active master version must be exactly one, got %d", activeCount)
+	}
+
+	// 抽選できないガチャがないか
+	invalidGachas := make([]int64, 0)
+	query := "SELECT gacha_id FROM gacha_item_masters GROUP BY gacha_id" +
+		" HAVING MIN(weight) < 0 OR MIN(COALESCE(rate_up_percent, 100)) < 0 OR SUM(weight * COALESCE(rate_up_percent, 100)) = 0"
+	if err := tx.Select(&invalidGachas, query); err != nil {
+		return err
+	}
+	if len(invalidGachas) > 0 {
+		return errors.Wrapf(ErrInvalidGachaWeight, "gachaIDs=%v", invalidGachas)
+	}
+	return nil
+}
+
+// //////////////////////////////////////
+// master update jobs
+
+// MasterUpdateJob 非同期のマスタ更新の進捗。シャードごと・テーブルごとに取り込んだ行数をジョブの途中経過として公開する
+type MasterUpdateJob struct {
+	*Job
+
+	mu        sync.Mutex
+	rowCounts []map[string]int
+}
+
+// MasterUpdateProgress マスタ更新の途中経過
+type MasterUpdateProgress struct {
+	RowCounts []map[string]int `json:"rowCounts"` // シャードごとの、テーブルごとに取り込んだ行数
+}
+
+// newMasterUpdateJob ジョブの取り込み行数の記録を作成する
+func newMasterUpdateJob(job *Job, shardCount int) *MasterUpdateJob {
+	rowCounts := make([]map[string]int, shardCount)
+	for i := range rowCounts {
+		rowCounts[i] = make(map[string]int)
+	}
+	return &MasterUpdateJob{
+		Job:       job,
+		rowCounts: rowCounts,
+	}
+}
+
+// SetRows シャードのテーブルの取り込んだ行数を更新する
+func (j *MasterUpdateJob) SetRows(shard int, table string, rows int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.rowCounts[shard][table] = rows
+	rowCounts := make([]map[string]int, len(j.rowCounts))
+	for i, counts := range j.rowCounts {
+		rowCounts[i] = make(map[string]int, len(counts))
+		for table, rows := range counts {
+			rowCounts[i][table] = rows
+		}
+	}
+	j.SetProgress(&MasterUpdateProgress{RowCounts: rowCounts})
+}
+
+// RowCounts シャードのテーブルごとに取り込んだ行数
+func (j *MasterUpdateJob) RowCounts(shard int) map[string]int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	counts := make(map[string]int, len(j.rowCounts[shard]))
+	for table, rows := range j.rowCounts[shard] {
+		counts[table] = rows
+	}
+	return counts
+}
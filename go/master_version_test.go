@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// newTestNoActiveVersionDB 有効なマスタバージョンがなく、最も新しいバージョンが"2"のDB
+func newTestNoActiveVersionDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("WHERE status=1", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onQuery("ORDER BY id DESC", []string{"id", "status", "master_version"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(2), int64(0), "2"}}
+	})
+	return fake
+}
+
+func TestAPIMiddlewareWithoutActiveMasterVersion(t *testing.T) {
+	prev := masterVersionFallback
+	t.Cleanup(func() { masterVersionFallback = prev })
+
+	for _, fallback := range []bool{false, true} {
+		masterVersionFallback = fallback
+		fake := newTestNoActiveVersionDB()
+		h := newTestHandler(t)
+		h.DB = fake.open()
+
+		e := echo.New()
+		logs := new(bytes.Buffer)
+		e.Logger.SetOutput(logs)
+		e.Logger.SetLevel(log.WARN)
+		e.GET("/health", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, h.apiMiddleware)
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("x-master-version", "2")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if !fallback {
+			// デフォルトでは有効なバージョンがなければ全てのAPIを止める
+			if rec.Code != http.StatusNotFound || fake.executed("ORDER BY id DESC") != 0 {
+				t.Errorf("strict: status = %d, body = %s, want 404 without falling back", rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		// 最も新しいバージョンを有効なものとして扱い、警告を出す
+		if rec.Code != http.StatusOK {
+			t.Errorf("fallback: status = %d, body = %s, want 200 with the latest version", rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(logs.String(), "fallback to latest version: 2") {
+			t.Errorf("fallback: logs = %s, want a warning", logs.String())
+		}
+	}
+}
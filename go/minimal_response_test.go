@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newTestUpdateDeckDB カード11〜13を所持するユーザーのデッキの付け替えに応答する
+func newTestUpdateDeckDB() *fakeSQL {
+	fake := (&fakeSQL{}).withDevice()
+	fake.onQuery("FROM user_cards", []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11)}, {int64(12)}, {int64(13)}}
+	})
+	fake.onExec("UPDATE user_decks", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_decks", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+// newTestRewardDB カード11〜13を装備したユーザーの放置報酬の受け取りに応答する
+func newTestRewardDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT isu_coin, last_getreward_at FROM users", []string{"isu_coin", "last_getreward_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0), int64(900)}}
+	})
+	fake.onQuery("LEFT JOIN user_devices", []string{"id", "isu_coin", "last_getreward_at", "device_id"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[1], int64(0), int64(900), int64(1)}}
+	})
+	fake.onQuery("FROM user_decks", []string{"id", "user_id", "user_card_id_1", "user_card_id_2", "user_card_id_3"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], int64(11), int64(12), int64(13)}}
+	})
+	fake.onQuery("FROM user_cards", []string{"id", "amount_per_sec"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11), int64(1)}, {int64(12), int64(2)}, {int64(13), int64(3)}}
+	})
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO reward_histories", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestMinimalResponse(t *testing.T) {
+	endpoints := []struct {
+		name    string
+		route   string
+		path    string
+		body    string
+		write   string
+		open    func() *fakeSQL
+		handler func(h *Handler) echo.HandlerFunc
+	}{
+		{
+			name:    "updateDeck",
+			route:   "/user/:userID/card",
+			path:    "/user/100/card",
+			body:    `{"viewerId":"viewer","cardIds":[11,12,13]}`,
+			write:   "INSERT INTO user_decks",
+			open:    newTestUpdateDeckDB,
+			handler: func(h *Handler) echo.HandlerFunc { return h.updateDeck },
+		},
+		{
+			name:    "reward",
+			route:   "/user/:userID/reward",
+			path:    "/user/100/reward",
+			body:    `{"viewerId":"viewer"}`,
+			write:   "INSERT INTO reward_histories",
+			open:    newTestRewardDB,
+			handler: func(h *Handler) echo.HandlerFunc { return h.reward },
+		},
+	}
+	for _, ep := range endpoints {
+		for _, minimal := range []bool{false, true} {
+			fake := ep.open()
+			h := newTestHandler(t, fake)
+			path := ep.path
+			if minimal {
+				path += "?minimal=1"
+			}
+
+			rec := postJSON(ep.route, ep.handler(h), path, ep.body)
+			if fake.executed(ep.write) != 1 {
+				t.Errorf("%s minimal=%v: committed = %v, want the update committed", ep.name, minimal, fake.committed)
+			}
+			if minimal {
+				// 更新は行い、結果を返さない
+				if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+					t.Errorf("%s minimal: status = %d, body = %s, want 204 without a body", ep.name, rec.Code, rec.Body.String())
+				}
+				continue
+			}
+			// 指定しない場合はこれまでどおり更新したリソースを返す
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"updatedResources"`) {
+				t.Errorf("%s default: status = %d, body = %s, want 200 with updatedResources", ep.name, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
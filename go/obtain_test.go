@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// newTestObtainDB 強化素材とカードの付与に応答する。item_id 10と12は所持済みで、11は新しく作る
+func newTestObtainDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_items", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(100), args[0], int64(ItemTypeEnhanceA), int64(12), int64(1)},
+			{int64(900), args[0], int64(ItemTypeEnhanceA), int64(10), int64(1)},
+		}
+	})
+	fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[:len(args)-2] {
+			rows = append(rows, []driver.Value{id, int64(ItemTypeEnhanceA)})
+		}
+		return rows
+	})
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.onExec("INSERT INTO user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_cards", func(args []driver.Value) (int64, error) { return 3, nil })
+	return fake
+}
+
+func TestObtainItemsBatchOrderIsDeterministic(t *testing.T) {
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeEnhanceA, ItemID: 12, Amount: 1},
+		{ID: 2, ItemType: ItemTypeCard, ItemID: 3, Amount: 1},
+		{ID: 3, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 2},
+		{ID: 4, ItemType: ItemTypeCard, ItemID: 2, Amount: 2},
+		{ID: 5, ItemType: ItemTypeEnhanceA, ItemID: 11, Amount: 3},
+	}
+	amountPerSec := 1
+	rng := rand.New(rand.NewSource(1))
+
+	var firstItems, firstCards []int64
+	for run := 0; run < 10; run++ {
+		h := newTestHandler(t)
+		h.Cache.SetItemMaster(&ItemMaster{ID: 2, ItemType: ItemTypeCard, AmountPerSec: &amountPerSec})
+		h.Cache.SetItemMaster(&ItemMaster{ID: 3, ItemType: ItemTypeCard, AmountPerSec: &amountPerSec})
+		tx, err := newTestObtainDB().open().Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 同じ付与をプレゼントの並び順だけ変えて繰り返す
+		shuffled := append([]*UserPresent{}, presents...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		obtained, err := h.obtainItemsBatch(context.Background(), tx, shuffled, 100, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Rollback() //nolint:errcheck
+
+		items := make([]int64, 0, len(obtained.Items))
+		for _, item := range obtained.Items {
+			items = append(items, item.ItemID)
+		}
+		cards := make([]int64, 0, len(obtained.Cards))
+		for _, card := range obtained.Cards {
+			cards = append(cards, card.CardID)
+		}
+		if run == 0 {
+			firstItems, firstCards = items, cards
+		} else if !reflect.DeepEqual(items, firstItems) || !reflect.DeepEqual(cards, firstCards) {
+			t.Fatalf("run %d: items %v, cards %v, want %v and %v as in the first run", run+1, items, cards, firstItems, firstCards)
+		}
+
+		// レスポンスではid順に並ぶ
+		res := makeUpdatedResources(1000, nil, nil, obtained.Cards, nil, obtained.Items, nil, nil)
+		if !sort.SliceIsSorted(res.UserItems, func(i, j int) bool { return res.UserItems[i].ID < res.UserItems[j].ID }) ||
+			!sort.SliceIsSorted(res.UserCards, func(i, j int) bool { return res.UserCards[i].ID < res.UserCards[j].ID }) {
+			t.Fatalf("run %d: updated resources are not in id order", run+1)
+		}
+	}
+	if !reflect.DeepEqual(firstItems, []int64{10, 11, 12}) || !reflect.DeepEqual(firstCards, []int64{2, 2, 3}) {
+		t.Errorf("items %v, cards %v, want item_id order [10 11 12] and [2 2 3]", firstItems, firstCards)
+	}
+}
+
+func TestConcurrentObtainItemsBatchLocksInIDOrder(t *testing.T) {
+	// 所持済みの行のidは、item_idとは逆の順になっている
+	rowIDs := map[int64]int64{10: 3, 20: 2, 30: 1}
+	var mu sync.Mutex
+	unlockedReads := 0
+	updated := make([][]int64, 0)
+	fake := &fakeSQL{}
+	fake.onQuery("ORDER BY id FOR UPDATE", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, itemID := range args[1:] {
+			rows = append(rows, []driver.Value{rowIDs[itemID.(int64)], args[0], int64(ItemTypeEnhanceA), itemID, int64(1)})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][0].(int64) < rows[j][0].(int64) })
+		return rows
+	})
+	fake.onQuery("FROM user_items", []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		unlockedReads++
+		return nil
+	})
+	fake.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[:len(args)-2] {
+			rows = append(rows, []driver.Value{id, int64(ItemTypeEnhanceA)})
+		}
+		return rows
+	})
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) {
+		ids := make([]int64, len(args))
+		for i, id := range args {
+			ids[i] = id.(int64)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		updated = append(updated, ids)
+		return int64(len(ids)), nil
+	})
+	db := fake.open()
+	h := newTestHandler(t)
+
+	// 同じユーザーへの、重なりのあるアイテムの付与を逆の並びで同時に行う
+	grants := [][]int64{{30, 10}, {10, 20, 30}}
+	var wg sync.WaitGroup
+	for _, itemIDs := range grants {
+		presents := make([]*UserPresent, len(itemIDs))
+		for i, itemID := range itemIDs {
+			presents[i] = &UserPresent{ID: int64(i + 1), ItemType: ItemTypeEnhanceA, ItemID: itemID, Amount: 1}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.Beginx()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tx.Rollback() //nolint:errcheck
+			if _, err := h.obtainItemsBatch(context.Background(), tx, presents, 100, 1000); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if unlockedReads != 0 {
+		t.Errorf("read user_items %d times without locking in id order", unlockedReads)
+	}
+	if len(updated) != len(grants) {
+		t.Fatalf("updated %v, want one update per grant", updated)
+	}
+	for _, ids := range updated {
+		if !sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }) {
+			t.Errorf("updated rows in order %v, want ascending ids", ids)
+		}
+	}
+}
+
+func TestObtainItemsBatchAggregatesMixedBatch(t *testing.T) {
+	var coin driver.Value
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT isu_coin FROM users", []string{"isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1000)}}
+	})
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) {
+		coin = args[0]
+		return 1, nil
+	})
+	fake.rules = append(fake.rules, newTestObtainDB().rules...)
+	amountPerSec := 1
+	h := newTestHandler(t)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 1, ItemType: ItemTypeCoin})
+	h.Cache.SetItemMaster(&ItemMaster{ID: 2, ItemType: ItemTypeCard, AmountPerSec: &amountPerSec})
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 同じコイン・強化素材のプレゼントは合算して付与する
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 2},
+		{ID: 2, ItemType: ItemTypeCoin, ItemID: 1, Amount: 100},
+		{ID: 3, ItemType: ItemTypeCard, ItemID: 2, Amount: 2},
+		{ID: 4, ItemType: ItemTypeEnhanceA, ItemID: 11, Amount: 4},
+		{ID: 5, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 3},
+		{ID: 6, ItemType: ItemTypeCoin, ItemID: 1, Amount: 50},
+		{ID: 7, ItemType: ItemTypeEnhanceA, ItemID: 12, Amount: 1},
+	}
+	obtained, err := h.obtainItemsBatch(context.Background(), tx, presents, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if coin != int64(1150) {
+		t.Errorf("isu_coin = %v, want 1000 plus 150", coin)
+	}
+	if len(obtained.Cards) != 2 {
+		t.Errorf("created %d cards, want 2", len(obtained.Cards))
+	}
+	// 所持済みの10と12は所持数に加算し、11は新しく作る
+	amounts := make(map[int64]int)
+	for _, item := range obtained.Items {
+		amounts[item.ItemID] = item.Amount
+	}
+	if want := map[int64]int{10: 6, 11: 4, 12: 2}; !reflect.DeepEqual(amounts, want) {
+		t.Errorf("item amounts = %v, want %v", amounts, want)
+	}
+
+	// コイン、カード、強化素材の順に書き込む
+	order := make([]string, 0)
+	for _, q := range fake.committed {
+		for _, match := range []string{"UPDATE users", "INSERT INTO user_cards", "UPDATE user_items", "INSERT INTO user_items"} {
+			if countMatches([]string{q}, match) > 0 {
+				order = append(order, match)
+			}
+		}
+	}
+	if want := []string{"UPDATE users", "INSERT INTO user_cards", "UPDATE user_items", "INSERT INTO user_items"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("write order = %v, want %v", order, want)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// events outbox
+
+const (
+	// EventTypeCoinGrant 管理画面からの一括のコイン付与。シャードごとに1件
+	EventTypeCoinGrant string = "coin_grant"
+	// EventTypeCardMaxLevel カードが最大レベルに達した
+	EventTypeCardMaxLevel string = "card_max_level"
+	// EventTypeMergeCompensation シャードをまたぐアカウントの統合で、統合元から所持品を取り除く補償の処理。統合先のシャードに書く
+	EventTypeMergeCompensation string = "merge_compensation"
+
+	// outboxRelayLockName シャードごとに中継するプロセスを1つに絞るための名前付きロック
+	outboxRelayLockName string = "events_outbox_relay"
+	// outboxLastErrorMaxLength events_outbox.last_errorに残すエラーの最大長
+	outboxLastErrorMaxLength int = 255
+)
+
+// OutboxEvent シャードをまたいで伝えるイベント
+// 元になった変更と同じトランザクションでevents_outboxに書き、OutboxRelayが後から中継する
+type OutboxEvent struct {
+	ID          int64           `json:"id" db:"id"`
+	EventType   string          `json:"eventType" db:"event_type"`
+	UserID      *int64          `json:"userId,omitempty" db:"user_id"`
+	Payload     json.RawMessage `json:"payload" db:"payload"`
+	CreatedAt   int64           `json:"createdAt" db:"created_at"`
+	ProcessedAt *int64          `json:"processedAt,omitempty" db:"processed_at"`
+	Attempts    int             `json:"attempts" db:"attempts"`
+	LastError   *string         `json:"lastError,omitempty" db:"last_error"`
+	FailedAt    *int64          `json:"failedAt,omitempty" db:"failed_at"`
+
+	// Shard 書き込まれたシャード。中継時に設定する
+	Shard int `json:"shard" db:"-"`
+}
+
+// insertOutboxEvent イベントをevents_outboxに書く。元になった変更と同じトランザクションで呼ぶこと
+func insertOutboxEvent(tx sqlx.Execer, eventType string, userID *int64, payload interface{}, createdAt int64) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO events_outbox(event_type, user_id, payload, created_at) VALUES (?, ?, ?, ?)"
+	_, err = tx.Exec(query, eventType, userID, string(body), createdAt)
+	return err
+}
+
+// OutboxHandler 中継されたイベントを処理する。エラーを返した場合、そのイベントは次の周期で再度中継される
+// 中継は少なくとも1回(at-least-once)で、処理済みにする前にプロセスが落ちた場合などは同じイベントが再度渡される
+// ハンドラはイベントのidで重複を除くなど、同じイベントを複数回処理しても結果が変わらないようにすること
+type OutboxHandler func(event *OutboxEvent) error
+
+// OutboxRelay 各シャードのevents_outboxから未処理のイベントを読み、登録されたハンドラに渡す
+// 今はプロセス内のハンドラに渡すのみで、外部への配信はハンドラとして追加する
+type OutboxRelay struct {
+	dbs       []*sqlx.DB
+	interval  time.Duration
+	batchSize int
+	// maxAttempts ハンドラがこの回数失敗したイベントはデッドレターとして中継をやめる。0以下の場合は無制限
+	maxAttempts int
+	logger      echo.Logger
+
+	mu       sync.RWMutex
+	handlers map[string][]OutboxHandler
+
+	relayed      int64
+	failed       int64
+	deadLettered int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewOutboxRelay 設定に応じて中継を作成する。Startを呼ぶまでは中継しない
+func NewOutboxRelay(dbs []*sqlx.DB, logger echo.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		dbs:         dbs,
+		interval:    time.Duration(getEnvInt("ISUCON_OUTBOX_RELAY_INTERVAL_MS", 1000)) * time.Millisecond,
+		batchSize:   getEnvInt("ISUCON_OUTBOX_RELAY_BATCH_SIZE", 100),
+		maxAttempts: getEnvInt("ISUCON_OUTBOX_MAX_ATTEMPTS", 5),
+		logger:      logger,
+		handlers:    make(map[string][]OutboxHandler),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Subscribe イベントの種類ごとにハンドラを登録する
+func (r *OutboxRelay) Subscribe(eventType string, handler OutboxHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[eventType] = append(r.handlers[eventType], handler)
+}
+
+// Start シャードごとに中継のワーカーを起動する
+// ISUCON_OUTBOX_RELAY_INTERVAL_MS が0以下の場合は起動せず、イベントは未処理のまま溜まる
+func (r *OutboxRelay) Start() {
+	if r.interval <= 0 {
+		return
+	}
+
+	for i, db := range r.dbs {
+		r.wg.Add(1)
+		go func(shard int, db *sqlx.DB) {
+			defer r.wg.Done()
+
+			ticker := time.NewTicker(r.interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-r.stop:
+					return
+				case <-ticker.C:
+					if _, err := r.RelayShard(shard, db); err != nil {
+						r.logger.Errorf("outbox relay failed: shard=%d, err=%v", shard, err)
+					}
+				}
+			}
+		}(i, db)
+	}
+}
+
+// Close 中継のワーカーを止め、処理中の中継が終わるまで待つ
+func (r *OutboxRelay) Close() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// RelayShard 1シャード分の未処理のイベントを古い順にbatchSize件まで中継し、中継した件数を返す
+// シャードごとに名前付きロックを取り、取れなかった場合は他のプロセスが中継中なので何もしない
+// 1つのプロセスだけが古い順に中継するため、複数のプロセスで動かしてもイベントの順序は入れ替わらない
+// ハンドラが失敗した場合は順序を保つためそこで打ち切り、失敗したイベントは次の周期で再度中継する
+// 失敗がmaxAttempts回に達したイベントはデッドレター(failed_at)として以降は中継せず、後続のイベントの中継を続ける
+// デッドレターを再度中継するには、原因を取り除いてから failed_at と attempts を戻す
+// ハンドラを呼んだ後に処理済みにできなかった場合(コミットの失敗など)も再度中継するため、中継はat-least-onceとなる
+func (r *OutboxRelay) RelayShard(shard int, db *sqlx.DB) (int, error) {
+	ctx := context.Background()
+	// 名前付きロックは接続ごとのため、ロックの取得からトランザクション、解放までを同じ接続で行う
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, 0)", outboxRelayLockName); err != nil {
+		return 0, err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return 0, nil
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", outboxRelayLockName) //nolint:errcheck
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	events := make([]*OutboxEvent, 0)
+	query := "SELECT * FROM events_outbox WHERE processed_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT ? FOR UPDATE"
+	if err := tx.Select(&events, query, r.batchSize); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().Unix()
+	processed := make([]int64, 0, len(events))
+	var handleErr error
+	for _, event := range events {
+		event.Shard = shard
+		err := r.dispatch(event)
+		if err == nil {
+			processed = append(processed, event.ID)
+			continue
+		}
+		atomic.AddInt64(&r.failed, 1)
+
+		event.Attempts++
+		lastError := err.Error()
+		if len(lastError) > outboxLastErrorMaxLength {
+			lastError = lastError[:outboxLastErrorMaxLength]
+		}
+		var failedAt *int64
+		if r.maxAttempts > 0 && event.Attempts >= r.maxAttempts {
+			failedAt = &now
+		}
+		query := "UPDATE events_outbox SET attempts=?, last_error=?, failed_at=? WHERE id=?"
+		if _, err := tx.Exec(query, event.Attempts, lastError, failedAt, event.ID); err != nil {
+			return 0, err
+		}
+		if failedAt == nil {
+			handleErr = err
+			break
+		}
+		// 1つのイベントでシャードの中継が止まり続けないよう、デッドレターにしたイベントは飛ばして後続を中継する
+		atomic.AddInt64(&r.deadLettered, 1)
+		r.logger.Errorf("outbox event dead-lettered: shard=%d, id=%d, type=%s, attempts=%d, err=%v", shard, event.ID, event.EventType, event.Attempts, err)
+	}
+
+	if len(processed) > 0 {
+		query, params, err := sqlx.In("UPDATE events_outbox SET processed_at=? WHERE id IN (?)", now, processed)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(query, params...); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&r.relayed, int64(len(processed)))
+
+	return len(processed), handleErr
+}
+
+// dispatch イベントを種類に応じたハンドラに渡す。ハンドラがない種類のイベントは処理済みとする
+func (r *OutboxRelay) dispatch(event *OutboxEvent) error {
+	r.mu.RLock()
+	handlers := r.handlers[event.EventType]
+	r.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats 起動してから中継した件数、失敗した件数とデッドレターにした件数
+func (r *OutboxRelay) Stats() *OutboxRelayStats {
+	return &OutboxRelayStats{
+		Relayed:      atomic.LoadInt64(&r.relayed),
+		Failed:       atomic.LoadInt64(&r.failed),
+		DeadLettered: atomic.LoadInt64(&r.deadLettered),
+	}
+}
+
+type OutboxRelayStats struct {
+	Relayed      int64 `json:"relayed"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"deadLettered"`
+}
+
+// logOutboxEvent 中継されたイベントをログに出すハンドラ
+func logOutboxEvent(logger echo.Logger) OutboxHandler {
+	return func(event *OutboxEvent) error {
+		logger.Infof("outbox event: shard=%d, id=%d, type=%s, payload=%s", event.Shard, event.ID, event.EventType, string(event.Payload))
+		return nil
+	}
+}
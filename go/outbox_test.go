@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/labstack/gommon/log"
+)
+
+func TestOutboxEventRecordedWithSourceChange(t *testing.T) {
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.onExec("INSERT INTO events_outbox", func(args []driver.Value) (int64, error) { return 1, nil })
+
+	updated, err := grantCoinsToShard(context.Background(), fake.open(), []int64{1, 2}, false, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 2 {
+		t.Errorf("updated = %d, want 2", updated)
+	}
+	if fake.executed("UPDATE users") != 1 || fake.executed("INSERT INTO events_outbox") != 1 {
+		t.Errorf("committed = %v, want the grant and its event in one commit", fake.committed)
+	}
+}
+
+func TestOutboxEventRolledBackWithSourceChange(t *testing.T) {
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) { return 2, nil })
+	fake.onExec("INSERT INTO events_outbox", func(args []driver.Value) (int64, error) { return 0, errors.New("lock wait timeout") })
+
+	if _, err := grantCoinsToShard(context.Background(), fake.open(), []int64{1, 2}, false, 100, 1000); err == nil {
+		t.Fatal("grant succeeded without its event")
+	}
+	if len(fake.committed) != 0 || fake.discarded("UPDATE users") != 1 {
+		t.Errorf("committed = %v, rolledBack = %v, want the grant rolled back with its event", fake.committed, fake.rolledBack)
+	}
+}
+
+var outboxColumns = []string{"id", "event_type", "user_id", "payload", "created_at", "processed_at", "attempts", "last_error", "failed_at"}
+
+// fakeOutbox events_outboxをメモリに持ち、RelayShardが発行する文に応答する
+type fakeOutbox struct {
+	events []*OutboxEvent
+}
+
+func (o *fakeOutbox) open() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("GET_LOCK", []string{"locked"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1)}}
+	})
+	fake.onExec("RELEASE_LOCK", func(args []driver.Value) (int64, error) { return 0, nil })
+	fake.onQuery("FROM events_outbox", outboxColumns, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, e := range o.events {
+			if e.ProcessedAt != nil || e.FailedAt != nil || int64(len(rows)) >= args[0].(int64) {
+				continue
+			}
+			rows = append(rows, []driver.Value{e.ID, e.EventType, nil, []byte(e.Payload), e.CreatedAt, nil, int64(e.Attempts), nil, nil})
+		}
+		return rows
+	})
+	fake.onExec("SET processed_at", func(args []driver.Value) (int64, error) {
+		at := args[0].(int64)
+		for _, id := range args[1:] {
+			o.event(id.(int64)).ProcessedAt = &at
+		}
+		return int64(len(args) - 1), nil
+	})
+	fake.onExec("SET attempts", func(args []driver.Value) (int64, error) {
+		e := o.event(args[3].(int64))
+		e.Attempts = int(args[0].(int64))
+		if args[2] != nil {
+			at := args[2].(int64)
+			e.FailedAt = &at
+		}
+		return 1, nil
+	})
+	return fake
+}
+
+func (o *fakeOutbox) event(id int64) *OutboxEvent {
+	for _, e := range o.events {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func newTestOutboxRelay(maxAttempts int) *OutboxRelay {
+	return &OutboxRelay{
+		batchSize:   10,
+		maxAttempts: maxAttempts,
+		logger:      log.New("test"),
+		handlers:    make(map[string][]OutboxHandler),
+	}
+}
+
+func newTestOutbox(n int) *fakeOutbox {
+	o := &fakeOutbox{}
+	for id := int64(1); id <= int64(n); id++ {
+		o.events = append(o.events, &OutboxEvent{ID: id, EventType: EventTypeCoinGrant, Payload: []byte(`{}`), CreatedAt: 1000})
+	}
+	return o
+}
+
+func TestOutboxRelayRelaysOnce(t *testing.T) {
+	outbox := newTestOutbox(3)
+	db := outbox.open().open()
+	relay := newTestOutboxRelay(5)
+	handled := make(map[int64]int)
+	relay.Subscribe(EventTypeCoinGrant, func(event *OutboxEvent) error {
+		handled[event.ID]++
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		n, err := relay.RelayShard(0, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: 3, false: 0}[i == 0]; n != want {
+			t.Errorf("cycle %d relayed %d events, want %d", i+1, n, want)
+		}
+	}
+	for id := int64(1); id <= 3; id++ {
+		if handled[id] != 1 {
+			t.Errorf("event %d was handled %d times, want once", id, handled[id])
+		}
+	}
+}
+
+func TestOutboxRelayDeadLettersFailingEvent(t *testing.T) {
+	outbox := newTestOutbox(3)
+	db := outbox.open().open()
+	relay := newTestOutboxRelay(3)
+	handled := make([]int64, 0)
+	relay.Subscribe(EventTypeCoinGrant, func(event *OutboxEvent) error {
+		if event.ID == 1 {
+			return errors.New("broken payload")
+		}
+		handled = append(handled, event.ID)
+		return nil
+	})
+
+	// 上限に達するまでは順序を保つため、失敗したイベントより後は中継しない
+	for i := 0; i < 2; i++ {
+		if n, err := relay.RelayShard(0, db); err == nil || n != 0 {
+			t.Fatalf("cycle %d = (%d, %v), want to stop at the failing event", i+1, n, err)
+		}
+	}
+	if len(handled) != 0 {
+		t.Fatalf("handled %v behind the failing event", handled)
+	}
+
+	n, err := relay.RelayShard(0, db)
+	if err != nil || n != 2 {
+		t.Fatalf("cycle 3 = (%d, %v), want the later events relayed after the dead letter", n, err)
+	}
+	if e := outbox.event(1); e.FailedAt == nil || e.Attempts != 3 {
+		t.Errorf("event 1 = attempts %d, failedAt %v, want dead-lettered after 3 attempts", e.Attempts, e.FailedAt)
+	}
+	if n, err := relay.RelayShard(0, db); err != nil || n != 0 {
+		t.Errorf("cycle 4 = (%d, %v), want nothing left to relay", n, err)
+	}
+	if stats := relay.Stats(); stats.DeadLettered != 1 || stats.Failed != 3 || stats.Relayed != 2 {
+		t.Errorf("stats = %+v, want relayed 2, failed 3, deadLettered 1", stats)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidatePlatformType(t *testing.T) {
+	tests := []struct {
+		platformType int
+		wantErr      bool
+	}{
+		{platformType: math.MinInt32, wantErr: true},
+		{platformType: -1, wantErr: true},
+		{platformType: 0, wantErr: true},
+		{platformType: PlatformWeb},
+		{platformType: PlatformIOS},
+		{platformType: PlatformAndroid},
+		{platformType: 4, wantErr: true},
+		{platformType: math.MaxInt32, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validatePlatformType(tt.platformType)
+		if tt.wantErr && err != ErrInvalidPlatformType {
+			t.Errorf("validatePlatformType(%d) = %v, want ErrInvalidPlatformType", tt.platformType, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("validatePlatformType(%d) = %v, want nil", tt.platformType, err)
+		}
+	}
+}
+
+func TestCreateUserRejectsUnknownPlatformType(t *testing.T) {
+	// 検証はDBに触れる前に行う
+	h := newTestIDHandler(t)
+
+	for _, platformType := range []int{0, 4} {
+		rec := postJSON("/user", h.createUser, "/user", fmt.Sprintf(`{"viewerId":"viewer","platformType":%d}`, platformType))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrInvalidPlatformType.Error()) {
+			t.Errorf("platformType=%d: status = %d, body = %s, want 400 with %v", platformType, rec.Code, rec.Body.String(), ErrInvalidPlatformType)
+		}
+	}
+}
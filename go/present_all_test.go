@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+)
+
+// presentAllInserts 全員プレゼントの付与で挿入したプレゼントと履歴
+type presentAllInserts struct {
+	presentStatements, historyStatements int
+	presentSources, historyPresentAllIDs map[int64]bool
+}
+
+// newTestPresentAllDB n件の全員プレゼントの付与に応答し、挿入した行をinsertsに記録する
+// 履歴の挿入がfailHistoryAt回目になったらエラーを返す。0の場合は失敗しない
+func newTestPresentAllDB(n int, inserts *presentAllInserts, failHistoryAt int) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM present_all_masters", []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0, n)
+		for id := int64(1); id <= int64(n); id++ {
+			rows = append(rows, []driver.Value{id, int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), fmt.Sprintf("gift%d", id)})
+		}
+		return rows
+	})
+	fake.onQuery("FROM user_present_all_received_history", []string{"present_all_id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	// プレゼントは11列、履歴は6列ずつ一括挿入する
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) {
+		inserts.presentStatements++
+		for i := 0; i+11 <= len(args); i += 11 {
+			inserts.presentSources[args[i+8].(int64)] = true
+		}
+		return int64(len(args) / 11), nil
+	})
+	fake.onExec("INSERT INTO user_present_all_received_history", func(args []driver.Value) (int64, error) {
+		inserts.historyStatements++
+		if inserts.historyStatements == failHistoryAt {
+			return 0, fmt.Errorf("history insert failed")
+		}
+		for i := 0; i+6 <= len(args); i += 6 {
+			inserts.historyPresentAllIDs[args[i+2].(int64)] = true
+		}
+		return int64(len(args) / 6), nil
+	})
+	return fake
+}
+
+func newPresentAllInserts() *presentAllInserts {
+	return &presentAllInserts{presentSources: make(map[int64]bool), historyPresentAllIDs: make(map[int64]bool)}
+}
+
+func TestObtainPresentInsertsInBatches(t *testing.T) {
+	prev := presentInsertBatchSize
+	presentInsertBatchSize = 30
+	t.Cleanup(func() { presentInsertBatchSize = prev })
+
+	inserts := newPresentAllInserts()
+	fake := newTestPresentAllDB(200, inserts, 0)
+	h := newTestIDHandler(t)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	presents, err := h.obtainPresent(context.Background(), tx, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 200件を30件ずつ7回に分けて挿入し、プレゼントと履歴の全員プレゼントが一致する
+	if inserts.presentStatements != 7 || inserts.historyStatements != 7 {
+		t.Errorf("inserted presents in %d and histories in %d statements, want 7 each", inserts.presentStatements, inserts.historyStatements)
+	}
+	if len(presents) != 200 || len(inserts.presentSources) != 200 || len(inserts.historyPresentAllIDs) != 200 {
+		t.Fatalf("returned %d, inserted %d presents and %d histories, want 200 each", len(presents), len(inserts.presentSources), len(inserts.historyPresentAllIDs))
+	}
+	for id := range inserts.presentSources {
+		if !inserts.historyPresentAllIDs[id] {
+			t.Errorf("present-all %d inserted without its history", id)
+		}
+	}
+}
+
+func TestObtainPresentBatchFailureKeepsNothing(t *testing.T) {
+	prev := presentInsertBatchSize
+	presentInsertBatchSize = 30
+	t.Cleanup(func() { presentInsertBatchSize = prev })
+
+	// 3回目の履歴の挿入で失敗する
+	fake := newTestPresentAllDB(200, newPresentAllInserts(), 3)
+	h := newTestIDHandler(t)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.obtainPresent(context.Background(), tx, 100, 1000); err == nil {
+		t.Fatal("obtainPresent succeeded, want the history insert error")
+	}
+	tx.Rollback() //nolint:errcheck
+
+	if fake.executed("INSERT INTO user_presents") != 0 || fake.executed("INSERT INTO user_present_all_received_history") != 0 {
+		t.Errorf("committed = %v, want neither presents nor histories kept", fake.committed)
+	}
+}
+
+func BenchmarkObtainPresent200(b *testing.B) {
+	h := newTestIDHandler(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tx, err := newTestPresentAllDB(200, newPresentAllInserts(), 0).open().Beginx()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, err := h.obtainPresent(context.Background(), tx, 100, 1000); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		tx.Rollback() //nolint:errcheck
+		b.StartTimer()
+	}
+}
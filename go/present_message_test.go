@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// masterCSVTableFor フォーム名からマスタのCSVの定義を探す
+func masterCSVTableFor(t *testing.T, formName string) *masterCSVTable {
+	t.Helper()
+	for _, table := range masterCSVTables {
+		if table.formName == formName {
+			return table
+		}
+	}
+	t.Fatalf("no master table for %s", formName)
+	return nil
+}
+
+func TestSanitizePresentMessage(t *testing.T) {
+	prev := presentMessageMaxLength
+	presentMessageMaxLength = 10
+	t.Cleanup(func() { presentMessageMaxLength = prev })
+
+	// 制御文字は取り除き、取り除いた後の文字数で判定する
+	got, err := sanitizePresentMessage("ログイン\x00ボーナス\r\n\t")
+	if err != nil || got != "ログインボーナス" {
+		t.Errorf("sanitized = (%q, %v), want ログインボーナス", got, err)
+	}
+	if got, err := sanitizePresentMessage(strings.Repeat("あ", 10) + "\x1b"); err != nil || got != strings.Repeat("あ", 10) {
+		t.Errorf("message at the limit = (%q, %v), want it accepted", got, err)
+	}
+
+	// 上限を超える場合は切り詰めずにエラーを返す
+	if got, err := sanitizePresentMessage(strings.Repeat("あ", 11)); errors.Cause(err) != ErrPresentMessageTooLong || got != "" {
+		t.Errorf("over-long message = (%q, %v), want ErrPresentMessageTooLong", got, err)
+	}
+}
+
+func TestMasterImportRejectsLongPresentMessage(t *testing.T) {
+	prev := presentMessageMaxLength
+	presentMessageMaxLength = 12
+	t.Cleanup(func() { presentMessageMaxLength = prev })
+
+	presentAll := masterCSVTableFor(t, "presentAllMaster")
+	row, err := presentAll.toRow([]string{"1", "0", "2000", "1", "1", "100", "お詫び\x07です", "0"})
+	if err != nil || row["present_message"] != "お詫びです" {
+		t.Errorf("row = (%v, %v), want the control character stripped", row["present_message"], err)
+	}
+	if _, err := presentAll.toRow([]string{"1", "0", "2000", "1", "1", "100", strings.Repeat("あ", 13), "0"}); errors.Cause(err) != ErrPresentMessageTooLong {
+		t.Errorf("over-long present-all message err = %v, want ErrPresentMessageTooLong", err)
+	}
+
+	// ガチャ名は「の付与アイテムです」を付けた長さで判定する
+	gacha := masterCSVTableFor(t, "gachaMaster")
+	if _, err := gacha.toRow([]string{"1", "ガチャ", "0", "2000", "1", "0"}); err != nil {
+		t.Errorf("short gacha name err = %v, want nil", err)
+	}
+	if _, err := gacha.toRow([]string{"1", "ロングガチャ", "0", "2000", "1", "0"}); errors.Cause(err) != ErrPresentMessageTooLong {
+		t.Errorf("gacha name overflowing the present message err = %v, want ErrPresentMessageTooLong", err)
+	}
+}
+
+func TestObtainPresentRejectsLongPresentMessage(t *testing.T) {
+	prev := presentMessageMaxLength
+	presentMessageMaxLength = 10
+	t.Cleanup(func() { presentMessageMaxLength = prev })
+
+	// マスタを直接書き換えた場合も、プレゼントを作る際に弾く
+	fake := &fakeSQL{}
+	fake.onQuery("FROM present_all_masters", []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(5), int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), strings.Repeat("あ", 11)}}
+	})
+	fake.onQuery("FROM user_present_all_received_history", []string{"present_all_id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	h := newTestIDHandler(t)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := h.obtainPresent(context.Background(), tx, 100, 1000); errors.Cause(err) != ErrPresentMessageTooLong {
+		t.Errorf("err = %v, want ErrPresentMessageTooLong", err)
+	}
+}
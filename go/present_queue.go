@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// present grant queue
+
+// PresentGrantQueue 全員プレゼントの付与をシャードごとに非同期でまとめてINSERTするキュー
+// ログインが集中した際のINSERTを平準化するためのもので、付与したプレゼントは少し遅れて一覧に反映される
+// 付与履歴は先にコミット済みのため、INSERTに失敗した付与は間隔を空けて成功するまで再試行し、取りこぼさない
+// ISUCON_ASYNC_PRESENT_GRANT=1 の場合のみ有効。無効な場合はnilのままで、各メソッドはnilでも呼び出せる
+type PresentGrantQueue struct {
+	// insert shard番目のシャードにプレゼントを一括INSERTする
+	insert     func(shard int, presents []*UserPresent) error
+	queues     []chan *UserPresent
+	batchSize  int
+	interval   time.Duration
+	retryDelay time.Duration
+	// retryMaxDelay 再試行の間隔は失敗するごとに倍にし、この長さで頭打ちにする
+	retryMaxDelay time.Duration
+	logger        echo.Logger
+	wg            sync.WaitGroup
+
+	// mu closedの確認とキューへの送信を、Closeでのチャネルのcloseと排他にする
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newPresentGrantQueue 設定に応じてキューを作成し、シャードごとのワーカーを起動する
+func newPresentGrantQueue(dbs []*sqlx.DB, logger echo.Logger) *PresentGrantQueue {
+	if getEnv("ISUCON_ASYNC_PRESENT_GRANT", "") != "1" {
+		return nil
+	}
+
+	q := &PresentGrantQueue{
+		insert: func(shard int, presents []*UserPresent) error {
+			return insertPresents(dbs[shard], presents)
+		},
+		queues:        make([]chan *UserPresent, len(dbs)),
+		batchSize:     getEnvInt("ISUCON_ASYNC_PRESENT_BATCH_SIZE", 100),
+		interval:      time.Duration(getEnvInt("ISUCON_ASYNC_PRESENT_FLUSH_MS", 50)) * time.Millisecond,
+		retryDelay:    10 * time.Millisecond,
+		retryMaxDelay: time.Duration(getEnvInt("ISUCON_ASYNC_PRESENT_RETRY_MAX_MS", 1000)) * time.Millisecond,
+		logger:        logger,
+	}
+	if q.interval <= 0 {
+		q.interval = 50 * time.Millisecond
+	}
+	q.start(getEnvInt("ISUCON_ASYNC_PRESENT_BUFFER", 10000), getEnvInt("ISUCON_ASYNC_PRESENT_WORKERS", 2))
+
+	return q
+}
+
+// start シャードごとにキューを作り、ワーカーを起動する
+func (q *PresentGrantQueue) start(bufferSize, workers int) {
+	for i := range q.queues {
+		q.queues[i] = make(chan *UserPresent, bufferSize)
+		for j := 0; j < workers; j++ {
+			q.wg.Add(1)
+			go q.work(i)
+		}
+	}
+}
+
+// Enabled 非同期付与が有効かどうか
+func (q *PresentGrantQueue) Enabled() bool {
+	return q != nil
+}
+
+// Enqueue プレゼントの付与をキューに積む。付与履歴をコミットした後に呼ぶこと
+// キューが詰まっている場合は空くまで待つ。Closeの後に呼ばれた場合は、その場でINSERTし終えるまで待つ
+func (q *PresentGrantQueue) Enqueue(shard int, presents []*UserPresent) {
+	if q == nil || len(presents) == 0 {
+		return
+	}
+
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		q.deliver(shard, presents)
+		return
+	}
+	defer q.mu.RUnlock()
+	for _, p := range presents {
+		q.queues[shard] <- p
+	}
+}
+
+// Close 新規の受け付けを止め、キューに残っている付与をすべてINSERTし終えるまで待つ
+// サーバーを停止してから呼ぶこと
+func (q *PresentGrantQueue) Close() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, ch := range q.queues {
+			close(ch)
+		}
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// work キューからプレゼントを取り出し、batchSize件ごとまたは一定時間ごとにまとめてINSERTする
+func (q *PresentGrantQueue) work(shard int) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]*UserPresent, 0, q.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		q.deliver(shard, batch)
+		batch = make([]*UserPresent, 0, q.batchSize)
+	}
+
+	ch := q.queues[shard]
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) >= q.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// deliver プレゼントを一括INSERTする。失敗した場合は間隔を倍にしながら成功するまで再試行する
+// 一括INSERTは1文のため、失敗した場合は1件も挿入されておらず、同じIDのまま再試行できる
+func (q *PresentGrantQueue) deliver(shard int, presents []*UserPresent) {
+	delay := q.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := q.insert(shard, presents)
+		if err == nil {
+			return
+		}
+		q.logger.Errorf("failed to insert queued presents, retrying: shard=%d, count=%d, attempt=%d, err=%v", shard, len(presents), attempt, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > q.retryMaxDelay {
+			delay = q.retryMaxDelay
+		}
+	}
+}
+
+// insertPresents プレゼントを一括INSERTする
+func insertPresents(db sqlx.Ext, presents []*UserPresent) error {
+	query := `INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_at)
+			  VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :source, :source_id, :created_at, :updated_at)`
+	_, err := sqlx.NamedExec(db, query, presents)
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// fakePresentStore キューからINSERTされたプレゼントをシャードごとに記録する
+// failures回目までのINSERTは失敗させる
+type fakePresentStore struct {
+	mu       sync.Mutex
+	presents map[int][]*UserPresent
+	calls    int
+	failures int
+}
+
+func (s *fakePresentStore) insert(shard int, presents []*UserPresent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("connection refused")
+	}
+	if s.presents == nil {
+		s.presents = make(map[int][]*UserPresent)
+	}
+	s.presents[shard] = append(s.presents[shard], presents...)
+	return nil
+}
+
+func (s *fakePresentStore) count(shard int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.presents[shard])
+}
+
+func newTestPresentGrantQueue(store *fakePresentStore, shards, bufferSize int) *PresentGrantQueue {
+	q := &PresentGrantQueue{
+		insert:        store.insert,
+		queues:        make([]chan *UserPresent, shards),
+		batchSize:     10,
+		interval:      5 * time.Millisecond,
+		retryDelay:    time.Millisecond,
+		retryMaxDelay: 4 * time.Millisecond,
+		logger:        log.New("test"),
+	}
+	q.start(bufferSize, 2)
+	return q
+}
+
+func testPresents(userID int64, n int) []*UserPresent {
+	presents := make([]*UserPresent, 0, n)
+	for i := 0; i < n; i++ {
+		presents = append(presents, &UserPresent{ID: userID*1000 + int64(i), UserID: userID, Amount: 1})
+	}
+	return presents
+}
+
+// waitFor condが満たされるまで待つ
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPresentGrantQueueEventuallyInserts(t *testing.T) {
+	store := &fakePresentStore{}
+	q := newTestPresentGrantQueue(store, 2, 100)
+	defer q.Close()
+
+	q.Enqueue(1, testPresents(1, 3))
+
+	waitFor(t, func() bool { return store.count(1) == 3 })
+	if n := store.count(0); n != 0 {
+		t.Errorf("shard 0 got %d presents, want 0", n)
+	}
+}
+
+func TestPresentGrantQueueRetriesFailedInsert(t *testing.T) {
+	store := &fakePresentStore{failures: 3}
+	q := newTestPresentGrantQueue(store, 1, 100)
+
+	q.Enqueue(0, testPresents(1, 5))
+	q.Close()
+
+	if n := store.count(0); n != 5 {
+		t.Fatalf("inserted %d presents after retries, want 5", n)
+	}
+}
+
+func TestPresentGrantQueueCloseDrains(t *testing.T) {
+	store := &fakePresentStore{}
+	q := newTestPresentGrantQueue(store, 1, 1000)
+
+	for userID := int64(1); userID <= 50; userID++ {
+		q.Enqueue(0, testPresents(userID, 4))
+	}
+	q.Close()
+
+	if n := store.count(0); n != 200 {
+		t.Fatalf("inserted %d presents before Close returned, want 200", n)
+	}
+}
+
+func TestPresentGrantQueueWaitsWhenFull(t *testing.T) {
+	store := &fakePresentStore{}
+	q := newTestPresentGrantQueue(store, 1, 1)
+
+	q.Enqueue(0, testPresents(1, 30))
+	q.Close()
+
+	if n := store.count(0); n != 30 {
+		t.Fatalf("inserted %d presents, want 30", n)
+	}
+}
+
+func TestPresentGrantQueueEnqueueAfterClose(t *testing.T) {
+	store := &fakePresentStore{}
+	q := newTestPresentGrantQueue(store, 1, 100)
+	q.Close()
+
+	// シャットダウンの待ち時間を過ぎてから戻ったハンドラが積んでもpanicせず、その場で付与する
+	q.Enqueue(0, testPresents(1, 2))
+
+	if n := store.count(0); n != 2 {
+		t.Fatalf("inserted %d presents, want 2", n)
+	}
+}
+
+func TestPresentGrantQueueNil(t *testing.T) {
+	var q *PresentGrantQueue
+	if q.Enabled() {
+		t.Error("nil queue is enabled")
+	}
+	q.Enqueue(0, testPresents(1, 1))
+	q.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+// presentSource 挿入したプレゼントのsourceとsource_id
+type presentSource struct {
+	source   int64
+	sourceID driver.Value
+}
+
+// recordPresentSources user_presentsへの一括挿入から、行ごとのsourceとsource_idを記録する
+// 列はid, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_atの順
+func recordPresentSources(fake *fakeSQL, sources *[]presentSource) {
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) {
+		for i := 0; i+11 <= len(args); i += 11 {
+			*sources = append(*sources, presentSource{source: args[i+7].(int64), sourceID: args[i+8]})
+		}
+		return int64(len(args) / 11), nil
+	})
+}
+
+func TestPresentSourceFromGacha(t *testing.T) {
+	sources := make([]presentSource, 0)
+	fake := &fakeSQL{}
+	recordPresentSources(fake, &sources)
+	fake.onExec("INSERT INTO user_gacha_draws", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("INSERT INTO user_gacha_draw_histories", func(args []driver.Value) (int64, error) { return 2, nil })
+	h := newTestIDHandler(t)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	gacha := &GachaMaster{ID: 7, Name: "gacha7"}
+	result := []*GachaItemMaster{
+		{ID: 1, GachaID: 7, ItemType: ItemTypeCard, ItemID: 2, Amount: 1},
+		{ID: 2, GachaID: 7, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 3},
+	}
+	if _, _, err := h.insertGachaDraw(context.Background(), tx, 100, gacha, result, 1000, nil, 0, false, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 {
+		t.Fatalf("inserted %d presents, want 2", len(sources))
+	}
+	for _, s := range sources {
+		if s.source != int64(PresentSourceGacha) || s.sourceID != int64(7) {
+			t.Errorf("source = %+v, want gacha 7", s)
+		}
+	}
+}
+
+func TestPresentSourceFromPresentAll(t *testing.T) {
+	sources := make([]presentSource, 0)
+	fake := &fakeSQL{}
+	recordPresentSources(fake, &sources)
+	fake.onQuery("FROM present_all_masters", []string{"id", "registered_start_at", "registered_end_at", "item_type", "item_id", "amount", "present_message"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(5), int64(0), int64(2000), int64(ItemTypeCoin), int64(1), int64(100), "gift"}}
+	})
+	fake.onQuery("FROM user_present_all_received_history", []string{"present_all_id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onExec("INSERT INTO user_present_all_received_history", func(args []driver.Value) (int64, error) { return 1, nil })
+	h := newTestIDHandler(t)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	presents, err := h.obtainPresent(context.Background(), tx, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].source != int64(PresentSourcePresentAll) || sources[0].sourceID != int64(5) {
+		t.Errorf("inserted sources = %+v, want present-all 5", sources)
+	}
+	if len(presents) != 1 || presents[0].Source != PresentSourcePresentAll || presents[0].SourceID == nil || *presents[0].SourceID != 5 {
+		t.Errorf("returned presents = %+v, want present-all 5", presents)
+	}
+}
+
+func TestPresentSourceFromLoginBonus(t *testing.T) {
+	grant := &loginBonusGrant{
+		userBonus: &UserLoginBonus{LoginBonusID: 3, LastRewardSequence: 1},
+		reward:    &LoginBonusRewardMaster{LoginBonusID: 3, RewardSequence: 1, ItemType: ItemTypeCoin, ItemID: 1, Amount: 100},
+	}
+
+	p := loginBonusRewardPresent(grant)
+	if p.Source != PresentSourceLoginBonus || p.SourceID == nil || *p.SourceID != 3 {
+		t.Errorf("present = %+v, want login bonus 3", p)
+	}
+}
+
+func TestPresentSourceFromCoinOverflow(t *testing.T) {
+	prev := coinOverflowMode
+	coinOverflowMode = CoinOverflowModePresent
+	t.Cleanup(func() { coinOverflowMode = prev })
+
+	var source driver.Value
+	fake := &fakeSQL{}
+	fake.onExec("INSERT INTO user_presents", func(args []driver.Value) (int64, error) {
+		// 所持上限を超えたコインはsource_idを持たない
+		source = args[7]
+		return 1, nil
+	})
+	h := newTestIDHandler(t)
+
+	if err := h.handleCoinOverflow(context.Background(), fake.open(), 100, 50, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if source != int64(PresentSourceCoinOverflow) {
+		t.Errorf("source = %v, want %d", source, PresentSourceCoinOverflow)
+	}
+}
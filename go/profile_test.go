@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestProfileShard existsのユーザーのプロフィールを返し、問い合わせたユーザーIDをaskedに記録する
+// BANされた・削除されたユーザーはシャードのクエリで除かれるため、existsに含めないことで再現する
+func newTestProfileShard(mu *sync.Mutex, asked *[]int64, exists map[int64]bool) *sqlx.DB {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM users AS u", []string{"id", "name", "registered_at", "total_amount_per_sec"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		rows := make([][]driver.Value, 0)
+		for _, arg := range args {
+			id := arg.(int64)
+			*asked = append(*asked, id)
+			if exists[id] {
+				rows = append(rows, []driver.Value{id, fmt.Sprintf("user%d", id), int64(500), int64(6)})
+			}
+		}
+		return rows
+	})
+	return fake.open()
+}
+
+func TestGetUserProfilesAcrossShards(t *testing.T) {
+	// シャードはユーザーIDの23ビット目から上で決まる
+	user0, user1, missing := int64(1), int64(1)<<23, int64(2)
+	var mu sync.Mutex
+	asked := [][]int64{{}, {}}
+	h := &Handler{DBs: []*sqlx.DB{
+		newTestProfileShard(&mu, &asked[0], map[int64]bool{user0: true}),
+		newTestProfileShard(&mu, &asked[1], map[int64]bool{user1: true}),
+	}}
+
+	body := fmt.Sprintf(`{"userIds":[%d,%d,%d,%d]}`, user0, user1, missing, user0)
+	rec := postJSON("/users/profiles", h.getUserProfiles, "/users/profiles", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	// 重複したIDは1度だけ、そのユーザーのシャードに問い合わせる
+	if len(asked[0]) != 2 || len(asked[1]) != 1 || asked[1][0] != user1 {
+		t.Errorf("asked shards %v, want user %d and %d on shard 0 and user %d on shard 1", asked, user0, missing, user1)
+	}
+
+	res := new(UserProfilesResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Profiles) != 3 {
+		t.Fatalf("profiles = %v, want 3 keys", res.Profiles)
+	}
+	for _, id := range []int64{user0, user1} {
+		if p := res.Profiles[id]; p == nil || p.UserID != id || p.TotalAmountPerSec != 6 || p.RegisteredAt != 500 {
+			t.Errorf("profile %d = %+v, want the shard's profile", id, p)
+		}
+	}
+	// 存在しないユーザーはnullとして区別できる
+	if p, ok := res.Profiles[missing]; !ok || p != nil {
+		t.Errorf("profile %d = (%+v, %v), want a null entry", missing, p, ok)
+	}
+	if strings.Contains(rec.Body.String(), "isuCoin") {
+		t.Errorf("body = %s, want no coins", rec.Body.String())
+	}
+}
+
+func TestGetUserProfilesBoundsCount(t *testing.T) {
+	h := &Handler{}
+	ids := make([]string, UserProfilesMaxCount+1)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i + 1)
+	}
+
+	for _, body := range []string{`{"userIds":[]}`, fmt.Sprintf(`{"userIds":[%s]}`, strings.Join(ids, ","))} {
+		if rec := postJSON("/users/profiles", h.getUserProfiles, "/users/profiles", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%d ids: status = %d, want 400", strings.Count(body, ",")+1, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// soft-delete purge
+
+var (
+	// 論理削除した行を物理削除するまでの保持期間(秒)
+	softDeleteRetention int64 = int64(getEnvInt("ISUCON_SOFT_DELETE_RETENTION_SEC", 7*24*60*60))
+	// 受け取り済みのプレゼントを物理削除するまでの保持期間(秒)
+	// この期間は POST /user/{userID}/present/check で received と返す。物理削除した後は not_found になる
+	receivedPresentRetention int64 = int64(getEnvInt("ISUCON_RECEIVED_PRESENT_RETENTION_SEC", 30*24*60*60))
+	// 物理削除で1回のDELETEで読む主キーの最大件数
+	purgeBatchSize int = getEnvInt("ISUCON_PURGE_BATCH_SIZE", 1000)
+)
+
+// purgeTable 論理削除した行を物理削除するテーブル
+// ガチャの天井のカウント(user_gacha_pities)と端数(user_item_fractions)は論理削除せず、ユーザーの現在の状態として持ち続けるため対象にしない
+type purgeTable struct {
+	name string
+	// cond 削除する行に追加する条件
+	cond string
+}
+
+var (
+	purgeTokens   = &purgeTable{name: "user_one_time_tokens"}
+	purgeSessions = &purgeTable{name: "user_sessions"}
+	purgeDecks    = &purgeTable{name: "user_decks"}
+	// 抽選履歴(user_gacha_draw_histories.present_id)から参照されているプレゼントは残す
+	purgePresents = &purgeTable{
+		name: "user_presents",
+		cond: "NOT EXISTS (SELECT 1 FROM user_gacha_draw_histories WHERE user_gacha_draw_histories.present_id = user_presents.id)",
+	}
+)
+
+// purgeRangeDB 主キーの範囲ごとに物理削除するDB
+type purgeRangeDB interface {
+	// nextUpper afterより大きい主キーをbatchSize件進めた位置を返す。残りの行がなければfalse
+	nextUpper(ctx context.Context, t *purgeTable, after int64, batchSize int) (int64, bool, error)
+	// deleteRange 主キーが(after, upper]の行のうち、border以前に論理削除した行を物理削除する
+	deleteRange(ctx context.Context, t *purgeTable, after, upper, border int64) (int64, error)
+}
+
+type sqlPurgeRangeDB struct {
+	db *sqlx.DB
+}
+
+func (p *sqlPurgeRangeDB) nextUpper(ctx context.Context, t *purgeTable, after int64, batchSize int) (int64, bool, error) {
+	var upper sql.NullInt64
+	query := fmt.Sprintf("SELECT MAX(id) FROM (SELECT id FROM %s WHERE id > ? ORDER BY id LIMIT ?) AS chunk", t.name)
+	if err := p.db.GetContext(ctx, &upper, query, after, batchSize); err != nil {
+		return 0, false, err
+	}
+	return upper.Int64, upper.Valid, nil
+}
+
+func (p *sqlPurgeRangeDB) deleteRange(ctx context.Context, t *purgeTable, after, upper, border int64) (int64, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id > ? AND id <= ? AND deleted_at IS NOT NULL AND deleted_at < ?", t.name)
+	if t.cond != "" {
+		query += " AND " + t.cond
+	}
+	res, err := p.db.ExecContext(ctx, query, after, upper, border)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// purgeInRanges 主キーをbatchSize件ずつ区切って進めながら、border以前に論理削除した行を物理削除し、件数を返す
+// deleted_atにはインデックスがないため、1回のDELETEで読む範囲を主キーでbatchSize件に抑え、ロックを長時間保持しないようにする
+// 範囲の間でctxを確認し、キャンセルされた場合はそれまでの件数とエラーを返す
+func purgeInRanges(ctx context.Context, db purgeRangeDB, t *purgeTable, border int64, batchSize int) (int64, error) {
+	var total int64
+	after := int64(math.MinInt64)
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		upper, ok, err := db.nextUpper(ctx, t, after, batchSize)
+		if err != nil || !ok {
+			return total, err
+		}
+		deleted, err := db.deleteRange(ctx, t, after, upper, border)
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		after = upper
+	}
+}
+
+// purgeBorders 物理削除する論理削除日時の境界
+type purgeBorders struct {
+	deleted  int64 // セッション・デッキ・ワンタイムトークン
+	received int64 // 受け取り済みのプレゼント
+}
+
+// purgeShard 1シャード分の、境界以前に論理削除した行を物理削除し、テーブルごとの件数を返す
+// キャンセルされた場合はそれまでの件数を返す
+func purgeShard(ctx context.Context, db purgeRangeDB, res *PurgeShardResult, borders purgeBorders, batchSize int) error {
+	var err error
+	if res.Tokens, err = purgeInRanges(ctx, db, purgeTokens, borders.deleted, batchSize); err != nil {
+		return errors.Wrap(err, purgeTokens.name)
+	}
+	// メインのDBにはユーザーごとのデータはトークンしかない
+	if res.Shard < 0 {
+		return nil
+	}
+
+	if res.Sessions, err = purgeInRanges(ctx, db, purgeSessions, borders.deleted, batchSize); err != nil {
+		return errors.Wrap(err, purgeSessions.name)
+	}
+	if res.Decks, err = purgeInRanges(ctx, db, purgeDecks, borders.deleted, batchSize); err != nil {
+		return errors.Wrap(err, purgeDecks.name)
+	}
+	if res.Presents, err = purgeInRanges(ctx, db, purgePresents, borders.received, batchSize); err != nil {
+		return errors.Wrap(err, purgePresents.name)
+	}
+	return nil
+}
+
+// adminPurge 保持期間(ISUCON_SOFT_DELETE_RETENTION_SEC)より前に論理削除したセッション・デッキ・ワンタイムトークンと、
+// 保持期間(ISUCON_RECEIVED_PRESENT_RETENTION_SEC)より前に受け取ったプレゼントを全シャードから物理削除する
+// ジョブとして実行するため、async=1 でバックグラウンドで実行でき、POST /admin/jobs/{jobID}/cancel で止められる
+// 削除は冪等なため、途中で失敗・キャンセルした場合は再実行で続きから消す
+// POST /admin/purge
+func (h *Handler) adminPurge(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	batchSize := purgeBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	borders := purgeBorders{
+		deleted:  requestAt - softDeleteRetention,
+		received: requestAt - receivedPresentRetention,
+	}
+
+	logger := c.Logger()
+	return h.runAdminJob(c, JobKindPurge, requestAt, func(job *Job) (interface{}, error) {
+		res, err := h.purge(job, borders, batchSize)
+		if err != nil {
+			logger.Errorf("purge stopped: purged=%+v", res.Shards)
+		}
+		return res, err
+	})
+}
+
+// purge 全シャードから物理削除する。シャードを終えるごと、または止まった時点でジョブの途中経過を更新する
+func (h *Handler) purge(job *Job, borders purgeBorders, batchSize int) (*AdminPurgeResponse, error) {
+	res := &AdminPurgeResponse{
+		Border:         borders.deleted,
+		ReceivedBorder: borders.received,
+		Shards:         make([]*PurgeShardResult, 0, len(h.DBs)+1),
+	}
+	for _, loc := range h.tokenLocations() {
+		shardRes := &PurgeShardResult{Shard: loc.shard, Name: loc.name}
+		err := purgeShard(job.Context(), &sqlPurgeRangeDB{db: loc.db}, shardRes, borders, batchSize)
+		res.add(shardRes)
+		job.SetProgress(res.snapshot())
+		if err != nil {
+			return res, errors.Wrap(err, loc.name)
+		}
+	}
+	return res, nil
+}
+
+type AdminPurgeResponse struct {
+	Border         int64               `json:"border"`
+	ReceivedBorder int64               `json:"receivedBorder"`
+	Tokens         int64               `json:"tokens"`
+	Sessions       int64               `json:"sessions"`
+	Decks          int64               `json:"decks"`
+	Presents       int64               `json:"presents"`
+	Shards         []*PurgeShardResult `json:"shards"`
+}
+
+func (r *AdminPurgeResponse) add(s *PurgeShardResult) {
+	r.Tokens += s.Tokens
+	r.Sessions += s.Sessions
+	r.Decks += s.Decks
+	r.Presents += s.Presents
+	r.Shards = append(r.Shards, s)
+}
+
+// snapshot ジョブの途中経過用にコピーする。追加済みのシャードの結果は以降変更しないため共有する
+func (r *AdminPurgeResponse) snapshot() *AdminPurgeResponse {
+	s := *r
+	s.Shards = append([]*PurgeShardResult{}, r.Shards...)
+	return &s
+}
+
+type PurgeShardResult struct {
+	Shard    int    `json:"shard"`
+	Name     string `json:"name"`
+	Tokens   int64  `json:"tokens"`
+	Sessions int64  `json:"sessions"`
+	Decks    int64  `json:"decks"`
+	Presents int64  `json:"presents"`
+}
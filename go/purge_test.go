@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+)
+
+type fakePurgeRow struct {
+	id        int64
+	deletedAt *int64
+	// drawn 抽選履歴から参照されているプレゼント
+	drawn bool
+}
+
+// fakePurgeDB テーブルごとの行をメモリに持ち、主キーの範囲ごとの物理削除を再現する
+type fakePurgeDB struct {
+	tables map[string][]*fakePurgeRow
+	// maxRange 1回のdeleteRangeで読んだ主キーの最大件数
+	maxRange int
+}
+
+func (db *fakePurgeDB) nextUpper(ctx context.Context, t *purgeTable, after int64, batchSize int) (int64, bool, error) {
+	ids := make([]int64, 0)
+	for _, r := range db.tables[t.name] {
+		if r.id > after {
+			ids = append(ids, r.id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, false, nil
+	}
+	sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+	if len(ids) > batchSize {
+		ids = ids[:batchSize]
+	}
+	return ids[len(ids)-1], true, nil
+}
+
+func (db *fakePurgeDB) deleteRange(ctx context.Context, t *purgeTable, after, upper, border int64) (int64, error) {
+	kept := make([]*fakePurgeRow, 0)
+	scanned, deleted := 0, int64(0)
+	for _, r := range db.tables[t.name] {
+		if r.id <= after || r.id > upper {
+			kept = append(kept, r)
+			continue
+		}
+		scanned++
+		if r.deletedAt != nil && *r.deletedAt < border && !(t == purgePresents && r.drawn) {
+			deleted++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if scanned > db.maxRange {
+		db.maxRange = scanned
+	}
+	db.tables[t.name] = kept
+	return deleted, nil
+}
+
+func (db *fakePurgeDB) ids(table string) []int64 {
+	ids := make([]int64, 0)
+	for _, r := range db.tables[table] {
+		ids = append(ids, r.id)
+	}
+	sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+	return ids
+}
+
+func deletedAt(at int64) *int64 {
+	return &at
+}
+
+func TestPurgeShardKeepsRowsNewerThanRetention(t *testing.T) {
+	db := &fakePurgeDB{tables: map[string][]*fakePurgeRow{
+		"user_one_time_tokens": {
+			{id: 1, deletedAt: deletedAt(100)},
+			{id: 2, deletedAt: deletedAt(1000)},
+			{id: 3},
+		},
+		"user_sessions": {
+			{id: 1, deletedAt: deletedAt(100)},
+			{id: 2, deletedAt: deletedAt(999)},
+			{id: 3, deletedAt: deletedAt(1000)},
+			{id: 4},
+		},
+		"user_decks": {
+			{id: 1, deletedAt: deletedAt(100)},
+			{id: 2},
+		},
+		"user_presents": {
+			{id: 1, deletedAt: deletedAt(100)},
+			{id: 2, deletedAt: deletedAt(100), drawn: true},
+			{id: 3, deletedAt: deletedAt(600)},
+			{id: 4},
+		},
+	}}
+	res := &PurgeShardResult{Shard: 0}
+
+	err := purgeShard(context.Background(), db, res, purgeBorders{deleted: 1000, received: 500}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]int64{
+		"user_one_time_tokens": {2, 3},
+		"user_sessions":        {3, 4},
+		"user_decks":           {2},
+		// 受け取り済みのプレゼントは論理削除の保持期間ではなく、受け取り済みの保持期間まで残す
+		"user_presents": {2, 3, 4},
+	}
+	for table, ids := range want {
+		if got := db.ids(table); !equalIDs(got, ids) {
+			t.Errorf("%s = %v, want %v", table, got, ids)
+		}
+	}
+	if res.Tokens != 1 || res.Sessions != 2 || res.Decks != 1 || res.Presents != 1 {
+		t.Errorf("result = %+v, want tokens 1, sessions 2, decks 1, presents 1", res)
+	}
+}
+
+func TestPurgeShardMainDBPurgesOnlyTokens(t *testing.T) {
+	db := &fakePurgeDB{tables: map[string][]*fakePurgeRow{
+		"user_one_time_tokens": {{id: 1, deletedAt: deletedAt(100)}},
+		"user_sessions":        {{id: 1, deletedAt: deletedAt(100)}},
+	}}
+	res := &PurgeShardResult{Shard: -1}
+
+	if err := purgeShard(context.Background(), db, res, purgeBorders{deleted: 1000, received: 1000}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.ids("user_one_time_tokens")) != 0 || len(db.ids("user_sessions")) != 1 {
+		t.Errorf("tokens = %v, sessions = %v, want only the token purged", db.ids("user_one_time_tokens"), db.ids("user_sessions"))
+	}
+}
+
+func TestPurgeInRangesBoundsEachDelete(t *testing.T) {
+	rows := make([]*fakePurgeRow, 0, 25)
+	for id := int64(1); id <= 25; id++ {
+		rows = append(rows, &fakePurgeRow{id: id * 10, deletedAt: deletedAt(100)})
+	}
+	db := &fakePurgeDB{tables: map[string][]*fakePurgeRow{"user_sessions": rows}}
+
+	deleted, err := purgeInRanges(context.Background(), db, purgeSessions, 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 25 || len(db.ids("user_sessions")) != 0 {
+		t.Errorf("deleted = %d, left = %v, want all 25 rows purged", deleted, db.ids("user_sessions"))
+	}
+	if db.maxRange > 10 {
+		t.Errorf("a delete read %d rows, want at most the batch size 10", db.maxRange)
+	}
+}
+
+func TestPurgeInRangesStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db := &fakePurgeDB{tables: map[string][]*fakePurgeRow{
+		"user_sessions": {{id: 1, deletedAt: deletedAt(100)}},
+	}}
+
+	deleted, err := purgeInRanges(ctx, db, purgeSessions, 1000, 10)
+	if err != context.Canceled || deleted != 0 || len(db.ids("user_sessions")) != 1 {
+		t.Errorf("deleted = %d, err = %v, want to stop before deleting", deleted, err)
+	}
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
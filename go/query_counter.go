@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// //////////////////////////////////////
+// db query counter
+
+const (
+	// DebugDBQueriesHeader このヘッダに1を指定したリクエストは、発行したクエリ数をX-DB-Queriesで返す
+	DebugDBQueriesHeader string = "X-Debug-DB-Queries"
+	// DBQueriesHeader リクエストで発行したクエリ数を返すヘッダ
+	DBQueriesHeader string = "X-DB-Queries"
+)
+
+// debugDBQueries クエリ数を数えるかどうか。開発時のN+1の確認用で、本番では有効にしないこと
+// ISUCON_DEBUG_DB_QUERIES=1 の場合のみ、DBへの接続をクエリを数えるドライバで包む
+var debugDBQueries = getEnv("ISUCON_DEBUG_DB_QUERIES", "") == "1"
+
+// queryCounter 1リクエストで発行したクエリ数
+// リクエストのcontextに入れて渡し、ドライバはcontextにカウンタがある場合のみ数える
+// contextを渡さないクエリ(バックグラウンドのジョブなど)は数えない
+type queryCounter struct {
+	count int64
+}
+
+type queryCounterKey struct{}
+
+// withQueryCounter クエリ数を数えるカウンタを入れたcontextを返す
+func withQueryCounter(ctx context.Context, qc *queryCounter) context.Context {
+	return context.WithValue(ctx, queryCounterKey{}, qc)
+}
+
+// queryCounterFrom contextに入っているカウンタ。ない場合はnil
+func queryCounterFrom(ctx context.Context) *queryCounter {
+	if ctx == nil {
+		return nil
+	}
+	qc, _ := ctx.Value(queryCounterKey{}).(*queryCounter)
+	return qc
+}
+
+// inc クエリを1つ数える。qcがnilの場合は何もしない
+// driver.ErrSkipはdatabase/sqlが別の方法で実行し直すため数えない
+func (qc *queryCounter) inc(err error) {
+	if qc == nil || err == driver.ErrSkip {
+		return
+	}
+	atomic.AddInt64(&qc.count, 1)
+}
+
+// dbContext ハンドラからDBに渡すcontext
+// クライアントの切断でトランザクションの途中のクエリが中断されないよう、リクエストのキャンセルは引き継がない
+// requestTimeoutMiddlewareの期限とカウンタだけを引き継ぐ
+func dbContext(c echo.Context) context.Context {
+	ctx := context.Background()
+	if deadline, ok := c.Request().Context().Value(dbDeadlineKey{}).(context.Context); ok {
+		ctx = deadline
+	}
+	if qc := queryCounterFrom(c.Request().Context()); qc != nil {
+		return withQueryCounter(ctx, qc)
+	}
+	return ctx
+}
+
+type dbDeadlineKey struct{}
+
+// withDBTimeout 以降のdbContextにtimeout後に期限切れになるcontextを使わせる
+func withDBTimeout(c echo.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), dbDeadlineKey{}, ctx)))
+	return ctx, cancel
+}
+
+// isDBTimedOut dbContextの期限を過ぎたかどうか
+func isDBTimedOut(c echo.Context) bool {
+	ctx, ok := c.Request().Context().Value(dbDeadlineKey{}).(context.Context)
+	return ok && ctx.Err() == context.DeadlineExceeded
+}
+
+// dbQueryCounterMiddleware X-Debug-DB-Queries: 1 のリクエストで発行したクエリ数をX-DB-Queriesで返す
+// カウンタはリクエストごとで、他のリクエストやバックグラウンドのジョブのクエリは含まない
+func dbQueryCounterMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	if !debugDBQueries {
+		return next
+	}
+	return func(c echo.Context) error {
+		if c.Request().Header.Get(DebugDBQueriesHeader) != "1" {
+			return next(c)
+		}
+
+		qc := &queryCounter{}
+		c.SetRequest(c.Request().WithContext(withQueryCounter(c.Request().Context(), qc)))
+		// レスポンスを書き出す前にヘッダを付ける必要があるため、書き出す直前の数を返す
+		c.Response().Before(func() {
+			c.Response().Header().Set(DBQueriesHeader, strconv.FormatInt(atomic.LoadInt64(&qc.count), 10))
+		})
+		return next(c)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestMasterDataCache テストごとに独立したキャッシュ
+// NewMasterDataCacheはプロセス内で共有するため、テスト間でマスタが混ざらないようこちらを使う
+func newTestMasterDataCache() *MasterDataCache {
+	return &MasterDataCache{
+		gachaItems:        make(map[int64][]*GachaItemMaster),
+		gachaCumWeights:   make(map[int64][]int64),
+		loginBonusRewards: make(map[string]*LoginBonusRewardMaster),
+		itemMasters:       make(map[int64]*ItemMaster),
+	}
+}
+
+// openCountingFakeDB クエリを数えるドライバで包んだfakeSQLのDB
+func openCountingFakeDB(fake *fakeSQL) *sqlx.DB {
+	return sqlx.NewDb(sql.OpenDB(&errorRecordingConnector{connector: fake}), "mysql")
+}
+
+func newTestQueryCountServer(t *testing.T, h *Handler, path string, handler echo.HandlerFunc) *echo.Echo {
+	t.Helper()
+	prev := debugDBQueries
+	debugDBQueries = true
+	t.Cleanup(func() { debugDBQueries = prev })
+
+	setRequestTime := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("requestTime", int64(1000))
+			return next(c)
+		}
+	}
+	e := echo.New()
+	e.GET(path, handler, dbQueryCounterMiddleware, setRequestTime)
+	return e
+}
+
+// countQueries リクエストを送り、X-DB-Queriesで返ったクエリ数を返す
+func countQueries(t *testing.T, e *echo.Echo, path string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set(DebugDBQueriesHeader, "1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	n, err := strconv.Atoi(rec.Header().Get(DBQueriesHeader))
+	if err != nil {
+		t.Fatalf("%s = %q: %v", DBQueriesHeader, rec.Header().Get(DBQueriesHeader), err)
+	}
+	return n
+}
+
+func TestDBQueriesHeaderForHome(t *testing.T) {
+	shard := &fakeSQL{}
+	shard.onQuery("FROM users", []string{"id", "last_getreward_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(900)}}
+	})
+	shard.onQuery("FROM user_decks", []string{"id", "user_id", "user_card_id_1", "user_card_id_2", "user_card_id_3"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], int64(11), int64(12), int64(13)}}
+	})
+	shard.onQuery("FROM user_cards", []string{"id", "amount_per_sec"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11), int64(1)}, {int64(12), int64(2)}, {int64(13), int64(3)}}
+	})
+	h := &Handler{DBs: []*sqlx.DB{openCountingFakeDB(shard)}}
+	e := newTestQueryCountServer(t, h, "/user/:userID/home", h.home)
+
+	// ユーザー・デッキ・装備カードの3件で、装備カードの枚数によらない
+	if n := countQueries(t, e, "/user/100/home"); n != 3 {
+		t.Errorf("home issued %d queries, want 3", n)
+	}
+}
+
+func TestDBQueriesHeaderForListGacha(t *testing.T) {
+	main := &fakeSQL{}
+	main.onQuery("FROM gacha_masters", []string{"id", "name", "start_at", "end_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(1), "gacha1", int64(0), int64(2000)},
+			{int64(2), "gacha2", int64(0), int64(2000)},
+			{int64(3), "gacha3", int64(0), int64(2000)},
+		}
+	})
+	main.onQuery("FROM gacha_item_masters", []string{"id", "gacha_id", "item_type", "item_id", "amount", "weight"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for gachaID := int64(1); gachaID <= 3; gachaID++ {
+			rows = append(rows,
+				[]driver.Value{gachaID*10 + 1, gachaID, int64(ItemTypeCard), int64(2), int64(1), int64(1)},
+				[]driver.Value{gachaID*10 + 2, gachaID, int64(ItemTypeEnhanceA), int64(10), int64(3), int64(1)},
+			)
+		}
+		return rows
+	})
+	main.onQuery("FROM item_masters", []string{"id", "item_type"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(ItemTypeEnhanceA)}}
+	})
+	main.onExec("UPDATE user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+	main.onExec("INSERT INTO user_one_time_tokens", func(args []driver.Value) (int64, error) { return 1, nil })
+
+	h := newTestHandler(t)
+	h.DB = openCountingFakeDB(main)
+	h.TokenIssues = NewTokenIssueCounter()
+	e := newTestQueryCountServer(t, h, "/user/:userID/gacha/index", h.listGacha)
+
+	// ガチャの索引・全ガチャのアイテム・アイテムマスタ2件・トークンの失効と発行で、ガチャの数によらない
+	if n := countQueries(t, e, "/user/100/gacha/index"); n != 6 {
+		t.Errorf("listGacha issued %d queries with a cold cache, want 6", n)
+	}
+	// 一覧をキャッシュした後はトークンの失効と発行のみ
+	if n := countQueries(t, e, "/user/100/gacha/index"); n != 2 {
+		t.Errorf("listGacha issued %d queries with a warm cache, want 2", n)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReceivePresentIgnoresOtherUsersPresents(t *testing.T) {
+	// プレゼント1と2はユーザー200のもの
+	owners := map[int64]int64{1: 200, 2: 200}
+	var askedUserID driver.Value
+	fake := (&fakeSQL{}).withDevice()
+	// 列はid IN (?)のプレゼントID、user_idの順
+	fake.onQuery("FROM user_presents", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		askedUserID = args[len(args)-1]
+		rows := make([][]driver.Value, 0)
+		for _, id := range args[:len(args)-1] {
+			if owner, ok := owners[id.(int64)]; ok && owner == askedUserID {
+				rows = append(rows, []driver.Value{id, owner, int64(ItemTypeCoin), int64(1), int64(100)})
+			}
+		}
+		return rows
+	})
+	h := newTestHandler(t, fake)
+
+	// ユーザー100がユーザー200のプレゼントを受け取ろうとする
+	rec := postJSON("/user/:userID/present/receive", h.receivePresent, "/user/100/present/receive", `{"viewerId":"viewer","presentIds":[1,2]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if askedUserID != int64(100) {
+		t.Errorf("presents selected for user %v, want the session's user 100", askedUserID)
+	}
+
+	// 存在しないプレゼントと同じく何も受け取らず、何も書き込まない
+	res := new(ReceivePresentResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.UpdatedResources.UserPresents) != 0 || len(res.FailedPresents) != 0 {
+		t.Errorf("response = %s, want nothing received", rec.Body.String())
+	}
+	for _, q := range append(fake.committed, fake.rolledBack...) {
+		if !strings.HasPrefix(q, "SELECT") {
+			t.Errorf("executed %q, want no writes", q)
+		}
+	}
+}
+
+func TestReceivePresentSkipsNonPositiveAmounts(t *testing.T) {
+	// プレゼント3は付与数が負、4は0
+	fake := (&fakeSQL{}).withDevice()
+	fake.onQuery("FROM user_presents", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{
+			{int64(3), int64(100), int64(ItemTypeCoin), int64(1), int64(-100)},
+			{int64(4), int64(100), int64(ItemTypeEnhanceA), int64(10), int64(0)},
+		}
+	})
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/present/receive", h.receivePresent, "/user/100/present/receive", `{"viewerId":"viewer","presentIds":[3,4]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(ReceivePresentResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.FailedPresents) != 2 {
+		t.Fatalf("body = %s, want both presents reported as failed", rec.Body.String())
+	}
+	for i, want := range []int64{3, 4} {
+		if f := res.FailedPresents[i]; f.PresentID != want || f.Reason != ErrInvalidPresentAmount.Error() {
+			t.Errorf("failed present %d = %+v, want present %d with %v", i, f, want, ErrInvalidPresentAmount)
+		}
+	}
+	// 受け取らずに残すので、コインもプレゼントも更新しない
+	for _, q := range append(fake.committed, fake.rolledBack...) {
+		if !strings.HasPrefix(q, "SELECT") {
+			t.Errorf("executed %q, want no writes", q)
+		}
+	}
+}
+
+func TestObtainItemsBatchSkipsNonPositiveAmount(t *testing.T) {
+	var coin driver.Value
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT isu_coin FROM users", []string{"isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0)}}
+	})
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) {
+		coin = args[0]
+		return 1, nil
+	})
+	h := newTestHandler(t)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 1, ItemType: ItemTypeCoin})
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 負と0の付与数は飛ばし、残りは付与する
+	presents := []*UserPresent{
+		{ID: 1, ItemType: ItemTypeCoin, ItemID: 1, Amount: 100},
+		{ID: 2, ItemType: ItemTypeCoin, ItemID: 1, Amount: -500},
+		{ID: 3, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 0},
+		{ID: 4, ItemType: ItemTypeCard, ItemID: 2, Amount: 0},
+	}
+	obtained, err := h.obtainItemsBatch(context.Background(), tx, presents, 100, 1000)
+	if err != nil {
+		t.Fatalf("err = %v, want the invalid grants skipped", err)
+	}
+	if coin != int64(100) {
+		t.Errorf("isu_coin = %v, want only the valid 100 coins", coin)
+	}
+	if len(obtained.Cards) != 0 || len(obtained.Items) != 0 {
+		t.Errorf("obtained = %+v, want no cards or items", obtained)
+	}
+}
+
+func TestLoginWithZeroAmountBonusReward(t *testing.T) {
+	// ログインボーナス1の報酬の付与数が0に設定されている
+	fake := newTestLoginDB(&fakeLoginUser{lastActivatedAt: 1000 - 86400})
+	h := newTestHandler(t, fake)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA})
+	h.Cache.SetLoginBonusReward(&LoginBonusRewardMaster{ID: 1, LoginBonusID: 1, RewardSequence: 1, ItemType: ItemTypeEnhanceA, ItemID: 10, Amount: 0})
+	h.LoginMetrics = NewLoginGrantMetrics()
+
+	// 報酬は付与しないが、ログインと進捗の更新は失敗させない
+	rec := postJSON("/login", h.login, "/login", `{"viewerId":"viewer","userId":100}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s, want 200", rec.Code, rec.Body.String())
+	}
+	if fake.executed("INSERT INTO user_login_bonuses") != 1 || fake.executed("user_items") != 0 {
+		t.Errorf("committed = %v, want the progress saved without the reward", fake.committed)
+	}
+}
+
+func TestCheckPresentsStatuses(t *testing.T) {
+	// 1は受け取れる、2は受け取り済み、3はユーザー101のもの、4は付与数が0、5は存在しない
+	fake := (&fakeSQL{}).withDevice()
+	var selects int
+	fake.onQuery("FROM user_presents", []string{"id", "user_id", "amount", "deleted_at"}, func(args []driver.Value) [][]driver.Value {
+		selects++
+		return [][]driver.Value{
+			{int64(1), int64(100), int64(1), nil},
+			{int64(2), int64(100), int64(1), int64(900)},
+			{int64(3), int64(101), int64(1), nil},
+			{int64(4), int64(100), int64(0), nil},
+		}
+	})
+	h := newTestHandler(t, fake)
+
+	rec := postJSON("/user/:userID/present/check", h.checkPresents, "/user/100/present/check", `{"viewerId":"viewer","presentIds":[1,2,3,4,5,1]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(CheckPresentsResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重複したIDはまとめ、リクエストの順に返す
+	want := []string{PresentStatusClaimable, PresentStatusReceived, PresentStatusWrongOwner, PresentStatusInvalidAmount, PresentStatusNotFound}
+	if len(res.Presents) != len(want) {
+		t.Fatalf("body = %s, want %d statuses", rec.Body.String(), len(want))
+	}
+	for i, p := range res.Presents {
+		if p.PresentID != int64(i+1) || p.Status != want[i] {
+			t.Errorf("present %d = %+v, want %s", i+1, p, want[i])
+		}
+	}
+	if selects != 1 {
+		t.Errorf("user_presents read %d times, want a single query", selects)
+	}
+	for _, q := range fake.committed {
+		if !strings.HasPrefix(q, "SELECT") {
+			t.Errorf("executed %q, want nothing updated", q)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// request limits
+
+var (
+	// maxRequestBodyBytes リクエストボディの最大バイト数
+	maxRequestBodyBytes = getEnvInt("ISUCON_MAX_REQUEST_BODY_BYTES", 1<<20)
+	// maxRequestJSONDepth リクエストボディのJSONのネストの最大の深さ
+	maxRequestJSONDepth = getEnvInt("ISUCON_MAX_REQUEST_JSON_DEPTH", 16)
+	// disallowUnknownFields リクエストの構造体にないフィールドを含むボディを弾くかどうか
+	// 古いクライアントが余分なフィールドを送ってくる可能性があるため、デフォルトでは弾かない
+	disallowUnknownFields = getEnv("ISUCON_DISALLOW_UNKNOWN_FIELDS", "") == "1"
+)
+
+const (
+	// 一度に受け取れるプレゼントの数
+	ReceivePresentMaxCount int = 10000
+	// 強化に一度に使えるアイテムの種類数
+	AddExpItemsMaxCount int = 100
+	// 一括でコインを付与する際に、userIdsで指定できるユーザー数。それ以上はallActiveを使う
+	AdminCoinGrantMaxUserIDs int = 10000
+)
+
+// requestLimiter パースした直後に配列の長さなどの上限を検証するリクエスト
+// parseRequestBodyでまとめて検証するため、ハンドラごとに検証を書かなくてよい
+type requestLimiter interface {
+	validateLimits() error
+}
+
+// checkArrayLimit 配列の長さが上限以下か検証する
+func checkArrayLimit(field string, length, max int) error {
+	if length > max {
+		return errors.Wrapf(ErrInvalidRequestBody, "too many %s: max=%d", field, max)
+	}
+	return nil
+}
+
+func (r *ReceivePresentRequest) validateLimits() error {
+	return checkArrayLimit("presentIds", len(r.PresentIDs), ReceivePresentMaxCount)
+}
+
+func (r *CheckPresentsRequest) validateLimits() error {
+	return checkArrayLimit("presentIds", len(r.PresentIDs), PresentCheckMaxCount)
+}
+
+func (r *AddExpToCardRequest) validateLimits() error {
+	return checkArrayLimit("items", len(r.Items), AddExpItemsMaxCount)
+}
+
+func (r *UpdateDeckRequest) validateLimits() error {
+	return checkArrayLimit("cardIds", len(r.CardIDs), DeckCardNumber)
+}
+
+func (r *SaveDeckPresetRequest) validateLimits() error {
+	return checkArrayLimit("cardIds", len(r.CardIDs), DeckCardNumber)
+}
+
+func (r *UserProfilesRequest) validateLimits() error {
+	return checkArrayLimit("userIds", len(r.UserIDs), UserProfilesMaxCount)
+}
+
+func (r *AdminGrantCoinsRequest) validateLimits() error {
+	return checkArrayLimit("userIds", len(r.UserIDs), AdminCoinGrantMaxUserIDs)
+}
+
+// jsonDepthExceeds JSONのネストがmaxDepthより深いかどうか
+// デコードする前に文字列の外の括弧だけを数え、深くネストしたボディで大量に確保しないようにする
+func jsonDepthExceeds(buf []byte, maxDepth int) bool {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, b := range buf {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
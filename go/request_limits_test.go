@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// parseTestBody bodyをリクエストボディとしてdistにパースする
+func parseTestBody(body string, dist interface{}) error {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return parseRequestBody(echo.New().NewContext(req, httptest.NewRecorder()), dist)
+}
+
+func TestParseRequestBodyLimits(t *testing.T) {
+	prevBytes, prevDepth, prevUnknown := maxRequestBodyBytes, maxRequestJSONDepth, disallowUnknownFields
+	t.Cleanup(func() {
+		maxRequestBodyBytes, maxRequestJSONDepth, disallowUnknownFields = prevBytes, prevDepth, prevUnknown
+	})
+	maxRequestBodyBytes, maxRequestJSONDepth = 1024, 4
+
+	items := make([]string, AddExpItemsMaxCount+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"id":%d,"amount":1}`, i+1)
+	}
+	tests := []struct {
+		name    string
+		unknown bool
+		body    string
+		dist    func() interface{}
+		wantErr bool
+	}{
+		{name: "deck", body: `{"viewerId":"viewer","cardIds":[1,2,3]}`, dist: func() interface{} { return new(UpdateDeckRequest) }},
+		{name: "deck too many cards", body: `{"viewerId":"viewer","cardIds":[1,2,3,4]}`, dist: func() interface{} { return new(UpdateDeckRequest) }, wantErr: true},
+		{name: "addexp too many items", body: `{"viewerId":"viewer","items":[` + strings.Join(items, ",") + `]}`, dist: func() interface{} { return new(AddExpToCardRequest) }, wantErr: true},
+		{name: "body too large", body: `{"viewerId":"` + strings.Repeat("v", 1024) + `"}`, dist: func() interface{} { return new(UpdateDeckRequest) }, wantErr: true},
+		{name: "too deep", body: `{"viewerId":"viewer","extra":[[[[1]]]]}`, dist: func() interface{} { return new(UpdateDeckRequest) }, wantErr: true},
+		// 文字列の中の括弧はネストに数えない
+		{name: "brackets in string", body: `{"viewerId":"[[[[\"{{{{"}`, dist: func() interface{} { return new(UpdateDeckRequest) }},
+		// 未知のフィールドは設定した場合のみ弾く
+		{name: "unknown field allowed", body: `{"viewerId":"viewer","unknown":1}`, dist: func() interface{} { return new(UpdateDeckRequest) }},
+		{name: "unknown field rejected", unknown: true, body: `{"viewerId":"viewer","unknown":1}`, dist: func() interface{} { return new(UpdateDeckRequest) }, wantErr: true},
+	}
+	for _, tt := range tests {
+		disallowUnknownFields = tt.unknown
+		err := parseTestBody(tt.body, tt.dist())
+		if !tt.wantErr {
+			if err != nil {
+				t.Errorf("%s: err = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if errors.Cause(err) != ErrInvalidRequestBody {
+			t.Errorf("%s: err = %v, want ErrInvalidRequestBody", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// orderRecorder WriteHeaderの時点でハンドラが戻っていたかを記録するResponseWriter
+type orderRecorder struct {
+	*httptest.ResponseRecorder
+	returned          *bool
+	returnedAtWriting bool
+}
+
+func (r *orderRecorder) WriteHeader(code int) {
+	r.returnedAtWriting = *r.returned
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestRequestTimeoutMiddlewareSlowHandler(t *testing.T) {
+	t.Setenv("ISUCON_WRITE_TIMEOUT_MS", "20")
+
+	returned := false
+	e := echo.New()
+	e.POST("/slow", func(c echo.Context) error {
+		// トランザクションのロールバックの代わりに、戻った時点を記録する
+		defer func() { returned = true }()
+		ctx := dbContext(c)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("dbContext has no deadline")
+		}
+		<-ctx.Done()
+		return errorResponse(c, http.StatusInternalServerError, ctx.Err())
+	}, requestTimeoutMiddleware())
+
+	rec := &orderRecorder{ResponseRecorder: httptest.NewRecorder(), returned: &returned}
+	start := time.Now()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/slow", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if !rec.returnedAtWriting {
+		t.Error("503 was written before the handler returned")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, want about 20ms", elapsed)
+	}
+}
+
+func TestRequestTimeoutMiddlewareFastHandler(t *testing.T) {
+	t.Setenv("ISUCON_WRITE_TIMEOUT_MS", "1000")
+
+	e := echo.New()
+	e.POST("/fast", func(c echo.Context) error {
+		return successResponse(c, map[string]string{"status": "ok"})
+	}, requestTimeoutMiddleware())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fast", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRequestTimeoutMiddlewareReadsAndWritesSeparately(t *testing.T) {
+	t.Setenv("ISUCON_READ_TIMEOUT_MS", "0")
+	t.Setenv("ISUCON_WRITE_TIMEOUT_MS", "20")
+
+	e := echo.New()
+	e.GET("/read", func(c echo.Context) error {
+		if _, ok := dbContext(c).Deadline(); ok {
+			t.Error("GET has a deadline while ISUCON_READ_TIMEOUT_MS=0")
+		}
+		return successResponse(c, map[string]string{"status": "ok"})
+	}, requestTimeoutMiddleware())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/read", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRequestTimeoutMiddlewareRunsLaterMiddlewaresWithinDeadline(t *testing.T) {
+	t.Setenv("ISUCON_WRITE_TIMEOUT_MS", "1000")
+
+	var middlewareDeadline bool
+	later := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			_, middlewareDeadline = dbContext(c).Deadline()
+			return next(c)
+		}
+	}
+	e := echo.New()
+	g := e.Group("", requestTimeoutMiddleware(), later)
+	g.POST("/user", func(c echo.Context) error {
+		return successResponse(c, map[string]string{"status": "ok"})
+	})
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/user", nil))
+	if !middlewareDeadline {
+		t.Error("middleware after requestTimeoutMiddleware ran without the deadline")
+	}
+}
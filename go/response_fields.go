@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// sparse fieldsets
+
+// parseFieldsParam ?fields=a,b で指定されたレスポンスのトップレベルのフィールド名を返す
+// 指定がない場合はnilを返し、全てのフィールドを返す。respのJSONにないフィールド名が含まれる場合はErrInvalidFieldsを返す
+func parseFieldsParam(c echo.Context, resp interface{}) (map[string]bool, error) {
+	param := c.QueryParam("fields")
+	if param == "" {
+		return nil, nil
+	}
+
+	known := jsonFieldNames(reflect.TypeOf(resp))
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, errors.Wrapf(ErrInvalidFields, "unknown field: %s", name)
+		}
+		fields[name] = true
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidFields
+	}
+	return fields, nil
+}
+
+// jsonFieldNames 構造体のJSONのトップレベルのフィールド名
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	names := make(map[string]bool)
+	if t.Kind() != reflect.Struct {
+		return names
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// sparseResponse fieldsで指定されたトップレベルのフィールドだけを返す。fieldsがnilの場合はsuccessResponseと同じ
+func sparseResponse(c echo.Context, fields map[string]bool, v interface{}) error {
+	if fields == nil {
+		return successResponse(c, v)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	all := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &all); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	filtered := make(map[string]json.RawMessage, len(fields))
+	for name := range fields {
+		if value, ok := all[name]; ok {
+			filtered[name] = value
+		}
+	}
+	return successResponse(c, filtered)
+}
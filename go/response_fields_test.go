@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestHomeDB ユーザー100のホームに応答する。デッキはカード11,12,13で、最後に報酬を受け取ったのは900
+func newTestHomeDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM users", []string{"id", "isu_coin", "last_getreward_at"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(500), int64(900)}}
+	})
+	fake.onQuery("FROM user_decks", []string{"id", "user_id", "user_card_id_1", "user_card_id_2", "user_card_id_3"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), args[0], int64(11), int64(12), int64(13)}}
+	})
+	fake.onQuery("FROM user_cards", []string{"id", "amount_per_sec"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11), int64(1)}, {int64(12), int64(2)}, {int64(13), int64(3)}}
+	})
+	return fake
+}
+
+func TestHomeSparseFields(t *testing.T) {
+	h := &Handler{DBs: []*sqlx.DB{newTestHomeDB().open()}}
+
+	rec := getJSON("/user/:userID/home", h.home, "/user/100/home?fields=now,%20totalAmountPerSec")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(res))
+	for name := range res {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "now" || names[1] != "totalAmountPerSec" {
+		t.Errorf("fields = %v, want only now and totalAmountPerSec", names)
+	}
+	if string(res["now"]) != "1000" || string(res["totalAmountPerSec"]) != "6" {
+		t.Errorf("body = %s, want the same values as the full response", rec.Body.String())
+	}
+
+	// 指定がなければ全てのフィールドを返す
+	rec = getJSON("/user/:userID/home", h.home, "/user/100/home")
+	full := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(rec.Body.Bytes(), &full); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"now", "user", "deck", "totalAmountPerSec", "pastTime"} {
+		if _, ok := full[name]; !ok {
+			t.Errorf("body = %s, want %s in the full response", rec.Body.String(), name)
+		}
+	}
+}
+
+func TestHomeSparseFieldsRejectsUnknownField(t *testing.T) {
+	for _, fields := range []string{"now,isuCoin", ",", "User"} {
+		h := &Handler{DBs: []*sqlx.DB{newTestHomeDB().open()}}
+		rec := getJSON("/user/:userID/home", h.home, "/user/100/home?fields="+fields)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("fields=%s: status = %d, body = %s, want 400", fields, rec.Code, rec.Body.String())
+		}
+	}
+}
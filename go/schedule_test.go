@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestGetSchedule(t *testing.T) {
+	h := &Handler{Cache: newTestMasterDataCache()}
+	h.Cache.SetGachaIndex(newGachaIndex("", []*GachaMaster{
+		{ID: 1, Name: "past", StartAt: 0, EndAt: 500},
+		{ID: 2, Name: "active", StartAt: 500, EndAt: 1500},
+		{ID: 3, Name: "ending", StartAt: 900, EndAt: 1100},
+		{ID: 4, Name: "future", StartAt: 1200, EndAt: 2000},
+	}))
+	h.Cache.SetLoginBonuses([]*LoginBonusMaster{
+		{ID: 1, StartAt: 0, EndAt: 3000},
+		{ID: 2, StartAt: 1050, EndAt: 3000},
+		{ID: 3, StartAt: 0, EndAt: 999},
+	})
+
+	rec := getJSON("/user/:userID/schedule", h.getSchedule, "/user/100/schedule")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(ScheduleResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		typ     string
+		id      int64
+		seconds int64
+	}
+	check := func(name string, got []*ScheduleEntry, want []entry) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s = %d entries, want %d: %s", name, len(got), len(want), rec.Body.String())
+			return
+		}
+		for i, w := range want {
+			if g := got[i]; g.Type != w.typ || g.ID != w.id || g.Seconds != w.seconds {
+				t.Errorf("%s[%d] = %+v, want %+v", name, i, g, w)
+			}
+		}
+	}
+	// 終わったものはどちらにも含めず、残り秒数の短い順に並べる
+	check("endingSoon", res.EndingSoon, []entry{
+		{typ: ScheduleTypeGacha, id: 3, seconds: 100},
+		{typ: ScheduleTypeGacha, id: 2, seconds: 500},
+		{typ: ScheduleTypeLoginBonus, id: 1, seconds: 2000},
+	})
+	check("startingSoon", res.StartingSoon, []entry{
+		{typ: ScheduleTypeLoginBonus, id: 2, seconds: 50},
+		{typ: ScheduleTypeGacha, id: 4, seconds: 200},
+	})
+	if res.Now != 1000 {
+		t.Errorf("now = %d, want the request time 1000", res.Now)
+	}
+}
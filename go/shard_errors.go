@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"time"
+)
+
+// //////////////////////////////////////
+// shard errors
+
+var (
+	// shardErrorLogSize シャードごとに保持する直近のエラーの件数
+	shardErrorLogSize = getEnvInt("ISUCON_SHARD_ERROR_LOG_SIZE", 20)
+	// shardErrorMaxAge この時間より古いエラーは返さない
+	shardErrorMaxAge = time.Duration(getEnvInt("ISUCON_SHARD_ERROR_MAX_AGE_SEC", 300)) * time.Second
+)
+
+// ShardErrorLog シャードが返した直近のエラーのリングバッファ
+// シャードが遅いだけなのか、特定のSQLエラーを返しているのかを切り分けるためのもの
+type ShardErrorLog struct {
+	mu      sync.Mutex
+	host    string
+	size    int
+	maxAge  time.Duration
+	entries []*ShardError
+	// next 次に書き込む位置。entriesがsizeに達するまでは末尾に追加する
+	next  int
+	total int64
+	// txs 同じ接続で数えるトランザクションの回数
+	txs *ShardTxCounter
+}
+
+// NewShardErrorLog シャードのエラーのログを作成
+func NewShardErrorLog(host string, size int, maxAge time.Duration) *ShardErrorLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &ShardErrorLog{
+		host:    host,
+		size:    size,
+		maxAge:  maxAge,
+		entries: make([]*ShardError, 0, size),
+		txs:     &ShardTxCounter{},
+	}
+}
+
+// Record エラーを記録する。driver.ErrSkipはdatabase/sqlが別の方法で実行し直すためのもので、エラーではないので記録しない
+// クエリ数を数えるためだけに包んだ接続ではlがnilになり、何も記録しない
+func (l *ShardErrorLog) Record(err error, at time.Time) {
+	if l == nil || err == nil || err == driver.ErrSkip {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := &ShardError{OccurredAt: at.Unix(), Message: err.Error()}
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+	l.next = (l.next + 1) % l.size
+	l.total++
+}
+
+// Recent 直近maxAge以内のエラーを新しい順に取得する
+func (l *ShardErrorLog) Recent(now time.Time) []*ShardError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	border := int64(0)
+	if l.maxAge > 0 {
+		border = now.Add(-l.maxAge).Unix()
+	}
+	errs := make([]*ShardError, 0, len(l.entries))
+	for i := 1; i <= len(l.entries); i++ {
+		e := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if e.OccurredAt < border {
+			break
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// Total 起動してからのエラーの件数
+func (l *ShardErrorLog) Total() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.total
+}
+
+// Txs シャードのトランザクションの回数。クエリ数を数えるためだけに包んだ接続ではnilを返す
+func (l *ShardErrorLog) Txs() *ShardTxCounter {
+	if l == nil {
+		return nil
+	}
+	return l.txs
+}
+
+// Host シャードのホスト
+func (l *ShardErrorLog) Host() string {
+	return l.host
+}
+
+type ShardError struct {
+	OccurredAt int64  `json:"occurredAt"`
+	Message    string `json:"message"`
+}
+
+// errorRecordingConnector 接続とクエリの実行で返ったエラーをShardErrorLogに記録するdriver.Connector
+// 各ハンドラに手を入れずに全てのクエリのエラーを拾えるよう、ドライバの層で包む
+// ISUCON_DEBUG_DB_QUERIES=1 の場合は、contextにカウンタを入れたリクエストが発行したクエリ数も数える
+type errorRecordingConnector struct {
+	connector driver.Connector
+	log       *ShardErrorLog
+}
+
+func (c *errorRecordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		c.log.Record(err, time.Now())
+		return nil, err
+	}
+	return &errorRecordingConn{Conn: conn, log: c.log}, nil
+}
+
+func (c *errorRecordingConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// errorRecordingConn エラーを記録するdriver.Conn
+// 元の接続が対応しているインターフェースはそのまま使い、対応していないものはdriver.ErrSkipでdatabase/sqlに任せる
+type errorRecordingConn struct {
+	driver.Conn
+	log *ShardErrorLog
+	// txCounter トランザクション中は、開始したときのcontextのカウンタ
+	// tx.Execなどcontextを渡さないクエリも、トランザクション中は接続を専有するためそのリクエストのクエリとして数える
+	txCounter *queryCounter
+}
+
+// counter クエリを数えるカウンタ。contextにない場合はトランザクションのカウンタを使う
+func (c *errorRecordingConn) counter(ctx context.Context) *queryCounter {
+	if qc := queryCounterFrom(ctx); qc != nil {
+		return qc
+	}
+	return c.txCounter
+}
+
+func (c *errorRecordingConn) record(err error) error {
+	c.log.Record(err, time.Now())
+	return err
+}
+
+func (c *errorRecordingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, c.record(err)
+	}
+	return &errorRecordingStmt{Stmt: stmt, log: c.log, conn: c}, nil
+}
+
+func (c *errorRecordingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	pc, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Prepare(query)
+	}
+	stmt, err := pc.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, c.record(err)
+	}
+	return &errorRecordingStmt{Stmt: stmt, log: c.log, conn: c}, nil
+}
+
+func (c *errorRecordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	res, err := ec.ExecContext(ctx, query, args)
+	c.counter(ctx).inc(err)
+	return res, c.record(err)
+}
+
+func (c *errorRecordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := qc.QueryContext(ctx, query, args)
+	c.counter(ctx).inc(err)
+	return rows, c.record(err)
+}
+
+func (c *errorRecordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin() //nolint:staticcheck
+	}
+	if err != nil {
+		return nil, c.record(err)
+	}
+	c.log.Txs().Begin()
+	c.txCounter = queryCounterFrom(ctx)
+	return &errorRecordingTx{Tx: tx, log: c.log, conn: c}, nil
+}
+
+func (c *errorRecordingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return c.record(p.Ping(ctx))
+	}
+	return nil
+}
+
+func (c *errorRecordingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *errorRecordingConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *errorRecordingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// errorRecordingStmt エラーを記録するdriver.Stmt
+// シャードの接続はinterpolateParamsを使わないため、引数つきのクエリはこちらを経由する
+type errorRecordingStmt struct {
+	driver.Stmt
+	log  *ShardErrorLog
+	conn *errorRecordingConn
+}
+
+func (s *errorRecordingStmt) record(err error) error {
+	s.log.Record(err, time.Now())
+	return err
+}
+
+func (s *errorRecordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(s.conn.txCounter, args)
+}
+
+func (s *errorRecordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.query(s.conn.txCounter, args)
+}
+
+func (s *errorRecordingStmt) exec(qc *queryCounter, args []driver.Value) (driver.Result, error) {
+	res, err := s.Stmt.Exec(args) //nolint:staticcheck
+	qc.inc(err)
+	return res, s.record(err)
+}
+
+func (s *errorRecordingStmt) query(qc *queryCounter, args []driver.Value) (driver.Rows, error) {
+	rows, err := s.Stmt.Query(args) //nolint:staticcheck
+	qc.inc(err)
+	return rows, s.record(err)
+}
+
+func (s *errorRecordingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.exec(s.conn.counter(ctx), values)
+	}
+	res, err := ec.ExecContext(ctx, args)
+	s.conn.counter(ctx).inc(err)
+	return res, s.record(err)
+}
+
+func (s *errorRecordingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.query(s.conn.counter(ctx), values)
+	}
+	rows, err := qc.QueryContext(ctx, args)
+	s.conn.counter(ctx).inc(err)
+	return rows, s.record(err)
+}
+
+func (s *errorRecordingStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// namedValuesToValues 名前つきの引数に対応していないドライバ向けに引数を変換する
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, driver.ErrSkip
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// errorRecordingTx エラーを記録するdriver.Tx。コミット時のデッドロックなどを拾い、コミットとロールバックの回数も数える
+type errorRecordingTx struct {
+	driver.Tx
+	log  *ShardErrorLog
+	conn *errorRecordingConn
+}
+
+func (t *errorRecordingTx) Commit() error {
+	t.conn.txCounter = nil
+	err := t.Tx.Commit()
+	t.log.Record(err, time.Now())
+	t.log.Txs().Commit(err)
+	return err
+}
+
+func (t *errorRecordingTx) Rollback() error {
+	t.conn.txCounter = nil
+	err := t.Tx.Rollback()
+	t.log.Record(err, time.Now())
+	t.log.Txs().Rollback()
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestShardErrorLogKeepsRecentErrors(t *testing.T) {
+	l := NewShardErrorLog("db1", 3, time.Minute)
+	base := time.Unix(1000, 0)
+
+	// リングバッファに収まらない古いエラーから上書きする
+	for i := 0; i < 5; i++ {
+		l.Record(fmt.Errorf("error %d", i), base.Add(time.Duration(i)*10*time.Second))
+	}
+	l.Record(nil, base)
+	l.Record(driver.ErrSkip, base)
+
+	messages := func(errs []*ShardError) []string {
+		ms := make([]string, len(errs))
+		for i, e := range errs {
+			ms[i] = e.Message
+		}
+		return ms
+	}
+	if got := messages(l.Recent(base.Add(40 * time.Second))); strings.Join(got, ",") != "error 4,error 3,error 2" {
+		t.Errorf("recent = %v, want the last 3 errors newest first", got)
+	}
+	if l.Total() != 5 {
+		t.Errorf("total = %d, want 5 without nil and ErrSkip", l.Total())
+	}
+
+	// maxAgeを過ぎたエラーは返さない
+	if got := messages(l.Recent(base.Add(85 * time.Second))); strings.Join(got, ",") != "error 4,error 3" {
+		t.Errorf("recent after aging = %v, want errors within the last minute", got)
+	}
+	if got := l.Recent(base.Add(10 * time.Minute)); len(got) != 0 {
+		t.Errorf("recent long after = %v, want none", messages(got))
+	}
+}
+
+func TestAdminShardErrorsFromQueries(t *testing.T) {
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE users", func(args []driver.Value) (int64, error) {
+		return 0, fmt.Errorf("Error 1213: Deadlock found when trying to get lock")
+	})
+	errLog := NewShardErrorLog("db1", 10, time.Minute)
+	db := sqlx.NewDb(sql.OpenDB(&errorRecordingConnector{connector: fake, log: errLog}), "mysql")
+	h := &Handler{DBs: []*sqlx.DB{db}, ShardErrors: []*ShardErrorLog{errLog}}
+
+	// ドライバが返したエラーをハンドラを経由せずに記録する
+	if _, err := db.Exec("UPDATE users SET isu_coin=0 WHERE id=?", 100); err == nil {
+		t.Fatal("injected error not returned")
+	}
+	if _, err := db.Exec("DELETE FROM users"); err == nil {
+		t.Fatal("unexpected statement succeeded")
+	}
+
+	rec := getJSON("/admin/shards/errors", h.adminShardErrors, "/admin/shards/errors")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(AdminShardErrorsResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Shards) != 1 || res.Shards[0].Host != "db1" || res.Shards[0].TotalErrors != 2 || len(res.Shards[0].Errors) != 2 {
+		t.Fatalf("body = %s, want 2 errors for db1", rec.Body.String())
+	}
+	if !strings.Contains(res.Shards[0].Errors[1].Message, "Deadlock") {
+		t.Errorf("oldest error = %q, want the injected deadlock", res.Shards[0].Errors[1].Message)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// //////////////////////////////////////
+// shard transaction metrics
+
+// ShardTxCounter シャードごとのトランザクションの開始・コミット・ロールバックの回数
+// ロールバックの割合が高いシャードでは、デッドロックやバリデーションエラーでの中断が多く起きている
+// シャードの接続を包むドライバの層で数えるため、ハンドラのトランザクションは全て数えられる
+// コミットした後のdefer tx.Rollback()はdatabase/sqlがドライバを呼ばずに返すため、ロールバックに数えない
+type ShardTxCounter struct {
+	begun        int64
+	committed    int64
+	commitFailed int64
+	rolledBack   int64
+}
+
+// Begin トランザクションの開始を数える。クエリ数を数えるためだけに包んだ接続ではcがnilになり、何も数えない
+func (c *ShardTxCounter) Begin() {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.begun, 1)
+}
+
+// Commit コミットを数える。コミットに失敗したトランザクションはMySQLがロールバックするため別に数える
+func (c *ShardTxCounter) Commit(err error) {
+	if c == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&c.commitFailed, 1)
+		return
+	}
+	atomic.AddInt64(&c.committed, 1)
+}
+
+// Rollback ロールバックを数える
+func (c *ShardTxCounter) Rollback() {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.rolledBack, 1)
+}
+
+// Stats レスポンス用に現在の値を取得する
+func (c *ShardTxCounter) Stats() *ShardTxStats {
+	stats := &ShardTxStats{
+		Begun:        atomic.LoadInt64(&c.begun),
+		Committed:    atomic.LoadInt64(&c.committed),
+		CommitFailed: atomic.LoadInt64(&c.commitFailed),
+		RolledBack:   atomic.LoadInt64(&c.rolledBack),
+	}
+	if finished := stats.Committed + stats.CommitFailed + stats.RolledBack; finished > 0 {
+		stats.RollbackRate = float64(stats.CommitFailed+stats.RolledBack) / float64(finished)
+	}
+	return stats
+}
+
+type ShardTxStats struct {
+	Shard        int     `json:"shard"`
+	Host         string  `json:"host"`
+	Begun        int64   `json:"begun"`
+	Committed    int64   `json:"committed"`
+	CommitFailed int64   `json:"commitFailed"`
+	RolledBack   int64   `json:"rolledBack"`
+	RollbackRate float64 `json:"rollbackRate"`
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func TestShardTxCounterFromTransactions(t *testing.T) {
+	fake := &fakeSQL{}
+	fake.onExec("UPDATE users", func(args []driver.Value) (int64, error) { return 1, nil })
+	errLog := NewShardErrorLog("db1", 10, time.Minute)
+	db := sqlx.NewDb(sql.OpenDB(&errorRecordingConnector{connector: fake, log: errLog}), "mysql")
+	h := &Handler{
+		DBs:          []*sqlx.DB{db},
+		ShardErrors:  []*ShardErrorLog{errLog},
+		LoginMetrics: NewLoginGrantMetrics(),
+		TokenIssues:  NewTokenIssueCounter(),
+		Outbox:       NewOutboxRelay(nil, echo.New().Logger),
+	}
+
+	// ハンドラと同じく、コミットした後もdeferでロールバックを呼ぶ
+	commit := func() {
+		tx, err := db.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if _, err := tx.Exec("UPDATE users SET isu_coin=0 WHERE id=?", 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollback := func() {
+		tx, err := db.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if _, err := tx.Exec("UPDATE users SET isu_coin=0 WHERE id=?", 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit()
+	rollback()
+	rollback()
+
+	rec := getJSON("/admin/metrics", h.adminMetrics, "/admin/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(AdminMetricsResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ShardTxs) != 1 {
+		t.Fatalf("body = %s, want one shard", rec.Body.String())
+	}
+	s := res.ShardTxs[0]
+	if s.Host != "db1" || s.Begun != 3 || s.Committed != 1 || s.RolledBack != 2 || s.CommitFailed != 0 {
+		t.Errorf("shard txs = %+v, want 3 begun, 1 committed and 2 rolled back", s)
+	}
+	if s.RollbackRate < 0.66 || s.RollbackRate > 0.67 {
+		t.Errorf("rollback rate = %v, want 2/3", s.RollbackRate)
+	}
+}
+
+func TestShardTxCounterCountsFailedCommits(t *testing.T) {
+	c := &ShardTxCounter{}
+	c.Begin()
+	c.Commit(driver.ErrBadConn)
+	if s := c.Stats(); s.Committed != 0 || s.CommitFailed != 1 || s.RollbackRate != 1 {
+		t.Errorf("stats = %+v, want the failed commit counted as rolled back", s)
+	}
+
+	// クエリ数を数えるためだけに包んだ接続では数えない
+	var none *ShardTxCounter
+	none.Begin()
+	none.Commit(nil)
+	none.Rollback()
+}
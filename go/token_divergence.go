@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// token divergence
+
+const (
+	// TokenDivergenceMissingInShard ユーザーのシャードにトークンがない。そのシャードで検証するエンドポイントでは使えない
+	TokenDivergenceMissingInShard string = "missing_in_shard"
+	// TokenDivergenceMissingInCache シャードにはあるがキャッシュにない。キャッシュのクリアや再起動の後は正常でも起こる
+	TokenDivergenceMissingInCache string = "missing_in_cache"
+	// TokenDivergenceWrongShard ユーザーのシャード以外のDBにトークンがある
+	TokenDivergenceWrongShard string = "wrong_shard"
+)
+
+// tokenLocation トークンを探すDB
+// メインのDBがいずれかのシャードと同じホストの場合は、そのシャードとして扱い二重に数えない
+type tokenLocation struct {
+	name  string
+	shard int // メインのDBの場合は-1
+	db    *sqlx.DB
+}
+
+// tokenLocations トークンを探すDBの一覧
+func (h *Handler) tokenLocations() []*tokenLocation {
+	mainHost := getEnv("ISUCON_DB_HOST", "127.0.0.1")
+	mainIsShard := false
+	locations := make([]*tokenLocation, 0, len(h.DBs)+1)
+	for i, db := range h.DBs {
+		if i < len(h.ShardErrors) && h.ShardErrors[i].Host() == mainHost {
+			mainIsShard = true
+		}
+		locations = append(locations, &tokenLocation{name: fmt.Sprintf("shard%d", i), shard: i, db: db})
+	}
+	if !mainIsShard {
+		locations = append(locations, &tokenLocation{name: "main", shard: -1, db: h.DB})
+	}
+	return locations
+}
+
+// sampledToken 不整合を確認するトークン
+type sampledToken struct {
+	token     string
+	userID    int64
+	tokenType int
+	createdAt int64
+}
+
+// sampleTokens キャッシュと各DBから有効なトークンを新しい順に最大n件集める
+// キャッシュにしかないトークンもDBにしかないトークンも対象にするため、両方から集めて新しいものを残す
+func (h *Handler) sampleTokens(ctx context.Context, locations []*tokenLocation, now int64, n int) ([]*sampledToken, error) {
+	tokens := make(map[string]*sampledToken, n)
+	for _, t := range h.TokenCache.Recent(now, n) {
+		tokens[t.Token] = &sampledToken{token: t.Token, userID: t.UserID, tokenType: t.TokenType, createdAt: t.CreatedAt}
+	}
+
+	query := "SELECT * FROM user_one_time_tokens WHERE deleted_at IS NULL AND expired_at >= ? ORDER BY created_at DESC LIMIT ?"
+	for _, loc := range locations {
+		rows := make([]*UserOneTimeToken, 0, n)
+		if err := loc.db.SelectContext(ctx, &rows, query, now, n); err != nil {
+			return nil, errors.Wrap(err, loc.name)
+		}
+		for _, row := range rows {
+			if _, ok := tokens[row.Token]; !ok {
+				tokens[row.Token] = &sampledToken{token: row.Token, userID: row.UserID, tokenType: row.TokenType, createdAt: row.CreatedAt}
+			}
+		}
+	}
+
+	samples := make([]*sampledToken, 0, len(tokens))
+	for _, t := range tokens {
+		samples = append(samples, t)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].createdAt > samples[j].createdAt
+	})
+	if len(samples) > n {
+		samples = samples[:n]
+	}
+	return samples, nil
+}
+
+// findTokens 指定したトークンのうち、DBに有効なまま残っているものを返す
+func findTokens(ctx context.Context, db *sqlx.DB, tokens []string, now int64) (map[string]struct{}, error) {
+	found := make(map[string]struct{}, len(tokens))
+	if len(tokens) == 0 {
+		return found, nil
+	}
+	query, params, err := sqlx.In("SELECT token FROM user_one_time_tokens WHERE token IN (?) AND deleted_at IS NULL AND expired_at >= ?", tokens, now)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]string, 0, len(tokens))
+	if err := db.SelectContext(ctx, &rows, query, params...); err != nil {
+		return nil, err
+	}
+	for _, token := range rows {
+		found[token] = struct{}{}
+	}
+	return found, nil
+}
+
+// checkTokenDivergence トークンを最大n件集め、ユーザーのシャード・キャッシュ・他のDBでの有無が食い違うものを調べる
+func (h *Handler) checkTokenDivergence(ctx context.Context, now int64, n int) (*AdminTokenDivergenceResponse, error) {
+	locations := h.tokenLocations()
+	samples, err := h.sampleTokens(ctx, locations, now, n)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]string, 0, len(samples))
+	for _, t := range samples {
+		tokens = append(tokens, t.token)
+	}
+	found := make([]map[string]struct{}, len(locations))
+	for i, loc := range locations {
+		if found[i], err = findTokens(ctx, loc.db, tokens, now); err != nil {
+			return nil, errors.Wrap(err, loc.name)
+		}
+	}
+
+	res := &AdminTokenDivergenceResponse{
+		Sampled:     len(samples),
+		ReasonCount: make(map[string]int),
+		Divergences: make([]*TokenDivergence, 0),
+	}
+	for _, t := range samples {
+		d := &TokenDivergence{
+			TokenPrefix:   maskToken(t.token),
+			UserID:        t.userID,
+			TokenType:     t.tokenType,
+			CreatedAt:     t.createdAt,
+			ExpectedShard: -1,
+			FoundIn:       make([]string, 0),
+			Reasons:       make([]string, 0),
+		}
+		if len(h.DBs) > 0 {
+			d.ExpectedShard = h.getShardIndex(t.userID)
+		}
+		if _, ok := h.TokenCache.GetToken(t.token); ok {
+			d.InCache = true
+		}
+
+		inExpectedShard := false
+		inWrongShard := false
+		for i, loc := range locations {
+			if _, ok := found[i][t.token]; !ok {
+				continue
+			}
+			d.FoundIn = append(d.FoundIn, loc.name)
+			if loc.shard == d.ExpectedShard {
+				inExpectedShard = true
+			} else {
+				inWrongShard = true
+			}
+		}
+
+		if !inExpectedShard {
+			d.Reasons = append(d.Reasons, TokenDivergenceMissingInShard)
+		} else if !d.InCache {
+			d.Reasons = append(d.Reasons, TokenDivergenceMissingInCache)
+		}
+		if inWrongShard {
+			d.Reasons = append(d.Reasons, TokenDivergenceWrongShard)
+		}
+		if len(d.Reasons) == 0 {
+			continue
+		}
+		for _, reason := range d.Reasons {
+			res.ReasonCount[reason]++
+		}
+		res.Divergent++
+		res.Divergences = append(res.Divergences, d)
+	}
+
+	return res, nil
+}
+
+// maskToken レスポンスやログに出すため、トークンを先頭の数文字だけにする
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return token
+	}
+	return token[:8] + "..."
+}
+
+type AdminTokenDivergenceResponse struct {
+	Sampled     int                `json:"sampled"`
+	Divergent   int                `json:"divergent"`
+	ReasonCount map[string]int     `json:"reasonCount"`
+	Divergences []*TokenDivergence `json:"divergences"`
+}
+
+type TokenDivergence struct {
+	TokenPrefix   string   `json:"tokenPrefix"`
+	UserID        int64    `json:"userId"`
+	TokenType     int      `json:"tokenType"`
+	CreatedAt     int64    `json:"createdAt"`
+	ExpectedShard int      `json:"expectedShard"`
+	InCache       bool     `json:"inCache"`
+	FoundIn       []string `json:"foundIn"`
+	Reasons       []string `json:"reasons"`
+}
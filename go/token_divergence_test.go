@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestTokenStoreDB tokensに保存した有効なトークンを一覧・検索する文に応答する
+func newTestTokenStoreDB(tokens ...*UserOneTimeToken) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("SELECT token FROM user_one_time_tokens", []string{"token"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, arg := range args[:len(args)-1] {
+			for _, t := range tokens {
+				if t.Token == arg {
+					rows = append(rows, []driver.Value{t.Token})
+				}
+			}
+		}
+		return rows
+	})
+	fake.onQuery("FROM user_one_time_tokens", []string{"id", "user_id", "token", "token_type", "created_at", "expired_at"}, func(args []driver.Value) [][]driver.Value {
+		rows := make([][]driver.Value, 0)
+		for _, t := range tokens {
+			rows = append(rows, []driver.Value{t.ID, t.UserID, t.Token, int64(t.TokenType), t.CreatedAt, t.ExpiredAt})
+		}
+		return rows
+	})
+	return fake
+}
+
+func TestCheckTokenDivergence(t *testing.T) {
+	// ユーザー100はシャード0、ユーザー1<<23はシャード1のユーザー
+	const otherShardUser = int64(1) << 23
+	shard0 := newTestTokenStoreDB(
+		&UserOneTimeToken{ID: 1, UserID: 100, Token: "consistent", TokenType: 1, CreatedAt: 990, ExpiredAt: 2000},
+		&UserOneTimeToken{ID: 2, UserID: 100, Token: "uncached", TokenType: 1, CreatedAt: 980, ExpiredAt: 2000},
+	)
+	shard1 := newTestTokenStoreDB()
+	// シャードではなくメインのDBに書いてしまったトークン
+	mainDB := newTestTokenStoreDB(
+		&UserOneTimeToken{ID: 3, UserID: otherShardUser, Token: "written-to-main", TokenType: 2, CreatedAt: 970, ExpiredAt: 2000},
+	)
+	h := &Handler{DBs: []*sqlx.DB{shard0.open(), shard1.open()}, DB: mainDB.open(), TokenCache: NewTokenCache()}
+	h.TokenCache.SetToken("consistent", 100, 1, 2000, 990)
+	h.TokenCache.SetToken("written-to-main", otherShardUser, 2, 2000, 970)
+	h.TokenCache.SetToken("cache-only", 100, 1, 2000, 960)
+
+	res, err := h.checkTokenDivergence(context.Background(), 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Sampled != 4 || res.Divergent != 3 {
+		t.Fatalf("sampled %d, divergent %d, want 4 and 3", res.Sampled, res.Divergent)
+	}
+	want := map[string]string{
+		"uncached": TokenDivergenceMissingInCache,
+		"written-": TokenDivergenceMissingInShard + "," + TokenDivergenceWrongShard,
+		"cache-on": TokenDivergenceMissingInShard,
+	}
+	for _, d := range res.Divergences {
+		prefix := strings.TrimSuffix(d.TokenPrefix, "...")
+		if got := strings.Join(d.Reasons, ","); got != want[prefix] {
+			t.Errorf("token %s reasons = %s, want %s", d.TokenPrefix, got, want[prefix])
+		}
+	}
+	wantCount := map[string]int{TokenDivergenceMissingInShard: 2, TokenDivergenceMissingInCache: 1, TokenDivergenceWrongShard: 1}
+	for reason, count := range wantCount {
+		if res.ReasonCount[reason] != count {
+			t.Errorf("reason %s count = %d, want %d", reason, res.ReasonCount[reason], count)
+		}
+	}
+
+	// サンプル数を指定した場合は新しいトークンから確認する
+	res, err = h.checkTokenDivergence(context.Background(), 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := make([]string, 0, len(res.Divergences))
+	for _, d := range res.Divergences {
+		prefixes = append(prefixes, d.TokenPrefix)
+	}
+	if res.Sampled != 2 || strings.Join(prefixes, ",") != "uncached" {
+		t.Errorf("sampled %d with divergences %v, want the 2 newest tokens and only uncached divergent", res.Sampled, prefixes)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// //////////////////////////////////////
+// one-time token issuance counter
+
+// TokenIssueCounter ユーザーごとのワンタイムトークンの発行回数を直近window分だけ数える
+// listGacha・listItemを繰り返し呼んでトークンを大量に発行するクライアントを検知するためのもの
+// limitが0以下の場合は数えるだけで、発行は拒否しない
+type TokenIssueCounter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	limit    int
+	maxUsers int
+	// issuedAt ユーザーごとの直近window内の発行日時(古い順)。limit件を超えては保持しない
+	issuedAt map[int64][]time.Time
+
+	// 直近1分間の発行数を求めるための、秒ごとの発行数のリングバッファ
+	perSecond     [60]int
+	perSecondUnix [60]int64
+}
+
+// NewTokenIssueCounter 設定に応じてカウンタを作成する
+func NewTokenIssueCounter() *TokenIssueCounter {
+	window := time.Duration(getEnvInt("ISUCON_TOKEN_ISSUE_WINDOW_SEC", 60)) * time.Second
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &TokenIssueCounter{
+		window:   window,
+		limit:    getEnvInt("ISUCON_TOKEN_ISSUE_LIMIT", 0),
+		maxUsers: getEnvInt("ISUCON_TOKEN_ISSUE_MAX_USERS", 100000),
+		issuedAt: make(map[int64][]time.Time),
+	}
+}
+
+// Allow ユーザーへのトークンの発行を記録する。直近windowの発行数がlimitに達している場合は記録せずにfalseを返す
+func (tc *TokenIssueCounter) Allow(userID int64, now time.Time) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	issued := tc.prune(tc.issuedAt[userID], now)
+	if tc.limit > 0 && len(issued) >= tc.limit {
+		tc.issuedAt[userID] = issued
+		return false
+	}
+
+	if _, ok := tc.issuedAt[userID]; !ok && tc.maxUsers > 0 && len(tc.issuedAt) >= tc.maxUsers {
+		tc.evict(now)
+	}
+	issued = append(issued, now)
+	if tc.limit > 0 && len(issued) > tc.limit {
+		issued = issued[len(issued)-tc.limit:]
+	}
+	tc.issuedAt[userID] = issued
+
+	sec := now.Unix()
+	i := int(sec % int64(len(tc.perSecond)))
+	if tc.perSecondUnix[i] != sec {
+		tc.perSecondUnix[i] = sec
+		tc.perSecond[i] = 0
+	}
+	tc.perSecond[i]++
+	return true
+}
+
+// Count ユーザーの直近windowのトークンの発行数
+func (tc *TokenIssueCounter) Count(userID int64, now time.Time) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return len(tc.prune(tc.issuedAt[userID], now))
+}
+
+// Stats 発行数の統計
+func (tc *TokenIssueCounter) Stats(now time.Time) *TokenIssueStats {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	issued := 0
+	sec := now.Unix()
+	for i, unix := range tc.perSecondUnix {
+		if sec-unix < int64(len(tc.perSecond)) {
+			issued += tc.perSecond[i]
+		}
+	}
+	return &TokenIssueStats{
+		IssuedPerMinute: issued,
+		TrackedUsers:    len(tc.issuedAt),
+		Limit:           tc.limit,
+		WindowSeconds:   int64(tc.window / time.Second),
+	}
+}
+
+// prune window外になった発行日時を取り除く
+func (tc *TokenIssueCounter) prune(issued []time.Time, now time.Time) []time.Time {
+	border := now.Add(-tc.window)
+	i := 0
+	for i < len(issued) && !issued[i].After(border) {
+		i++
+	}
+	return issued[i:]
+}
+
+// evict 追跡するユーザー数がmaxUsersに達した場合に、直近windowに発行のないユーザーを削除する
+// それでも減らない場合は、最後の発行が最も古いユーザーを削除する
+func (tc *TokenIssueCounter) evict(now time.Time) {
+	var oldestID int64
+	var oldestAt time.Time
+	for userID, issued := range tc.issuedAt {
+		issued = tc.prune(issued, now)
+		if len(issued) == 0 {
+			delete(tc.issuedAt, userID)
+			continue
+		}
+		tc.issuedAt[userID] = issued
+		if last := issued[len(issued)-1]; oldestAt.IsZero() || last.Before(oldestAt) {
+			oldestID, oldestAt = userID, last
+		}
+	}
+	if len(tc.issuedAt) >= tc.maxUsers && !oldestAt.IsZero() {
+		delete(tc.issuedAt, oldestID)
+	}
+}
+
+// TokenIssueStats ワンタイムトークンの発行数の統計
+type TokenIssueStats struct {
+	IssuedPerMinute int   `json:"issuedPerMinute"`
+	TrackedUsers    int   `json:"trackedUsers"`
+	Limit           int   `json:"limit"`
+	WindowSeconds   int64 `json:"windowSeconds"`
+	// UserIssued userIdを指定した場合の、そのユーザーの直近windowの発行数
+	UserIssued *int `json:"userIssued,omitempty"`
+}
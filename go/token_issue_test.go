@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestTokenIssueCounter(limit, maxUsers int) *TokenIssueCounter {
+	return &TokenIssueCounter{
+		window:   time.Minute,
+		limit:    limit,
+		maxUsers: maxUsers,
+		issuedAt: make(map[int64][]time.Time),
+	}
+}
+
+func TestTokenIssueCounterNormalRate(t *testing.T) {
+	tc := newTestTokenIssueCounter(3, 100)
+	now := time.Unix(1000, 0)
+
+	// 30秒に1回の発行なら、直近1分間に上限の3回に達しない
+	for i := 0; i < 10; i++ {
+		if !tc.Allow(100, now) {
+			t.Fatalf("issue %d rejected at a normal rate", i+1)
+		}
+		now = now.Add(30 * time.Second)
+	}
+	if n := tc.Count(100, now); n != 1 {
+		t.Errorf("count = %d, want only the issue within the last minute", n)
+	}
+}
+
+func TestTokenIssueCounterAbusiveRate(t *testing.T) {
+	tc := newTestTokenIssueCounter(3, 100)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !tc.Allow(100, now.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("issue %d rejected under the limit", i+1)
+		}
+	}
+	if tc.Allow(100, now.Add(3*time.Second)) {
+		t.Error("4th issue within a minute allowed, want it rejected")
+	}
+	// 他のユーザーには影響しない
+	if !tc.Allow(101, now.Add(3*time.Second)) {
+		t.Error("another user's issue rejected")
+	}
+	// 拒否した発行は1分あたりの発行数に含めない
+	if stats := tc.Stats(now.Add(3 * time.Second)); stats.IssuedPerMinute != 4 || stats.Limit != 3 {
+		t.Errorf("stats = %+v, want 4 issued in the last minute", stats)
+	}
+
+	// 最初の発行から1分経てば、また発行できる
+	if !tc.Allow(100, now.Add(time.Minute+time.Second)) {
+		t.Error("issue after the window rejected")
+	}
+}
+
+func TestTokenIssueCounterEvictsUsers(t *testing.T) {
+	tc := newTestTokenIssueCounter(0, 2)
+	now := time.Unix(1000, 0)
+
+	tc.Allow(100, now)
+	tc.Allow(101, now.Add(time.Second))
+	tc.Allow(102, now.Add(2*time.Second))
+	if n := tc.Stats(now).TrackedUsers; n != 2 {
+		t.Errorf("tracked %d users, want at most 2", n)
+	}
+	// 最後の発行が最も古いユーザーから削除する
+	if tc.Count(100, now.Add(2*time.Second)) != 0 || tc.Count(102, now.Add(2*time.Second)) != 1 {
+		t.Error("evicted a recent user instead of the oldest")
+	}
+}
+
+func TestListGachaRejectsAbusiveTokenIssues(t *testing.T) {
+	h := newTestHandler(t, newTestGachaArtDB())
+	h.TokenIssues = newTestTokenIssueCounter(1, 100)
+
+	if rec := getJSON("/user/:userID/gacha/index", h.listGacha, "/user/100/gacha/index"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	rec := getJSON("/user/:userID/gacha/index", h.listGacha, "/user/100/gacha/index")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, body = %s, want 429", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestTokenDB キャッシュにないトークンをDBから確認・失効させる文に応答する。tokenは1つだけ未使用で保存されている
+func newTestTokenDB(userID int64, token string, tokenType int, expiredAt int64) *fakeSQL {
+	fake := &fakeSQL{}
+	used := false
+	fake.onQuery("FROM user_one_time_tokens", []string{"id", "user_id", "token", "token_type", "expired_at"}, func(args []driver.Value) [][]driver.Value {
+		if used {
+			return nil
+		}
+		return [][]driver.Value{{int64(1), userID, token, int64(tokenType), expiredAt}}
+	})
+	fake.onExec("UPDATE user_one_time_tokens", func(args []driver.Value) (int64, error) {
+		if used {
+			return 0, nil
+		}
+		used = true
+		return 1, nil
+	})
+	return fake
+}
+
+func getTokenValidity(t *testing.T, h *Handler, path string) *ValidateOneTimeTokenResponse {
+	t.Helper()
+	e := echo.New()
+	e.GET("/user/:userID/token/:tokenType/valid", h.validateOneTimeToken, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("requestTime", int64(1000))
+			return next(c)
+		}
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(ValidateOneTimeTokenResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestValidateOneTimeTokenDoesNotConsume(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached bool
+	}{
+		{name: "cache", cached: true},
+		{name: "db fallback", cached: false},
+	}
+	for _, tt := range tests {
+		fake := newTestTokenDB(100, "token", 2, 2000)
+		h := &Handler{DBs: []*sqlx.DB{fake.open()}, TokenCache: NewTokenCache()}
+		if tt.cached {
+			h.TokenCache.SetToken("token", 100, 2, 2000, 0)
+		}
+
+		for i := 0; i < 2; i++ {
+			res := getTokenValidity(t, h, "/user/100/token/2/valid?token=token")
+			if !res.Valid || res.ExpiredAt != 2000 {
+				t.Errorf("%s: check %d = %+v, want valid until 2000", tt.name, i+1, res)
+			}
+		}
+		if fake.executed("UPDATE") != 0 {
+			t.Errorf("%s: committed = %v, want the check to leave the token unused", tt.name, fake.committed)
+		}
+
+		// 確認した後も、本来のエンドポイントで1回だけ使える
+		if err := h.checkOneTimeToken(context.Background(), 100, "token", 2, 1000); err != nil {
+			t.Errorf("%s: token unusable after the check: %v", tt.name, err)
+		}
+		if err := h.checkOneTimeToken(context.Background(), 100, "token", 2, 1000); !isTokenError(err) {
+			t.Errorf("%s: reused token = %v, want a token error", tt.name, err)
+		}
+	}
+}
+
+func TestValidateOneTimeTokenRejectsWrongType(t *testing.T) {
+	h := &Handler{DBs: []*sqlx.DB{newTestTokenDB(100, "token", 2, 2000).open()}, TokenCache: NewTokenCache()}
+	h.TokenCache.SetToken("token", 100, 2, 2000, 0)
+
+	if res := getTokenValidity(t, h, "/user/100/token/1/valid?token=token"); res.Valid {
+		t.Errorf("enhance token checked as a gacha token = %+v, want invalid", res)
+	}
+	if res := getTokenValidity(t, h, "/user/101/token/2/valid?token=token"); res.Valid {
+		t.Errorf("another user's token = %+v, want invalid", res)
+	}
+}
+
+func TestCheckOneTimeTokenErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		cached     bool
+		userID     int64
+		token      string
+		tokenType  int
+		expiredAt  int64
+		want       error
+		wantStatus int
+	}{
+		{name: "cache expired", cached: true, userID: 100, token: "token", tokenType: 2, expiredAt: 999, want: ErrTokenExpired, wantStatus: http.StatusGone},
+		{name: "cache type mismatch", cached: true, userID: 100, token: "token", tokenType: 1, expiredAt: 2000, want: ErrTokenTypeMismatch, wantStatus: http.StatusBadRequest},
+		{name: "cache another user", cached: true, userID: 101, token: "token", tokenType: 2, expiredAt: 2000, want: ErrTokenNotFound, wantStatus: http.StatusNotFound},
+		{name: "db expired", userID: 100, token: "token", tokenType: 2, expiredAt: 999, want: ErrTokenExpired, wantStatus: http.StatusGone},
+		{name: "db type mismatch", userID: 100, token: "token", tokenType: 1, expiredAt: 2000, want: ErrTokenTypeMismatch, wantStatus: http.StatusBadRequest},
+		{name: "db another user", userID: 101, token: "token", tokenType: 2, expiredAt: 2000, want: ErrTokenNotFound, wantStatus: http.StatusNotFound},
+		{name: "db not found", userID: 100, token: "unknown", tokenType: 2, expiredAt: 2000, want: ErrTokenNotFound, wantStatus: http.StatusNotFound},
+	}
+	prev := detailedTokenErrors
+	t.Cleanup(func() { detailedTokenErrors = prev })
+	for _, detailed := range []bool{true, false} {
+		detailedTokenErrors = detailed
+		for _, tt := range tests {
+			// 保存されているのはユーザー100の強化用(種別2)のトークン
+			fake := newTestTokenDB(100, "token", 2, tt.expiredAt)
+			if tt.token == "unknown" {
+				fake = &fakeSQL{}
+				fake.onQuery("FROM user_one_time_tokens", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+			}
+			h := &Handler{DBs: []*sqlx.DB{fake.open()}, TokenCache: NewTokenCache()}
+			if tt.cached {
+				h.TokenCache.SetToken("token", 100, 2, tt.expiredAt, 0)
+			}
+
+			err := h.checkOneTimeToken(context.Background(), tt.userID, tt.token, tt.tokenType, 1000)
+			if !detailed {
+				// 理由を返さない設定では、トークンが存在するかを漏らさない
+				if err != ErrInvalidToken {
+					t.Errorf("%s: err = %v, want ErrInvalidToken", tt.name, err)
+				}
+				continue
+			}
+			if err != tt.want {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+			}
+			if status := tokenErrorStatus(err); status != tt.wantStatus {
+				t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+			}
+		}
+	}
+	if status := tokenErrorStatus(ErrInvalidToken); status != http.StatusBadRequest {
+		t.Errorf("status for ErrInvalidToken = %d, want 400", status)
+	}
+}
+
+func TestGachaTokenRejectedByAddExpStaysValid(t *testing.T) {
+	for _, cached := range []bool{true, false} {
+		// ユーザー100のガチャ用(種別1)のトークン
+		fake := newTestTokenDB(100, "token", 1, 2000)
+		fake.rules = append(fake.rules, newTestGachaDrawDB(&gachaDrawRecord{}).rules...)
+		h := newTestHandler(t, fake)
+		if cached {
+			h.TokenCache.SetToken("token", 100, 1, 2000, 0)
+		}
+
+		rec := postJSON("/user/:userID/card/addexp/:cardID", h.addExpToCard, "/user/100/card/addexp/11", `{"viewerId":"viewer","oneTimeToken":"token","items":[]}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("cached=%v: addexp status = %d, body = %s, want 400", cached, rec.Code, rec.Body.String())
+		}
+		if fake.executed("UPDATE user_one_time_tokens") != 0 {
+			t.Errorf("cached=%v: committed = %v, want the token left unused", cached, fake.committed)
+		}
+
+		// 種別の違うエンドポイントで弾かれても、ガチャではまだ使える
+		rec = postJSON("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha, "/user/100/gacha/draw/1/1", `{"viewerId":"viewer","oneTimeToken":"token"}`)
+		if rec.Code != http.StatusOK {
+			t.Errorf("cached=%v: draw status = %d, body = %s, want 200", cached, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// //////////////////////////////////////
+// user merge
+
+// MergeInsertBatchSize 統合先のシャードにカード・プレゼントを複製する際に、1回のINSERTで挿入する最大件数
+const MergeInsertBatchSize int = 500
+
+// mergeUser ゲストアカウントなど、呼び出し元が持つ別のアカウントを統合する
+// sourceUserIdのコイン・カード・強化素材・未受け取りのプレゼントをuserIDのユーザーに移し、統合元には何も残さない
+// 繰り越し中の端数(user_item_fractions)も移し、統合先の端数と合わせて1に達した分は付与する
+// ガチャの天井のカウント(user_gacha_pities)は移さない。アカウントをまとめるだけで天井に近づけないよう、統合先のカウントのままとする
+// 統合元の端末(sourceViewerId)と有効なセッション(sourceSessionId)の両方を示せた場合のみ、統合元も呼び出し元のものとみなす
+// 同じシャードのユーザー同士は1つのトランザクションで移す
+// シャードが異なる場合は、統合元の行をロックしたまま統合先に複製してコミットし、その後に統合元から取り除く
+// 統合先には取り除くものを補償のイベントとして同じトランザクションで記録し、統合元のコミットに失敗した場合はOutboxRelayが取り除き直す
+// POST /user/{userID}/merge
+func (h *Handler) mergeUser(c echo.Context) error {
+	ctx := dbContext(c)
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(MergeUserRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	sourceID := req.SourceUserID
+	if sourceID <= 0 || sourceID == userID {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidMergeSource)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(ctx, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if err = h.checkMergeSourceOwnership(ctx, sourceID, req.SourceViewerID, req.SourceSessionID, requestAt); err != nil {
+		if err == ErrForbidden {
+			return errorResponse(c, http.StatusForbidden, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	sameShard := h.getShardIndex(userID) == h.getShardIndex(sourceID)
+	release, err := h.acquireWriteSlot(userID)
+	if err != nil {
+		return shardBusyResponse(c, err)
+	}
+	defer release()
+	if !sameShard {
+		releaseSource, err := h.acquireWriteSlot(sourceID)
+		if err != nil {
+			return shardBusyResponse(c, err)
+		}
+		defer releaseSource()
+	}
+
+	sourceTx, err := h.getDBForUserID(sourceID).BeginTxx(ctx, nil)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer sourceTx.Rollback() //nolint:errcheck
+
+	holdings, err := loadMergeHoldings(sourceTx, sourceID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	mergeID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	compensation := newMergeCompensation(mergeID, userID, sourceID, holdings)
+
+	targetTx := sourceTx
+	if !sameShard {
+		targetTx, err = h.getDBForUserID(userID).BeginTxx(ctx, nil)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		defer targetTx.Rollback() //nolint:errcheck
+
+		// 統合元から取り除けなかった場合に後から取り除けるよう、複製と同じトランザクションで記録する
+		if err = insertOutboxEvent(targetTx, EventTypeMergeCompensation, &sourceID, compensation, requestAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	if err = h.applyMergeHoldings(ctx, targetTx, userID, sourceID, holdings, sameShard, requestAt); err != nil {
+		if err == ErrUserNotFound || err == ErrItemNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	user := new(User)
+	if err = targetTx.Get(user, "SELECT * FROM users WHERE id=?", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if !sameShard {
+		if err = targetTx.Commit(); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	// 統合元から取り除く。シャードが異なる場合は、統合先に複製済みのものを取り除く補償の処理になる
+	if err = clearMergedHoldings(sourceTx, compensation, sameShard, requestAt); err == nil {
+		err = sourceTx.Commit()
+	}
+	if err != nil {
+		if !sameShard {
+			// 統合先はコミット済みのため、統合元に残ったものは補償のイベントから取り除き直す
+			c.Logger().Errorf("merged holdings remain in source user until compensated: mergeID=%d, sourceUserID=%d, userID=%d, err=%v",
+				mergeID, sourceID, userID, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &MergeUserResponse{
+		User:          user,
+		MovedCoins:    holdings.Coins,
+		MovedCards:    len(holdings.Cards),
+		MovedItems:    len(holdings.Items),
+		MovedPresents: len(holdings.Presents),
+	})
+}
+
+type MergeUserRequest struct {
+	ViewerID        string `json:"viewerId"`
+	SourceUserID    int64  `json:"sourceUserId"`
+	SourceViewerID  string `json:"sourceViewerId"`
+	SourceSessionID string `json:"sourceSessionId"`
+}
+
+type MergeUserResponse struct {
+	User          *User `json:"user"`
+	MovedCoins    int64 `json:"movedCoins"`
+	MovedCards    int   `json:"movedCards"`
+	MovedItems    int   `json:"movedItems"`
+	MovedPresents int   `json:"movedPresents"`
+}
+
+// checkMergeSourceOwnership 統合元のユーザーの端末と有効なセッションを示せたか確認する。示せない場合はErrForbiddenを返す
+func (h *Handler) checkMergeSourceOwnership(ctx context.Context, sourceID int64, viewerID, sessionID string, requestAt int64) error {
+	if err := h.checkViewerID(ctx, sourceID, viewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return ErrForbidden
+		}
+		return err
+	}
+
+	sess := new(Session)
+	query := "SELECT * FROM user_sessions WHERE session_id=? AND user_id=? AND deleted_at IS NULL"
+	if err := h.getDBForUserID(sourceID).GetContext(ctx, sess, query, sessionID, sourceID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrForbidden
+		}
+		return err
+	}
+	if sess.ExpiredAt < requestAt {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// mergeHoldings 統合元から移すもの
+type mergeHoldings struct {
+	Coins    int64
+	Cards    []*UserCard
+	Items    []*UserItem
+	Presents []*UserPresent
+	// Fractions 端数単位のコイン・強化素材の、繰り越し中の端数
+	Fractions []*UserItemFraction
+}
+
+// loadMergeHoldings 統合元の所持品を、移し終えるまで変更されないようロックして読む
+func loadMergeHoldings(tx *sqlx.Tx, sourceID int64) (*mergeHoldings, error) {
+	holdings := new(mergeHoldings)
+	if err := tx.Get(&holdings.Coins, "SELECT isu_coin FROM users WHERE id=? FOR UPDATE", sourceID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	holdings.Cards = make([]*UserCard, 0)
+	if err := tx.Select(&holdings.Cards, "SELECT * FROM user_cards WHERE user_id=? AND deleted_at IS NULL ORDER BY id FOR UPDATE", sourceID); err != nil {
+		return nil, err
+	}
+	holdings.Items = make([]*UserItem, 0)
+	if err := tx.Select(&holdings.Items, "SELECT * FROM user_items WHERE user_id=? AND amount > 0 AND deleted_at IS NULL ORDER BY id FOR UPDATE", sourceID); err != nil {
+		return nil, err
+	}
+	holdings.Presents = make([]*UserPresent, 0)
+	if err := tx.Select(&holdings.Presents, "SELECT * FROM user_presents WHERE user_id=? AND deleted_at IS NULL ORDER BY id FOR UPDATE", sourceID); err != nil {
+		return nil, err
+	}
+	holdings.Fractions = make([]*UserItemFraction, 0)
+	if err := tx.Select(&holdings.Fractions, "SELECT item_id, fraction FROM user_item_fractions WHERE user_id=? AND fraction > 0 ORDER BY item_id FOR UPDATE", sourceID); err != nil {
+		return nil, err
+	}
+	return holdings, nil
+}
+
+// applyMergeHoldings 統合元の所持品を統合先のユーザーに加える
+// コインと強化素材は統合先の所持数に加算し、上限を超えた分は通常の付与と同じく処理する
+// 端数は端数単位の付与数として通常の付与と同じく加算し、統合先の端数と合わせて1に達した分を付与する
+// カードとプレゼントは、同じシャードであれば持ち主を付け替え、異なるシャードであれば同じidのまま複製する
+func (h *Handler) applyMergeHoldings(ctx context.Context, tx *sqlx.Tx, userID, sourceID int64, holdings *mergeHoldings, sameShard bool, requestAt int64) error {
+	if holdings.Coins > 0 {
+		var currentCoin int64
+		if err := tx.Get(&currentCoin, "SELECT isu_coin FROM users WHERE id=? FOR UPDATE", userID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		totalCoin, overflow := capCoin(currentCoin, holdings.Coins)
+		if _, err := tx.Exec("UPDATE users SET isu_coin=?, updated_at=? WHERE id=?", totalCoin, requestAt, userID); err != nil {
+			return err
+		}
+		if err := h.handleCoinOverflow(ctx, tx, userID, overflow, requestAt); err != nil {
+			return err
+		}
+	}
+
+	if err := h.mergeItems(ctx, tx, userID, holdings.Items, requestAt); err != nil {
+		return err
+	}
+	if err := h.mergeFractions(ctx, tx, userID, holdings.Fractions, requestAt); err != nil {
+		return err
+	}
+
+	if sameShard {
+		if _, err := tx.Exec("UPDATE user_cards SET user_id=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL", userID, requestAt, sourceID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE user_presents SET user_id=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL", userID, requestAt, sourceID); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for start := 0; start < len(holdings.Cards); start += MergeInsertBatchSize {
+		end := start + MergeInsertBatchSize
+		if end > len(holdings.Cards) {
+			end = len(holdings.Cards)
+		}
+		cards := make([]*UserCard, 0, end-start)
+		for _, card := range holdings.Cards[start:end] {
+			copied := *card
+			copied.UserID = userID
+			copied.UpdatedAt = requestAt
+			cards = append(cards, &copied)
+		}
+		query := `INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at)
+				  VALUES (:id, :user_id, :card_id, :amount_per_sec, :level, :total_exp, :created_at, :updated_at)`
+		if _, err := tx.NamedExec(query, cards); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(holdings.Presents); start += MergeInsertBatchSize {
+		end := start + MergeInsertBatchSize
+		if end > len(holdings.Presents) {
+			end = len(holdings.Presents)
+		}
+		presents := make([]*UserPresent, 0, end-start)
+		for _, present := range holdings.Presents[start:end] {
+			copied := *present
+			copied.UserID = userID
+			copied.UpdatedAt = requestAt
+			presents = append(presents, &copied)
+		}
+		query := `INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, source, source_id, created_at, updated_at)
+				  VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :source, :source_id, :created_at, :updated_at)`
+		if _, err := tx.NamedExec(query, presents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeItems 統合元の強化素材を統合先の所持数に加算する
+func (h *Handler) mergeItems(ctx context.Context, tx *sqlx.Tx, userID int64, items []*UserItem, requestAt int64) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	amounts := make(map[int64]int64, len(items))
+	itemIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		if _, ok := amounts[item.ItemID]; !ok {
+			itemIDs = append(itemIDs, item.ItemID)
+		}
+		amounts[item.ItemID] += int64(item.Amount)
+	}
+	sort.Slice(itemIDs, func(i, j int) bool { return itemIDs[i] < itemIDs[j] })
+
+	query, params, err := sqlx.In("SELECT * FROM user_items WHERE user_id=? AND item_id IN (?) ORDER BY id FOR UPDATE", userID, itemIDs)
+	if err != nil {
+		return err
+	}
+	existingItems := make([]*UserItem, 0)
+	if err := tx.Select(&existingItems, query, params...); err != nil {
+		return err
+	}
+	existingMap := make(map[int64]*UserItem, len(existingItems))
+	for _, item := range existingItems {
+		existingMap[item.ItemID] = item
+	}
+
+	for _, itemID := range itemIDs {
+		master, err := h.getItemMaster(ctx, itemID)
+		if err != nil {
+			return err
+		}
+
+		existing, exists := existingMap[itemID]
+		current := int64(0)
+		if exists {
+			current = int64(existing.Amount)
+		}
+		total, overflow := capItemAmount(master, current, amounts[itemID])
+		if err := h.handleItemOverflow(ctx, tx, userID, master, overflow, requestAt); err != nil {
+			return err
+		}
+
+		if exists {
+			if _, err := tx.Exec("UPDATE user_items SET amount=?, updated_at=? WHERE id=?", total, requestAt, existing.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		uitem := &UserItem{UserID: userID, ItemID: itemID, ItemType: master.ItemType, Amount: int(total), CreatedAt: requestAt, UpdatedAt: requestAt}
+		if uitem.ID, err = h.generateID(); err != nil {
+			return err
+		}
+		query := "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		if err := h.retryOnIDCollision(func() error {
+			_, err := tx.Exec(query, uitem.ID, uitem.UserID, uitem.ItemID, uitem.ItemType, uitem.Amount, uitem.CreatedAt, uitem.UpdatedAt)
+			return err
+		}, &uitem.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeFractions 統合元の端数を、端数単位の付与数として統合先に付与する
+func (h *Handler) mergeFractions(ctx context.Context, tx *sqlx.Tx, userID int64, fractions []*UserItemFraction, requestAt int64) error {
+	if len(fractions) == 0 {
+		return nil
+	}
+
+	grants := make([]*UserPresent, 0, len(fractions))
+	for _, f := range fractions {
+		master, err := h.getItemMaster(ctx, f.ItemID)
+		if err != nil {
+			return err
+		}
+		grants = append(grants, &UserPresent{
+			UserID:    userID,
+			SentAt:    requestAt,
+			ItemType:  master.ItemType,
+			ItemID:    f.ItemID,
+			Amount:    int(f.Fraction),
+			CreatedAt: requestAt,
+			UpdatedAt: requestAt,
+		})
+	}
+	_, err := h.obtainItemsBatch(ctx, tx, grants, userID, requestAt)
+	return err
+}
+
+// MergeCompensation 統合元から取り除くもの。シャードが異なる場合は補償のイベントの内容になる
+type MergeCompensation struct {
+	MergeID      int64         `json:"mergeId"`
+	UserID       int64         `json:"userId"`
+	SourceUserID int64         `json:"sourceUserId"`
+	Coins        int64         `json:"coins"`
+	Items        []*MergedItem `json:"items"`
+	CardIDs      []int64       `json:"cardIds"`
+	PresentIDs   []int64       `json:"presentIds"`
+	// Fractions 古いイベントには含まれないため、省略された場合は端数を取り除かない
+	Fractions []*MergedFraction `json:"fractions,omitempty"`
+}
+
+// MergedItem 統合元から移した強化素材の行と数
+type MergedItem struct {
+	ID     int64 `json:"id"`
+	Amount int   `json:"amount"`
+}
+
+// MergedFraction 統合元から移した端数
+type MergedFraction struct {
+	ItemID   int64 `json:"itemId"`
+	Fraction int64 `json:"fraction"`
+}
+
+// newMergeCompensation 統合元から読んだ所持品から、取り除くものを作る
+func newMergeCompensation(mergeID, userID, sourceID int64, holdings *mergeHoldings) *MergeCompensation {
+	mc := &MergeCompensation{
+		MergeID:      mergeID,
+		UserID:       userID,
+		SourceUserID: sourceID,
+		Coins:        holdings.Coins,
+		Items:        make([]*MergedItem, 0, len(holdings.Items)),
+		CardIDs:      make([]int64, 0, len(holdings.Cards)),
+		PresentIDs:   make([]int64, 0, len(holdings.Presents)),
+	}
+	for _, item := range holdings.Items {
+		mc.Items = append(mc.Items, &MergedItem{ID: item.ID, Amount: item.Amount})
+	}
+	for _, card := range holdings.Cards {
+		mc.CardIDs = append(mc.CardIDs, card.ID)
+	}
+	for _, present := range holdings.Presents {
+		mc.PresentIDs = append(mc.PresentIDs, present.ID)
+	}
+	for _, f := range holdings.Fractions {
+		mc.Fractions = append(mc.Fractions, &MergedFraction{ItemID: f.ItemID, Fraction: f.Fraction})
+	}
+	return mc
+}
+
+// clearMergedHoldings 統合元から移したものを取り除き、統合元のセッションとデッキを無効にする
+// 同じシャードの場合、カードとプレゼントは持ち主を付け替え済みのため取り除かない
+// 統合の記録(user_merges)を先に挿入し、既に記録がある場合は取り除き済みのため何もしない。補償で再実行しても二重に取り除かない
+// コインと強化素材、端数は移した数だけ減らす。統合元の行をロックしたまま取り除く場合は0になり、強化素材の行は論理削除せずに残す
+func clearMergedHoldings(tx *sqlx.Tx, mc *MergeCompensation, sameShard bool, requestAt int64) error {
+	query := "INSERT IGNORE INTO user_merges(id, user_id, source_user_id, merged_at) VALUES (?, ?, ?, ?)"
+	res, err := tx.Exec(query, mc.MergeID, mc.UserID, mc.SourceUserID, requestAt)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	if mc.Coins > 0 {
+		if _, err := tx.Exec("UPDATE users SET isu_coin=isu_coin-LEAST(isu_coin, ?), updated_at=? WHERE id=?", mc.Coins, requestAt, mc.SourceUserID); err != nil {
+			return err
+		}
+	}
+	for _, item := range mc.Items {
+		query := "UPDATE user_items SET amount=amount-LEAST(amount, ?), updated_at=? WHERE id=? AND user_id=?"
+		if _, err := tx.Exec(query, item.Amount, requestAt, item.ID, mc.SourceUserID); err != nil {
+			return err
+		}
+	}
+	for _, f := range mc.Fractions {
+		query := "UPDATE user_item_fractions SET fraction=fraction-LEAST(fraction, ?), updated_at=? WHERE user_id=? AND item_id=?"
+		if _, err := tx.Exec(query, f.Fraction, requestAt, mc.SourceUserID, f.ItemID); err != nil {
+			return err
+		}
+	}
+	if !sameShard {
+		if err := softDeleteByIDs(tx, "user_cards", mc.SourceUserID, mc.CardIDs, requestAt); err != nil {
+			return err
+		}
+		if err := softDeleteByIDs(tx, "user_presents", mc.SourceUserID, mc.PresentIDs, requestAt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE user_decks SET deleted_at=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL", requestAt, requestAt, mc.SourceUserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE user_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL", requestAt, mc.SourceUserID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// softDeleteByIDs 統合元のカード・プレゼントのうち、統合先に複製したidのものをMergeInsertBatchSize件ずつ論理削除する
+func softDeleteByIDs(tx *sqlx.Tx, table string, sourceID int64, ids []int64, requestAt int64) error {
+	for start := 0; start < len(ids); start += MergeInsertBatchSize {
+		end := start + MergeInsertBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, params, err := sqlx.In("UPDATE "+table+" SET deleted_at=?, updated_at=? WHERE id IN (?) AND user_id=? AND deleted_at IS NULL", requestAt, requestAt, ids[start:end], sourceID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensateMerge シャードをまたぐ統合で、統合元に残ったものを取り除く。OutboxRelayから呼ばれる
+// 統合元のコミットに成功していた場合は統合の記録があるため何もしない
+func (h *Handler) compensateMerge(event *OutboxEvent) error {
+	mc := new(MergeCompensation)
+	if err := json.Unmarshal(event.Payload, mc); err != nil {
+		return errors.Wrapf(err, "outbox event id=%d", event.ID)
+	}
+
+	tx, err := h.getDBForUserID(mc.SourceUserID).Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 統合のリクエストと同じ順にロックを取り、統合元のトランザクションがまだ終わっていない場合はその結果を待つ
+	var sourceID int64
+	if err := tx.Get(&sourceID, "SELECT id FROM users WHERE id=? FOR UPDATE", mc.SourceUserID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if err := clearMergedHoldings(tx, mc, false, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
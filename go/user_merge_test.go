@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newTestMergeClearDB clearMergedHoldingsが発行する文に応答し、統合元の端数を減らした数をfractionsに記録する
+func newTestMergeClearDB(fractions map[int64]int64) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onExec("INSERT IGNORE INTO user_merges", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("UPDATE users SET isu_coin", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("UPDATE user_items", func(args []driver.Value) (int64, error) { return 1, nil })
+	fake.onExec("UPDATE user_item_fractions", func(args []driver.Value) (int64, error) {
+		fractions[args[3].(int64)] += args[0].(int64)
+		return 1, nil
+	})
+	fake.onExec("UPDATE user_decks", func(args []driver.Value) (int64, error) { return 0, nil })
+	fake.onExec("UPDATE user_sessions", func(args []driver.Value) (int64, error) { return 0, nil })
+	return fake
+}
+
+func TestClearMergedHoldingsRemovesFractions(t *testing.T) {
+	holdings := &mergeHoldings{
+		Coins:     100,
+		Items:     []*UserItem{{ID: 5, ItemID: 10, Amount: 3}},
+		Fractions: []*UserItemFraction{{ItemID: 1, Fraction: 250}, {ItemID: 10, Fraction: 7}},
+	}
+	mc := newMergeCompensation(1, 100, 200, holdings)
+	fractions := make(map[int64]int64)
+	fake := newTestMergeClearDB(fractions)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clearMergedHoldings(tx, mc, true, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// 移した端数だけ統合元から減らし、天井のカウントには触れない
+	if fractions[1] != 250 || fractions[10] != 7 {
+		t.Errorf("removed fractions = %v, want item 1: 250, item 10: 7", fractions)
+	}
+	if fake.executed("user_gacha_pities") != 0 {
+		t.Errorf("committed = %v, want pities left as they are", fake.committed)
+	}
+}
+
+func TestMergeCompensationWithoutFractions(t *testing.T) {
+	// 端数を移すようになる前に記録した補償のイベントは、端数を取り除かずに補償する
+	payload := `{"mergeId":1,"userId":100,"sourceUserId":200,"coins":0,"items":[],"cardIds":[],"presentIds":[]}`
+	mc := new(MergeCompensation)
+	if err := json.Unmarshal([]byte(payload), mc); err != nil {
+		t.Fatal(err)
+	}
+	fractions := make(map[int64]int64)
+	fake := newTestMergeClearDB(fractions)
+	tx, err := fake.open().Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clearMergedHoldings(tx, mc, true, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.executed("UPDATE user_item_fractions") != 0 {
+		t.Errorf("committed = %v, want no fractions removed", fake.committed)
+	}
+}
+
+// newTestMergeDB ユーザー100への統合に応答する。統合元sourceIDはコイン300、カード2枚、強化素材10を3つ、プレゼント1つを持ち、
+// 端末source-viewerと有効期限2000のセッションsource-sessionを持つ
+func newTestMergeDB(sourceID int64) *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("FROM user_devices", []string{"id", "user_id", "platform_id"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] == sourceID && args[1] != "source-viewer" {
+			return nil
+		}
+		return [][]driver.Value{{int64(1), args[0], args[1]}}
+	})
+	fake.onQuery("FROM user_sessions", []string{"id", "user_id", "session_id", "expired_at"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] != "source-session" || args[1] != sourceID {
+			return nil
+		}
+		return [][]driver.Value{{int64(1), sourceID, "source-session", int64(2000)}}
+	})
+	fake.onQuery("SELECT isu_coin FROM users", []string{"isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] == sourceID {
+			return [][]driver.Value{{int64(300)}}
+		}
+		return [][]driver.Value{{int64(1000)}}
+	})
+	fake.onQuery("FROM users", []string{"id", "isu_coin"}, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], int64(1300)}}
+	})
+	fake.onQuery("FROM user_cards", []string{"id", "user_id", "card_id", "amount_per_sec", "level", "total_exp"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] != sourceID {
+			return nil
+		}
+		return [][]driver.Value{
+			{int64(21), sourceID, int64(2), int64(1), int64(1), int64(0)},
+			{int64(22), sourceID, int64(3), int64(1), int64(1), int64(0)},
+		}
+	})
+	// 統合先はまだ強化素材10を持っていない
+	fake.onQuery("AND item_id IN", []string{"id"}, func(args []driver.Value) [][]driver.Value { return nil })
+	fake.onQuery("FROM user_items", []string{"id", "user_id", "item_id", "item_type", "amount"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] != sourceID {
+			return nil
+		}
+		return [][]driver.Value{{int64(5), sourceID, int64(10), int64(ItemTypeEnhanceA), int64(3)}}
+	})
+	fake.onQuery("FROM user_presents", []string{"id", "user_id", "item_type", "item_id", "amount"}, func(args []driver.Value) [][]driver.Value {
+		if args[0] != sourceID {
+			return nil
+		}
+		return [][]driver.Value{{int64(31), sourceID, int64(ItemTypeCoin), int64(1), int64(100)}}
+	})
+	fake.onQuery("FROM user_item_fractions", []string{"item_id", "fraction"}, func(args []driver.Value) [][]driver.Value { return nil })
+	for _, stmt := range []string{
+		"INSERT INTO events_outbox", "UPDATE users SET isu_coin", "INSERT INTO user_items", "UPDATE user_items",
+		"UPDATE user_cards", "UPDATE user_presents", "INSERT INTO user_cards", "INSERT INTO user_presents",
+		"INSERT IGNORE INTO user_merges", "UPDATE user_decks", "UPDATE user_sessions",
+	} {
+		fake.onExec(stmt, func(args []driver.Value) (int64, error) { return 1, nil })
+	}
+	return fake
+}
+
+func newTestMergeHandler(t *testing.T, shards ...*fakeSQL) *Handler {
+	t.Helper()
+	h := newTestHandler(t, shards...)
+	h.Cache.SetItemMaster(&ItemMaster{ID: 10, ItemType: ItemTypeEnhanceA})
+	return h
+}
+
+func TestMergeUserSameShard(t *testing.T) {
+	// ユーザー100と101はどちらもシャード0にいる
+	fake := newTestMergeDB(101)
+	h := newTestMergeHandler(t, fake, &fakeSQL{})
+
+	body := `{"viewerId":"viewer","sourceUserId":101,"sourceViewerId":"source-viewer","sourceSessionId":"source-session"}`
+	rec := postJSON("/user/:userID/merge", h.mergeUser, "/user/100/merge", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := new(MergeUserResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.MovedCoins != 300 || res.MovedCards != 2 || res.MovedItems != 1 || res.MovedPresents != 1 {
+		t.Errorf("response = %+v, want 300 coins, 2 cards, 1 item and 1 present moved", res)
+	}
+
+	// カードとプレゼントは複製せずに持ち主を付け替え、補償のイベントは記録しない
+	if fake.executed("UPDATE user_cards SET user_id") != 1 || fake.executed("UPDATE user_presents SET user_id") != 1 {
+		t.Errorf("committed = %v, want cards and presents reassigned", fake.committed)
+	}
+	for _, stmt := range []string{"INSERT INTO user_cards", "INSERT INTO user_presents", "INSERT INTO events_outbox", "SET deleted_at=?, updated_at=? WHERE id IN"} {
+		if fake.executed(stmt) != 0 {
+			t.Errorf("committed = %v, want no %q", fake.committed, stmt)
+		}
+	}
+	if fake.executed("UPDATE users SET isu_coin=?") != 1 || fake.executed("INSERT INTO user_items") != 1 || fake.executed("INSERT IGNORE INTO user_merges") != 1 {
+		t.Errorf("committed = %v, want coins and items added and the merge recorded", fake.committed)
+	}
+}
+
+func TestMergeUserAcrossShards(t *testing.T) {
+	// 統合元の1<<23はシャード1にいる
+	const sourceID = 1 << 23
+	target := newTestMergeDB(sourceID)
+	source := newTestMergeDB(sourceID)
+	h := newTestMergeHandler(t, target, source)
+
+	body := `{"viewerId":"viewer","sourceUserId":8388608,"sourceViewerId":"source-viewer","sourceSessionId":"source-session"}`
+	rec := postJSON("/user/:userID/merge", h.mergeUser, "/user/100/merge", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	// 統合先には同じidで複製し、補償のイベントと同じトランザクションでコミットする
+	for _, stmt := range []string{"INSERT INTO user_cards", "INSERT INTO user_presents", "INSERT INTO events_outbox", "UPDATE users SET isu_coin=?"} {
+		if target.executed(stmt) != 1 {
+			t.Errorf("target committed = %v, want %q once", target.committed, stmt)
+		}
+	}
+	if target.executed("INSERT IGNORE INTO user_merges") != 0 || target.executed("UPDATE user_cards") != 0 {
+		t.Errorf("target committed = %v, want nothing removed from the target", target.committed)
+	}
+
+	// 統合元からは複製したものを論理削除する
+	for _, stmt := range []string{"INSERT IGNORE INTO user_merges", "UPDATE users SET isu_coin=isu_coin-LEAST", "UPDATE user_cards SET deleted_at", "UPDATE user_presents SET deleted_at", "UPDATE user_sessions"} {
+		if source.executed(stmt) != 1 {
+			t.Errorf("source committed = %v, want %q once", source.committed, stmt)
+		}
+	}
+	if source.executed("INSERT INTO") != 0 || source.executed("SET user_id") != 0 {
+		t.Errorf("source committed = %v, want nothing copied into the source", source.committed)
+	}
+}
+
+func TestMergeUserRequiresSourceOwnership(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "wrong viewer", body: `{"viewerId":"viewer","sourceUserId":101,"sourceViewerId":"other","sourceSessionId":"source-session"}`},
+		{name: "wrong session", body: `{"viewerId":"viewer","sourceUserId":101,"sourceViewerId":"source-viewer","sourceSessionId":"other"}`},
+	}
+	for _, tt := range tests {
+		fake := newTestMergeDB(101)
+		h := newTestMergeHandler(t, fake)
+
+		rec := postJSON("/user/:userID/merge", h.mergeUser, "/user/100/merge", tt.body)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, body = %s, want 403", tt.name, rec.Code, rec.Body.String())
+		}
+		for _, q := range append(fake.committed, fake.rolledBack...) {
+			if !strings.HasPrefix(q, "SELECT") {
+				t.Errorf("%s: executed %q, want nothing merged", tt.name, q)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValidateUserName(t *testing.T) {
+	prev := userNameFilter
+	userNameFilter = func(name string) bool { return strings.Contains(name, "badword") }
+	t.Cleanup(func() { userNameFilter = prev })
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr error
+	}{
+		{name: "trimmed", input: "  いすこん太郎 ", want: "いすこん太郎"},
+		{name: "max length", input: strings.Repeat("あ", UserNameMaxLength), want: strings.Repeat("あ", UserNameMaxLength)},
+		{name: "empty", input: "", wantErr: ErrInvalidUserName},
+		{name: "blank", input: "   ", wantErr: ErrInvalidUserName},
+		{name: "too long", input: strings.Repeat("あ", UserNameMaxLength+1), wantErr: ErrInvalidUserName},
+		{name: "control character", input: "isu\ncon", wantErr: ErrInvalidUserName},
+		{name: "filtered", input: "my badword", wantErr: ErrInvalidUserName},
+	}
+	for _, tt := range tests {
+		got, err := validateUserName(tt.input)
+		if err != tt.wantErr || got != tt.want {
+			t.Errorf("%s: validateUserName(%q) = %q, %v, want %q, %v", tt.name, tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// newTestUserNameDB 表示名の予約を保持するメインのDB兼シャードに応答する
+func newTestUserNameDB() *fakeSQL {
+	var mu sync.Mutex
+	owners := make(map[string]int64)
+	fake := (&fakeSQL{}).withDevice()
+	fake.onExec("INSERT IGNORE INTO user_names", func(args []driver.Value) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := owners[args[0].(string)]; ok {
+			return 0, nil
+		}
+		owners[args[0].(string)] = args[1].(int64)
+		return 1, nil
+	})
+	fake.onExec("DELETE FROM user_names", func(args []driver.Value) (int64, error) { return 0, nil })
+	fake.onQuery("FROM user_names", []string{"user_id"}, func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		return [][]driver.Value{{owners[args[0].(string)]}}
+	})
+	fake.onExec("UPDATE users SET name", func(args []driver.Value) (int64, error) { return 1, nil })
+	return fake
+}
+
+func TestUpdateUserName(t *testing.T) {
+	prev := uniqueUserNames
+	t.Cleanup(func() { uniqueUserNames = prev })
+
+	for _, unique := range []bool{false, true} {
+		uniqueUserNames = unique
+		fake := newTestUserNameDB()
+		h := newTestHandler(t, fake)
+
+		rec := postJSON("/user/:userID/name", h.updateUserName, "/user/100/name", `{"viewerId":"viewer","name":" alice "}`)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name":"alice"`) {
+			t.Fatalf("unique=%v: status = %d, body = %s, want the trimmed name set", unique, rec.Code, rec.Body.String())
+		}
+		rec = postJSON("/user/:userID/name", h.updateUserName, "/user/100/name", `{"viewerId":"viewer","name":""}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unique=%v: empty name status = %d, want 400", unique, rec.Code)
+		}
+
+		// 他のユーザーと同じ表示名は、重複させない設定の場合のみ弾く
+		rec = postJSON("/user/:userID/name", h.updateUserName, "/user/101/name", `{"viewerId":"viewer","name":"alice"}`)
+		if unique {
+			if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), ErrUserNameTaken.Error()) {
+				t.Errorf("taken name: status = %d, body = %s, want 409 with %v", rec.Code, rec.Body.String(), ErrUserNameTaken)
+			}
+			if fake.executed("UPDATE users SET name") != 1 {
+				t.Errorf("taken name: committed = %v, want only the first user renamed", fake.committed)
+			}
+			// 自分が予約済みの表示名は設定し直せる
+			rec = postJSON("/user/:userID/name", h.updateUserName, "/user/100/name", `{"viewerId":"viewer","name":"alice"}`)
+			if rec.Code != http.StatusOK {
+				t.Errorf("own name: status = %d, body = %s, want 200", rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || fake.executed("INSERT IGNORE INTO user_names") != 0 {
+			t.Errorf("duplicate name: status = %d, committed = %v, want 200 without reserving", rec.Code, fake.committed)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ビルド時に -ldflags "-X main.gitCommit=... -X main.buildTime=..." で埋め込まれる
+var (
+	gitCommit = "unknown"
+	buildTime = "unknown"
+)
+
+// version 稼働中のバイナリのビルド情報を返す
+// ベンチマーク中に全ホストが同じビルドで動いているかを確認するためのもの
+// シャードのホスト一覧は ISUCON_VERSION_DETAIL=1 の場合のみ返す
+// GET /version
+func (h *Handler) version(c echo.Context) error {
+	res := &VersionResponse{
+		GitCommit:       gitCommit,
+		BuildTime:       buildTime,
+		GoVersion:       runtime.Version(),
+		SnowflakeNodeID: snowflakeNodeID,
+	}
+	if getEnv("ISUCON_VERSION_DETAIL", "") == "1" {
+		res.ShardHosts = dbHosts
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type VersionResponse struct {
+	GitCommit       string   `json:"gitCommit"`
+	BuildTime       string   `json:"buildTime"`
+	GoVersion       string   `json:"goVersion"`
+	SnowflakeNodeID int64    `json:"snowflakeNodeId"`
+	ShardHosts      []string `json:"shardHosts,omitempty"`
+}
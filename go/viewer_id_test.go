@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestViewerDB ユーザー100はviewer端末のみ登録済みで、ユーザー101は存在しない
+func newTestViewerDB() *fakeSQL {
+	fake := &fakeSQL{}
+	fake.onQuery("LEFT JOIN user_devices", []string{"id", "isu_coin", "last_getreward_at", "device_id"}, func(args []driver.Value) [][]driver.Value {
+		if args[1] != int64(100) {
+			return nil
+		}
+		var deviceID driver.Value
+		if args[0] == "viewer" {
+			deviceID = int64(1)
+		}
+		return [][]driver.Value{{args[1], int64(0), int64(900), deviceID}}
+	})
+	return fake
+}
+
+func TestGetUserWithViewerID(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   int64
+		viewerID string
+		want     error
+	}{
+		{name: "registered device", userID: 100, viewerID: "viewer", want: nil},
+		{name: "unknown device", userID: 100, viewerID: "other", want: ErrUserDeviceNotFound},
+		{name: "unknown user", userID: 101, viewerID: "viewer", want: ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		h := &Handler{DBs: []*sqlx.DB{newTestViewerDB().open()}}
+		user, err := h.getUserWithViewerID(context.Background(), tt.userID, tt.viewerID)
+		if err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && user.ID != tt.userID {
+			t.Errorf("%s: user = %+v, want user %d", tt.name, user, tt.userID)
+		}
+	}
+}
+
+func TestRewardReportsViewerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want error
+	}{
+		{name: "unknown device", path: "/user/100/reward", body: `{"viewerId":"other"}`, want: ErrUserDeviceNotFound},
+		{name: "unknown user", path: "/user/101/reward", body: `{"viewerId":"viewer"}`, want: ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		fake := newTestViewerDB()
+		h := newTestHandler(t, fake)
+
+		rec := postJSON("/user/:userID/reward", h.reward, tt.path, tt.body)
+		if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), tt.want.Error()) {
+			t.Errorf("%s: status = %d, body = %s, want 404 with %v", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteSemaphoreBoundsConcurrency(t *testing.T) {
+	const limit = 2
+	sem := NewWriteSemaphore(limit)
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sem.Acquire(time.Second) {
+				t.Error("acquire timed out")
+				return
+			}
+			defer sem.Release()
+
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if peak > limit {
+		t.Errorf("%d writers ran at once, want at most %d", peak, limit)
+	}
+
+	// 枠が埋まっている間は待たずに諦める
+	for i := 0; i < limit; i++ {
+		if !sem.Acquire(time.Millisecond) {
+			t.Fatalf("acquire %d failed with free slots", i+1)
+		}
+	}
+	if sem.Acquire(10 * time.Millisecond) {
+		t.Error("acquired a slot beyond the limit")
+	}
+}
+
+func TestWriteSlotReleasedOnRollback(t *testing.T) {
+	fake := newTestRerollDB(&gachaDrawRecord{}, 1)
+	h := newTestHandler(t, fake)
+	h.WriteSems = []*WriteSemaphore{NewWriteSemaphore(1)}
+
+	// 枠が1つでも、ロールバックしたリクエストが枠を解放していれば続けて処理できる
+	for i := 0; i < 3; i++ {
+		rec := postJSON("/user/:userID/gacha/reroll", h.rerollGacha, "/user/100/gacha/reroll", `{"viewerId":"viewer"}`)
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("request %d status = %d, body = %s, want 409", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	if fake.discarded("UPDATE user_presents") != 3 {
+		t.Errorf("rolledBack = %v, want 3 rolled back cancellations", fake.rolledBack)
+	}
+
+	// 枠を使い切っている間は503とRetry-Afterで負荷を逃がす
+	release, err := h.acquireWriteSlot(100)
+	if err != nil {
+		t.Fatalf("slot was not released after rollback: %v", err)
+	}
+	rec := postJSON("/user/:userID/gacha/reroll", h.rerollGacha, "/user/100/gacha/reroll", `{"viewerId":"viewer"}`)
+	release()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("status = %d, Retry-After = %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -5,6 +5,9 @@ DROP TABLE IF EXISTS `user_sessions`;
 DROP TABLE IF EXISTS `user_one_time_tokens`;
 DROP TABLE IF EXISTS `users`;
 DROP TABLE IF EXISTS `user_decks`;
+DROP TABLE IF EXISTS `user_deck_presets`;
+DROP TABLE IF EXISTS `user_names`;
+DROP TABLE IF EXISTS `initialize_markers`;
 DROP TABLE IF EXISTS `user_bans`;
 DROP TABLE IF EXISTS `user_devices`;
 DROP TABLE IF EXISTS `login_bonus_masters`;
@@ -14,9 +17,17 @@ DROP TABLE IF EXISTS `present_all_masters`;
 DROP TABLE IF EXISTS `user_present_all_received_history`;
 DROP TABLE IF EXISTS `gacha_masters`;
 DROP TABLE IF EXISTS `gacha_item_masters`;
+DROP TABLE IF EXISTS `user_gacha_draws`;
+DROP TABLE IF EXISTS `user_gacha_pities`;
+DROP TABLE IF EXISTS `user_gacha_draw_histories`;
+DROP TABLE IF EXISTS `events_outbox`;
+DROP TABLE IF EXISTS `user_merges`;
 DROP TABLE IF EXISTS `user_items`;
+DROP TABLE IF EXISTS `user_item_fractions`;
 DROP TABLE IF EXISTS `user_cards`;
+DROP TABLE IF EXISTS `reward_histories`;
 DROP TABLE IF EXISTS `item_masters`;
+DROP TABLE IF EXISTS `exchange_masters`;
 DROP TABLE IF EXISTS `version_masters`;
 DROP TABLE IF EXISTS `admin_users`;
 
@@ -26,6 +37,7 @@ CREATE TABLE `users` (
   `last_getreward_at` bigint NOT NULL comment '最後にリワードを取得した日時',
   `last_activated_at` bigint NOT NULL comment '最終アクティブ日時',
   `registered_at` bigint NOT NULL comment '登録日時',
+  `name` varchar(32) default NULL comment '表示名',
   `created_at` bigint NOT NULL,
   `updated_at`bigint NOT NULL,
   `deleted_at` bigint default NULL,
@@ -45,6 +57,37 @@ CREATE TABLE `user_decks` (
   UNIQUE uniq_user_id ( `user_id`,  `deleted_at`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+CREATE TABLE `user_deck_presets` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `name` varchar(64) NOT NULL comment 'プリセット名',
+  `user_card_id_1` bigint NOT NULL comment '装備枠1',
+  `user_card_id_2` bigint NOT NULL comment '装備枠2',
+  `user_card_id_3` bigint NOT NULL comment '装備枠3',
+  `created_at` bigint NOT NULL,
+  `updated_at`bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE uniq_user_name (`user_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* 表示名の重複を防ぐための予約(ISUCON_UNIQUE_USER_NAME=1 の場合のみ使用) */
+CREATE TABLE `user_names` (
+  `name` varchar(32) NOT NULL comment '表示名',
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`name`),
+  INDEX userid_idx (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* initializeの再投入を省略するための、最後に初期化した時点の状態 */
+CREATE TABLE `initialize_markers` (
+  `id` int NOT NULL,
+  `baseline` varchar(64) NOT NULL comment '初期データのファイルのチェックサム',
+  `fingerprint` varchar(64) NOT NULL comment '初期化直後のユーザーデータのチェックサム',
+  `initialized_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
 CREATE TABLE `user_bans` (
   `id` bigint NOT NULL,
   `user_id` bigint NOT NULL comment 'ユーザID', 
@@ -142,6 +185,9 @@ CREATE TABLE `gacha_masters` (
   `end_at` bigint NOT NULL comment '終了日時',
   `display_order` int(2) comment 'ガチャ台の表示順,小さいほど左に表示',
   `created_at` bigint NOT NULL,
+  `icon_url` varchar(255) comment 'アイコン画像のURL',
+  `banner_url` varchar(255) comment 'バナー画像のURL',
+  `pity_ceiling` int comment '天井の回数。レアのアイテムが出ないまま続いた場合、この回数目はレアのアイテムだけから抽選する。NULLの場合は天井なし',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
@@ -153,10 +199,78 @@ CREATE TABLE `gacha_item_masters` (
   `amount` int NOT NULL comment 'アイテム数',
   `weight` int NOT NULL comment '確率。万分率で表示',
   `created_at` bigint NOT NULL,
+  `rate_up_percent` int comment 'ピックアップによる確率アップ。weightに掛ける百分率で、200の場合は2倍。NULLの場合は100',
+  `is_rare` tinyint(1) comment '天井の対象のレアなアイテムか。NULLの場合はレアではない',
   PRIMARY KEY (`id`),
   UNIQUE uniq_item_id (`gacha_id`, `item_type`, `item_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+CREATE TABLE `user_gacha_draws` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `gacha_id` bigint NOT NULL comment 'ガチャ台のID',
+  `gacha_count` int NOT NULL comment '抽選回数',
+  `consumed_coin` bigint NOT NULL comment '消費したISU-COIN',
+  `rerolled` tinyint(1) NOT NULL default 0 comment '引き直し済みか',
+  `reroll_of` bigint default NULL comment '引き直し元の抽選ID',
+  `drawn_at` bigint NOT NULL comment '抽選日時',
+  `created_at` bigint NOT NULL,
+  `pity_count` int NOT NULL default 0 comment '抽選前の天井のカウント。引き直しはこのカウントから抽選する',
+  PRIMARY KEY (`id`),
+  INDEX idx_user_id (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `user_gacha_pities` (
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `gacha_id` bigint NOT NULL comment 'ガチャ台のID',
+  `count` int NOT NULL comment 'レアのアイテムが出ないまま続いた抽選の回数',
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* ガチャ抽選履歴テーブル */
+
+CREATE TABLE `user_gacha_draw_histories` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `draw_id` bigint NOT NULL comment '抽選ID',
+  `gacha_id` bigint NOT NULL comment 'ガチャ台のID',
+  `gacha_item_id` bigint NOT NULL comment '抽選されたガチャアイテムマスタのID',
+  `present_id` bigint default NULL comment '付与したプレゼントのID。プレゼントを経由せずに直接付与した場合はNULL',
+  `item_type` int(1) NOT NULL comment 'アイテム種別',
+  `item_id` int NOT NULL comment 'アイテムID',
+  `amount` int NOT NULL comment 'アイテム数',
+  `drawn_at` bigint NOT NULL comment '抽選日時',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX idx_gacha_drawn_at (`gacha_id`, `drawn_at`),
+  INDEX idx_draw_id (`draw_id`),
+  INDEX idx_present_id (`present_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `events_outbox` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `event_type` varchar(64) NOT NULL comment 'イベントの種類',
+  `user_id` bigint default NULL comment '対象のユーザID。シャード全体に対するイベントの場合はNULL',
+  `payload` mediumtext NOT NULL comment 'イベントの内容(JSON)',
+  `created_at` bigint NOT NULL,
+  `processed_at` bigint default NULL comment '中継した日時。未処理の場合はNULL',
+  `attempts` int NOT NULL default 0 comment 'ハンドラが失敗した回数',
+  `last_error` varchar(255) default NULL comment '直近のハンドラのエラー',
+  `failed_at` bigint default NULL comment '失敗が上限に達して中継をやめた日時(デッドレター)',
+  PRIMARY KEY (`id`),
+  INDEX idx_processed_at (`processed_at`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `user_merges` (
+  `id` bigint NOT NULL comment '統合ID',
+  `user_id` bigint NOT NULL comment '統合先のユーザID',
+  `source_user_id` bigint NOT NULL comment '統合元のユーザID',
+  `merged_at` bigint NOT NULL comment '統合元から所持品を取り除いた日時',
+  PRIMARY KEY (`id`),
+  INDEX idx_source_user_id (`source_user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
 CREATE TABLE `user_items` (
   `id` bigint NOT NULL,
   `user_id` bigint NOT NULL comment 'ユーザID',
@@ -170,6 +284,14 @@ CREATE TABLE `user_items` (
   INDEX userid_idx (`user_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+CREATE TABLE `user_item_fractions` (
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `item_id` bigint NOT NULL comment 'アイテムID',
+  `fraction` bigint NOT NULL default 0 comment '1未満の端数(item_masters.amount_scale単位)',
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `item_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
 CREATE TABLE `user_cards` (
   `id` bigint NOT NULL,
   `user_id` bigint NOT NULL comment 'ユーザID',
@@ -184,6 +306,19 @@ CREATE TABLE `user_cards` (
   UNIQUE uniq_card_id (`user_id`, `card_id`, `deleted_at`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+CREATE TABLE `reward_histories` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `amount` bigint NOT NULL comment '受け取ったコイン(所持上限で切り詰める前)',
+  `overflow` bigint NOT NULL default 0 comment '所持上限を超えたコイン',
+  `past_time` bigint NOT NULL comment '前回の受け取りからの経過秒数',
+  `deck_amount_per_sec` bigint NOT NULL comment '受け取り時のデッキの生産性の合計',
+  `claimed_at` bigint NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX idx_user_id_claimed_at (`user_id`, `claimed_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
 /*　アイテムマスタ、カードマスタ */
 
 CREATE TABLE `item_masters` (
@@ -197,10 +332,29 @@ CREATE TABLE `item_masters` (
   `base_exp_per_level` int comment 'TYP2:level1 -> 2に必要な経験値、以降、前のlevelの1.2倍(切り上げ)必要',
   `gained_exp` int comment 'TYPE3:獲得経験値',
   `shortening_min` bigint comment 'TYPE4:短縮時間(分)',
+  `amount_growth_type` int(1) comment 'TYPE2:生産性の成長曲線 1:線形、2:指数。NULLの場合は線形',
+  `exp_growth_rate` double comment 'TYPE2:次のlevelに必要な経験値の倍率。NULLの場合は1.2',
+  `amount_scale` int comment 'TYPE1,3,4:付与数の単位。1000の場合は付与数を1/1000単位で扱う。NULLの場合は1',
+  `icon_url` varchar(255) comment 'アイコン画像のURL',
+  `banner_url` varchar(255) comment 'バナー画像のURL',
+  `max_stack` int comment 'TYPE3,4:所持数の上限。NULLの場合はintの上限',
   -- `created_at` bigint,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+/* アイテム交換マスタ */
+CREATE TABLE `exchange_masters` (
+  `id` bigint NOT NULL,
+  `from_item_id` int NOT NULL comment '交換元のアイテムID',
+  `from_amount` int NOT NULL comment '1回の交換で消費する交換元アイテム数',
+  `to_item_type` int(1) NOT NULL comment '交換先のアイテム種別',
+  `to_item_id` int NOT NULL comment '交換先のアイテムID',
+  `to_amount` int NOT NULL comment '1回の交換で得られる交換先アイテム数',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE uniq_from_item_id (`from_item_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
 
 /*　マスタバージョンを管理するテーブル */
 CREATE TABLE `version_masters` (
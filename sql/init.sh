@@ -20,6 +20,16 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < 4_alldata_exclude_user_presents.sql
 
+# user_presentsは作り直さないので、付与元のカラムがなければ追加する
+HAS_SOURCE=`mysql -u"$ISUCON_DB_USER" -p"$ISUCON_DB_PASSWORD" -h "$ISUCON_DB_HOST" -P "$ISUCON_DB_PORT" -Ns -e "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema='$ISUCON_DB_NAME' AND table_name='user_presents' AND column_name='source'"`
+if [ "$HAS_SOURCE" = "0" ]; then
+	echo "ALTER TABLE user_presents ADD COLUMN source int(1) NOT NULL default 0 comment '付与元', ADD COLUMN source_id bigint default NULL comment '付与元のID'" | mysql -u"$ISUCON_DB_USER" \
+			-p"$ISUCON_DB_PASSWORD" \
+			--host "$ISUCON_DB_HOST" \
+			--port "$ISUCON_DB_PORT" \
+			"$ISUCON_DB_NAME"
+fi
+
 echo "delete from user_presents where id > 100000000000" | mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
 		--host "$ISUCON_DB_HOST" \
@@ -31,7 +41,7 @@ SECURE_DIR=${DIR:-/var/lib/mysql-files/}
 
 # sudo cp 5_user_presents_not_receive_data.tsv ${SECURE_DIR}
 sudo cp /home/isucon/webapp/sql/5_user_presents_not_receive_data.tsv ${SECURE_DIR}
-echo "LOAD DATA INFILE '${SECURE_DIR}5_user_presents_not_receive_data.tsv' REPLACE INTO TABLE user_presents FIELDS ESCAPED BY '|' IGNORE 1 LINES ;" | mysql -u"$ISUCON_DB_USER" \
+echo "LOAD DATA INFILE '${SECURE_DIR}5_user_presents_not_receive_data.tsv' REPLACE INTO TABLE user_presents FIELDS ESCAPED BY '|' IGNORE 1 LINES (id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at, deleted_at);" | mysql -u"$ISUCON_DB_USER" \
         -p"$ISUCON_DB_PASSWORD" \
         --host "$ISUCON_DB_HOST" \
         --port "$ISUCON_DB_PORT" \